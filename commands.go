@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"gobackend/database"
+	"gobackend/jwtkeys"
+	"gobackend/models"
+)
+
+// runCommand runs a one-off maintenance command instead of starting the server
+func runCommand(name string, db *database.DB) error {
+	switch name {
+	case "reconcile-exp":
+		corrections, err := models.NewUserRepository(db.DB).ReconcileExp()
+		if err != nil {
+			return err
+		}
+		audit := models.NewAuditRepository(db.DB)
+		for _, c := range corrections {
+			entry := &models.AuditEntry{
+				Action:     models.AuditExpReconcile,
+				TargetType: "user",
+				TargetID:   c.UserID,
+				Before:     json.RawMessage(fmt.Sprintf(`{"exp":%d}`, c.Cached)),
+				After:      json.RawMessage(fmt.Sprintf(`{"exp":%d}`, c.Ledger)),
+			}
+			switch {
+			case c.TeamID == 0:
+				log.Printf("user %d: cached exp %d, ledger %d", c.UserID, c.Cached, c.Ledger)
+			case c.UserID == 0:
+				log.Printf("team %d: cached exp %d, ledger %d", c.TeamID, c.Cached, c.Ledger)
+				entry.TargetType, entry.TargetID = "team", c.TeamID
+			default:
+				log.Printf("team %d member %d: cached exp %d, ledger %d", c.TeamID, c.UserID, c.Cached, c.Ledger)
+				entry.TargetType, entry.TargetID = "team", c.TeamID
+				entry.Before = json.RawMessage(fmt.Sprintf(`{"user_id":%d,"exp":%d}`, c.UserID, c.Cached))
+				entry.After = json.RawMessage(fmt.Sprintf(`{"user_id":%d,"exp":%d}`, c.UserID, c.Ledger))
+			}
+			if err := audit.Record(entry); err != nil {
+				return err
+			}
+		}
+		log.Printf("reconciled %d cached totals", len(corrections))
+		return nil
+
+	case "generate-signing-key":
+		// prints a private key for JWT_KEYS_FILE; the algorithm defaults to EdDSA
+		alg := "EdDSA"
+		if len(os.Args) > 2 {
+			alg = os.Args[2]
+		}
+		key, err := jwtkeys.Generate(alg)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(key)
+		return err
+
+	case "prune-audit":
+		n, err := models.NewAuditRepository(db.DB).Prune(auditRetention())
+		if err != nil {
+			return err
+		}
+		log.Printf("pruned %d audit log entries", n)
+		return nil
+
+	case "backfill-achievements":
+		// awards found here are not announced; users earned them long ago
+		defs, err := models.LoadAchievements(os.Getenv("ACHIEVEMENTS_PATH"))
+		if err != nil {
+			return err
+		}
+		achievementRepo := models.NewAchievementRepository(db.DB, defs)
+		users, err := models.NewUserRepository(db.DB).GetAll()
+		if err != nil {
+			return err
+		}
+		total := 0
+		for _, u := range users {
+			awarded, err := achievementRepo.Evaluate(u.ID)
+			if err != nil {
+				return fmt.Errorf("user %d: %w", u.ID, err)
+			}
+			total += len(awarded)
+		}
+		log.Printf("awarded %d achievements to %d users", total, len(users))
+		return nil
+	}
+	return fmt.Errorf("unknown command")
+}
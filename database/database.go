@@ -23,7 +23,9 @@ func Initialize(dbPath string) (*DB, error) {
 	}
 
 	// Open database connection
-	db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on")
+	// Writers take the lock when a transaction begins and wait for each other,
+	// so concurrent prefork processes serialize instead of failing with SQLITE_BUSY
+	db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -55,6 +57,19 @@ func (db *DB) migrate() error {
                 password TEXT NOT NULL,
                 is_admin BOOLEAN NOT NULL DEFAULT 0,
                 exp INTEGER NOT NULL DEFAULT 0,
+                timezone TEXT NOT NULL DEFAULT 'UTC',
+                is_sponsor BOOLEAN NOT NULL DEFAULT 0,
+                points INTEGER NOT NULL DEFAULT 0,
+                role TEXT NOT NULL DEFAULT 'user',
+                suspended_until DATETIME,
+                status TEXT NOT NULL DEFAULT 'active',
+                token_version INTEGER NOT NULL DEFAULT 0,
+                email_verified_at DATETIME,
+                two_factor_enabled_at DATETIME,
+                hide_from_leaderboard BOOLEAN NOT NULL DEFAULT 0,
+                hide_activity BOOLEAN NOT NULL DEFAULT 0,
+                private_profile BOOLEAN NOT NULL DEFAULT 0,
+                avatar_key TEXT NOT NULL DEFAULT '',
                 created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
                 updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
         );`
@@ -84,6 +99,57 @@ func (db *DB) migrate() error {
 		return fmt.Errorf("failed to check exp column: %w", err)
 	}
 
+	// Ensure timezone column exists for old installations
+	if err := db.addColumnIfMissing("users", "timezone", "TEXT NOT NULL DEFAULT 'UTC'"); err != nil {
+		return err
+	}
+
+	// Ensure sponsor flag and points wallet exist for old installations
+	if err := db.addColumnIfMissing("users", "is_sponsor", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("users", "points", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// Ensure moderation columns exist for old installations
+	if err := db.addColumnIfMissing("users", "role", "TEXT NOT NULL DEFAULT 'user'"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("users", "suspended_until", "DATETIME"); err != nil {
+		return err
+	}
+
+	// Ensure account state columns exist for old installations
+	if err := db.addColumnIfMissing("users", "status", "TEXT NOT NULL DEFAULT 'active'"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("users", "token_version", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// Ensure email verification column exists for old installations
+	if err := db.addColumnIfMissing("users", "email_verified_at", "DATETIME"); err != nil {
+		return err
+	}
+
+	// Ensure two-factor column exists for old installations
+	if err := db.addColumnIfMissing("users", "two_factor_enabled_at", "DATETIME"); err != nil {
+		return err
+	}
+
+	// Ensure privacy columns exist for old installations
+	for _, column := range []string{"hide_from_leaderboard", "hide_activity", "private_profile"} {
+		if err := db.addColumnIfMissing("users", column, "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+
+	// Ensure avatar column exists for old installations
+	if err := db.addColumnIfMissing("users", "avatar_key", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
 	// Create trash_posts table
 	createTrashTable := `
        CREATE TABLE IF NOT EXISTS trash_posts (
@@ -94,6 +160,11 @@ func (db *DB) migrate() error {
                image_path TEXT,
                description TEXT NOT NULL,
                trail TEXT,
+               severity INTEGER NOT NULL DEFAULT 0,
+               volume_liters REAL NOT NULL DEFAULT 0,
+               status TEXT NOT NULL DEFAULT 'open',
+               hidden BOOLEAN NOT NULL DEFAULT 0,
+               status_changed_at DATETIME,
                created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
                FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
        );`
@@ -102,6 +173,27 @@ func (db *DB) migrate() error {
 		return fmt.Errorf("failed to create trash_posts table: %w", err)
 	}
 
+	// Ensure status columns exist for old installations
+	if err := db.addColumnIfMissing("trash_posts", "status", "TEXT NOT NULL DEFAULT 'open'"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("trash_posts", "status_changed_at", "DATETIME"); err != nil {
+		return err
+	}
+
+	// Ensure severity and volume columns exist for old installations
+	if err := db.addColumnIfMissing("trash_posts", "severity", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("trash_posts", "volume_liters", "REAL NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// Ensure hidden column exists for old installations
+	if err := db.addColumnIfMissing("trash_posts", "hidden", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
 	// Create comments table
 	createCommentsTable := `
        CREATE TABLE IF NOT EXISTS comments (
@@ -109,6 +201,7 @@ func (db *DB) migrate() error {
                post_id INTEGER NOT NULL,
                user_id INTEGER NOT NULL,
                content TEXT NOT NULL,
+               hidden BOOLEAN NOT NULL DEFAULT 0,
                created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
                FOREIGN KEY (post_id) REFERENCES trash_posts(id) ON DELETE CASCADE,
                FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
@@ -118,13 +211,673 @@ func (db *DB) migrate() error {
 		return fmt.Errorf("failed to create comments table: %w", err)
 	}
 
+	// Ensure hidden column exists for old installations
+	if err := db.addColumnIfMissing("comments", "hidden", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// Create teams table
+	createTeamsTable := `
+       CREATE TABLE IF NOT EXISTS teams (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+               description TEXT NOT NULL DEFAULT '',
+               invite_code TEXT NOT NULL UNIQUE,
+               owner_id INTEGER NOT NULL,
+               exp INTEGER NOT NULL DEFAULT 0,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createTeamsTable); err != nil {
+		return fmt.Errorf("failed to create teams table: %w", err)
+	}
+
+	// Create team_members table; exp holds what the member earned while in the team
+	createTeamMembersTable := `
+       CREATE TABLE IF NOT EXISTS team_members (
+               team_id INTEGER NOT NULL,
+               user_id INTEGER NOT NULL,
+               role TEXT NOT NULL DEFAULT 'member',
+               exp INTEGER NOT NULL DEFAULT 0,
+               joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               PRIMARY KEY (team_id, user_id),
+               FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE,
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createTeamMembersTable); err != nil {
+		return fmt.Errorf("failed to create team_members table: %w", err)
+	}
+
+	// Create exp_events table; one row per EXP award, located where the action happened
+	createExpEventsTable := `
+       CREATE TABLE IF NOT EXISTS exp_events (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               user_id INTEGER NOT NULL,
+               amount INTEGER NOT NULL,
+               latitude REAL,
+               longitude REAL,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createExpEventsTable); err != nil {
+		return fmt.Errorf("failed to create exp_events table: %w", err)
+	}
+
+	// Ensure ledger attribution columns exist for old installations
+	expEventColumns := []struct{ name, definition string }{
+		{"reason", "TEXT NOT NULL DEFAULT ''"},
+		{"source_type", "TEXT NOT NULL DEFAULT ''"},
+		{"source_id", "INTEGER"},
+		{"actor_id", "INTEGER REFERENCES users(id) ON DELETE SET NULL"},
+		{"reversal_of", "INTEGER REFERENCES exp_events(id)"},
+		{"post_id", "INTEGER"},
+	}
+	for _, c := range expEventColumns {
+		if err := db.addColumnIfMissing("exp_events", c.name, c.definition); err != nil {
+			return err
+		}
+	}
+
+	// The ledger is append-only; corrections are made with reversal events.
+	// The one update allowed is forgetting the actor when their account is
+	// deleted, which the foreign key does on its own. Older installations
+	// had a trigger that refused that too.
+	createExpEventsTrigger := `
+       DROP TRIGGER IF EXISTS exp_events_append_only;
+       CREATE TRIGGER IF NOT EXISTS exp_events_immutable
+       BEFORE UPDATE OF id, user_id, amount, latitude, longitude, created_at, reason, source_type, source_id, reversal_of, post_id ON exp_events
+       BEGIN
+               SELECT RAISE(ABORT, 'exp_events is append-only');
+       END;
+       CREATE TRIGGER IF NOT EXISTS exp_events_actor_forgotten
+       BEFORE UPDATE OF actor_id ON exp_events
+       WHEN NEW.actor_id IS NOT NULL
+       BEGIN
+               SELECT RAISE(ABORT, 'exp_events is append-only');
+       END;`
+
+	if _, err := db.Exec(createExpEventsTrigger); err != nil {
+		return fmt.Errorf("failed to create exp_events trigger: %w", err)
+	}
+
+	// Create exp_event_teams table; the teams each ledger entry was credited to
+	createExpEventTeamsTable := `
+       CREATE TABLE IF NOT EXISTS exp_event_teams (
+               event_id INTEGER NOT NULL,
+               team_id INTEGER NOT NULL,
+               PRIMARY KEY (event_id, team_id),
+               FOREIGN KEY (event_id) REFERENCES exp_events(id) ON DELETE CASCADE,
+               FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createExpEventTeamsTable); err != nil {
+		return fmt.Errorf("failed to create exp_event_teams table: %w", err)
+	}
+
+	// Create regions table for named leaderboard areas
+	createRegionsTable := `
+       CREATE TABLE IF NOT EXISTS regions (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+               min_latitude REAL NOT NULL,
+               min_longitude REAL NOT NULL,
+               max_latitude REAL NOT NULL,
+               max_longitude REAL NOT NULL,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+       );`
+
+	if _, err := db.Exec(createRegionsTable); err != nil {
+		return fmt.Errorf("failed to create regions table: %w", err)
+	}
+
+	// Create user_achievements table
+	createUserAchievementsTable := `
+       CREATE TABLE IF NOT EXISTS user_achievements (
+               user_id INTEGER NOT NULL,
+               achievement_key TEXT NOT NULL,
+               awarded_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               PRIMARY KEY (user_id, achievement_key),
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createUserAchievementsTable); err != nil {
+		return fmt.Errorf("failed to create user_achievements table: %w", err)
+	}
+
+	// Create user_streaks table; last_day is the user's local date of their last qualifying action
+	createUserStreaksTable := `
+       CREATE TABLE IF NOT EXISTS user_streaks (
+               user_id INTEGER PRIMARY KEY,
+               current INTEGER NOT NULL DEFAULT 0,
+               longest INTEGER NOT NULL DEFAULT 0,
+               last_day TEXT NOT NULL DEFAULT '',
+               freezes INTEGER NOT NULL DEFAULT 0,
+               updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createUserStreaksTable); err != nil {
+		return fmt.Errorf("failed to create user_streaks table: %w", err)
+	}
+
+	// Create quest_templates table
+	createQuestTemplatesTable := `
+       CREATE TABLE IF NOT EXISTS quest_templates (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               title TEXT NOT NULL,
+               description TEXT NOT NULL DEFAULT '',
+               action TEXT NOT NULL,
+               condition TEXT NOT NULL DEFAULT '',
+               target INTEGER NOT NULL,
+               exp_reward INTEGER NOT NULL DEFAULT 0,
+               active BOOLEAN NOT NULL DEFAULT 1,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+       );`
+
+	if _, err := db.Exec(createQuestTemplatesTable); err != nil {
+		return fmt.Errorf("failed to create quest_templates table: %w", err)
+	}
+
+	// Create user_quests table; week_start is the Monday of the user's local week
+	createUserQuestsTable := `
+       CREATE TABLE IF NOT EXISTS user_quests (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               user_id INTEGER NOT NULL,
+               template_id INTEGER NOT NULL,
+               week_start TEXT NOT NULL,
+               progress INTEGER NOT NULL DEFAULT 0,
+               completed_at DATETIME,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               UNIQUE (user_id, template_id, week_start),
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+               FOREIGN KEY (template_id) REFERENCES quest_templates(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createUserQuestsTable); err != nil {
+		return fmt.Errorf("failed to create user_quests table: %w", err)
+	}
+
+	// Create point_transactions table; users.points caches the sum per user
+	createPointTransactionsTable := `
+       CREATE TABLE IF NOT EXISTS point_transactions (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               user_id INTEGER NOT NULL,
+               amount INTEGER NOT NULL,
+               reason TEXT NOT NULL,
+               exp_event_id INTEGER,
+               redemption_id INTEGER,
+               actor_id INTEGER,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createPointTransactionsTable); err != nil {
+		return fmt.Errorf("failed to create point_transactions table: %w", err)
+	}
+
+	createPointTransactionsTrigger := `
+       CREATE TRIGGER IF NOT EXISTS point_transactions_append_only
+       BEFORE UPDATE ON point_transactions
+       BEGIN
+               SELECT RAISE(ABORT, 'point_transactions is append-only');
+       END;`
+
+	if _, err := db.Exec(createPointTransactionsTrigger); err != nil {
+		return fmt.Errorf("failed to create point_transactions trigger: %w", err)
+	}
+
+	// Create rewards table; a NULL stock is unlimited and a per_user_limit of 0 is no limit
+	createRewardsTable := `
+       CREATE TABLE IF NOT EXISTS rewards (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               sponsor_id INTEGER NOT NULL,
+               title TEXT NOT NULL,
+               description TEXT NOT NULL DEFAULT '',
+               cost INTEGER NOT NULL,
+               stock INTEGER,
+               per_user_limit INTEGER NOT NULL DEFAULT 0,
+               active BOOLEAN NOT NULL DEFAULT 1,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               FOREIGN KEY (sponsor_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createRewardsTable); err != nil {
+		return fmt.Errorf("failed to create rewards table: %w", err)
+	}
+
+	// Create redemptions table
+	createRedemptionsTable := `
+       CREATE TABLE IF NOT EXISTS redemptions (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               reward_id INTEGER NOT NULL,
+               user_id INTEGER NOT NULL,
+               cost INTEGER NOT NULL,
+               code TEXT NOT NULL UNIQUE,
+               status TEXT NOT NULL DEFAULT 'issued',
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               used_at DATETIME,
+               voided_at DATETIME,
+               voided_by INTEGER,
+               void_reason TEXT NOT NULL DEFAULT '',
+               FOREIGN KEY (reward_id) REFERENCES rewards(id) ON DELETE CASCADE,
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createRedemptionsTable); err != nil {
+		return fmt.Errorf("failed to create redemptions table: %w", err)
+	}
+
+	// Create trash_verifications table; distance is meters from the post when the vote was cast
+	createTrashVerificationsTable := `
+       CREATE TABLE IF NOT EXISTS trash_verifications (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               post_id INTEGER NOT NULL,
+               user_id INTEGER NOT NULL,
+               status TEXT NOT NULL,
+               latitude REAL NOT NULL,
+               longitude REAL NOT NULL,
+               distance REAL NOT NULL,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               FOREIGN KEY (post_id) REFERENCES trash_posts(id) ON DELETE CASCADE,
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createTrashVerificationsTable); err != nil {
+		return fmt.Errorf("failed to create trash_verifications table: %w", err)
+	}
+
+	// Create trash_categories table; categories are deactivated rather than deleted
+	createTrashCategoriesTable := `
+       CREATE TABLE IF NOT EXISTS trash_categories (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               key TEXT NOT NULL UNIQUE,
+               name TEXT NOT NULL,
+               hazardous BOOLEAN NOT NULL DEFAULT 0,
+               active BOOLEAN NOT NULL DEFAULT 1,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+       );`
+
+	if _, err := db.Exec(createTrashCategoriesTable); err != nil {
+		return fmt.Errorf("failed to create trash_categories table: %w", err)
+	}
+
+	// Create trash_post_categories table
+	createTrashPostCategoriesTable := `
+       CREATE TABLE IF NOT EXISTS trash_post_categories (
+               post_id INTEGER NOT NULL,
+               category_id INTEGER NOT NULL,
+               PRIMARY KEY (post_id, category_id),
+               FOREIGN KEY (post_id) REFERENCES trash_posts(id) ON DELETE CASCADE,
+               FOREIGN KEY (category_id) REFERENCES trash_categories(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createTrashPostCategoriesTable); err != nil {
+		return fmt.Errorf("failed to create trash_post_categories table: %w", err)
+	}
+
+	// Create trash_post_hazards table
+	createTrashPostHazardsTable := `
+       CREATE TABLE IF NOT EXISTS trash_post_hazards (
+               post_id INTEGER NOT NULL,
+               hazard TEXT NOT NULL,
+               PRIMARY KEY (post_id, hazard),
+               FOREIGN KEY (post_id) REFERENCES trash_posts(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createTrashPostHazardsTable); err != nil {
+		return fmt.Errorf("failed to create trash_post_hazards table: %w", err)
+	}
+
+	// Create reports table; target_type is post, comment or user
+	createReportsTable := `
+       CREATE TABLE IF NOT EXISTS reports (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               reporter_id INTEGER NOT NULL,
+               target_type TEXT NOT NULL,
+               target_id INTEGER NOT NULL,
+               reason TEXT NOT NULL,
+               details TEXT NOT NULL DEFAULT '',
+               status TEXT NOT NULL DEFAULT 'open',
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               resolved_at DATETIME,
+               resolved_by INTEGER,
+               FOREIGN KEY (reporter_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createReportsTable); err != nil {
+		return fmt.Errorf("failed to create reports table: %w", err)
+	}
+
+	// Create moderation_actions table; moderator_id is NULL for automatic actions.
+	// It keeps no foreign keys so history survives deleted content and users.
+	createModerationActionsTable := `
+       CREATE TABLE IF NOT EXISTS moderation_actions (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               moderator_id INTEGER,
+               target_type TEXT NOT NULL,
+               target_id INTEGER NOT NULL,
+               subject_user_id INTEGER,
+               action TEXT NOT NULL,
+               reason TEXT NOT NULL DEFAULT '',
+               reports_resolved INTEGER NOT NULL DEFAULT 0,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+       );`
+
+	if _, err := db.Exec(createModerationActionsTable); err != nil {
+		return fmt.Errorf("failed to create moderation_actions table: %w", err)
+	}
+
+	// Create account_appeals table; suspended users ask for their suspension to be lifted
+	createAppealsTable := `
+       CREATE TABLE IF NOT EXISTS account_appeals (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               user_id INTEGER NOT NULL,
+               moderation_action_id INTEGER,
+               message TEXT NOT NULL,
+               status TEXT NOT NULL DEFAULT 'open',
+               response TEXT NOT NULL DEFAULT '',
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               resolved_at DATETIME,
+               resolved_by INTEGER,
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createAppealsTable); err != nil {
+		return fmt.Errorf("failed to create account_appeals table: %w", err)
+	}
+
+	// Create user_tokens table; single-use tokens mailed to users, stored hashed.
+	// email is the address the token was sent to.
+	createUserTokensTable := `
+       CREATE TABLE IF NOT EXISTS user_tokens (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               user_id INTEGER NOT NULL,
+               purpose TEXT NOT NULL,
+               token_hash TEXT NOT NULL UNIQUE,
+               email TEXT NOT NULL,
+               expires_at DATETIME NOT NULL,
+               used_at DATETIME,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createUserTokensTable); err != nil {
+		return fmt.Errorf("failed to create user_tokens table: %w", err)
+	}
+
+	// Create magic_links table; single-use sign-in links, stored hashed. They are
+	// keyed by address rather than user, since the account may not exist yet.
+	createMagicLinksTable := `
+       CREATE TABLE IF NOT EXISTS magic_links (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               email TEXT NOT NULL,
+               token_hash TEXT NOT NULL UNIQUE,
+               expires_at DATETIME NOT NULL,
+               used_at DATETIME,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+       );`
+
+	if _, err := db.Exec(createMagicLinksTable); err != nil {
+		return fmt.Errorf("failed to create magic_links table: %w", err)
+	}
+
+	// Create user_totp table; one TOTP secret per user. last_step is the newest
+	// time step accepted, so a code cannot be replayed.
+	createUserTOTPTable := `
+       CREATE TABLE IF NOT EXISTS user_totp (
+               user_id INTEGER PRIMARY KEY,
+               secret TEXT NOT NULL,
+               last_step INTEGER NOT NULL DEFAULT 0,
+               failures INTEGER NOT NULL DEFAULT 0,
+               locked_until DATETIME,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createUserTOTPTable); err != nil {
+		return fmt.Errorf("failed to create user_totp table: %w", err)
+	}
+
+	// Create user_recovery_codes table; one-time two-factor codes, stored hashed
+	createRecoveryCodesTable := `
+       CREATE TABLE IF NOT EXISTS user_recovery_codes (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               user_id INTEGER NOT NULL,
+               code_hash TEXT NOT NULL,
+               used_at DATETIME,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createRecoveryCodesTable); err != nil {
+		return fmt.Errorf("failed to create user_recovery_codes table: %w", err)
+	}
+
+	// Create two_factor_policy table; roles listed must enable two-factor authentication
+	createTwoFactorPolicyTable := `
+       CREATE TABLE IF NOT EXISTS two_factor_policy (
+               role TEXT PRIMARY KEY,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+       );`
+
+	if _, err := db.Exec(createTwoFactorPolicyTable); err != nil {
+		return fmt.Errorf("failed to create two_factor_policy table: %w", err)
+	}
+
+	// Create passkeys table; WebAuthn credentials, several per user.
+	// public_key is the COSE encoded key the authenticator created.
+	createPasskeysTable := `
+       CREATE TABLE IF NOT EXISTS passkeys (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               user_id INTEGER NOT NULL,
+               credential_id TEXT NOT NULL UNIQUE,
+               public_key BLOB NOT NULL,
+               alg INTEGER NOT NULL,
+               sign_count INTEGER NOT NULL DEFAULT 0,
+               aaguid TEXT NOT NULL DEFAULT '',
+               transports TEXT NOT NULL DEFAULT '',
+               name TEXT NOT NULL DEFAULT '',
+               backup_eligible BOOLEAN NOT NULL DEFAULT 0,
+               backed_up BOOLEAN NOT NULL DEFAULT 0,
+               last_used_at DATETIME,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createPasskeysTable); err != nil {
+		return fmt.Errorf("failed to create passkeys table: %w", err)
+	}
+
+	// Create webauthn_challenges table; outstanding ceremony challenges, kept in
+	// the database so any server process can finish a ceremony. user_id is NULL
+	// for passwordless sign-in, where the user is not known yet.
+	createWebAuthnChallengesTable := `
+       CREATE TABLE IF NOT EXISTS webauthn_challenges (
+               challenge TEXT PRIMARY KEY,
+               ceremony TEXT NOT NULL,
+               user_id INTEGER,
+               expires_at DATETIME NOT NULL,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createWebAuthnChallengesTable); err != nil {
+		return fmt.Errorf("failed to create webauthn_challenges table: %w", err)
+	}
+
+	// Create user_identities table; sign-in identities at external providers.
+	// An identity is the provider's stable subject, never the email it reports.
+	createUserIdentitiesTable := `
+       CREATE TABLE IF NOT EXISTS user_identities (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               user_id INTEGER NOT NULL,
+               provider TEXT NOT NULL,
+               subject TEXT NOT NULL,
+               email TEXT NOT NULL DEFAULT '',
+               last_login_at DATETIME,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               UNIQUE (provider, subject),
+               UNIQUE (user_id, provider),
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createUserIdentitiesTable); err != nil {
+		return fmt.Errorf("failed to create user_identities table: %w", err)
+	}
+
+	// Create oauth_states table; outstanding authorization requests. The state
+	// is also set in a cookie, and is stored hashed. user_id is set when a
+	// signed-in user is linking an identity rather than signing in.
+	createOAuthStatesTable := `
+       CREATE TABLE IF NOT EXISTS oauth_states (
+               state_hash TEXT PRIMARY KEY,
+               provider TEXT NOT NULL,
+               verifier TEXT NOT NULL,
+               nonce TEXT NOT NULL,
+               user_id INTEGER,
+               expires_at DATETIME NOT NULL,
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createOAuthStatesTable); err != nil {
+		return fmt.Errorf("failed to create oauth_states table: %w", err)
+	}
+
+	// Create api_keys table; long-lived credentials for scripts and other
+	// systems. Only the key's hash is stored; prefix is kept to recognise it.
+	// team_id is set for keys a team shares, which act as the user who made them.
+	createAPIKeysTable := `
+       CREATE TABLE IF NOT EXISTS api_keys (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               user_id INTEGER NOT NULL,
+               team_id INTEGER,
+               name TEXT NOT NULL,
+               prefix TEXT NOT NULL,
+               key_hash TEXT NOT NULL UNIQUE,
+               scopes TEXT NOT NULL,
+               expires_at DATETIME NOT NULL,
+               last_used_at DATETIME,
+               last_used_ip TEXT NOT NULL DEFAULT '',
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+               FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+               FOREIGN KEY (team_id) REFERENCES teams(id) ON DELETE CASCADE
+       );`
+
+	if _, err := db.Exec(createAPIKeysTable); err != nil {
+		return fmt.Errorf("failed to create api_keys table: %w", err)
+	}
+
+	// Create rate_limit_buckets table; token buckets shared by all server
+	// processes. updated_at is in fractional unix seconds.
+	createRateLimitBucketsTable := `
+       CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+               bucket TEXT PRIMARY KEY,
+               tokens REAL NOT NULL,
+               updated_at REAL NOT NULL
+       );`
+
+	if _, err := db.Exec(createRateLimitBucketsTable); err != nil {
+		return fmt.Errorf("failed to create rate_limit_buckets table: %w", err)
+	}
+
+	// Create login_failures table; failed password sign-ins by the email tried,
+	// which need not belong to an account.
+	createLoginFailuresTable := `
+       CREATE TABLE IF NOT EXISTS login_failures (
+               account TEXT PRIMARY KEY COLLATE NOCASE,
+               failures INTEGER NOT NULL DEFAULT 0,
+               last_failure_at DATETIME NOT NULL,
+               locked_until DATETIME
+       );`
+
+	if _, err := db.Exec(createLoginFailuresTable); err != nil {
+		return fmt.Errorf("failed to create login_failures table: %w", err)
+	}
+
+	// Create audit_log table; actor_id is NULL for actions the system takes on its own.
+	// It keeps no foreign keys so entries outlive the users and content they describe.
+	createAuditLogTable := `
+       CREATE TABLE IF NOT EXISTS audit_log (
+               id INTEGER PRIMARY KEY AUTOINCREMENT,
+               actor_id INTEGER,
+               action TEXT NOT NULL,
+               target_type TEXT NOT NULL,
+               target_id INTEGER,
+               before TEXT,
+               after TEXT,
+               ip TEXT NOT NULL DEFAULT '',
+               user_agent TEXT NOT NULL DEFAULT '',
+               created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+       );`
+
+	if _, err := db.Exec(createAuditLogTable); err != nil {
+		return fmt.Errorf("failed to create audit_log table: %w", err)
+	}
+
+	// Entries can only be removed by retention pruning, and never while recent
+	createAuditLogTriggers := `
+       CREATE TRIGGER IF NOT EXISTS audit_log_append_only
+       BEFORE UPDATE ON audit_log
+       BEGIN
+               SELECT RAISE(ABORT, 'audit_log is append-only');
+       END;
+       CREATE TRIGGER IF NOT EXISTS audit_log_retention
+       BEFORE DELETE ON audit_log
+       WHEN OLD.created_at > datetime('now', '-30 days')
+       BEGIN
+               SELECT RAISE(ABORT, 'audit_log entries are kept at least 30 days');
+       END;`
+
+	if _, err := db.Exec(createAuditLogTriggers); err != nil {
+		return fmt.Errorf("failed to create audit_log triggers: %w", err)
+	}
+
 	// Create indexes
 	createIndexes := []string{
 		"CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);",
+		"CREATE INDEX IF NOT EXISTS idx_user_recovery_codes_user ON user_recovery_codes(user_id);",
+		"CREATE INDEX IF NOT EXISTS idx_passkeys_user ON passkeys(user_id);",
+		"CREATE INDEX IF NOT EXISTS idx_api_keys_user ON api_keys(user_id);",
+		"CREATE INDEX IF NOT EXISTS idx_api_keys_team ON api_keys(team_id);",
+		"CREATE INDEX IF NOT EXISTS idx_rate_limit_buckets_updated ON rate_limit_buckets(updated_at);",
+		"CREATE INDEX IF NOT EXISTS idx_oauth_states_expires ON oauth_states(expires_at);",
+		"CREATE INDEX IF NOT EXISTS idx_magic_links_email ON magic_links(email COLLATE NOCASE, created_at);",
+		"CREATE INDEX IF NOT EXISTS idx_webauthn_challenges_expires ON webauthn_challenges(expires_at);",
 		"CREATE INDEX IF NOT EXISTS idx_trash_user_id ON trash_posts(user_id);",
 		"CREATE INDEX IF NOT EXISTS idx_trash_created_at ON trash_posts(created_at);",
+		"CREATE INDEX IF NOT EXISTS idx_trash_post_categories_category ON trash_post_categories(category_id);",
+		"CREATE INDEX IF NOT EXISTS idx_trash_post_hazards_hazard ON trash_post_hazards(hazard);",
 		"CREATE INDEX IF NOT EXISTS idx_comments_post_id ON comments(post_id);",
 		"CREATE INDEX IF NOT EXISTS idx_comments_created_at ON comments(created_at);",
+		"CREATE INDEX IF NOT EXISTS idx_teams_exp ON teams(exp);",
+		"CREATE INDEX IF NOT EXISTS idx_team_members_user_id ON team_members(user_id);",
+		"CREATE INDEX IF NOT EXISTS idx_exp_events_created_at ON exp_events(created_at);",
+		"CREATE INDEX IF NOT EXISTS idx_exp_events_user_id ON exp_events(user_id);",
+		"CREATE INDEX IF NOT EXISTS idx_exp_events_source ON exp_events(source_type, source_id);",
+		"CREATE INDEX IF NOT EXISTS idx_exp_events_user_reason ON exp_events(user_id, reason, created_at);",
+		"CREATE INDEX IF NOT EXISTS idx_exp_events_post_id ON exp_events(post_id);",
+		"CREATE INDEX IF NOT EXISTS idx_exp_event_teams_team_id ON exp_event_teams(team_id);",
+		"CREATE INDEX IF NOT EXISTS idx_user_quests_user_week ON user_quests(user_id, week_start);",
+		"CREATE INDEX IF NOT EXISTS idx_point_transactions_user_id ON point_transactions(user_id);",
+		"CREATE INDEX IF NOT EXISTS idx_point_transactions_exp_event_id ON point_transactions(exp_event_id);",
+		"CREATE INDEX IF NOT EXISTS idx_trash_verifications_post_id ON trash_verifications(post_id, created_at);",
+		"CREATE INDEX IF NOT EXISTS idx_trash_verifications_user_id ON trash_verifications(user_id, created_at);",
+		"CREATE INDEX IF NOT EXISTS idx_reports_target ON reports(target_type, target_id, status);",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_reports_open_per_reporter ON reports(reporter_id, target_type, target_id) WHERE status = 'open';",
+		"CREATE INDEX IF NOT EXISTS idx_moderation_actions_target ON moderation_actions(target_type, target_id);",
+		"CREATE INDEX IF NOT EXISTS idx_moderation_actions_subject ON moderation_actions(subject_user_id);",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_account_appeals_open_per_user ON account_appeals(user_id) WHERE status = 'open';",
+		"CREATE INDEX IF NOT EXISTS idx_users_status ON users(status);",
+		"CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at);",
+		"CREATE INDEX IF NOT EXISTS idx_user_tokens_user_purpose ON user_tokens(user_id, purpose, created_at);",
+		"CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(actor_id, created_at);",
+		"CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target_type, target_id);",
+		"CREATE INDEX IF NOT EXISTS idx_redemptions_user_reward ON redemptions(user_id, reward_id);",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_exp_events_reversal_of ON exp_events(reversal_of) WHERE reversal_of IS NOT NULL;",
 	}
 
 	for _, query := range createIndexes {
@@ -133,6 +886,109 @@ func (db *DB) migrate() error {
 		}
 	}
 
+	if err := db.migrateData(); err != nil {
+		return err
+	}
+
 	log.Println("Database migrations completed successfully")
 	return nil
 }
+
+// addColumnIfMissing adds a column to an existing table for old installations
+func (db *DB) addColumnIfMissing(table, column, definition string) error {
+	var col string
+	err := db.QueryRow("SELECT name FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&col)
+	if err == sql.ErrNoRows {
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+			return fmt.Errorf("failed to add %s.%s column: %w", table, column, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check %s.%s column: %w", table, column, err)
+	}
+	return nil
+}
+
+// dataMigrations are one-off data fixes. They run in order and the number
+// applied is tracked in PRAGMA user_version, so append only.
+var dataMigrations = []struct {
+	name  string
+	query string
+}{
+	{
+		// users.exp predates the ledger; record the difference so the
+		// ledger sums to the cached totals
+		name: "backfill legacy exp balances",
+		query: `
+       INSERT INTO exp_events (user_id, amount, reason)
+       SELECT u.id, u.exp - COALESCE(SUM(e.amount), 0), 'legacy_balance'
+       FROM users u
+       LEFT JOIN exp_events e ON e.user_id = u.id
+       GROUP BY u.id
+       HAVING u.exp != COALESCE(SUM(e.amount), 0)`,
+	},
+	{
+		name: "seed trash categories",
+		query: `
+       INSERT OR IGNORE INTO trash_categories (key, name, hazardous) VALUES
+               ('plastic', 'Plastic', 0),
+               ('glass', 'Glass', 0),
+               ('metal', 'Metal', 0),
+               ('paper', 'Paper and cardboard', 0),
+               ('tires', 'Tires', 0),
+               ('bulky', 'Bulky waste', 0),
+               ('electronics', 'Electronics', 1),
+               ('hazardous', 'Hazardous waste', 1),
+               ('other', 'Other', 0)`,
+	},
+	{
+		name:  "backfill admin roles",
+		query: `UPDATE users SET role = 'admin' WHERE is_admin = 1`,
+	},
+	{
+		// team credits were not recorded before; the best guess is the
+		// teams the user belonged to when the award was made
+		name: "backfill exp team credits",
+		query: `
+       INSERT OR IGNORE INTO exp_event_teams (event_id, team_id)
+       SELECT e.id, m.team_id
+       FROM exp_events e
+       JOIN team_members m ON m.user_id = e.user_id
+       LEFT JOIN exp_events o ON o.id = e.reversal_of
+       WHERE m.joined_at <= COALESCE(o.created_at, e.created_at)`,
+	},
+}
+
+// migrateData applies pending data migrations
+func (db *DB) migrateData() error {
+	for {
+		// read the version inside the transaction so concurrent prefork
+		// processes cannot apply the same migration twice
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		var i int
+		if err := tx.QueryRow("PRAGMA user_version").Scan(&i); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to read schema version: %w", err)
+		}
+		if i >= len(dataMigrations) {
+			tx.Rollback()
+			return nil
+		}
+		m := dataMigrations[i]
+		if _, err := tx.Exec(m.query); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to %s: %w", m.name, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to update schema version: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+}
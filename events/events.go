@@ -0,0 +1,64 @@
+// Package events is a small in-process publish/subscribe bus used to announce
+// things that happened (posts, comments, achievements) to interested parties
+// such as achievement checks and notifications.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	TrashPostCreated    = "trash_post.created"
+	CommentCreated      = "comment.created"
+	TrashPostVerified   = "trash_post.verified"
+	HazardReported      = "trash_post.hazard_reported"
+	AchievementUnlocked = "achievement.unlocked"
+	QuestCompleted      = "quest.completed"
+	LevelUp             = "user.level_up"
+	UserWarned          = "user.warned"
+	UserSuspended       = "user.suspended"
+	UserCreated         = "user.created"
+)
+
+// All subscribes a handler to every event type
+const All = "*"
+
+// Event is something that happened to or was done by a user
+type Event struct {
+	Type   string                 `json:"type"`
+	UserID int                    `json:"user_id"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+	At     time.Time              `json:"at"`
+}
+
+// Handler receives published events
+type Handler func(Event)
+
+var (
+	mu       sync.RWMutex
+	handlers = map[string][]Handler{}
+)
+
+// Subscribe registers h for events of the given type, or for all events with All
+func Subscribe(eventType string, h Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	handlers[eventType] = append(handlers[eventType], h)
+}
+
+// Publish delivers e synchronously to its subscribers in registration order
+func Publish(e Event) {
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+
+	mu.RLock()
+	hs := append(append([]Handler{}, handlers[e.Type]...), handlers[All]...)
+	mu.RUnlock()
+
+	for _, h := range hs {
+		h(e)
+	}
+}
@@ -0,0 +1,38 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// LogNotifier writes events to the server log
+func LogNotifier(e Event) {
+	log.Printf("notify user %d: %s %v", e.UserID, e.Type, e.Data)
+}
+
+// WebhookNotifier returns a handler that POSTs events as JSON to url.
+// Delivery happens in the background and failures are only logged.
+func WebhookNotifier(url string) Handler {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(e Event) {
+		body, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("webhook: encode %s: %v", e.Type, err)
+			return
+		}
+		go func() {
+			resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.Printf("webhook: deliver %s: %v", e.Type, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("webhook: deliver %s: status %d", e.Type, resp.StatusCode)
+			}
+		}()
+	}
+}
@@ -0,0 +1,449 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gobackend/events"
+	"gobackend/mailer"
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Mailed token lifetimes
+const (
+	verifyEmailTTL   = 48 * time.Hour
+	resetPasswordTTL = time.Hour
+	magicLinkTTL     = 15 * time.Minute
+	changeEmailTTL   = 24 * time.Hour
+)
+
+// minPasswordLength is the shortest password a reset accepts
+const minPasswordLength = 8
+
+// AccountHandler handles email verification, password reset and magic-link sign-in
+type AccountHandler struct {
+	userRepo *models.UserRepository
+	tokens   *models.TokenRepository
+	mail     mailer.Mailer
+	// baseURL is where the app that opens mailed links is served
+	baseURL string
+	// perHour is how many mails of one kind a user can be sent per hour
+	perHour int
+	// autoCreate lets magic links sign up addresses that have no account yet
+	autoCreate bool
+}
+
+func NewAccountHandler(userRepo *models.UserRepository, tokens *models.TokenRepository, mail mailer.Mailer) *AccountHandler {
+	h := &AccountHandler{userRepo: userRepo, tokens: tokens, mail: mail, baseURL: "http://localhost:8080", perHour: 3}
+	if u := os.Getenv("APP_BASE_URL"); u != "" {
+		h.baseURL = strings.TrimRight(u, "/")
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAIL_RATE_LIMIT_PER_HOUR")); err == nil && n > 0 {
+		h.perHour = n
+	}
+	h.autoCreate, _ = strconv.ParseBool(os.Getenv("MAGIC_LINK_AUTO_CREATE"))
+	return h
+}
+
+// validEmail reports whether email is a bare address that mail can be sent to
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email && len(email) <= 254
+}
+
+// link returns an app URL carrying a mailed token
+func (h *AccountHandler) link(path, token string) string {
+	return h.baseURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// sendVerification mails the user a link that verifies their current address
+func (h *AccountHandler) sendVerification(user *models.User) error {
+	token, err := h.tokens.Issue(user.ID, models.TokenVerifyEmail, user.Email, verifyEmailTTL, h.perHour)
+	if err != nil {
+		return err
+	}
+	return h.mail.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm this is your email address by opening the link below:\n\n%s\n\nThe link expires in %d hours.\n",
+			user.Name, h.link("/verify-email", token), int(verifyEmailTTL.Hours())),
+	})
+}
+
+// OnUserCreated mails new users a verification link. It is subscribed to UserCreated.
+func (h *AccountHandler) OnUserCreated(e events.Event) {
+	user, err := h.userRepo.GetByID(e.UserID)
+	if err != nil || user == nil || user.EmailVerifiedAt != nil {
+		return
+	}
+	if err := h.sendVerification(user); err != nil {
+		log.Printf("user %d: send verification: %v", user.ID, err)
+	}
+}
+
+// RequestVerification mails the caller a new verification link
+func (h *AccountHandler) RequestVerification(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	user, err := h.userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": "invalid user"})
+		return
+	}
+	if user.EmailVerifiedAt != nil {
+		writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": "email already verified"})
+		return
+	}
+
+	if err := h.sendVerification(user); err != nil {
+		if errors.Is(err, models.ErrTooManyTokens) {
+			writeJSON(ctx, fasthttp.StatusTooManyRequests, map[string]string{"error": err.Error()})
+			return
+		}
+		log.Printf("user %d: send verification: %v", user.ID, err)
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to send email"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusAccepted, map[string]string{"message": "verification email sent"})
+}
+
+// tokenRequest represents a payload carrying a mailed token
+type tokenRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// VerifyEmail marks the address a verification link was sent to as verified
+func (h *AccountHandler) VerifyEmail(ctx *fasthttp.RequestCtx) {
+	var req tokenRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if _, err := h.tokens.VerifyEmail(req.Token); err != nil {
+		if errors.Is(err, models.ErrTokenInvalid) {
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to verify email"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"message": "email verified"})
+}
+
+// passwordResetRequest represents the payload for requesting a reset link
+type passwordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// RequestPasswordReset mails a reset link if the address belongs to a user.
+// The response is the same either way so it cannot be used to probe for accounts.
+func (h *AccountHandler) RequestPasswordReset(ctx *fasthttp.RequestCtx) {
+	var req passwordResetRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	user, err := h.userRepo.GetByEmail(strings.TrimSpace(req.Email))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to request reset"})
+		return
+	}
+	if user != nil && user.Status != models.AccountBanned {
+		if err := h.sendReset(user); err != nil {
+			log.Printf("user %d: send password reset: %v", user.ID, err)
+		}
+	}
+	writeJSON(ctx, fasthttp.StatusAccepted, map[string]string{"message": "if the address is registered, a reset link is on its way"})
+}
+
+// sendReset mails the user a password reset link
+func (h *AccountHandler) sendReset(user *models.User) error {
+	token, err := h.tokens.Issue(user.ID, models.TokenResetPassword, user.Email, resetPasswordTTL, h.perHour)
+	if err != nil {
+		return err
+	}
+	return h.mail.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset your password. If it was you, open the link below to choose a new one:\n\n%s\n\nThe link expires in %d minutes. If you did not ask for this, ignore this email.\n",
+			user.Name, h.link("/reset-password", token), int(resetPasswordTTL.Minutes())),
+	})
+}
+
+// ResetPassword sets a new password using a reset link. Existing sessions are signed out.
+func (h *AccountHandler) ResetPassword(ctx *fasthttp.RequestCtx) {
+	var req tokenRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": fmt.Sprintf("password must be at least %d characters", minPasswordLength)})
+		return
+	}
+
+	var u models.User
+	if err := u.SetPassword(req.Password); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to set password"})
+		return
+	}
+	if _, err := h.tokens.ResetPassword(req.Token, u.PasswordHash); err != nil {
+		if errors.Is(err, models.ErrTokenInvalid) {
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to reset password"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"message": "password changed"})
+}
+
+// magicLinkRequest represents the payload for requesting a sign-in link
+type magicLinkRequest struct {
+	Email string `json:"email"`
+}
+
+// RequestMagicLink mails a single-use sign-in link. Unless accounts are
+// created on demand, links are only sent to registered addresses, but the
+// response does not say whether one was.
+func (h *AccountHandler) RequestMagicLink(ctx *fasthttp.RequestCtx) {
+	var req magicLinkRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	if !validEmail(email) {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid email"})
+		return
+	}
+
+	// every address counts towards its limit, registered or not
+	token, err := h.tokens.IssueMagicLink(email, magicLinkTTL, h.perHour)
+	if err != nil {
+		if errors.Is(err, models.ErrTooManyTokens) {
+			writeJSON(ctx, fasthttp.StatusTooManyRequests, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to request link"})
+		return
+	}
+	user, err := h.userRepo.FindByEmail(email)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to request link"})
+		return
+	}
+
+	accepted := map[string]string{"message": "if the address can sign in, a link is on its way"}
+	if (user == nil && !h.autoCreate) || (user != nil && user.Status == models.AccountBanned) {
+		writeJSON(ctx, fasthttp.StatusAccepted, accepted)
+		return
+	}
+	greeting := "Hi"
+	if user != nil {
+		greeting = "Hi " + user.Name
+	}
+	err = h.mail.Send(mailer.Message{
+		To:      email,
+		Subject: "Your sign-in link",
+		Body: fmt.Sprintf("%s,\n\nOpen the link below to sign in:\n\n%s\n\nThe link works once and expires in %d minutes. If you did not ask for it, ignore this email.\n",
+			greeting, h.link("/magic-link", token), int(magicLinkTTL.Minutes())),
+	})
+	if err != nil {
+		log.Printf("send magic link: %v", err)
+	}
+	writeJSON(ctx, fasthttp.StatusAccepted, accepted)
+}
+
+// ExchangeMagicLink signs in with a magic link, returning what Login does.
+// Following the link proves the address, so it also counts as verified, and
+// an account is created for unregistered addresses if that is enabled.
+func (h *AccountHandler) ExchangeMagicLink(ctx *fasthttp.RequestCtx) {
+	var req tokenRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	email, err := h.tokens.ConsumeMagicLink(req.Token)
+	if err != nil {
+		if errors.Is(err, models.ErrTokenInvalid) {
+			writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to sign in"})
+		return
+	}
+
+	user, err := h.userRepo.FindByEmail(email)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to sign in"})
+		return
+	}
+	created := false
+	if user == nil {
+		if !h.autoCreate {
+			writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": models.ErrTokenInvalid.Error()})
+			return
+		}
+		if user, err = h.createPasswordless(email); err != nil {
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to create user"})
+			return
+		}
+		created = true
+	}
+	// suspended users may still sign in, to appeal
+	if user.Status == models.AccountBanned {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "account banned"})
+		return
+	}
+	if user.EmailVerifiedAt == nil {
+		if err := h.userRepo.MarkEmailVerified(user.ID); err != nil {
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to sign in"})
+			return
+		}
+		now := time.Now().UTC()
+		user.EmailVerifiedAt = &now
+	}
+	if created {
+		events.Publish(events.Event{Type: events.UserCreated, UserID: user.ID})
+	}
+	writeSession(ctx, user)
+}
+
+// createPasswordless creates an account for a magic-link address. It is named
+// after the address and gets a random password; the user can set a real one
+// through a password reset.
+func (h *AccountHandler) createPasswordless(email string) (*models.User, error) {
+	name, _, _ := strings.Cut(email, "@")
+	password, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	user := &models.User{Name: name, Email: email}
+	if err := user.SetPassword(password); err != nil {
+		return nil, err
+	}
+	if err := h.userRepo.Create(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// emailChangeRequest represents the payload for changing the caller's address
+type emailChangeRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// RequestEmailChange mails a confirmation link to a new address given the
+// caller's password. The address only changes once the link is followed, and
+// the current address is told about the request.
+func (h *AccountHandler) RequestEmailChange(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var req emailChangeRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	if !validEmail(email) {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid email"})
+		return
+	}
+	user, err := h.userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get user"})
+		return
+	}
+	if !user.CheckPassword(req.Password) {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "current password is incorrect; if you never set one, use a password reset"})
+		return
+	}
+	if strings.EqualFold(email, user.Email) {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "that is already your email"})
+		return
+	}
+	existing, err := h.userRepo.FindByEmail(email)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to request change"})
+		return
+	}
+	if existing != nil {
+		writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": models.ErrEmailTaken.Error()})
+		return
+	}
+
+	token, err := h.tokens.Issue(user.ID, models.TokenChangeEmail, email, changeEmailTTL, h.perHour)
+	if err != nil {
+		if errors.Is(err, models.ErrTooManyTokens) {
+			writeJSON(ctx, fasthttp.StatusTooManyRequests, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to request change"})
+		return
+	}
+	err = h.mail.Send(mailer.Message{
+		To:      email,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen the link below to use this address for your account:\n\n%s\n\nThe link expires in %d hours.\n",
+			user.Name, h.link("/change-email", token), int(changeEmailTTL.Hours())),
+	})
+	if err != nil {
+		log.Printf("user %d: send email change: %v", user.ID, err)
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to send email"})
+		return
+	}
+	err = h.mail.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your email address is being changed",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to change the email address of your account to %s. If it was not you, reset your password.\n",
+			user.Name, email),
+	})
+	if err != nil {
+		log.Printf("user %d: send email change notice: %v", user.ID, err)
+	}
+	writeJSON(ctx, fasthttp.StatusAccepted, map[string]string{"message": "confirmation email sent to the new address"})
+}
+
+// ConfirmEmailChange switches the account to the address a change link was sent to
+func (h *AccountHandler) ConfirmEmailChange(ctx *fasthttp.RequestCtx) {
+	var req tokenRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if _, err := h.tokens.ChangeEmail(req.Token); err != nil {
+		switch {
+		case errors.Is(err, models.ErrTokenInvalid):
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		case errors.Is(err, models.ErrEmailTaken):
+			writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": err.Error()})
+		default:
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to change email"})
+		}
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"message": "email changed"})
+}
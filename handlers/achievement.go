@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"log"
+	"strconv"
+
+	"gobackend/events"
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// AchievementHandler handles achievement endpoints and awards achievements as activity happens
+type AchievementHandler struct {
+	repo     *models.AchievementRepository
+	userRepo *models.UserRepository
+}
+
+func NewAchievementHandler(repo *models.AchievementRepository, userRepo *models.UserRepository) *AchievementHandler {
+	return &AchievementHandler{repo: repo, userRepo: userRepo}
+}
+
+// GetAchievements lists every achievement that can be earned
+func (h *AchievementHandler) GetAchievements(ctx *fasthttp.RequestCtx) {
+	writeJSON(ctx, fasthttp.StatusOK, h.repo.Definitions())
+}
+
+// GetUserAchievements lists the achievements a user has earned, unless
+// their profile is private
+func (h *AchievementHandler) GetUserAchievements(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return
+	}
+
+	user, err := h.userRepo.GetByID(id)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get user"})
+		return
+	}
+	if user == nil || user.Status == models.AccountDeleted {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "user not found"})
+		return
+	}
+	if user.Privacy.PrivateProfile && viewerID(ctx) != id {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "profile is private"})
+		return
+	}
+
+	awards, err := h.repo.GetByUserID(id)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get achievements"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, awards)
+}
+
+// OnActivity re-evaluates the acting user's achievements and announces new ones.
+// It is subscribed to activity events.
+func (h *AchievementHandler) OnActivity(e events.Event) {
+	awarded, err := h.repo.Evaluate(e.UserID)
+	if err != nil {
+		log.Printf("achievements: evaluate user %d: %v", e.UserID, err)
+		return
+	}
+	for _, a := range awarded {
+		events.Publish(events.Event{
+			Type:   events.AchievementUnlocked,
+			UserID: e.UserID,
+			Data:   map[string]interface{}{"key": a.Key, "name": a.Name},
+		})
+	}
+}
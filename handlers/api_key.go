@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// API key limits
+const (
+	defaultAPIKeyDays = 90
+	maxAPIKeyDays     = 365
+	maxAPIKeys        = 25
+	maxAPIKeyName     = 64
+)
+
+// apiKeys authenticates API keys in the auth path. API keys are refused
+// until SetAPIKeyRepository is called.
+var apiKeys *models.APIKeyRepository
+
+// SetAPIKeyRepository enables API keys in the auth path
+func SetAPIKeyRepository(repo *models.APIKeyRepository) {
+	apiKeys = repo
+}
+
+// apiKeyScope returns the scope an API key needs for the request, or "" for
+// requests API keys may not make at all, such as managing credentials
+func apiKeyScope(ctx *fasthttp.RequestCtx) string {
+	path := string(ctx.Path())
+	read := ctx.IsGet() || ctx.IsHead()
+	switch {
+	case strings.HasPrefix(path, "/moderation/"),
+		strings.HasPrefix(path, "/admin/users/") && strings.HasSuffix(path, "/state"):
+		return models.ScopeAdminModeration
+	case strings.HasPrefix(path, "/auth/"), strings.HasPrefix(path, "/admin/"),
+		path == "/users/me", path == "/users/me/password", path == "/users/me/email", path == "/users/me/export",
+		strings.HasPrefix(path, "/users/me/identities"), strings.HasSuffix(path, "/api-keys"),
+		strings.Contains(path, "/api-keys/"):
+		return ""
+	case read:
+		return models.ScopeReadPosts
+	case strings.HasPrefix(path, "/trashposts"), path == "/reports":
+		return models.ScopeWritePosts
+	}
+	return ""
+}
+
+// authenticateAPIKey returns the user an API key acts as, if the key is
+// valid and has the scope the request needs
+func authenticateAPIKey(ctx *fasthttp.RequestCtx, key string) (int, error) {
+	if apiKeys == nil {
+		return 0, models.ErrAPIKeyInvalid
+	}
+	k, err := apiKeys.Authenticate(key)
+	if err != nil {
+		if errors.Is(err, models.ErrAPIKeyInvalid) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("failed to check API key")
+	}
+	scope := apiKeyScope(ctx)
+	if scope == "" {
+		return 0, fmt.Errorf("API keys cannot be used for this request")
+	}
+	if !k.HasScope(scope) {
+		return 0, fmt.Errorf("API key lacks the %s scope", scope)
+	}
+	if err := apiKeys.RecordUse(k.ID, ctx.RemoteIP().String()); err != nil {
+		log.Printf("api key %d: failed to record use: %v", k.ID, err)
+	}
+	return k.UserID, nil
+}
+
+// APIKeyHandler handles API key management. Keys can only be managed with a
+// session token, never with another API key.
+type APIKeyHandler struct {
+	repo     *models.APIKeyRepository
+	userRepo *models.UserRepository
+	teamRepo *models.TeamRepository
+}
+
+func NewAPIKeyHandler(repo *models.APIKeyRepository, userRepo *models.UserRepository, teamRepo *models.TeamRepository) *APIKeyHandler {
+	return &APIKeyHandler{repo: repo, userRepo: userRepo, teamRepo: teamRepo}
+}
+
+// createAPIKeyRequest represents the payload for creating an API key
+type createAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresInDays defaults to 90
+	ExpiresInDays int `json:"expires_in_days"`
+}
+
+// teamParam resolves the team in the path, requiring the caller to manage it
+func (h *APIKeyHandler) teamParam(ctx *fasthttp.RequestCtx, userID int) (int, bool) {
+	teamID, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid team id"})
+		return 0, false
+	}
+	member, err := h.teamRepo.GetMember(teamID, userID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get membership"})
+		return 0, false
+	}
+	if member == nil || !member.CanManage() {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "team admin required"})
+		return 0, false
+	}
+	return teamID, true
+}
+
+// create validates the request and creates a key for the caller, shared
+// with teamID if set
+func (h *APIKeyHandler) create(ctx *fasthttp.RequestCtx, userID, teamID int) {
+	var req createAPIKeyRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxAPIKeyName {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "name must be 1 to 64 characters"})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "at least one scope required"})
+		return
+	}
+	for _, s := range req.Scopes {
+		if !models.ValidAPIKeyScope(s) {
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "unknown scope " + s})
+			return
+		}
+	}
+	days := req.ExpiresInDays
+	if days == 0 {
+		days = defaultAPIKeyDays
+	}
+	if days < 1 || days > maxAPIKeyDays {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": fmt.Sprintf("expires_in_days must be 1 to %d", maxAPIKeyDays)})
+		return
+	}
+
+	user, err := h.userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get user"})
+		return
+	}
+	k := &models.APIKey{UserID: userID, TeamID: teamID, Name: name, Scopes: req.Scopes, ExpiresAt: time.Now().Add(time.Duration(days) * 24 * time.Hour)}
+	if k.HasScope(models.ScopeAdminModeration) && !user.IsModerator() {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "moderator required for " + models.ScopeAdminModeration})
+		return
+	}
+
+	existing, err := h.repo.GetByUser(userID)
+	if teamID != 0 {
+		existing, err = h.repo.GetByTeam(teamID)
+	}
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get API keys"})
+		return
+	}
+	if len(existing) >= maxAPIKeys {
+		writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": fmt.Sprintf("at most %d API keys; revoke one first", maxAPIKeys)})
+		return
+	}
+
+	key, err := h.repo.Create(k)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to create API key"})
+		return
+	}
+	recordAudit(ctx, userID, models.AuditAPIKeyCreate, "api_key", k.ID, nil, k)
+	// the key is shown this once; only its hash is kept
+	writeJSON(ctx, fasthttp.StatusCreated, map[string]interface{}{"key": key, "api_key": k})
+}
+
+// writeRevoked reports the outcome of revoking a key
+func writeRevoked(ctx *fasthttp.RequestCtx, userID int, k *models.APIKey, err error) {
+	if err != nil {
+		if errors.Is(err, models.ErrAPIKeyNotFound) {
+			writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to revoke API key"})
+		return
+	}
+	recordAudit(ctx, userID, models.AuditAPIKeyRevoke, "api_key", k.ID, k, nil)
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// GetMyKeys lists the caller's personal API keys
+func (h *APIKeyHandler) GetMyKeys(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	keys, err := h.repo.GetByUser(userID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get API keys"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, keys)
+}
+
+// CreateMyKey creates a personal API key for the caller
+func (h *APIKeyHandler) CreateMyKey(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	h.create(ctx, userID, 0)
+}
+
+// RevokeMyKey revokes one of the caller's personal API keys
+func (h *APIKeyHandler) RevokeMyKey(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	id, err := strconv.Atoi(ctx.UserValue("keyId").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid API key id"})
+		return
+	}
+	k, err := h.repo.Revoke(id, userID)
+	writeRevoked(ctx, userID, k, err)
+}
+
+// GetTeamKeys lists a team's API keys to its admins
+func (h *APIKeyHandler) GetTeamKeys(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	teamID, ok := h.teamParam(ctx, userID)
+	if !ok {
+		return
+	}
+	keys, err := h.repo.GetByTeam(teamID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get API keys"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, keys)
+}
+
+// CreateTeamKey creates a key shared by the team. It acts as the admin who
+// created it, and stops working if they no longer manage the team.
+func (h *APIKeyHandler) CreateTeamKey(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	teamID, ok := h.teamParam(ctx, userID)
+	if !ok {
+		return
+	}
+	h.create(ctx, userID, teamID)
+}
+
+// RevokeTeamKey lets any team admin revoke one of the team's keys
+func (h *APIKeyHandler) RevokeTeamKey(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	teamID, ok := h.teamParam(ctx, userID)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(ctx.UserValue("keyId").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid API key id"})
+		return
+	}
+	k, err := h.repo.RevokeTeamKey(id, teamID)
+	writeRevoked(ctx, userID, k, err)
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// auditLog receives entries for privileged and destructive actions. It is
+// nil until SetAuditLog is called, and then nothing is recorded.
+var auditLog *models.AuditRepository
+
+// SetAuditLog enables audit logging
+func SetAuditLog(repo *models.AuditRepository) {
+	auditLog = repo
+}
+
+// snapshot encodes an object as it looked at one point in time
+func snapshot(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// recordAudit appends an entry to the audit log. ctx is the request that
+// caused the action, or nil when the system acts on its own. Failures are
+// logged rather than failing the action, which has already happened.
+func recordAudit(ctx *fasthttp.RequestCtx, actorID int, action, targetType string, targetID int, before, after interface{}) {
+	if auditLog == nil {
+		return
+	}
+	e := &models.AuditEntry{
+		ActorID:    actorID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Before:     snapshot(before),
+		After:      snapshot(after),
+	}
+	if ctx != nil {
+		e.IP = ctx.RemoteIP().String()
+		e.UserAgent = string(ctx.UserAgent())
+	}
+	if err := auditLog.Record(e); err != nil {
+		log.Printf("audit %s %s %d: %v", action, targetType, targetID, err)
+	}
+}
+
+// AuditHandler serves the audit log to admins
+type AuditHandler struct {
+	repo     *models.AuditRepository
+	userRepo *models.UserRepository
+}
+
+func NewAuditHandler(repo *models.AuditRepository, userRepo *models.UserRepository) *AuditHandler {
+	return &AuditHandler{repo: repo, userRepo: userRepo}
+}
+
+// GetAuditLog lists audit entries, newest first, if user is admin. It can be
+// narrowed with actor_id, action (a trailing dot matches a prefix such as
+// "moderation."), target_type, target_id, and since and until as RFC 3339 times.
+func (h *AuditHandler) GetAuditLog(ctx *fasthttp.RequestCtx) {
+	if requireAdmin(ctx, h.userRepo) == nil {
+		return
+	}
+
+	args := ctx.QueryArgs()
+	f := models.AuditFilter{
+		Action:     string(args.Peek("action")),
+		TargetType: string(args.Peek("target_type")),
+	}
+	f.ActorID, _ = strconv.Atoi(string(args.Peek("actor_id")))
+	f.TargetID, _ = strconv.Atoi(string(args.Peek("target_id")))
+	for _, p := range []struct {
+		name string
+		into **time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if v := string(args.Peek(p.name)); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid " + p.name})
+				return
+			}
+			*p.into = &t
+		}
+	}
+	f.Limit, f.Offset = pageArgs(ctx)
+
+	entries, err := h.repo.Query(f)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get audit log"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, entries)
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gobackend/jwtkeys"
+	"gobackend/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/valyala/fasthttp"
+)
+
+// accounts is consulted on every authenticated request to enforce account
+// states. It is nil until SetAccountRepository is called.
+var accounts *models.UserRepository
+
+// SetAccountRepository enables account state checks in the auth path
+func SetAccountRepository(repo *models.UserRepository) {
+	accounts = repo
+}
+
+// signingKeys signs and verifies tokens. Tokens can neither be issued nor
+// accepted until SetSigningKeys is called.
+var signingKeys *jwtkeys.Manager
+
+// SetSigningKeys sets the keys tokens are signed and verified with
+func SetSigningKeys(keys *jwtkeys.Manager) {
+	signingKeys = keys
+}
+
+// errNoSigningKeys is returned by the token functions before SetSigningKeys
+var errNoSigningKeys = fmt.Errorf("no signing keys")
+
+// signToken signs claims with the active key
+func signToken(claims jwt.MapClaims) (string, error) {
+	if signingKeys == nil {
+		return "", errNoSigningKeys
+	}
+	return signingKeys.Sign(claims)
+}
+
+// JWKS publishes the public keys tokens are signed with, so other services
+// can verify them
+func JWKS(ctx *fasthttp.RequestCtx) {
+	if signingKeys == nil {
+		writeJSON(ctx, fasthttp.StatusServiceUnavailable, map[string]string{"error": errNoSigningKeys.Error()})
+		return
+	}
+	ctx.Response.Header.Set("Cache-Control", "public, max-age=300")
+	writeJSON(ctx, fasthttp.StatusOK, signingKeys.JWKS())
+}
+
+// issueToken signs a session token for the user
+func issueToken(user *models.User) (string, error) {
+	return signToken(jwt.MapClaims{
+		"user_id": user.ID,
+		"tv":      user.TokenVersion,
+		"exp":     time.Now().Add(72 * time.Hour).Unix(),
+	})
+}
+
+// challengeTTL is how long a user has to enter their second factor after
+// their password was accepted
+const challengeTTL = 5 * time.Minute
+
+// challengePurpose marks challenge tokens, which only the second step of a
+// two-factor login accepts
+const challengePurpose = "2fa"
+
+// issueChallenge signs a short-lived token that proves the user's first
+// factor was accepted
+func issueChallenge(user *models.User) (string, error) {
+	return signToken(jwt.MapClaims{
+		"user_id": user.ID,
+		"tv":      user.TokenVersion,
+		"purpose": challengePurpose,
+		"exp":     time.Now().Add(challengeTTL).Unix(),
+	})
+}
+
+// writeSession completes a sign-in. Users with two-factor authentication get a
+// challenge token to exchange at /auth/2fa/verify instead of a session token.
+func writeSession(ctx *fasthttp.RequestCtx, user *models.User) {
+	if user.TwoFactorEnabledAt != nil {
+		challenge, err := issueChallenge(user)
+		if err != nil {
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to sign token"})
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{"two_factor_required": true, "challenge_token": challenge})
+		return
+	}
+
+	signed, err := issueToken(user)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to sign token"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{"token": signed, "user": user})
+}
+
+// bearerCredential returns the session token or API key the request carries
+func bearerCredential(ctx *fasthttp.RequestCtx) (string, error) {
+	header := string(ctx.Request.Header.Peek("Authorization"))
+	if header == "" {
+		return "", fmt.Errorf("authorization header missing")
+	}
+
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) == 2 && strings.ToLower(parts[0]) == "bearer" {
+		return parts[1], nil
+	}
+	return header, nil
+}
+
+// parseChallenge validates a challenge token and returns its user id and token version
+func parseChallenge(tokenString string) (int, int, error) {
+	return parseClaims(tokenString, challengePurpose)
+}
+
+// parseClaims validates a signed token issued for purpose, where session
+// tokens have none, and returns its user id and token version
+func parseClaims(tokenString, purpose string) (int, int, error) {
+	if signingKeys == nil {
+		return 0, 0, errNoSigningKeys
+	}
+	claims, err := signingKeys.Parse(tokenString)
+	if err != nil {
+		return 0, 0, err
+	}
+	if p, _ := claims["purpose"].(string); p != purpose {
+		return 0, 0, fmt.Errorf("invalid token")
+	}
+	idVal, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, 0, fmt.Errorf("user_id missing in token")
+	}
+	// tokens issued before token versions existed carry none, which is version 0
+	tv, _ := claims["tv"].(float64)
+	return int(idVal), int(tv), nil
+}
+
+// authenticate returns the caller's user id after checking the account may
+// still use the API. Suspended accounts are only let through if allowSuspended.
+func authenticate(ctx *fasthttp.RequestCtx, allowSuspended bool) (int, error) {
+	credential, err := bearerCredential(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// API keys are revoked one by one, not by bumping the token version
+	isAPIKey := models.IsAPIKey(credential)
+	var userID, tv int
+	if isAPIKey {
+		userID, err = authenticateAPIKey(ctx, credential)
+	} else {
+		userID, tv, err = parseClaims(credential, "")
+	}
+	if err != nil || accounts == nil {
+		return userID, err
+	}
+
+	user, err := accounts.GetByID(userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get account")
+	}
+	if user == nil || user.Status == models.AccountDeleted {
+		return 0, fmt.Errorf("invalid token")
+	}
+	switch user.AccountState(time.Now()) {
+	case models.AccountBanned:
+		return 0, fmt.Errorf("account banned")
+	case models.AccountSuspended:
+		if !allowSuspended {
+			return 0, fmt.Errorf("account suspended until %s", user.SuspendedUntil.UTC().Format(time.RFC3339))
+		}
+	}
+	if !isAPIKey && user.TokenVersion != tv {
+		return 0, fmt.Errorf("invalid token")
+	}
+	return userID, nil
+}
+
+func getUserIDFromToken(ctx *fasthttp.RequestCtx) (int, error) {
+	return authenticate(ctx, false)
+}
+
+// getSuspendedUserIDFromToken is getUserIDFromToken for the few endpoints
+// suspended users may still use, such as appeals
+func getSuspendedUserIDFromToken(ctx *fasthttp.RequestCtx) (int, error) {
+	return authenticate(ctx, true)
+}
+
+// viewerID returns the caller's user id on public endpoints, or 0 for
+// anonymous callers and callers whose token is not accepted
+func viewerID(ctx *fasthttp.RequestCtx) int {
+	if len(ctx.Request.Header.Peek("Authorization")) == 0 {
+		return 0
+	}
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		return 0
+	}
+	return userID
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"sort"
+	"strconv"
+
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// CategoryHandler handles trash category endpoints
+type CategoryHandler struct {
+	repo     *models.CategoryRepository
+	userRepo *models.UserRepository
+}
+
+func NewCategoryHandler(repo *models.CategoryRepository, userRepo *models.UserRepository) *CategoryHandler {
+	return &CategoryHandler{repo: repo, userRepo: userRepo}
+}
+
+// GetCategories lists the active categories, severities and hazard flags posts can use
+func (h *CategoryHandler) GetCategories(ctx *fasthttp.RequestCtx) {
+	categories, err := h.repo.GetAll(true)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get categories"})
+		return
+	}
+	hazards := make([]string, 0, len(models.HazardFlags))
+	for flag := range models.HazardFlags {
+		hazards = append(hazards, flag)
+	}
+	sort.Strings(hazards)
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+		"categories": categories,
+		"severities": models.Severities,
+		"hazards":    hazards,
+	})
+}
+
+// GetAllCategories lists every category, including inactive ones, if user is admin
+func (h *CategoryHandler) GetAllCategories(ctx *fasthttp.RequestCtx) {
+	if requireAdmin(ctx, h.userRepo) == nil {
+		return
+	}
+	categories, err := h.repo.GetAll(false)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get categories"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, categories)
+}
+
+// CreateCategory adds a category if user is admin
+func (h *CategoryHandler) CreateCategory(ctx *fasthttp.RequestCtx) {
+	admin := requireAdmin(ctx, h.userRepo)
+	if admin == nil {
+		return
+	}
+
+	c := models.TrashCategory{Active: true}
+	if err := readJSON(ctx, &c); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := c.Validate(); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	// the key is unique, so failures here are almost always duplicates
+	if err := h.repo.Create(&c); err != nil {
+		writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": "failed to create category"})
+		return
+	}
+	recordAudit(ctx, admin.ID, models.AuditCategoryCreate, "category", c.ID, nil, c)
+	writeJSON(ctx, fasthttp.StatusCreated, c)
+}
+
+// UpdateCategory renames, flags or deactivates a category if user is admin.
+// The key cannot change.
+func (h *CategoryHandler) UpdateCategory(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	admin := requireAdmin(ctx, h.userRepo)
+	if admin == nil {
+		return
+	}
+
+	c, err := h.repo.GetByID(id)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get category"})
+		return
+	}
+	if c == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "category not found"})
+		return
+	}
+	key, before := c.Key, snapshot(c)
+	if err := readJSON(ctx, c); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	c.ID, c.Key = id, key
+	if err := c.Validate(); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := h.repo.Update(c); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to update category"})
+		return
+	}
+	recordAudit(ctx, admin.ID, models.AuditCategoryUpdate, "category", id, before, c)
+	writeJSON(ctx, fasthttp.StatusOK, c)
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"strconv"
 
+	"gobackend/events"
 	"gobackend/models"
 
 	"github.com/valyala/fasthttp"
@@ -13,10 +14,11 @@ type CommentHandler struct {
 	repo     *models.CommentRepository
 	userRepo *models.UserRepository
 	postRepo *models.TrashPostRepository
+	exp      *models.ExpEngine
 }
 
-func NewCommentHandler(repo *models.CommentRepository, userRepo *models.UserRepository, postRepo *models.TrashPostRepository) *CommentHandler {
-	return &CommentHandler{repo: repo, userRepo: userRepo, postRepo: postRepo}
+func NewCommentHandler(repo *models.CommentRepository, userRepo *models.UserRepository, postRepo *models.TrashPostRepository, exp *models.ExpEngine) *CommentHandler {
+	return &CommentHandler{repo: repo, userRepo: userRepo, postRepo: postRepo, exp: exp}
 }
 
 // createCommentRequest represents the payload for creating a comment
@@ -56,15 +58,47 @@ func (h *CommentHandler) CreateComment(ctx *fasthttp.RequestCtx) {
 		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid post"})
 		return
 	}
+	if visible, err := postVisible(h.userRepo, post, userID); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get post"})
+		return
+	} else if !visible {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "post not found"})
+		return
+	}
 
-	c := models.Comment{PostID: postID, UserID: userID, Content: req.Content, User: user}
+	c := models.Comment{PostID: postID, UserID: userID, Content: req.Content, User: user.Public()}
 	if err := h.repo.Create(&c); err != nil {
 		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to create comment"})
 		return
 	}
 
-	_ = h.userRepo.AddExp(userID, 10)
-	_ = h.userRepo.AddExp(post.UserID, 10)
+	award, _ := h.exp.Award(models.ExpAction{
+		Action:     models.ExpReasonComment,
+		UserID:     userID,
+		OwnerID:    post.UserID,
+		ActorID:    userID,
+		PostID:     post.ID,
+		SourceType: models.ExpSourceComment,
+		SourceID:   c.ID,
+	}.At(post.Latitude, post.Longitude))
+	// nobody else sees a shadow-banned user's comment, so the owner earns nothing for it
+	if user.Status != models.AccountShadowBanned {
+		_, _ = h.exp.Award(models.ExpAction{
+			Action:     models.ExpReasonCommentReceived,
+			UserID:     post.UserID,
+			OwnerID:    userID,
+			ActorID:    userID,
+			PostID:     post.ID,
+			SourceType: models.ExpSourceComment,
+			SourceID:   c.ID,
+		}.At(post.Latitude, post.Longitude))
+	}
+
+	events.Publish(events.Event{
+		Type:   events.CommentCreated,
+		UserID: userID,
+		Data:   map[string]interface{}{"post_id": post.ID, "comment_id": c.ID, "exp_awarded": award.Awarded()},
+	})
 
 	writeJSON(ctx, fasthttp.StatusCreated, c)
 }
@@ -78,7 +112,25 @@ func (h *CommentHandler) GetComments(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	comments, err := h.repo.GetByPostID(postID)
+	viewer := viewerID(ctx)
+	post, err := h.postRepo.GetByID(postID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get post"})
+		return
+	}
+	if post == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "post not found"})
+		return
+	}
+	if visible, err := postVisible(h.userRepo, post, viewer); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get post"})
+		return
+	} else if !visible {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "post not found"})
+		return
+	}
+
+	comments, err := h.repo.GetByPostID(postID, viewer)
 	if err != nil {
 		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get comments"})
 		return
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ExpRulesHandler exposes the EXP rules configuration to admins
+type ExpRulesHandler struct {
+	engine   *models.ExpEngine
+	userRepo *models.UserRepository
+}
+
+func NewExpRulesHandler(engine *models.ExpEngine, userRepo *models.UserRepository) *ExpRulesHandler {
+	return &ExpRulesHandler{engine: engine, userRepo: userRepo}
+}
+
+// GetRules returns the EXP rules currently in effect
+func (h *ExpRulesHandler) GetRules(ctx *fasthttp.RequestCtx) {
+	if requireAdmin(ctx, h.userRepo) == nil {
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, h.engine.Rules())
+}
+
+// UpdateRules replaces the EXP rules. Every server process reloads them without a restart.
+func (h *ExpRulesHandler) UpdateRules(ctx *fasthttp.RequestCtx) {
+	admin := requireAdmin(ctx, h.userRepo)
+	if admin == nil {
+		return
+	}
+
+	var rules models.ExpRules
+	if err := readJSON(ctx, &rules); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := rules.Validate(); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	before := h.engine.Rules()
+	if err := h.engine.Update(&rules); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to save rules"})
+		return
+	}
+	after := h.engine.Rules()
+	recordAudit(ctx, admin.ID, models.AuditExpRulesUpdate, "exp_rules", 0, before, after)
+	writeJSON(ctx, fasthttp.StatusOK, after)
+}
@@ -2,6 +2,9 @@ package handlers
 
 import (
 	"encoding/json"
+	"strconv"
+
+	"gobackend/models"
 
 	"github.com/valyala/fasthttp"
 )
@@ -21,3 +24,107 @@ func writeJSON(ctx *fasthttp.RequestCtx, status int, v interface{}) {
 func readJSON(ctx *fasthttp.RequestCtx, v interface{}) error {
 	return json.Unmarshal(ctx.PostBody(), v)
 }
+
+// pageArgs reads the limit and offset query parameters. The limit defaults
+// to 50 and is capped at 200.
+func pageArgs(ctx *fasthttp.RequestCtx) (limit, offset int) {
+	limit = 50
+	if l, err := strconv.Atoi(string(ctx.QueryArgs().Peek("limit"))); err == nil && l > 0 && l <= 200 {
+		limit = l
+	}
+	if o, err := strconv.Atoi(string(ctx.QueryArgs().Peek("offset"))); err == nil && o > 0 {
+		offset = o
+	}
+	return limit, offset
+}
+
+// requireAdmin authenticates the caller and checks they are an admin.
+// It writes an error response and returns nil when they are not.
+func requireAdmin(ctx *fasthttp.RequestCtx, userRepo *models.UserRepository) *models.User {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return nil
+	}
+	user, err := userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": "invalid user"})
+		return nil
+	}
+	if !user.IsAdmin {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "admin required"})
+		return nil
+	}
+	if !requireTwoFactor(ctx, userRepo, user) {
+		return nil
+	}
+	return user
+}
+
+// requireModerator authenticates the caller and checks they are a moderator
+// or an admin. It writes an error response and returns nil when they are not.
+func requireModerator(ctx *fasthttp.RequestCtx, userRepo *models.UserRepository) *models.User {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return nil
+	}
+	user, err := userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": "invalid user"})
+		return nil
+	}
+	if !user.IsModerator() {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "moderator required"})
+		return nil
+	}
+	if !requireTwoFactor(ctx, userRepo, user) {
+		return nil
+	}
+	return user
+}
+
+// requireTwoFactor checks a privileged user has two-factor authentication
+// enabled if the policy requires it for their role. It writes an error
+// response and returns false when they have not.
+func requireTwoFactor(ctx *fasthttp.RequestCtx, userRepo *models.UserRepository, user *models.User) bool {
+	if user.TwoFactorEnabledAt != nil {
+		return true
+	}
+	required, err := userRepo.TwoFactorRequired(user.Role)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to check two-factor policy"})
+		return false
+	}
+	if required {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "two-factor authentication required for your role"})
+		return false
+	}
+	return true
+}
+
+// postVisible reports whether viewer may see a post. Posts hidden by
+// moderation and posts by shadow-banned users are only visible to their owner
+// and to moderators.
+func postVisible(userRepo *models.UserRepository, post *models.TrashPost, viewer int) (bool, error) {
+	if viewer != 0 && viewer == post.UserID {
+		return true, nil
+	}
+	if !post.Hidden {
+		owner, err := userRepo.GetByID(post.UserID)
+		if err != nil {
+			return false, err
+		}
+		if owner == nil || owner.Status != models.AccountShadowBanned {
+			return true, nil
+		}
+	}
+	if viewer == 0 {
+		return false, nil
+	}
+	user, err := userRepo.GetByID(viewer)
+	if err != nil {
+		return false, err
+	}
+	return user != nil && user.IsModerator(), nil
+}
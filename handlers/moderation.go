@@ -0,0 +1,556 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"gobackend/events"
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ModerationHandler handles content reports and the moderation queue
+type ModerationHandler struct {
+	repo        *models.ModerationRepository
+	userRepo    *models.UserRepository
+	postRepo    *models.TrashPostRepository
+	commentRepo *models.CommentRepository
+	// autoHideFlags is how many users must report a post or comment before it is hidden
+	autoHideFlags int
+}
+
+func NewModerationHandler(repo *models.ModerationRepository, userRepo *models.UserRepository, postRepo *models.TrashPostRepository, commentRepo *models.CommentRepository) *ModerationHandler {
+	h := &ModerationHandler{repo: repo, userRepo: userRepo, postRepo: postRepo, commentRepo: commentRepo, autoHideFlags: 3}
+	if n, err := strconv.Atoi(os.Getenv("MODERATION_AUTO_HIDE_FLAGS")); err == nil && n >= 0 {
+		h.autoHideFlags = n
+	}
+	return h
+}
+
+// CreateReport flags a post, comment or user for moderators
+func (h *ModerationHandler) CreateReport(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var rep models.Report
+	if err := readJSON(ctx, &rep); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	rep.ReporterID = userID
+	if err := rep.Validate(); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if rep.TargetType == models.ReportTargetUser && rep.TargetID == userID {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "you cannot report yourself"})
+		return
+	}
+
+	if _, err := h.repo.CreateReport(&rep, h.autoHideFlags); err != nil {
+		switch {
+		case errors.Is(err, models.ErrTargetNotFound):
+			writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": err.Error()})
+		case errors.Is(err, models.ErrAlreadyReported):
+			writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": err.Error()})
+		default:
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to create report"})
+		}
+		return
+	}
+	// whether the report hid the content is not the reporter's business
+	writeJSON(ctx, fasthttp.StatusCreated, rep)
+}
+
+// GetQueue lists reported content waiting for a moderator, most reported first
+func (h *ModerationHandler) GetQueue(ctx *fasthttp.RequestCtx) {
+	if requireModerator(ctx, h.userRepo) == nil {
+		return
+	}
+	limit, offset := pageArgs(ctx)
+
+	items, err := h.repo.Queue(limit, offset)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get queue"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, items)
+}
+
+// moderationTarget parses the {type} and {id} path parameters
+func moderationTarget(ctx *fasthttp.RequestCtx) (string, int, bool) {
+	targetType := ctx.UserValue("type").(string)
+	if !models.ValidReportTarget(targetType) {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "type must be post, comment or user"})
+		return "", 0, false
+	}
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return "", 0, false
+	}
+	return targetType, id, true
+}
+
+// GetTarget returns every report on a target and the actions taken on it
+func (h *ModerationHandler) GetTarget(ctx *fasthttp.RequestCtx) {
+	targetType, id, ok := moderationTarget(ctx)
+	if !ok {
+		return
+	}
+	if requireModerator(ctx, h.userRepo) == nil {
+		return
+	}
+
+	reports, err := h.repo.GetReports(targetType, id)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get reports"})
+		return
+	}
+	actions, err := h.repo.History(models.ModerationHistoryFilter{TargetType: targetType, TargetID: id, Limit: 200})
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get history"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+		"target_type": targetType,
+		"target_id":   id,
+		"reports":     reports,
+		"actions":     actions,
+	})
+}
+
+// moderationActionRequest represents the payload for acting on a target
+type moderationActionRequest struct {
+	Action      string `json:"action"`
+	Reason      string `json:"reason"`
+	SuspendDays int    `json:"suspend_days"`
+}
+
+// Act dismisses the reports on a target, hides or deletes it, or warns or
+// suspends the user responsible. The target's open reports are closed.
+func (h *ModerationHandler) Act(ctx *fasthttp.RequestCtx) {
+	targetType, id, ok := moderationTarget(ctx)
+	if !ok {
+		return
+	}
+	mod := requireModerator(ctx, h.userRepo)
+	if mod == nil {
+		return
+	}
+
+	var req moderationActionRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if !models.ModerationActions[req.Action] {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "action must be dismiss, hide, delete, warn or suspend"})
+		return
+	}
+	if targetType == models.ReportTargetUser && (req.Action == models.ModHide || req.Action == models.ModDelete) {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "users can only be warned or suspended"})
+		return
+	}
+	if req.SuspendDays == 0 {
+		req.SuspendDays = 7
+	}
+	if req.SuspendDays < 0 || req.SuspendDays > 365 {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "suspend_days must be between 1 and 365"})
+		return
+	}
+
+	ownerID, err := h.repo.TargetOwner(targetType, id)
+	if errors.Is(err, models.ErrTargetNotFound) {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get target"})
+		return
+	}
+	if req.Action == models.ModWarn || req.Action == models.ModSuspend {
+		subject, err := h.userRepo.GetByID(ownerID)
+		if err != nil || subject == nil {
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get user"})
+			return
+		}
+		// only admins may discipline other staff
+		if subject.ID == mod.ID || (subject.IsModerator() && !mod.IsAdmin) {
+			writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "you cannot " + req.Action + " this user"})
+			return
+		}
+	}
+
+	before, err := h.targetSnapshot(targetType, id)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get target"})
+		return
+	}
+
+	var reversals []*models.ExpEvent
+	if req.Action == models.ModDelete {
+		// take back the EXP the content earned before it disappears
+		switch targetType {
+		case models.ReportTargetPost:
+			reversals, err = h.userRepo.ReverseExpAndDeletePost(id, mod.ID)
+		case models.ReportTargetComment:
+			reversals, err = h.userRepo.ReverseExpAndDeleteComment(id, mod.ID)
+		}
+		if err != nil {
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to delete " + targetType})
+			return
+		}
+	}
+
+	var until *time.Time
+	if req.Action == models.ModSuspend {
+		t := time.Now().UTC().Add(time.Duration(req.SuspendDays) * 24 * time.Hour).Truncate(time.Second)
+		until = &t
+	}
+	a := &models.ModerationAction{
+		ModeratorID:   mod.ID,
+		TargetType:    targetType,
+		TargetID:      id,
+		SubjectUserID: ownerID,
+		Action:        req.Action,
+		Reason:        req.Reason,
+	}
+	if err := h.repo.Act(a, until); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to record action"})
+		return
+	}
+	after := map[string]interface{}{"action": a}
+	if req.Action == models.ModDelete {
+		after["exp_reversals"] = reversals
+	} else if after["target"], err = h.targetSnapshot(targetType, id); err != nil {
+		log.Printf("moderation action %d: snapshot: %v", a.ID, err)
+	}
+	recordAudit(ctx, mod.ID, models.AuditModeration+req.Action, targetType, id, before, after)
+
+	switch req.Action {
+	case models.ModWarn:
+		events.Publish(events.Event{
+			Type:   events.UserWarned,
+			UserID: ownerID,
+			Data:   map[string]interface{}{"target_type": targetType, "target_id": id, "reason": req.Reason},
+		})
+	case models.ModSuspend:
+		events.Publish(events.Event{
+			Type:   events.UserSuspended,
+			UserID: ownerID,
+			Data:   map[string]interface{}{"target_type": targetType, "target_id": id, "reason": req.Reason, "suspended_until": until},
+		})
+	}
+	writeJSON(ctx, fasthttp.StatusCreated, a)
+}
+
+// targetSnapshot returns a target as the audit log should remember it
+func (h *ModerationHandler) targetSnapshot(targetType string, id int) (interface{}, error) {
+	switch targetType {
+	case models.ReportTargetPost:
+		return h.postRepo.GetByID(id)
+	case models.ReportTargetComment:
+		return h.commentRepo.GetByID(id)
+	}
+	user, err := h.userRepo.GetByID(id)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	return accountSnapshot(user), nil
+}
+
+// accountSnapshot is the part of a user that account state changes affect
+func accountSnapshot(u *models.User) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                    u.ID,
+		"role":                  u.Role,
+		"status":                u.Status,
+		"suspended_until":       u.SuspendedUntil,
+		"token_version":         u.TokenVersion,
+		"two_factor_enabled_at": u.TwoFactorEnabledAt,
+	}
+}
+
+// GetHistory lists moderation actions, newest first. It can be narrowed with
+// target_type, target_id, user_id (the user acted against), moderator_id and action.
+func (h *ModerationHandler) GetHistory(ctx *fasthttp.RequestCtx) {
+	if requireModerator(ctx, h.userRepo) == nil {
+		return
+	}
+	args := ctx.QueryArgs()
+	f := models.ModerationHistoryFilter{
+		TargetType: string(args.Peek("target_type")),
+		Action:     string(args.Peek("action")),
+	}
+	f.TargetID, _ = strconv.Atoi(string(args.Peek("target_id")))
+	f.SubjectUserID, _ = strconv.Atoi(string(args.Peek("user_id")))
+	f.ModeratorID, _ = strconv.Atoi(string(args.Peek("moderator_id")))
+	f.Limit, f.Offset = pageArgs(ctx)
+
+	actions, err := h.repo.History(f)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get history"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, actions)
+}
+
+// accountStateRequest represents the payload for changing an account state
+type accountStateRequest struct {
+	State       string `json:"state"`
+	Reason      string `json:"reason"`
+	SuspendDays int    `json:"suspend_days"`
+}
+
+// accountStateActions maps the states an admin can set to the action recorded
+var accountStateActions = map[string]string{
+	models.AccountActive:       models.ModReinstate,
+	models.AccountSuspended:    models.ModSuspend,
+	models.AccountBanned:       models.ModBan,
+	models.AccountShadowBanned: models.ModShadowBan,
+}
+
+// GetAccountState returns a user's account state and the actions taken against them if caller is admin
+func (h *ModerationHandler) GetAccountState(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	if requireAdmin(ctx, h.userRepo) == nil {
+		return
+	}
+
+	user, err := h.userRepo.GetByID(id)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "user not found"})
+		return
+	}
+	actions, err := h.repo.History(models.ModerationHistoryFilter{SubjectUserID: id, Limit: 200})
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get history"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+		"user_id":         id,
+		"state":           user.AccountState(time.Now()),
+		"suspended_until": user.SuspendedUntil,
+		"actions":         actions,
+	})
+}
+
+// SetAccountState reinstates, suspends, bans or shadow-bans a user if caller
+// is admin. A reason is required and recorded with the acting admin.
+func (h *ModerationHandler) SetAccountState(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	admin := requireAdmin(ctx, h.userRepo)
+	if admin == nil {
+		return
+	}
+	if admin.ID == id {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "you cannot change your own account state"})
+		return
+	}
+
+	var req accountStateRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	action, ok := accountStateActions[req.State]
+	if !ok {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "state must be active, suspended, banned or shadow_banned"})
+		return
+	}
+	if req.Reason == "" {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "reason required"})
+		return
+	}
+	if req.SuspendDays == 0 {
+		req.SuspendDays = 7
+	}
+	if req.SuspendDays < 0 || req.SuspendDays > 365 {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "suspend_days must be between 1 and 365"})
+		return
+	}
+	user, err := h.userRepo.GetByID(id)
+	if err != nil || user == nil || user.Status == models.AccountDeleted {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "user not found"})
+		return
+	}
+
+	a := &models.ModerationAction{
+		ModeratorID:   admin.ID,
+		TargetType:    models.ReportTargetUser,
+		TargetID:      id,
+		SubjectUserID: id,
+		Action:        action,
+		Reason:        req.Reason,
+	}
+	var until *time.Time
+	if req.State == models.AccountSuspended {
+		// a suspension is on top of an active account and closes reports on the user
+		t := time.Now().UTC().Add(time.Duration(req.SuspendDays) * 24 * time.Hour).Truncate(time.Second)
+		until = &t
+		if user.Status != models.AccountActive {
+			err = h.repo.SetAccountState(&models.ModerationAction{
+				ModeratorID: admin.ID, SubjectUserID: id, Action: models.ModReinstate, Reason: req.Reason,
+			}, models.AccountActive)
+		}
+		if err == nil {
+			err = h.repo.Act(a, until)
+		}
+	} else {
+		err = h.repo.SetAccountState(a, req.State)
+	}
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to update account"})
+		return
+	}
+	if updated, err := h.userRepo.GetByID(id); err == nil && updated != nil {
+		recordAudit(ctx, admin.ID, models.AuditUserState, models.ReportTargetUser, id, accountSnapshot(user),
+			map[string]interface{}{"account": accountSnapshot(updated), "action": a})
+	}
+
+	if until != nil {
+		events.Publish(events.Event{
+			Type:   events.UserSuspended,
+			UserID: id,
+			Data:   map[string]interface{}{"reason": req.Reason, "suspended_until": until},
+		})
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+		"user_id":         id,
+		"state":           req.State,
+		"suspended_until": until,
+		"action":          a,
+	})
+}
+
+// appealRequest represents the payload for appealing a suspension
+type appealRequest struct {
+	Message string `json:"message"`
+}
+
+// CreateAppeal lets a suspended user ask for the suspension to be lifted
+func (h *ModerationHandler) CreateAppeal(ctx *fasthttp.RequestCtx) {
+	userID, err := getSuspendedUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var req appealRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.Message == "" || len(req.Message) > 2000 {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "message must be 1-2000 characters"})
+		return
+	}
+	user, err := h.userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": "invalid user"})
+		return
+	}
+	if user.AccountState(time.Now()) != models.AccountSuspended {
+		writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": "account is not suspended"})
+		return
+	}
+
+	ap := models.Appeal{UserID: userID, Message: req.Message}
+	if err := h.repo.CreateAppeal(&ap); err != nil {
+		if errors.Is(err, models.ErrAppealOpen) {
+			writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to create appeal"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusCreated, ap)
+}
+
+// GetMyAppeals lists the caller's appeals, newest first
+func (h *ModerationHandler) GetMyAppeals(ctx *fasthttp.RequestCtx) {
+	userID, err := getSuspendedUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	limit, offset := pageArgs(ctx)
+
+	appeals, err := h.repo.GetAppeals(userID, "", limit, offset)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get appeals"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, appeals)
+}
+
+// GetAppeals lists appeals for moderators, optionally only those with ?status=
+func (h *ModerationHandler) GetAppeals(ctx *fasthttp.RequestCtx) {
+	if requireModerator(ctx, h.userRepo) == nil {
+		return
+	}
+	limit, offset := pageArgs(ctx)
+
+	appeals, err := h.repo.GetAppeals(0, string(ctx.QueryArgs().Peek("status")), limit, offset)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get appeals"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, appeals)
+}
+
+// resolveAppealRequest represents the payload for deciding an appeal
+type resolveAppealRequest struct {
+	Accept   bool   `json:"accept"`
+	Response string `json:"response"`
+}
+
+// ResolveAppeal accepts or rejects an appeal. Accepting it lifts the suspension.
+func (h *ModerationHandler) ResolveAppeal(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	mod := requireModerator(ctx, h.userRepo)
+	if mod == nil {
+		return
+	}
+
+	var req resolveAppealRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	ap, err := h.repo.ResolveAppeal(id, mod.ID, req.Accept, req.Response)
+	if err == nil {
+		recordAudit(ctx, mod.ID, models.AuditAppealResolve, "appeal", id, nil, ap)
+	}
+	switch {
+	case errors.Is(err, models.ErrAppealNotFound):
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, models.ErrAppealNotPending):
+		writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": err.Error()})
+	case err != nil:
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to resolve appeal"})
+	default:
+		writeJSON(ctx, fasthttp.StatusOK, ap)
+	}
+}
@@ -1,104 +1,336 @@
 package handlers
 
 import (
-	"context"
-	"encoding/json"
-	"math/rand"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
+	"gobackend/events"
 	"gobackend/models"
+	"gobackend/oidc"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/valyala/fasthttp"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 )
 
+// oauthStateTTL is how long a user has to finish signing in at the provider
+const oauthStateTTL = 10 * time.Minute
+
+// oauthStateCookie binds an authorization request to the browser that started it
+const oauthStateCookie = "oauth_state"
+
+// randomToken returns 32 random bytes, base64url encoded
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// OAuthHandler signs users in through the configured OAuth2 and OpenID
+// Connect providers and links provider accounts to existing users
 type OAuthHandler struct {
-	config   *oauth2.Config
-	userRepo *models.UserRepository
+	providers  *oidc.Registry
+	userRepo   *models.UserRepository
+	identities *models.IdentityRepository
+}
+
+func NewOAuthHandler(providers *oidc.Registry, userRepo *models.UserRepository, identities *models.IdentityRepository) *OAuthHandler {
+	return &OAuthHandler{
+		providers:  providers,
+		userRepo:   userRepo,
+		identities: identities,
+	}
+}
+
+// setStateCookie sets or, with an empty state, clears the state cookie
+func (h *OAuthHandler) setStateCookie(ctx *fasthttp.RequestCtx, p *oidc.Provider, state string) {
+	c := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(c)
+	c.SetKey(oauthStateCookie)
+	c.SetValue(state)
+	c.SetPath("/auth/")
+	c.SetHTTPOnly(true)
+	c.SetSecure(strings.HasPrefix(p.RedirectURL, "https://"))
+	// Lax still sends the cookie on the provider's top-level redirect back
+	c.SetSameSite(fasthttp.CookieSameSiteLaxMode)
+	if state == "" {
+		c.SetExpire(fasthttp.CookieExpireDelete)
+	} else {
+		c.SetMaxAge(int(oauthStateTTL.Seconds()))
+	}
+	ctx.Response.Header.SetCookie(c)
+}
+
+// begin stores a new authorization request with a random state, PKCE
+// verifier and nonce, binds it to the browser and returns the provider URL
+// to send the browser to. userID is set when linking rather than signing in.
+func (h *OAuthHandler) begin(ctx *fasthttp.RequestCtx, p *oidc.Provider, userID int) (string, error) {
+	state, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	pending := &models.OAuthState{Provider: p.Name, Verifier: oauth2.GenerateVerifier(), Nonce: nonce, UserID: userID}
+	url, err := p.AuthCodeURL(ctx, state, pending.Verifier, nonce)
+	if err != nil {
+		return "", err
+	}
+	if err := h.identities.CreateState(state, pending, oauthStateTTL); err != nil {
+		return "", err
+	}
+	h.setStateCookie(ctx, p, state)
+	return url, nil
 }
 
-func NewOAuthHandler(userRepo *models.UserRepository) *OAuthHandler {
-	conf := &oauth2.Config{
-		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
-		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
-		Endpoint:     google.Endpoint,
-		RedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
-		Scopes:       []string{"email", "profile"},
+// writeBeginError reports a failure to start an authorization request
+func writeBeginError(ctx *fasthttp.RequestCtx, err error) {
+	if errors.Is(err, oidc.ErrUnavailable) {
+		writeJSON(ctx, fasthttp.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
 	}
-	return &OAuthHandler{config: conf, userRepo: userRepo}
+	writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to start sign-in"})
 }
 
+// GetProviders lists the providers users can sign in with
+func (h *OAuthHandler) GetProviders(ctx *fasthttp.RequestCtx) {
+	writeJSON(ctx, fasthttp.StatusOK, h.providers.Names())
+}
+
+// Login sends the browser to the provider to sign in
 func (h *OAuthHandler) Login(ctx *fasthttp.RequestCtx) {
-	url := h.config.AuthCodeURL("state")
+	p := h.provider(ctx)
+	if p == nil {
+		return
+	}
+	url, err := h.begin(ctx, p, 0)
+	if err != nil {
+		writeBeginError(ctx, err)
+		return
+	}
 	ctx.Redirect(url, http.StatusFound)
 }
 
+// Callback completes an authorization request started by Login or LinkIdentity
 func (h *OAuthHandler) Callback(ctx *fasthttp.RequestCtx) {
+	p := h.provider(ctx)
+	if p == nil {
+		return
+	}
+	if e := ctx.QueryArgs().Peek("error"); len(e) > 0 {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "authorization denied: " + string(e)})
+		return
+	}
+
+	state := string(ctx.QueryArgs().Peek("state"))
+	cookie := ctx.Request.Header.Cookie(oauthStateCookie)
+	h.setStateCookie(ctx, p, "")
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), cookie) != 1 {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": models.ErrStateInvalid.Error()})
+		return
+	}
+	pending, err := h.identities.ConsumeState(state, p.Name)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": models.ErrStateInvalid.Error()})
+		return
+	}
+
 	code := string(ctx.QueryArgs().Peek("code"))
 	if code == "" {
 		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "code required"})
 		return
 	}
-
-	token, err := h.config.Exchange(context.Background(), code)
+	claims, err := p.Identify(ctx, code, pending.Verifier, pending.Nonce)
 	if err != nil {
-		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "token exchange failed"})
+		if errors.Is(err, oidc.ErrUnavailable) {
+			writeJSON(ctx, fasthttp.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
 		return
 	}
 
-	client := h.config.Client(context.Background(), token)
-	resp, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
+	if pending.UserID != 0 {
+		h.link(ctx, p, pending.UserID, claims)
+		return
+	}
+	h.signIn(ctx, p, claims)
+}
+
+// signIn signs in the user linked to the provider account, creating one for
+// first-time visitors. An existing account with the same email is never
+// signed into: its owner has to link the provider explicitly.
+func (h *OAuthHandler) signIn(ctx *fasthttp.RequestCtx, p *oidc.Provider, claims *oidc.Identity) {
+	identity, err := h.identities.Get(p.Name, claims.Subject)
 	if err != nil {
-		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get user info"})
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "db error"})
 		return
 	}
-	defer resp.Body.Close()
 
-	var info struct {
-		Email string `json:"email"`
-		Name  string `json:"name"`
+	var user *models.User
+	if identity != nil {
+		if user, err = h.userRepo.GetByID(identity.UserID); err != nil || user == nil {
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "db error"})
+			return
+		}
+		if err := h.identities.RecordLogin(identity.ID, claims.Email); err != nil {
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "db error"})
+			return
+		}
+	} else {
+		if user, err = h.signUp(ctx, p, claims); user == nil {
+			if err != nil {
+				writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "create user"})
+			}
+			return
+		}
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
-		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "decode user info"})
+
+	if user.Status == models.AccountBanned {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "account banned"})
 		return
 	}
+	writeSession(ctx, user)
+}
 
-	user, err := h.userRepo.GetByEmail(info.Email)
+// signUp creates a user for a provider account that is not linked yet. It
+// writes the response and returns nil when it refuses to.
+func (h *OAuthHandler) signUp(ctx *fasthttp.RequestCtx, p *oidc.Provider, claims *oidc.Identity) (*models.User, error) {
+	if claims.Email == "" {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "the provider did not share an email address"})
+		return nil, nil
+	}
+	existing, err := h.userRepo.FindByEmail(claims.Email)
 	if err != nil {
-		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "db error"})
-		return
+		return nil, err
+	}
+	if existing != nil {
+		writeJSON(ctx, fasthttp.StatusConflict, map[string]string{
+			"error": fmt.Sprintf("an account with this email already exists; sign in to it and link %s from your account", p.Name),
+		})
+		return nil, nil
 	}
-	if user == nil {
-		user = &models.User{Name: info.Name, Email: info.Email}
-		_ = user.SetPassword(randomString())
-		if err := h.userRepo.Create(user); err != nil {
-			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "create user"})
+
+	name := claims.Name
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+	password, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	user := &models.User{Name: name, Email: claims.Email}
+	if err := user.SetPassword(password); err != nil {
+		return nil, err
+	}
+	if err := h.userRepo.Create(user); err != nil {
+		return nil, err
+	}
+	if claims.EmailVerified {
+		if err := h.userRepo.MarkEmailVerified(user.ID); err != nil {
+			return nil, err
+		}
+		now := time.Now().UTC()
+		user.EmailVerifiedAt = &now
+	}
+	identity := &models.Identity{UserID: user.ID, Provider: p.Name, Subject: claims.Subject, Email: claims.Email}
+	if err := h.identities.Link(identity); err != nil {
+		return nil, err
+	}
+	if err := h.identities.RecordLogin(identity.ID, claims.Email); err != nil {
+		return nil, err
+	}
+	events.Publish(events.Event{Type: events.UserCreated, UserID: user.ID})
+	return user, nil
+}
+
+// link attaches the provider account to the user who started linking
+func (h *OAuthHandler) link(ctx *fasthttp.RequestCtx, p *oidc.Provider, userID int, claims *oidc.Identity) {
+	identity := &models.Identity{UserID: userID, Provider: p.Name, Subject: claims.Subject, Email: claims.Email}
+	if err := h.identities.Link(identity); err != nil {
+		if errors.Is(err, models.ErrIdentityLinked) || errors.Is(err, models.ErrProviderLinked) {
+			writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": err.Error()})
 			return
 		}
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to link account"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, identity)
+}
+
+// provider returns the provider named by the {provider} route parameter,
+// writing a 404 and returning nil if none is configured
+func (h *OAuthHandler) provider(ctx *fasthttp.RequestCtx) *oidc.Provider {
+	p := h.providers.Get(ctx.UserValue("provider").(string))
+	if p == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "unknown provider"})
 	}
+	return p
+}
 
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID,
-		"exp":     time.Now().Add(72 * time.Hour).Unix(),
-	})
-	secret := os.Getenv("JWT_SECRET")
-	signed, err := jwtToken.SignedString([]byte(secret))
+// GetIdentities lists the provider accounts linked to the caller
+func (h *OAuthHandler) GetIdentities(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	identities, err := h.identities.GetByUser(userID)
 	if err != nil {
-		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "token sign"})
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get identities"})
 		return
 	}
+	writeJSON(ctx, fasthttp.StatusOK, identities)
+}
 
-	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{"token": signed, "user": user})
+// LinkIdentity starts linking a provider account to the caller. The
+// returned URL is opened in the same browser, which the callback checks.
+func (h *OAuthHandler) LinkIdentity(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	p := h.provider(ctx)
+	if p == nil {
+		return
+	}
+	url, err := h.begin(ctx, p, userID)
+	if err != nil {
+		writeBeginError(ctx, err)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"url": url})
 }
 
-func randomString() string {
-	b := make([]byte, 16)
-	for i := range b {
-		b[i] = byte('a' + rand.Intn(26))
+// UnlinkIdentity detaches a provider account from the caller. It works for
+// providers that are no longer configured, too.
+func (h *OAuthHandler) UnlinkIdentity(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := h.identities.Unlink(userID, ctx.UserValue("provider").(string)); err != nil {
+		switch {
+		case errors.Is(err, models.ErrIdentityNotFound):
+			writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": err.Error()})
+		case errors.Is(err, models.ErrLastSignInMethod):
+			writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": err.Error()})
+		default:
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to unlink account"})
+		}
+		return
 	}
-	return string(b)
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
 }
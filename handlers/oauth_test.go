@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"gobackend/database"
+	"gobackend/jwtkeys"
+	"gobackend/models"
+	"gobackend/oidc"
+	"gobackend/oidc/oidctest"
+
+	"github.com/valyala/fasthttp"
+)
+
+var alice = oidctest.User{Subject: "alice-sub", Email: "alice@example.com", EmailVerified: true, Name: "Alice"}
+
+// oauthEnv is an OAuthHandler signing in through a fake issuer, backed by a
+// fresh database
+type oauthEnv struct {
+	handler    *OAuthHandler
+	issuer     *oidctest.Issuer
+	users      *models.UserRepository
+	identities *models.IdentityRepository
+}
+
+func newOAuthEnv(t *testing.T) *oauthEnv {
+	t.Helper()
+	iss, err := oidctest.NewIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(iss.Close)
+
+	t.Setenv("JWT_KEYS_FILE", "")
+	t.Setenv("JWT_SECRET", "0123456789abcdef0123456789abcdef")
+	keys, err := jwtkeys.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetSigningKeys(keys)
+	t.Cleanup(func() { SetSigningKeys(nil) })
+
+	t.Setenv("OAUTH_PROVIDERS_FILE", "")
+	t.Setenv("GOOGLE_CLIENT_ID", "")
+	t.Setenv("OAUTH_PROVIDERS", "mock")
+	t.Setenv("OAUTH_MOCK_ISSUER", iss.URL)
+	t.Setenv("OAUTH_MOCK_CLIENT_ID", "client")
+	t.Setenv("OAUTH_MOCK_CLIENT_SECRET", "secret")
+	t.Setenv("OAUTH_MOCK_REDIRECT_URL", "http://localhost/auth/mock/callback")
+	providers, err := oidc.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := database.Initialize(filepath.Join(t.TempDir(), "app.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	users := models.NewUserRepository(db.DB)
+	identities := models.NewIdentityRepository(db.DB)
+	return &oauthEnv{handler: NewOAuthHandler(providers, users, identities), issuer: iss, users: users, identities: identities}
+}
+
+// login starts a sign-in and returns the provider URL and the state cookie
+func (e *oauthEnv) login(t *testing.T) (string, string) {
+	t.Helper()
+	ctx := newRequestCtx()
+	ctx.Request.SetRequestURI("/auth/mock/login")
+	ctx.SetUserValue("provider", "mock")
+	e.handler.Login(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusFound {
+		t.Fatalf("login: status %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	return string(ctx.Response.Header.Peek("Location")), stateCookie(t, ctx)
+}
+
+// link starts linking the provider to user and returns the provider URL and the state cookie
+func (e *oauthEnv) link(t *testing.T, user *models.User) (string, string) {
+	t.Helper()
+	token, err := issueToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := newRequestCtx()
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	ctx.Request.SetRequestURI("/users/me/identities/mock")
+	ctx.Request.Header.Set("Authorization", "Bearer "+token)
+	ctx.SetUserValue("provider", "mock")
+	e.handler.LinkIdentity(ctx)
+	var resp struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &resp); err != nil || resp.URL == "" {
+		t.Fatalf("link: status %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	return resp.URL, stateCookie(t, ctx)
+}
+
+// newRequestCtx returns a request context usable outside a server, which the
+// handlers also pass on as a context.Context
+func newRequestCtx() *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&fasthttp.Request{}, nil, nil)
+	return ctx
+}
+
+func stateCookie(t *testing.T, ctx *fasthttp.RequestCtx) string {
+	t.Helper()
+	c := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(c)
+	c.SetKey(oauthStateCookie)
+	if !ctx.Response.Header.Cookie(c) || len(c.Value()) == 0 {
+		t.Fatal("no state cookie set")
+	}
+	return string(c.Value())
+}
+
+// callback returns to the handler from the provider with code and state,
+// presenting cookie as the browser would
+func (e *oauthEnv) callback(code, state, cookie string) *fasthttp.RequestCtx {
+	ctx := newRequestCtx()
+	ctx.Request.SetRequestURI("/auth/mock/callback?" + url.Values{"code": {code}, "state": {state}}.Encode())
+	ctx.Request.Header.SetCookie(oauthStateCookie, cookie)
+	ctx.SetUserValue("provider", "mock")
+	e.handler.Callback(ctx)
+	return ctx
+}
+
+// signIn goes through a whole sign-in as u and returns the callback response
+func (e *oauthEnv) signIn(t *testing.T, u oidctest.User) *fasthttp.RequestCtx {
+	t.Helper()
+	authURL, cookie := e.login(t)
+	code, state, err := e.issuer.Authorize(authURL, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e.callback(code, state, cookie)
+}
+
+// sessionUser returns the user id of a successful sign-in response
+func sessionUser(t *testing.T, ctx *fasthttp.RequestCtx) int {
+	t.Helper()
+	var resp struct {
+		Token string `json:"token"`
+		User  struct {
+			ID int `json:"id"`
+		} `json:"user"`
+	}
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("callback: status %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &resp); err != nil || resp.Token == "" {
+		t.Fatalf("callback: no session in %s", ctx.Response.Body())
+	}
+	return resp.User.ID
+}
+
+func TestOAuthSignUpAndSignIn(t *testing.T) {
+	e := newOAuthEnv(t)
+
+	id := sessionUser(t, e.signIn(t, alice))
+	user, err := e.users.GetByID(id)
+	if err != nil || user == nil {
+		t.Fatalf("user %d not created: %v", id, err)
+	}
+	if user.Email != alice.Email || user.Name != alice.Name || user.EmailVerifiedAt == nil {
+		t.Errorf("created user %+v does not match %+v", user, alice)
+	}
+	// the PKCE verifier stored with the state reached the token endpoint
+	if len(e.issuer.Verifiers) != 1 || e.issuer.Verifiers[0] == "" {
+		t.Errorf("token endpoint got verifiers %q", e.issuer.Verifiers)
+	}
+
+	if again := sessionUser(t, e.signIn(t, alice)); again != id {
+		t.Errorf("second sign-in as user %d, want %d", again, id)
+	}
+}
+
+func TestOAuthStateMismatch(t *testing.T) {
+	e := newOAuthEnv(t)
+	authURL, _ := e.login(t)
+	_, otherCookie := e.login(t)
+	code, state, err := e.issuer.Authorize(authURL, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := e.callback(code, state, otherCookie)
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Fatalf("status %d, want 400: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if len(e.issuer.Verifiers) != 0 {
+		t.Error("code exchanged despite the state mismatch")
+	}
+	// the request is still pending for its own browser, but completes only once
+	if ctx := e.callback(code, state, state); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("status %d with the matching cookie: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if ctx := e.callback(code, state, state); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Fatalf("replayed state accepted: status %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestOAuthRefusesEmailMatch(t *testing.T) {
+	e := newOAuthEnv(t)
+	existing := &models.User{Name: "alice", Email: alice.Email}
+	if err := existing.SetPassword("pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.users.Create(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := e.signIn(t, alice)
+	if ctx.Response.StatusCode() != fasthttp.StatusConflict {
+		t.Fatalf("status %d, want 409: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	identity, err := e.identities.Get("mock", alice.Subject)
+	if err != nil || identity != nil {
+		t.Errorf("identity linked by email match: %+v, %v", identity, err)
+	}
+}
+
+func TestOAuthLink(t *testing.T) {
+	e := newOAuthEnv(t)
+	bob := &models.User{Name: "bob", Email: "bob@example.com"}
+	if err := bob.SetPassword("pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.users.Create(bob); err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, cookie := e.link(t, bob)
+	code, state, err := e.issuer.Authorize(authURL, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := e.callback(code, state, cookie)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("link callback: status %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	identity, err := e.identities.Get("mock", alice.Subject)
+	if err != nil || identity == nil || identity.UserID != bob.ID {
+		t.Fatalf("identity = %+v, %v; want linked to user %d", identity, err, bob.ID)
+	}
+
+	// the provider account now signs in to bob despite its different email
+	if id := sessionUser(t, e.signIn(t, alice)); id != bob.ID {
+		t.Errorf("signed in as user %d, want %d", id, bob.ID)
+	}
+}
+
+func TestOAuthBadSignature(t *testing.T) {
+	e := newOAuthEnv(t)
+	e.issuer.BadSignature = true
+
+	ctx := e.signIn(t, alice)
+	if ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Fatalf("status %d, want 401: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+}
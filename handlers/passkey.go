@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gobackend/models"
+	"gobackend/webauthn"
+
+	"github.com/valyala/fasthttp"
+)
+
+// passkeyCeremonyTTL is how long a WebAuthn ceremony may take
+const passkeyCeremonyTTL = 5 * time.Minute
+
+// maxPasskeyName is the longest label a passkey can have
+const maxPasskeyName = 64
+
+// PasskeyHandler handles WebAuthn passkey registration and sign-in
+type PasskeyHandler struct {
+	repo     *models.PasskeyRepository
+	userRepo *models.UserRepository
+	rp       *webauthn.Config
+}
+
+func NewPasskeyHandler(repo *models.PasskeyRepository, userRepo *models.UserRepository, rp *webauthn.Config) *PasskeyHandler {
+	return &PasskeyHandler{repo: repo, userRepo: userRepo, rp: rp}
+}
+
+// passkeyCredential is a PublicKeyCredential in the WebAuthn JSON encoding,
+// where binary values are base64url
+type passkeyCredential struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+		AuthenticatorData string   `json:"authenticatorData"`
+		Signature         string   `json:"signature"`
+		UserHandle        string   `json:"userHandle"`
+	} `json:"response"`
+}
+
+// passkeyRequest represents the payload finishing a ceremony
+type passkeyRequest struct {
+	Name       string            `json:"name"`
+	Credential passkeyCredential `json:"credential"`
+}
+
+// pubKeyCredParams lists the algorithms the server accepts
+func pubKeyCredParams() []map[string]interface{} {
+	params := make([]map[string]interface{}, len(webauthn.SupportedAlgs))
+	for i, alg := range webauthn.SupportedAlgs {
+		params[i] = map[string]interface{}{"type": "public-key", "alg": alg}
+	}
+	return params
+}
+
+// newChallenge creates and stores a challenge for a ceremony
+func (h *PasskeyHandler) newChallenge(ctx *fasthttp.RequestCtx, ceremony string, userID int) (string, bool) {
+	challenge, err := webauthn.NewChallenge()
+	if err == nil {
+		err = h.repo.CreateChallenge(challenge, ceremony, userID, passkeyCeremonyTTL)
+	}
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to create challenge"})
+		return "", false
+	}
+	return challenge, true
+}
+
+// RegistrationOptions starts adding a passkey to the caller's account. The
+// response is the publicKey argument for navigator.credentials.create().
+func (h *PasskeyHandler) RegistrationOptions(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	user, err := h.userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": "invalid user"})
+		return
+	}
+	existing, err := h.repo.GetByUser(user.ID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get passkeys"})
+		return
+	}
+	challenge, ok := h.newChallenge(ctx, models.CeremonyRegistration, user.ID)
+	if !ok {
+		return
+	}
+
+	exclude := make([]map[string]interface{}, len(existing))
+	for i, p := range existing {
+		exclude[i] = map[string]interface{}{"type": "public-key", "id": p.CredentialID, "transports": p.Transports}
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+		"challenge": challenge,
+		"rp":        map[string]string{"id": h.rp.RPID, "name": h.rp.RPName},
+		"user": map[string]string{
+			"id":          webauthn.Encode(webauthn.UserHandle(user.ID)),
+			"name":        user.Email,
+			"displayName": user.Name,
+		},
+		"pubKeyCredParams":   pubKeyCredParams(),
+		"timeout":            passkeyCeremonyTTL.Milliseconds(),
+		"attestation":        "none",
+		"excludeCredentials": exclude,
+		"authenticatorSelection": map[string]interface{}{
+			"residentKey":        "required",
+			"requireResidentKey": true,
+			"userVerification":   "required",
+		},
+	})
+}
+
+// decodeFields base64url decodes WebAuthn response fields, failing on the first bad one
+func decodeFields(values ...string) ([][]byte, error) {
+	out := make([][]byte, len(values))
+	for i, v := range values {
+		b, err := webauthn.Decode(v)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid credential encoding")
+		}
+		out[i] = b
+	}
+	return out, nil
+}
+
+// Register verifies the authenticator's response and stores the new passkey
+func (h *PasskeyHandler) Register(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	var req passkeyRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > maxPasskeyName {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "name too long"})
+		return
+	}
+	fields, err := decodeFields(req.Credential.Response.ClientDataJSON, req.Credential.Response.AttestationObject)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	clientData, attestation := fields[0], fields[1]
+
+	challenge, err := webauthn.Challenge(clientData)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	owner, err := h.repo.ConsumeChallenge(challenge, models.CeremonyRegistration)
+	if err != nil || owner != userID {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": models.ErrChallengeInvalid.Error()})
+		return
+	}
+	cred, err := h.rp.VerifyRegistration(challenge, clientData, attestation)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	passkey := &models.Passkey{
+		UserID:         userID,
+		CredentialID:   webauthn.Encode(cred.ID),
+		PublicKey:      cred.PublicKey,
+		Alg:            cred.Alg,
+		SignCount:      cred.SignCount,
+		AAGUID:         hex.EncodeToString(cred.AAGUID),
+		Transports:     req.Credential.Response.Transports,
+		Name:           name,
+		BackupEligible: cred.BackupEligible,
+		BackedUp:       cred.BackedUp,
+	}
+	if err := h.repo.Create(passkey); err != nil {
+		if errors.Is(err, models.ErrPasskeyExists) {
+			writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to save passkey"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusCreated, passkey)
+}
+
+// LoginOptions starts a passwordless sign-in. The response is the publicKey
+// argument for navigator.credentials.get(); the authenticator offers the
+// passkeys it holds for this site, so no email is needed.
+func (h *PasskeyHandler) LoginOptions(ctx *fasthttp.RequestCtx) {
+	challenge, ok := h.newChallenge(ctx, models.CeremonyAuthentication, 0)
+	if !ok {
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+		"challenge":        challenge,
+		"rpId":             h.rp.RPID,
+		"timeout":          passkeyCeremonyTTL.Milliseconds(),
+		"userVerification": "required",
+		"allowCredentials": []interface{}{},
+	})
+}
+
+// Login verifies a passkey assertion and issues the same session token as
+// UserHandler.Login. The passkey proves possession and user verification,
+// so no TOTP challenge follows.
+func (h *PasskeyHandler) Login(ctx *fasthttp.RequestCtx) {
+	var req passkeyRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	c := req.Credential
+	fields, err := decodeFields(c.RawID, c.Response.ClientDataJSON, c.Response.AuthenticatorData, c.Response.Signature)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	rawID, clientData, authData, signature := fields[0], fields[1], fields[2], fields[3]
+
+	// the challenge is used up whether or not the assertion checks out
+	challenge, err := webauthn.Challenge(clientData)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if _, err := h.repo.ConsumeChallenge(challenge, models.CeremonyAuthentication); err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": models.ErrChallengeInvalid.Error()})
+		return
+	}
+
+	passkey, err := h.repo.GetByCredentialID(webauthn.Encode(rawID))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get passkey"})
+		return
+	}
+	if passkey == nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": "unknown passkey"})
+		return
+	}
+	if c.Response.UserHandle != "" {
+		handle, err := webauthn.Decode(c.Response.UserHandle)
+		if err != nil || webauthn.UserID(handle) != passkey.UserID {
+			writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": "unknown passkey"})
+			return
+		}
+	}
+	assertion, err := h.rp.VerifyAssertion(challenge, passkey.PublicKey, clientData, authData, signature)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := h.repo.RecordUse(passkey, assertion.SignCount, assertion.BackedUp); err != nil {
+		if errors.Is(err, models.ErrSignCount) {
+			log.Printf("passkey %d of user %d: sign count %d not above %d, possible clone",
+				passkey.ID, passkey.UserID, assertion.SignCount, passkey.SignCount)
+			writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to update passkey"})
+		return
+	}
+
+	user, err := h.userRepo.GetByID(passkey.UserID)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": "invalid user"})
+		return
+	}
+	// suspended users may still sign in, to appeal
+	if user.Status == models.AccountBanned {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "account banned"})
+		return
+	}
+	signed, err := issueToken(user)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to sign token"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{"token": signed, "user": user})
+}
+
+// GetPasskeys lists the caller's passkeys
+func (h *PasskeyHandler) GetPasskeys(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	passkeys, err := h.repo.GetByUser(userID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get passkeys"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, passkeys)
+}
+
+// RenamePasskey changes the label of one of the caller's passkeys
+func (h *PasskeyHandler) RenamePasskey(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid passkey id"})
+		return
+	}
+	var req passkeyRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxPasskeyName {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "name must be 1 to 64 characters"})
+		return
+	}
+
+	if err := h.repo.Rename(id, userID, name); err != nil {
+		if errors.Is(err, models.ErrPasskeyNotFound) {
+			writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to rename passkey"})
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// DeletePasskey removes one of the caller's passkeys
+func (h *PasskeyHandler) DeletePasskey(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid passkey id"})
+		return
+	}
+
+	if err := h.repo.Delete(id, userID); err != nil {
+		if errors.Is(err, models.ErrPasskeyNotFound) {
+			writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to delete passkey"})
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
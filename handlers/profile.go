@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"fmt"
+	"image/png"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"gobackend/identicon"
+	"gobackend/models"
+
+	"github.com/disintegration/imaging"
+	"github.com/valyala/fasthttp"
+)
+
+// ProfileHandler serves public user profiles, avatars and the privacy
+// settings that limit profiles
+type ProfileHandler struct {
+	userRepo     *models.UserRepository
+	achievements *models.AchievementRepository
+	streaks      *models.StreakRepository
+}
+
+func NewProfileHandler(userRepo *models.UserRepository, achievements *models.AchievementRepository, streaks *models.StreakRepository) *ProfileHandler {
+	return &ProfileHandler{userRepo: userRepo, achievements: achievements, streaks: streaks}
+}
+
+// GetProfile returns a user's public profile. Other users see only what the
+// user's privacy settings allow; the user always sees all of it.
+func (h *ProfileHandler) GetProfile(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return
+	}
+	user, err := h.userRepo.GetByID(id)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get user"})
+		return
+	}
+	if user == nil || user.Status == models.AccountDeleted {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "user not found"})
+		return
+	}
+
+	viewer := viewerID(ctx)
+	self := viewer == id
+	profile := &models.Profile{User: user.Public(), Private: user.Privacy.PrivateProfile}
+	if profile.Private && !self {
+		writeJSON(ctx, fasthttp.StatusOK, profile)
+		return
+	}
+	profile.JoinedAt = &user.CreatedAt
+	if profile.Badges, err = h.achievements.GetByUserID(id); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get achievements"})
+		return
+	}
+
+	if !user.Privacy.HideActivity || self {
+		stats, err := h.userRepo.GetProfileStats(id, viewer)
+		if err != nil {
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get stats"})
+			return
+		}
+		streak, err := h.streaks.Get(id)
+		if err != nil {
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get streak"})
+			return
+		}
+		if streak != nil {
+			stats.CurrentStreak, stats.LongestStreak = streak.Current, streak.Longest
+		}
+		profile.Stats = stats
+	}
+	writeJSON(ctx, fasthttp.StatusOK, profile)
+}
+
+// UpdatePrivacy replaces the caller's privacy settings
+func (h *ProfileHandler) UpdatePrivacy(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var req models.PrivacySettings
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := h.userRepo.SetPrivacy(userID, req); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to update privacy settings"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, req)
+}
+
+// UploadAvatar replaces the caller's avatar with the uploaded image, cropped
+// to a square from its center and stored at each of models.AvatarSizes
+func (h *ProfileHandler) UploadAvatar(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	file, err := ctx.FormFile("image")
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "image is required"})
+		return
+	}
+	img, err := decodeUpload(file)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid image"})
+		return
+	}
+	if err := os.MkdirAll(models.AvatarDir, 0755); err != nil {
+		log.Printf("user %d: avatar: %v", userID, err)
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to save avatar"})
+		return
+	}
+
+	// every upload gets a new key so cached copies of the old avatar go stale
+	key := fmt.Sprintf("%d-%d", userID, time.Now().UnixNano())
+	var written []string
+	for _, size := range models.AvatarSizes {
+		path := models.AvatarPath(key, size)
+		if err = saveJPEG(path, imaging.Fill(img, size, size, imaging.Center, imaging.Lanczos), 85); err != nil {
+			break
+		}
+		written = append(written, path)
+	}
+	var old []string
+	if err == nil {
+		old, err = h.userRepo.SetAvatar(userID, key)
+	}
+	if err != nil {
+		log.Printf("user %d: avatar: %v", userID, err)
+		removeFiles(written)
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to save avatar"})
+		return
+	}
+	removeFiles(old)
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{"avatar_urls": models.AvatarURLs(userID, key)})
+}
+
+// DeleteAvatar removes the caller's avatar so they are shown their identicon
+func (h *ProfileHandler) DeleteAvatar(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	old, err := h.userRepo.SetAvatar(userID, "")
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to delete avatar"})
+		return
+	}
+	removeFiles(old)
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// Identicon draws the generated picture of a user as a PNG. The size query
+// parameter picks one of models.AvatarSizes and defaults to 128.
+func (h *ProfileHandler) Identicon(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return
+	}
+	size := 128
+	if v := ctx.QueryArgs().Peek("size"); len(v) > 0 {
+		if size, err = strconv.Atoi(string(v)); err != nil || !models.ValidAvatarSize(size) {
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": fmt.Sprintf("size must be one of %v", models.AvatarSizes)})
+			return
+		}
+	}
+
+	// the picture depends only on the id, so it can be cached like a file
+	ctx.SetContentType("image/png")
+	ctx.Response.Header.Set("Cache-Control", "public, max-age=86400")
+	if err := png.Encode(ctx, identicon.Render([]byte("user:"+strconv.Itoa(id)), size)); err != nil {
+		log.Printf("identicon %d: %v", id, err)
+	}
+}
+
+// removeFiles deletes files that are no longer referenced, logging failures
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("remove %s: %v", path, err)
+		}
+	}
+}
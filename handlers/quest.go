@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"gobackend/events"
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// QuestHandler handles weekly quest endpoints and tracks quest progress as activity happens
+type QuestHandler struct {
+	repo     *models.QuestRepository
+	userRepo *models.UserRepository
+	perWeek  int
+}
+
+func NewQuestHandler(repo *models.QuestRepository, userRepo *models.UserRepository) *QuestHandler {
+	perWeek := 3
+	if n, err := strconv.Atoi(os.Getenv("QUESTS_PER_WEEK")); err == nil && n > 0 {
+		perWeek = n
+	}
+	return &QuestHandler{repo: repo, userRepo: userRepo, perWeek: perWeek}
+}
+
+// currentWeek returns the Monday of the user's local week, as stored and as an instant
+func currentWeek(user *models.User, now time.Time) (string, time.Time) {
+	loc := models.UserLocation(user.Timezone)
+	monday := models.WeekStart(models.LocalDay(now, loc))
+	start := time.Date(monday.Year(), monday.Month(), monday.Day(), 0, 0, 0, 0, loc)
+	return monday.Format("2006-01-02"), start
+}
+
+// GetMyQuests returns the caller's quests for the current week, assigning them if needed
+func (h *QuestHandler) GetMyQuests(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	user, err := h.userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid user"})
+		return
+	}
+
+	week, _ := currentWeek(user, time.Now())
+	quests, err := h.repo.EnsureAssigned(userID, week, h.perWeek)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get quests"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+		"week_start": week,
+		"quests":     quests,
+	})
+}
+
+// GetTemplates lists all quest templates if user is admin
+func (h *QuestHandler) GetTemplates(ctx *fasthttp.RequestCtx) {
+	if requireAdmin(ctx, h.userRepo) == nil {
+		return
+	}
+	templates, err := h.repo.GetTemplates(false)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get quests"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, templates)
+}
+
+// CreateTemplate adds a quest template if user is admin
+func (h *QuestHandler) CreateTemplate(ctx *fasthttp.RequestCtx) {
+	admin := requireAdmin(ctx, h.userRepo)
+	if admin == nil {
+		return
+	}
+
+	t := models.QuestTemplate{Active: true}
+	if err := readJSON(ctx, &t); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := t.Validate(); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := h.repo.CreateTemplate(&t); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to create quest"})
+		return
+	}
+	recordAudit(ctx, admin.ID, models.AuditQuestCreate, "quest_template", t.ID, nil, t)
+	writeJSON(ctx, fasthttp.StatusCreated, t)
+}
+
+// UpdateTemplate changes a quest template if user is admin. Fields missing from
+// the payload keep their current values.
+func (h *QuestHandler) UpdateTemplate(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	admin := requireAdmin(ctx, h.userRepo)
+	if admin == nil {
+		return
+	}
+
+	t, err := h.repo.GetTemplate(id)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get quest"})
+		return
+	}
+	if t == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "quest not found"})
+		return
+	}
+	before := snapshot(t)
+	if err := readJSON(ctx, t); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	t.ID = id
+	if err := t.Validate(); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := h.repo.UpdateTemplate(t); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to update quest"})
+		return
+	}
+	recordAudit(ctx, admin.ID, models.AuditQuestUpdate, "quest_template", id, before, t)
+	writeJSON(ctx, fasthttp.StatusOK, t)
+}
+
+// OnActivity advances the user's matching quests for the week and pays out
+// the EXP reward for quests it completes. It is subscribed to activity events.
+// Only actions that earned EXP count, so quests cannot be completed with
+// activity the anti-farming rules pay nothing for.
+func (h *QuestHandler) OnActivity(e events.Event) {
+	if awarded, _ := e.Data["exp_awarded"].(int); awarded <= 0 {
+		return
+	}
+	user, err := h.userRepo.GetByID(e.UserID)
+	if err != nil || user == nil {
+		return
+	}
+
+	week, weekStart := currentWeek(user, e.At)
+	quests, err := h.repo.EnsureAssigned(user.ID, week, h.perWeek)
+	if err != nil {
+		log.Printf("quests: assign user %d: %v", user.ID, err)
+		return
+	}
+
+	for _, q := range quests {
+		if q.CompletedAt != nil || q.Template.Action != e.Type {
+			continue
+		}
+		if q.Template.Condition == models.QuestConditionNewTrail {
+			trail, _ := e.Data["trail"].(string)
+			if trail == "" {
+				continue
+			}
+			seen, err := h.repo.HasReportedTrailBefore(user.ID, trail, weekStart)
+			if err != nil {
+				log.Printf("quests: check trail for user %d: %v", user.ID, err)
+				continue
+			}
+			if seen {
+				continue
+			}
+		}
+
+		completed, err := h.repo.Advance(q)
+		if err != nil {
+			log.Printf("quests: advance quest %d: %v", q.ID, err)
+			continue
+		}
+		if !completed {
+			continue
+		}
+
+		if q.Template.ExpReward > 0 {
+			if err := h.userRepo.AddExp(&models.ExpEvent{
+				UserID:     user.ID,
+				Amount:     q.Template.ExpReward,
+				Reason:     models.ExpReasonQuest,
+				SourceType: models.ExpSourceQuest,
+				SourceID:   q.ID,
+				ActorID:    user.ID,
+			}); err != nil {
+				log.Printf("quests: reward quest %d: %v", q.ID, err)
+			}
+		}
+		events.Publish(events.Event{
+			Type:   events.QuestCompleted,
+			UserID: user.ID,
+			Data:   map[string]interface{}{"quest_id": q.ID, "title": q.Template.Title, "exp_reward": q.Template.ExpReward},
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// RateLimiter throttles requests with the configured token buckets and
+// locks password sign-in after repeated failures. Limits fail open: a
+// database error lets the request through rather than take the API down.
+type RateLimiter struct {
+	repo   *models.RateLimitRepository
+	limits *models.RateLimits
+}
+
+func NewRateLimiter(repo *models.RateLimitRepository, limits *models.RateLimits) *RateLimiter {
+	return &RateLimiter{repo: repo, limits: limits}
+}
+
+// ceilSeconds rounds a duration up to whole seconds for headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// writeTooManyRequests rejects a request that may be retried after retry
+func writeTooManyRequests(ctx *fasthttp.RequestCtx, retry time.Duration, message string) {
+	ctx.Response.Header.Set("Retry-After", strconv.Itoa(max(ceilSeconds(retry), 1)))
+	writeJSON(ctx, fasthttp.StatusTooManyRequests, map[string]string{"error": message})
+}
+
+// callerKey identifies the caller for a rule's bucket. Signed-in callers are
+// identified by user id, API keys by key, and everyone else by address.
+func callerKey(ctx *fasthttp.RequestCtx, by string) string {
+	ip := "ip:" + ctx.RemoteIP().String()
+	if by != models.RateLimitByUser {
+		return ip
+	}
+	credential, err := bearerCredential(ctx)
+	if err != nil {
+		return ip
+	}
+	if models.IsAPIKey(credential) {
+		return "key:" + models.HashToken(credential)[:16]
+	}
+	if userID, _, err := parseClaims(credential, ""); err == nil {
+		return "user:" + strconv.Itoa(userID)
+	}
+	return ip
+}
+
+// Handler applies every rule matching the request before next. The
+// RateLimit headers describe the rule closest to its limit.
+func (l *RateLimiter) Handler(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		method, path := string(ctx.Method()), string(ctx.Path())
+		var tightest *models.RateLimitDecision
+		var tightestRule *models.RateLimitRule
+		for _, rule := range l.limits.Rules {
+			if !rule.Matches(method, path) {
+				continue
+			}
+			d, err := l.repo.Take(rule, callerKey(ctx, rule.By))
+			if err != nil {
+				log.Printf("rate limit %s: %v", rule.Route, err)
+				continue
+			}
+			if tightest == nil || (tightest.Allowed && !d.Allowed) || (tightest.Allowed == d.Allowed && d.Remaining < tightest.Remaining) {
+				tightest, tightestRule = d, rule
+			}
+		}
+
+		if tightest != nil {
+			h := &ctx.Response.Header
+			h.Set("RateLimit-Limit", strconv.Itoa(tightestRule.Capacity()))
+			h.Set("RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(tightest.Reset)))
+			h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", tightestRule.Limit, tightestRule.WindowSeconds))
+			if !tightest.Allowed {
+				writeTooManyRequests(ctx, tightest.RetryAfter, "rate limit exceeded, try again later")
+				return
+			}
+		}
+		next(ctx)
+	}
+}
+
+// loginAccount normalizes the email a sign-in was attempted for
+func loginAccount(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// checkLoginLock writes a 429 and returns false while password sign-in to
+// the account is locked
+func (l *RateLimiter) checkLoginLock(ctx *fasthttp.RequestCtx, email string) bool {
+	until, err := l.repo.LoginLockedUntil(loginAccount(email))
+	if err != nil {
+		log.Printf("login lockout: %v", err)
+		return true
+	}
+	if until.IsZero() {
+		return true
+	}
+	writeTooManyRequests(ctx, time.Until(until), "too many failed sign-ins, try again later")
+	return false
+}
+
+// loginFailed counts a failed password sign-in
+func (l *RateLimiter) loginFailed(email string) {
+	if _, err := l.repo.RecordLoginFailure(loginAccount(email), l.limits.LoginLockout); err != nil {
+		log.Printf("login lockout: %v", err)
+	}
+}
+
+// loginSucceeded forgets earlier failures
+func (l *RateLimiter) loginSucceeded(email string) {
+	if err := l.repo.ClearLoginFailures(loginAccount(email)); err != nil {
+		log.Printf("login lockout: %v", err)
+	}
+}
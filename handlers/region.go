@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// RegionHandler handles named leaderboard region endpoints
+type RegionHandler struct {
+	repo     *models.RegionRepository
+	userRepo *models.UserRepository
+}
+
+func NewRegionHandler(repo *models.RegionRepository, userRepo *models.UserRepository) *RegionHandler {
+	return &RegionHandler{repo: repo, userRepo: userRepo}
+}
+
+// GetRegions lists all named regions
+func (h *RegionHandler) GetRegions(ctx *fasthttp.RequestCtx) {
+	regions, err := h.repo.GetAll()
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get regions"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, regions)
+}
+
+// CreateRegion adds a named region if user is admin
+func (h *RegionHandler) CreateRegion(ctx *fasthttp.RequestCtx) {
+	admin := requireAdmin(ctx, h.userRepo)
+	if admin == nil {
+		return
+	}
+
+	var region models.Region
+	if err := readJSON(ctx, &region); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	region.Name = strings.TrimSpace(region.Name)
+	if region.Name == "" {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "name required"})
+		return
+	}
+	if !region.Valid() {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid bounding box"})
+		return
+	}
+
+	if err := h.repo.Create(&region); err != nil {
+		writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": "failed to create region"})
+		return
+	}
+	recordAudit(ctx, admin.ID, models.AuditRegionCreate, "region", region.ID, nil, region)
+	writeJSON(ctx, fasthttp.StatusCreated, region)
+}
+
+// DeleteRegion removes a named region if user is admin
+func (h *RegionHandler) DeleteRegion(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	admin := requireAdmin(ctx, h.userRepo)
+	if admin == nil {
+		return
+	}
+	region, err := h.repo.GetByID(id)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get region"})
+		return
+	}
+
+	if err := h.repo.Delete(id); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to delete region"})
+		return
+	}
+	if region != nil {
+		recordAudit(ctx, admin.ID, models.AuditRegionDelete, "region", id, region, nil)
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"message": "deleted"})
+}
@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"strconv"
+
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// RewardHandler handles the points wallet, reward catalog and redemption endpoints
+type RewardHandler struct {
+	repo     *models.RewardRepository
+	userRepo *models.UserRepository
+}
+
+func NewRewardHandler(repo *models.RewardRepository, userRepo *models.UserRepository) *RewardHandler {
+	return &RewardHandler{repo: repo, userRepo: userRepo}
+}
+
+// requireSponsor authenticates the caller and checks they may manage rewards.
+// It writes an error response and returns nil when they may not.
+func (h *RewardHandler) requireSponsor(ctx *fasthttp.RequestCtx) *models.User {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return nil
+	}
+	user, err := h.userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": "invalid user"})
+		return nil
+	}
+	if !user.IsSponsor && !user.IsAdmin {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "sponsor required"})
+		return nil
+	}
+	// admins manage any sponsor's rewards, so their two-factor policy applies
+	if !requireTwoFactor(ctx, h.userRepo, user) {
+		return nil
+	}
+	return user
+}
+
+// GetPoints returns the caller's points balance and ledger entries
+func (h *RewardHandler) GetPoints(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	limit, offset := pageArgs(ctx)
+
+	balance, err := h.repo.GetBalance(userID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get points"})
+		return
+	}
+	txs, err := h.repo.GetTransactions(userID, limit, offset)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get points"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+		"balance":      balance,
+		"transactions": txs,
+	})
+}
+
+// GetMyRedemptions returns the caller's redemptions and their codes
+func (h *RewardHandler) GetMyRedemptions(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	redemptions, err := h.repo.GetRedemptionsByUser(userID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get redemptions"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, redemptions)
+}
+
+// GetRewards lists the active catalog, or with ?mine=true all of the calling sponsor's rewards
+func (h *RewardHandler) GetRewards(ctx *fasthttp.RequestCtx) {
+	sponsorID := 0
+	if string(ctx.QueryArgs().Peek("mine")) == "true" {
+		sponsor := h.requireSponsor(ctx)
+		if sponsor == nil {
+			return
+		}
+		sponsorID = sponsor.ID
+	}
+
+	rewards, err := h.repo.GetRewards(sponsorID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get rewards"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, rewards)
+}
+
+// CreateReward adds a reward to the catalog if user is a sponsor or admin
+func (h *RewardHandler) CreateReward(ctx *fasthttp.RequestCtx) {
+	sponsor := h.requireSponsor(ctx)
+	if sponsor == nil {
+		return
+	}
+
+	rw := models.Reward{Active: true}
+	if err := readJSON(ctx, &rw); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := rw.Validate(); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	rw.SponsorID = sponsor.ID
+
+	if err := h.repo.CreateReward(&rw); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to create reward"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusCreated, rw)
+}
+
+// UpdateReward changes a reward if user is its sponsor or an admin. Fields
+// missing from the payload keep their current values.
+func (h *RewardHandler) UpdateReward(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	sponsor := h.requireSponsor(ctx)
+	if sponsor == nil {
+		return
+	}
+
+	rw, err := h.repo.GetReward(id)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get reward"})
+		return
+	}
+	if rw == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "reward not found"})
+		return
+	}
+	if rw.SponsorID != sponsor.ID && !sponsor.IsAdmin {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "not your reward"})
+		return
+	}
+
+	if err := readJSON(ctx, rw); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := rw.Validate(); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	rw.ID = id
+
+	if err := h.repo.UpdateReward(rw); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to update reward"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, rw)
+}
+
+// Redeem spends the caller's points on a reward and returns the issued code
+func (h *RewardHandler) Redeem(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	rd, err := h.repo.Redeem(id, userID)
+	switch err {
+	case nil:
+		writeJSON(ctx, fasthttp.StatusCreated, rd)
+	case models.ErrRewardUnavailable:
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": err.Error()})
+	case models.ErrOutOfStock, models.ErrRedemptionLimit, models.ErrInsufficientPoints:
+		writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to redeem reward"})
+	}
+}
+
+// useRedemptionRequest represents the payload for accepting a redemption code
+type useRedemptionRequest struct {
+	Code string `json:"code"`
+}
+
+// UseRedemption accepts a redemption code if user is the reward's sponsor or an admin.
+// Each code can be used once.
+func (h *RewardHandler) UseRedemption(ctx *fasthttp.RequestCtx) {
+	sponsor := h.requireSponsor(ctx)
+	if sponsor == nil {
+		return
+	}
+
+	var req useRedemptionRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	rd, err := h.repo.GetRedemptionByCode(req.Code)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get redemption"})
+		return
+	}
+	if rd == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "invalid code"})
+		return
+	}
+	rw, err := h.repo.GetReward(rd.RewardID)
+	if err != nil || rw == nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get reward"})
+		return
+	}
+	if rw.SponsorID != sponsor.ID && !sponsor.IsAdmin {
+		// do not reveal other sponsors' codes
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "invalid code"})
+		return
+	}
+
+	used, err := h.repo.MarkUsed(rd.ID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to use redemption"})
+		return
+	}
+	if !used {
+		writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": "code already " + rd.Status})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{"redemption_id": rd.ID, "reward": rw})
+}
+
+// voidRedemptionRequest represents the payload for voiding a redemption
+type voidRedemptionRequest struct {
+	Reason string `json:"reason"`
+}
+
+// VoidRedemption cancels a redemption and refunds its points if user is admin
+func (h *RewardHandler) VoidRedemption(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	admin := requireAdmin(ctx, h.userRepo)
+	if admin == nil {
+		return
+	}
+
+	var req voidRedemptionRequest
+	if len(ctx.PostBody()) > 0 {
+		if err := readJSON(ctx, &req); err != nil {
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	before, err := h.repo.GetRedemption(id)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to void redemption"})
+		return
+	}
+	rd, err := h.repo.Void(id, admin.ID, req.Reason)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to void redemption"})
+		return
+	}
+	if rd == nil {
+		writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": "redemption not found or already voided"})
+		return
+	}
+	recordAudit(ctx, admin.ID, models.AuditRedemptionVoid, "redemption", id, before, rd)
+	writeJSON(ctx, fasthttp.StatusOK, rd)
+}
+
+// sponsorRequest represents the payload for granting or revoking sponsor access
+type sponsorRequest struct {
+	Sponsor bool `json:"sponsor"`
+}
+
+// SetSponsor grants or revokes a user's sponsor access if caller is admin
+func (h *RewardHandler) SetSponsor(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	admin := requireAdmin(ctx, h.userRepo)
+	if admin == nil {
+		return
+	}
+
+	var req sponsorRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	user, err := h.userRepo.GetByID(id)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "user not found"})
+		return
+	}
+
+	if err := h.userRepo.SetSponsor(id, req.Sponsor); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to update user"})
+		return
+	}
+	before := map[string]interface{}{"is_sponsor": user.IsSponsor}
+	user.IsSponsor = req.Sponsor
+	recordAudit(ctx, admin.ID, models.AuditUserSponsor, models.ReportTargetUser, id, before,
+		map[string]interface{}{"is_sponsor": user.IsSponsor})
+	writeJSON(ctx, fasthttp.StatusOK, user)
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"log"
+
+	"gobackend/events"
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// StreakHandler handles activity streak endpoints and updates streaks as activity happens
+type StreakHandler struct {
+	repo *models.StreakRepository
+}
+
+func NewStreakHandler(repo *models.StreakRepository) *StreakHandler {
+	return &StreakHandler{repo: repo}
+}
+
+// GetStreak returns the caller's current streak
+func (h *StreakHandler) GetStreak(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	streak, err := h.repo.Get(userID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get streak"})
+		return
+	}
+	if streak == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "user not found"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, streak)
+}
+
+// OnActivity counts a qualifying action towards the user's streak.
+// It is subscribed to activity events.
+func (h *StreakHandler) OnActivity(e events.Event) {
+	if _, err := h.repo.RecordActivity(e.UserID, e.At); err != nil {
+		log.Printf("streaks: record user %d: %v", e.UserID, err)
+	}
+}
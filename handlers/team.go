@@ -0,0 +1,390 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// TeamHandler handles team endpoints
+type TeamHandler struct {
+	repo     *models.TeamRepository
+	userRepo *models.UserRepository
+}
+
+func NewTeamHandler(repo *models.TeamRepository, userRepo *models.UserRepository) *TeamHandler {
+	return &TeamHandler{repo: repo, userRepo: userRepo}
+}
+
+// createTeamRequest represents the payload for creating a team
+type createTeamRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// joinTeamRequest represents the payload for joining a team
+type joinTeamRequest struct {
+	InviteCode string `json:"invite_code"`
+}
+
+// updateMemberRequest represents the payload for changing a member's role
+type updateMemberRequest struct {
+	Role string `json:"role"`
+}
+
+// loadTeamMembership resolves the team from the path and the caller's membership in it.
+// It writes an error response and returns ok=false when the request cannot continue.
+func (h *TeamHandler) loadTeamMembership(ctx *fasthttp.RequestCtx) (team *models.Team, member *models.TeamMember, userID int, ok bool) {
+	teamID, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid team id"})
+		return nil, nil, 0, false
+	}
+
+	userID, err = getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return nil, nil, 0, false
+	}
+
+	team, err = h.repo.GetByID(teamID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get team"})
+		return nil, nil, 0, false
+	}
+	if team == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "team not found"})
+		return nil, nil, 0, false
+	}
+
+	member, err = h.repo.GetMember(teamID, userID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get membership"})
+		return nil, nil, 0, false
+	}
+	return team, member, userID, true
+}
+
+// CreateTeam creates a new team owned by the caller
+func (h *TeamHandler) CreateTeam(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var req createTeamRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "name required"})
+		return
+	}
+
+	code, err := models.NewInviteCode()
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to generate invite code"})
+		return
+	}
+
+	team := models.Team{Name: req.Name, Description: req.Description, InviteCode: code, OwnerID: userID}
+	if err := h.repo.Create(&team); err != nil {
+		if errors.Is(err, models.ErrTeamNameTaken) {
+			writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to create team"})
+		return
+	}
+
+	writeJSON(ctx, fasthttp.StatusCreated, team)
+}
+
+// GetTeam returns a team profile with its members and rank
+func (h *TeamHandler) GetTeam(ctx *fasthttp.RequestCtx) {
+	team, member, _, ok := h.loadTeamMembership(ctx)
+	if !ok {
+		return
+	}
+
+	members, err := h.repo.GetMembers(team.ID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get members"})
+		return
+	}
+	rank, err := h.repo.GetRank(team.ID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get rank"})
+		return
+	}
+
+	// only people who can invite others get to see the invite code
+	if member == nil || !member.CanManage() {
+		team.InviteCode = ""
+	}
+
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+		"team":    team,
+		"members": members,
+		"rank":    rank,
+		"role":    memberRole(member),
+	})
+}
+
+// DeleteTeam deletes a team if the caller owns it
+func (h *TeamHandler) DeleteTeam(ctx *fasthttp.RequestCtx) {
+	team, member, _, ok := h.loadTeamMembership(ctx)
+	if !ok {
+		return
+	}
+	if member == nil || member.Role != models.TeamRoleOwner {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "owner required"})
+		return
+	}
+
+	if err := h.repo.Delete(team.ID); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to delete team"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"message": "deleted"})
+}
+
+// JoinTeam adds the caller to the team matching an invite code
+func (h *TeamHandler) JoinTeam(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var req joinTeamRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	team, err := h.repo.GetByInviteCode(strings.ToUpper(strings.TrimSpace(req.InviteCode)))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get team"})
+		return
+	}
+	if team == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "invalid invite code"})
+		return
+	}
+
+	existing, err := h.repo.GetMember(team.ID, userID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get membership"})
+		return
+	}
+	if existing != nil {
+		writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": "already a member"})
+		return
+	}
+
+	if err := h.repo.AddMember(team.ID, userID, models.TeamRoleMember); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to join team"})
+		return
+	}
+
+	team.InviteCode = ""
+	team.MemberCount++
+	writeJSON(ctx, fasthttp.StatusOK, team)
+}
+
+// LeaveTeam removes the caller from a team. Owners must transfer ownership first.
+func (h *TeamHandler) LeaveTeam(ctx *fasthttp.RequestCtx) {
+	team, member, userID, ok := h.loadTeamMembership(ctx)
+	if !ok {
+		return
+	}
+	if member == nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "not a member"})
+		return
+	}
+	if member.Role == models.TeamRoleOwner {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "owner must transfer ownership or delete the team"})
+		return
+	}
+
+	if err := h.repo.RemoveMember(team.ID, userID); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to leave team"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"message": "left team"})
+}
+
+// RegenerateInviteCode replaces the team's invite code, invalidating the old one
+func (h *TeamHandler) RegenerateInviteCode(ctx *fasthttp.RequestCtx) {
+	team, member, _, ok := h.loadTeamMembership(ctx)
+	if !ok {
+		return
+	}
+	if member == nil || !member.CanManage() {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "team admin required"})
+		return
+	}
+
+	code, err := models.NewInviteCode()
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to generate invite code"})
+		return
+	}
+	if err := h.repo.SetInviteCode(team.ID, code); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to update invite code"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"invite_code": code})
+}
+
+// UpdateMember changes a member's role. Only the owner may do this; assigning
+// the owner role transfers ownership.
+func (h *TeamHandler) UpdateMember(ctx *fasthttp.RequestCtx) {
+	team, member, userID, ok := h.loadTeamMembership(ctx)
+	if !ok {
+		return
+	}
+	if member == nil || member.Role != models.TeamRoleOwner {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "owner required"})
+		return
+	}
+
+	targetID, err := strconv.Atoi(ctx.UserValue("userId").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return
+	}
+	if targetID == userID {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "cannot change your own role"})
+		return
+	}
+
+	var req updateMemberRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if !models.ValidTeamRole(req.Role) {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid role"})
+		return
+	}
+
+	target, err := h.repo.GetMember(team.ID, targetID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get membership"})
+		return
+	}
+	if target == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "member not found"})
+		return
+	}
+
+	if req.Role == models.TeamRoleOwner {
+		err = h.repo.TransferOwnership(team.ID, targetID)
+	} else {
+		err = h.repo.UpdateMemberRole(team.ID, targetID, req.Role)
+	}
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to update member"})
+		return
+	}
+
+	target.Role = req.Role
+	writeJSON(ctx, fasthttp.StatusOK, target)
+}
+
+// RemoveMember removes another member from the team. Admins may only remove plain members.
+func (h *TeamHandler) RemoveMember(ctx *fasthttp.RequestCtx) {
+	team, member, userID, ok := h.loadTeamMembership(ctx)
+	if !ok {
+		return
+	}
+	if member == nil || !member.CanManage() {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "team admin required"})
+		return
+	}
+
+	targetID, err := strconv.Atoi(ctx.UserValue("userId").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid user id"})
+		return
+	}
+	if targetID == userID {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "use leave to remove yourself"})
+		return
+	}
+
+	target, err := h.repo.GetMember(team.ID, targetID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get membership"})
+		return
+	}
+	if target == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "member not found"})
+		return
+	}
+	if target.Role == models.TeamRoleOwner || (member.Role == models.TeamRoleAdmin && target.Role != models.TeamRoleMember) {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "cannot remove this member"})
+		return
+	}
+
+	if err := h.repo.RemoveMember(team.ID, targetID); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to remove member"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"message": "removed"})
+}
+
+// Leaderboard returns the top 50 teams by EXP and the ranks of the caller's teams
+func (h *TeamHandler) Leaderboard(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	top, err := h.repo.GetTopByExp(50)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get leaderboard"})
+		return
+	}
+	for _, tr := range top {
+		tr.Team.InviteCode = ""
+	}
+
+	teams, err := h.repo.GetByUserID(userID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get teams"})
+		return
+	}
+	mine := make([]*models.TeamRank, 0, len(teams))
+	for _, t := range teams {
+		rank, err := h.repo.GetRank(t.ID)
+		if err != nil {
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get rank"})
+			return
+		}
+		t.InviteCode = ""
+		mine = append(mine, &models.TeamRank{Rank: rank, Team: t})
+	}
+
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+		"leaderboard": top,
+		"my_teams":    mine,
+	})
+}
+
+func memberRole(m *models.TeamMember) string {
+	if m == nil {
+		return ""
+	}
+	return m.Role
+}
@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"encoding/csv"
+	"errors"
 	"fmt"
+	"image"
 	"image/jpeg"
 	"mime/multipart"
 	"os"
@@ -11,52 +14,23 @@ import (
 	"time"
 
 	"github.com/disintegration/imaging"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/valyala/fasthttp"
 
+	"gobackend/events"
 	"gobackend/models"
 )
 
 // TrashPostHandler handles trash post endpoints
 type TrashPostHandler struct {
-	repo     *models.TrashPostRepository
-	userRepo *models.UserRepository
+	repo          *models.TrashPostRepository
+	userRepo      *models.UserRepository
+	categoryRepo  *models.CategoryRepository
+	verifications *models.VerificationRepository
+	exp           *models.ExpEngine
 }
 
-func NewTrashPostHandler(repo *models.TrashPostRepository, userRepo *models.UserRepository) *TrashPostHandler {
-	return &TrashPostHandler{repo: repo, userRepo: userRepo}
-}
-
-func getUserIDFromToken(ctx *fasthttp.RequestCtx) (int, error) {
-	header := string(ctx.Request.Header.Peek("Authorization"))
-	if header == "" {
-		return 0, fmt.Errorf("authorization header missing")
-	}
-
-	parts := strings.SplitN(header, " ", 2)
-	tokenString := header
-	if len(parts) == 2 && strings.ToLower(parts[0]) == "bearer" {
-		tokenString = parts[1]
-	}
-
-	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method")
-		}
-		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
-	if err != nil || !token.Valid {
-		return 0, fmt.Errorf("invalid token")
-	}
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return 0, fmt.Errorf("invalid claims")
-	}
-	idVal, ok := claims["user_id"].(float64)
-	if !ok {
-		return 0, fmt.Errorf("user_id missing in token")
-	}
-	return int(idVal), nil
+func NewTrashPostHandler(repo *models.TrashPostRepository, userRepo *models.UserRepository, categoryRepo *models.CategoryRepository, verifications *models.VerificationRepository, exp *models.ExpEngine) *TrashPostHandler {
+	return &TrashPostHandler{repo: repo, userRepo: userRepo, categoryRepo: categoryRepo, verifications: verifications, exp: exp}
 }
 
 // CreateTrashPost adds a new trash post
@@ -85,6 +59,33 @@ func (h *TrashPostHandler) CreateTrashPost(ctx *fasthttp.RequestCtx) {
 		Longitude:   lon,
 		Description: string(ctx.FormValue("description")),
 		Trail:       string(ctx.FormValue("trail")),
+		Categories:  formValues(ctx, "categories"),
+		Severity:    string(ctx.FormValue("severity")),
+		Hazards:     formValues(ctx, "hazards"),
+	}
+	if _, ok := models.SeverityRank(post.Severity); !ok {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "severity must be one of " + strings.Join(models.Severities, ", ")})
+		return
+	}
+	if v := ctx.FormValue("volume_liters"); len(v) > 0 {
+		if post.VolumeLiters, err = strconv.ParseFloat(string(v), 64); err != nil || post.VolumeLiters < 0 {
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid volume_liters"})
+			return
+		}
+	}
+	for _, hazard := range post.Hazards {
+		if !models.HazardFlags[hazard] {
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": fmt.Sprintf("unknown hazard %q", hazard)})
+			return
+		}
+	}
+	if _, err := h.categoryRepo.GetByKeys(post.Categories); err != nil {
+		if errors.Is(err, models.ErrUnknownCategory) {
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		} else {
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get categories"})
+		}
+		return
 	}
 
 	file, err := ctx.FormFile("image")
@@ -109,39 +110,221 @@ func (h *TrashPostHandler) CreateTrashPost(ctx *fasthttp.RequestCtx) {
 	}
 
 	// award experience for posting
-	_ = h.userRepo.AddExp(post.UserID, 50)
+	award, _ := h.exp.Award(models.ExpAction{
+		Action:     models.ExpReasonTrashPost,
+		UserID:     post.UserID,
+		ActorID:    post.UserID,
+		PostID:     post.ID,
+		SourceType: models.ExpSourceTrashPost,
+		SourceID:   post.ID,
+	}.At(post.Latitude, post.Longitude))
+
+	events.Publish(events.Event{
+		Type:   events.TrashPostCreated,
+		UserID: post.UserID,
+		Data:   map[string]interface{}{"post_id": post.ID, "trail": post.Trail, "exp_awarded": award.Awarded()},
+	})
+	// nobody else sees a shadow-banned user's post, so nobody is alerted either
+	if post.Hazardous && user.Status != models.AccountShadowBanned {
+		events.Publish(events.Event{
+			Type:   events.HazardReported,
+			UserID: post.UserID,
+			Data: map[string]interface{}{
+				"post_id":    post.ID,
+				"latitude":   post.Latitude,
+				"longitude":  post.Longitude,
+				"categories": post.Categories,
+				"hazards":    post.Hazards,
+				"severity":   post.Severity,
+			},
+		})
+	}
 
 	h.cleanupUploads()
 
 	writeJSON(ctx, fasthttp.StatusCreated, post)
 }
 
-// GetTrashPosts returns posts between start and end datetime
+// formValues returns the values of a repeated or comma-separated form field
+func formValues(ctx *fasthttp.RequestCtx, name string) []string {
+	var raw []string
+	if form, err := ctx.MultipartForm(); err == nil {
+		raw = form.Value[name]
+	} else {
+		for _, v := range ctx.PostArgs().PeekMulti(name) {
+			raw = append(raw, string(v))
+		}
+	}
+	return splitList(raw...)
+}
+
+// splitList splits comma-separated values and drops empty and repeated entries
+func splitList(values ...string) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" && !seen[part] {
+				seen[part] = true
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+// parseTrashPostFilter reads the post filter from the query string:
+// start, end (RFC3339), category, min_severity, hazard, hazardous and status.
+// category and hazard take comma-separated lists and match any entry.
+func parseTrashPostFilter(ctx *fasthttp.RequestCtx) (models.TrashPostFilter, error) {
+	args := ctx.QueryArgs()
+	var f models.TrashPostFilter
+	for _, p := range []struct {
+		name string
+		into **time.Time
+	}{{"start", &f.Start}, {"end", &f.End}} {
+		if v := string(args.Peek(p.name)); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s", p.name)
+			}
+			*p.into = &t
+		}
+	}
+	f.Categories = splitList(string(args.Peek("category")))
+	f.Hazards = splitList(string(args.Peek("hazard")))
+	if v := string(args.Peek("min_severity")); v != "" {
+		rank, ok := models.SeverityRank(v)
+		if !ok {
+			return f, fmt.Errorf("min_severity must be one of %s", strings.Join(models.Severities, ", "))
+		}
+		f.MinSeverity = rank
+	}
+	if v := string(args.Peek("hazardous")); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid hazardous")
+		}
+		f.Hazardous = &b
+	}
+	f.Status = string(args.Peek("status"))
+	f.ViewerID = viewerID(ctx)
+	return f, nil
+}
+
+// GetTrashPosts returns posts between start and end datetime, optionally filtered
 func (h *TrashPostHandler) GetTrashPosts(ctx *fasthttp.RequestCtx) {
-	startStr := string(ctx.QueryArgs().Peek("start"))
-	endStr := string(ctx.QueryArgs().Peek("end"))
-	if startStr == "" || endStr == "" {
+	f, err := parseTrashPostFilter(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if f.Start == nil || f.End == nil {
 		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "start and end required"})
 		return
 	}
 
-	start, err := time.Parse(time.RFC3339, startStr)
+	posts, err := h.repo.Search(f)
 	if err != nil {
-		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid start"})
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get posts"})
+		return
+	}
+	if err := h.verifications.Summarize(posts); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get posts"})
 		return
 	}
-	end, err := time.Parse(time.RFC3339, endStr)
+	writeJSON(ctx, fasthttp.StatusOK, posts)
+}
+
+// ExportTrashPosts returns the filtered posts as CSV, or GeoJSON with ?format=geojson
+func (h *TrashPostHandler) ExportTrashPosts(ctx *fasthttp.RequestCtx) {
+	f, err := parseTrashPostFilter(ctx)
 	if err != nil {
-		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid end"})
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	format := string(ctx.QueryArgs().Peek("format"))
+	if format != "" && format != "csv" && format != "geojson" {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "format must be csv or geojson"})
 		return
 	}
 
-	posts, err := h.repo.GetByDateRange(start, end)
+	posts, err := h.repo.Search(f)
 	if err != nil {
 		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get posts"})
 		return
 	}
-	writeJSON(ctx, fasthttp.StatusOK, posts)
+
+	if format == "geojson" {
+		features := make([]map[string]interface{}, 0, len(posts))
+		for _, p := range posts {
+			features = append(features, map[string]interface{}{
+				"type":     "Feature",
+				"geometry": map[string]interface{}{"type": "Point", "coordinates": []float64{p.Longitude, p.Latitude}},
+				"properties": map[string]interface{}{
+					"id":            p.ID,
+					"created_at":    p.CreatedAt,
+					"status":        p.Status,
+					"severity":      p.Severity,
+					"volume_liters": p.VolumeLiters,
+					"categories":    p.Categories,
+					"hazards":       p.Hazards,
+					"hazardous":     p.Hazardous,
+					"trail":         p.Trail,
+					"description":   p.Description,
+				},
+			})
+		}
+		ctx.Response.Header.Set("Content-Disposition", `attachment; filename="trashposts.geojson"`)
+		writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{"type": "FeatureCollection", "features": features})
+		return
+	}
+
+	ctx.Response.Header.Set("Content-Type", "text/csv")
+	ctx.Response.Header.Set("Content-Disposition", `attachment; filename="trashposts.csv"`)
+	w := csv.NewWriter(ctx)
+	_ = w.Write([]string{"id", "created_at", "latitude", "longitude", "status", "severity", "volume_liters", "categories", "hazards", "hazardous", "trail", "description"})
+	for _, p := range posts {
+		_ = w.Write([]string{
+			strconv.Itoa(p.ID),
+			p.CreatedAt.UTC().Format(time.RFC3339),
+			strconv.FormatFloat(p.Latitude, 'f', -1, 64),
+			strconv.FormatFloat(p.Longitude, 'f', -1, 64),
+			p.Status,
+			p.Severity,
+			strconv.FormatFloat(p.VolumeLiters, 'f', -1, 64),
+			strings.Join(p.Categories, ";"),
+			strings.Join(p.Hazards, ";"),
+			strconv.FormatBool(p.Hazardous),
+			csvText(p.Trail),
+			csvText(p.Description),
+		})
+	}
+	w.Flush()
+}
+
+// csvText quotes user-written text that a spreadsheet would otherwise run as a formula
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// TrashPostStats returns counts and volume for the filtered posts
+func (h *TrashPostHandler) TrashPostStats(ctx *fasthttp.RequestCtx) {
+	f, err := parseTrashPostFilter(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	stats, err := h.repo.Stats(f)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get stats"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, stats)
 }
 
 // DeleteTrashPost deletes a post if user is admin
@@ -152,38 +335,36 @@ func (h *TrashPostHandler) DeleteTrashPost(ctx *fasthttp.RequestCtx) {
 		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
 		return
 	}
-	userID, err := strconv.Atoi(string(ctx.QueryArgs().Peek("userId")))
-	if err != nil {
-		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid user"})
+	// the admin must be authenticated so the audit log names the right person
+	user := requireAdmin(ctx, h.userRepo)
+	if user == nil {
 		return
 	}
-	user, err := h.userRepo.GetByID(userID)
-	if err != nil || user == nil {
-		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid user"})
+	post, err := h.repo.GetByID(id)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get post"})
 		return
 	}
-	if !user.IsAdmin {
-		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "admin required"})
+	if post == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "post not found"})
 		return
 	}
 
-	if err := h.repo.Delete(id); err != nil {
+	// take back the EXP the post and its comments earned
+	reversals, err := h.userRepo.ReverseExpAndDeletePost(id, user.ID)
+	if err != nil {
 		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to delete post"})
 		return
 	}
+	recordAudit(ctx, user.ID, models.AuditTrashPostDelete, models.ReportTargetPost, id, post,
+		map[string]interface{}{"exp_reversals": reversals})
 	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"message": "deleted"})
 }
 
 func saveCompressedImage(file *multipart.FileHeader) (string, error) {
-	f, err := file.Open()
+	img, err := decodeUpload(file)
 	if err != nil {
-		return "", fmt.Errorf("open file: %w", err)
-	}
-	defer f.Close()
-
-	img, err := imaging.Decode(f)
-	if err != nil {
-		return "", fmt.Errorf("decode image: %w", err)
+		return "", err
 	}
 
 	resized := imaging.Resize(img, 1080, img.Bounds().Dy()*(1080/img.Bounds().Dx()), imaging.Lanczos)
@@ -194,17 +375,39 @@ func saveCompressedImage(file *multipart.FileHeader) (string, error) {
 
 	filename := fmt.Sprintf("%d.jpg", time.Now().UnixNano())
 	path := filepath.Join("uploads", filename)
+	if err := saveJPEG(path, resized, 50); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// decodeUpload decodes an uploaded image file
+func decodeUpload(file *multipart.FileHeader) (image.Image, error) {
+	f, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	img, err := imaging.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+	return img, nil
+}
+
+// saveJPEG writes img to path as a JPEG of the given quality
+func saveJPEG(path string, img image.Image, quality int) error {
 	out, err := os.Create(path)
 	if err != nil {
-		return "", fmt.Errorf("create file: %w", err)
+		return fmt.Errorf("create file: %w", err)
 	}
 	defer out.Close()
 
-	if err := jpeg.Encode(out, resized, &jpeg.Options{Quality: 50}); err != nil {
-		return "", fmt.Errorf("encode jpeg: %w", err)
+	if err := jpeg.Encode(out, img, &jpeg.Options{Quality: quality}); err != nil {
+		return fmt.Errorf("encode jpeg: %w", err)
 	}
-
-	return path, nil
+	return nil
 }
 
 func dirSize(path string) int64 {
@@ -231,6 +434,9 @@ func (h *TrashPostHandler) cleanupUploads() {
 		if post.ImagePath != "" {
 			_ = os.Remove(post.ImagePath)
 		}
-		_ = h.repo.Delete(post.ID)
+		// pruning for disk space is not the author's fault, so EXP is kept
+		if err := h.repo.Delete(post.ID); err == nil {
+			recordAudit(nil, 0, models.AuditTrashPostPrune, models.ReportTargetPost, post.ID, post, nil)
+		}
 	}
 }
@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"errors"
+	"os"
+	"strconv"
+
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// TwoFactorHandler handles TOTP enrollment, the second login step and the
+// two-factor policy
+type TwoFactorHandler struct {
+	repo     *models.TwoFactorRepository
+	userRepo *models.UserRepository
+	// issuer names the account in authenticator apps
+	issuer string
+}
+
+func NewTwoFactorHandler(repo *models.TwoFactorRepository, userRepo *models.UserRepository) *TwoFactorHandler {
+	h := &TwoFactorHandler{repo: repo, userRepo: userRepo, issuer: "trashman"}
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		h.issuer = issuer
+	}
+	return h
+}
+
+// twoFactorRequest represents a payload carrying a TOTP or recovery code
+type twoFactorRequest struct {
+	Code           string `json:"code"`
+	Password       string `json:"password"`
+	ChallengeToken string `json:"challenge_token"`
+}
+
+// writeTwoFactorError maps two-factor errors to responses
+func writeTwoFactorError(ctx *fasthttp.RequestCtx, err error) {
+	switch {
+	case errors.Is(err, models.ErrTwoFactorCode):
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+	case errors.Is(err, models.ErrTwoFactorLocked):
+		writeJSON(ctx, fasthttp.StatusTooManyRequests, map[string]string{"error": err.Error()})
+	case errors.Is(err, models.ErrTwoFactorNotEnrolled):
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, models.ErrTwoFactorEnabled):
+		writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "two-factor check failed"})
+	}
+}
+
+// currentUser authenticates the caller and loads their account
+func (h *TwoFactorHandler) currentUser(ctx *fasthttp.RequestCtx) *models.User {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return nil
+	}
+	user, err := h.userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": "invalid user"})
+		return nil
+	}
+	return user
+}
+
+// GetStatus returns the caller's two-factor setup
+func (h *TwoFactorHandler) GetStatus(ctx *fasthttp.RequestCtx) {
+	user := h.currentUser(ctx)
+	if user == nil {
+		return
+	}
+	status, err := h.repo.Status(user)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get two-factor status"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, status)
+}
+
+// Enroll creates a new TOTP secret for the caller. It only takes effect once
+// confirmed with a code from the authenticator app.
+func (h *TwoFactorHandler) Enroll(ctx *fasthttp.RequestCtx) {
+	user := h.currentUser(ctx)
+	if user == nil {
+		return
+	}
+	secret, err := h.repo.Enroll(user.ID)
+	if err != nil {
+		writeTwoFactorError(ctx, err)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{
+		"secret":           secret,
+		"provisioning_uri": models.ProvisioningURI(h.issuer, user.Email, secret),
+	})
+}
+
+// Confirm enables two-factor authentication and returns the recovery codes.
+// They are shown only this once. Every other session is signed out; the
+// caller gets a new token.
+func (h *TwoFactorHandler) Confirm(ctx *fasthttp.RequestCtx) {
+	user := h.currentUser(ctx)
+	if user == nil {
+		return
+	}
+	var req twoFactorRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	codes, err := h.repo.Confirm(user.ID, req.Code)
+	if err != nil {
+		writeTwoFactorError(ctx, err)
+		return
+	}
+	user.TokenVersion++
+	signed, err := issueToken(user)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to sign token"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{"recovery_codes": codes, "token": signed})
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes
+func (h *TwoFactorHandler) RegenerateRecoveryCodes(ctx *fasthttp.RequestCtx) {
+	user := h.currentUser(ctx)
+	if user == nil {
+		return
+	}
+	var req twoFactorRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if user.TwoFactorEnabledAt == nil {
+		writeTwoFactorError(ctx, models.ErrTwoFactorNotEnrolled)
+		return
+	}
+	codes, err := h.repo.RegenerateRecoveryCodes(user.ID, req.Code)
+	if err != nil {
+		writeTwoFactorError(ctx, err)
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{"recovery_codes": codes})
+}
+
+// Disable turns two-factor authentication off. It takes the password and a
+// current code, and is refused while the policy requires it for the caller's role.
+func (h *TwoFactorHandler) Disable(ctx *fasthttp.RequestCtx) {
+	user := h.currentUser(ctx)
+	if user == nil {
+		return
+	}
+	var req twoFactorRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if !user.CheckPassword(req.Password) {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": "invalid credentials"})
+		return
+	}
+	required, err := h.userRepo.TwoFactorRequired(user.Role)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to check two-factor policy"})
+		return
+	}
+	if required {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "two-factor authentication required for your role"})
+		return
+	}
+	if err := h.repo.Verify(user.ID, req.Code); err != nil {
+		writeTwoFactorError(ctx, err)
+		return
+	}
+	if err := h.repo.Disable(user.ID); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to disable two-factor authentication"})
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// Verify completes a two-factor login, exchanging a challenge token and a
+// TOTP or recovery code for a session token
+func (h *TwoFactorHandler) Verify(ctx *fasthttp.RequestCtx) {
+	var req twoFactorRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	userID, tv, err := parseChallenge(req.ChallengeToken)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": "invalid or expired challenge"})
+		return
+	}
+	user, err := h.userRepo.GetByID(userID)
+	if err != nil || user == nil || user.TokenVersion != tv {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": "invalid or expired challenge"})
+		return
+	}
+	if user.Status == models.AccountBanned {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "account banned"})
+		return
+	}
+
+	if err := h.repo.Verify(user.ID, req.Code); err != nil {
+		writeTwoFactorError(ctx, err)
+		return
+	}
+	signed, err := issueToken(user)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to sign token"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{"token": signed, "user": user})
+}
+
+// ResetUser turns two-factor authentication off for a user who lost both
+// their authenticator and recovery codes (admin only)
+func (h *TwoFactorHandler) ResetUser(ctx *fasthttp.RequestCtx) {
+	admin := requireAdmin(ctx, h.userRepo)
+	if admin == nil {
+		return
+	}
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+		return
+	}
+	user, err := h.userRepo.GetByID(id)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get user"})
+		return
+	}
+	if user == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "user not found"})
+		return
+	}
+
+	if err := h.repo.Disable(user.ID); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to reset two-factor authentication"})
+		return
+	}
+	if after, err := h.userRepo.GetByID(user.ID); err == nil && after != nil {
+		recordAudit(ctx, admin.ID, models.AuditUserTwoFactor, models.ReportTargetUser, user.ID, accountSnapshot(user), accountSnapshot(after))
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// twoFactorPolicy represents the roles that must use two-factor authentication
+type twoFactorPolicy struct {
+	RequiredRoles []string `json:"required_roles"`
+}
+
+// GetPolicy returns the two-factor policy (admin only)
+func (h *TwoFactorHandler) GetPolicy(ctx *fasthttp.RequestCtx) {
+	if requireAdmin(ctx, h.userRepo) == nil {
+		return
+	}
+	roles, err := h.repo.RequiredRoles()
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get policy"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, twoFactorPolicy{RequiredRoles: roles})
+}
+
+// UpdatePolicy replaces the roles that must use two-factor authentication.
+// Admins have to enable it themselves before requiring it of their own role,
+// so they cannot lock themselves out of the admin API.
+func (h *TwoFactorHandler) UpdatePolicy(ctx *fasthttp.RequestCtx) {
+	admin := requireAdmin(ctx, h.userRepo)
+	if admin == nil {
+		return
+	}
+	var req twoFactorPolicy
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	for _, role := range req.RequiredRoles {
+		if !models.ValidRole(role) {
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid role " + role})
+			return
+		}
+		if role == admin.Role && admin.TwoFactorEnabledAt == nil {
+			writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": "enable two-factor authentication before requiring it for your role"})
+			return
+		}
+	}
+
+	before, err := h.repo.RequiredRoles()
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get policy"})
+		return
+	}
+	if err := h.repo.SetRequiredRoles(req.RequiredRoles); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to save policy"})
+		return
+	}
+	after, err := h.repo.RequiredRoles()
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get policy"})
+		return
+	}
+	recordAudit(ctx, admin.ID, models.AuditTwoFactorPolicy, "two_factor_policy", 0,
+		twoFactorPolicy{RequiredRoles: before}, twoFactorPolicy{RequiredRoles: after})
+	writeJSON(ctx, fasthttp.StatusOK, twoFactorPolicy{RequiredRoles: after})
+}
@@ -1,25 +1,27 @@
 package handlers
 
 import (
-	"os"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
+	"gobackend/events"
 	"gobackend/models"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/valyala/fasthttp"
 )
 
 type UserHandler struct {
-	userRepo *models.UserRepository
+	userRepo   *models.UserRepository
+	regionRepo *models.RegionRepository
+	limiter    *RateLimiter
 }
 
 type createUserRequest struct {
 	Name     string `json:"name"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
-	IsAdmin  bool   `json:"is_admin"`
 }
 
 type loginRequest struct {
@@ -27,8 +29,8 @@ type loginRequest struct {
 	Password string `json:"password"`
 }
 
-func NewUserHandler(userRepo *models.UserRepository) *UserHandler {
-	return &UserHandler{userRepo: userRepo}
+func NewUserHandler(userRepo *models.UserRepository, regionRepo *models.RegionRepository, limiter *RateLimiter) *UserHandler {
+	return &UserHandler{userRepo: userRepo, regionRepo: regionRepo, limiter: limiter}
 }
 
 // Login authenticates a user and returns a JWT
@@ -39,27 +41,28 @@ func (h *UserHandler) Login(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	if !h.limiter.checkLoginLock(ctx, req.Email) {
+		return
+	}
+
 	user, err := h.userRepo.GetByEmail(req.Email)
 	if err != nil || user == nil || !user.CheckPassword(req.Password) {
+		h.limiter.loginFailed(req.Email)
 		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": "invalid credentials"})
 		return
 	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID,
-		"exp":     time.Now().Add(72 * time.Hour).Unix(),
-	})
-	secret := os.Getenv("JWT_SECRET")
-	signed, err := token.SignedString([]byte(secret))
-	if err != nil {
-		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to sign token"})
+	h.limiter.loginSucceeded(req.Email)
+	// suspended users may still sign in, to appeal
+	if user.Status == models.AccountBanned {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "account banned"})
 		return
 	}
 
-	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{"token": signed, "user": user})
+	writeSession(ctx, user)
 }
 
-// CreateUser creates a new user
+// CreateUser registers a new user. Accounts always start with the user role;
+// admins promote them through /admin/users/{id}/role.
 func (h *UserHandler) CreateUser(ctx *fasthttp.RequestCtx) {
 	var req createUserRequest
 	if err := readJSON(ctx, &req); err != nil {
@@ -67,7 +70,7 @@ func (h *UserHandler) CreateUser(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	user := models.User{Name: req.Name, Email: req.Email, IsAdmin: req.IsAdmin}
+	user := models.User{Name: req.Name, Email: req.Email, Role: models.RoleUser}
 	if err := user.SetPassword(req.Password); err != nil {
 		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to set password"})
 		return
@@ -77,118 +80,262 @@ func (h *UserHandler) CreateUser(ctx *fasthttp.RequestCtx) {
 		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "Failed to create user"})
 		return
 	}
+	events.Publish(events.Event{Type: events.UserCreated, UserID: user.ID})
 
 	writeJSON(ctx, fasthttp.StatusCreated, user)
 }
 
-// GetUser retrieves a user by ID
-func (h *UserHandler) GetUser(ctx *fasthttp.RequestCtx) {
-	idStr := ctx.UserValue("id").(string)
-	id, err := strconv.Atoi(idStr)
+// GetUsers retrieves all users
+func (h *UserHandler) GetUsers(ctx *fasthttp.RequestCtx) {
+	users, err := h.userRepo.GetAll()
 	if err != nil {
-		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "Failed to get users"})
 		return
 	}
 
-	user, err := h.userRepo.GetByID(id)
+	writeJSON(ctx, fasthttp.StatusOK, users)
+}
+
+// Leaderboard returns the top users by experience and the current user's rank.
+// The board can be limited to a period (week, month, season) and to a named
+// region or bounding box; the caller's neighbors above and below are included.
+func (h *UserHandler) Leaderboard(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
 	if err != nil {
-		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "Failed to get user"})
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
 		return
 	}
 
-	if user == nil {
-		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "User not found"})
-		return
+	args := ctx.QueryArgs()
+	q := models.LeaderboardQuery{Ranking: models.RankingStandard, Viewer: userID}
+
+	period := string(args.Peek("period"))
+	if period == "" {
+		period = models.PeriodAllTime
+	}
+	var start, end time.Time
+	if period != models.PeriodAllTime {
+		start, end, err = models.PeriodRange(period, time.Now())
+		if err != nil {
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid period"})
+			return
+		}
+		q.Start, q.End = &start, &end
 	}
 
-	writeJSON(ctx, fasthttp.StatusOK, user)
-}
+	if ranking := string(args.Peek("ranking")); ranking != "" {
+		if ranking != models.RankingStandard && ranking != models.RankingDense {
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid ranking"})
+			return
+		}
+		q.Ranking = ranking
+	}
 
-// GetUsers retrieves all users
-func (h *UserHandler) GetUsers(ctx *fasthttp.RequestCtx) {
-	users, err := h.userRepo.GetAll()
+	var region *models.Region
+	if name := string(args.Peek("region")); name != "" {
+		region, err = h.regionRepo.GetByName(name)
+		if err != nil {
+			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get region"})
+			return
+		}
+		if region == nil {
+			writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "region not found"})
+			return
+		}
+		q.Box = &region.BoundingBox
+	} else if bbox := string(args.Peek("bbox")); bbox != "" {
+		box, err := parseBoundingBox(bbox)
+		if err != nil {
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		q.Box = box
+	}
+
+	limit := 50
+	if l, err := strconv.Atoi(string(args.Peek("limit"))); err == nil && l > 0 && l <= 100 {
+		limit = l
+	}
+	neighbors := 2
+	if n, err := strconv.Atoi(string(args.Peek("neighbors"))); err == nil && n >= 0 && n <= 10 {
+		neighbors = n
+	}
+
+	entries, err := h.userRepo.GetLeaderboard(q, limit)
 	if err != nil {
-		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "Failed to get users"})
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get leaderboard"})
+		return
+	}
+	self, above, below, err := h.userRepo.GetLeaderboardPosition(q, userID, neighbors)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get rank"})
 		return
 	}
 
-	writeJSON(ctx, fasthttp.StatusOK, users)
+	rank, exp := 0, 0
+	if self != nil {
+		rank, exp = self.Rank, self.Exp
+	}
+	resp := map[string]interface{}{
+		"period":      period,
+		"ranking":     q.Ranking,
+		"leaderboard": entries,
+		"rank":        rank,
+		"exp":         exp,
+		"neighbors":   map[string]interface{}{"above": above, "below": below},
+	}
+	if q.Start != nil {
+		resp["start"] = start
+		resp["end"] = end
+	}
+	if region != nil {
+		resp["region"] = region
+	} else if q.Box != nil {
+		resp["bbox"] = q.Box
+	}
+	writeJSON(ctx, fasthttp.StatusOK, resp)
 }
 
-// UpdateUser updates a user
-func (h *UserHandler) UpdateUser(ctx *fasthttp.RequestCtx) {
-	idStr := ctx.UserValue("id").(string)
-	id, err := strconv.Atoi(idStr)
+// timezoneRequest represents the payload for changing the caller's timezone
+type timezoneRequest struct {
+	Timezone string `json:"timezone"`
+}
+
+// UpdateTimezone sets the IANA timezone used for the caller's streak and quest days
+func (h *UserHandler) UpdateTimezone(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
 	if err != nil {
-		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
 		return
 	}
 
-	var req createUserRequest
+	var req timezoneRequest
 	if err := readJSON(ctx, &req); err != nil {
 		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
-
-	user := models.User{ID: id, Name: req.Name, Email: req.Email, IsAdmin: req.IsAdmin}
-	if req.Password != "" {
-		if err := user.SetPassword(req.Password); err != nil {
-			writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to set password"})
-			return
-		}
+	if _, err := time.LoadLocation(req.Timezone); err != nil || req.Timezone == "" || req.Timezone == "Local" {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid timezone"})
+		return
 	}
 
-	if err := h.userRepo.Update(&user); err != nil {
-		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "Failed to update user"})
+	if err := h.userRepo.SetTimezone(userID, req.Timezone); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to update timezone"})
 		return
 	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"timezone": req.Timezone})
+}
 
-	updatedUser, err := h.userRepo.GetByID(id)
+// ExpHistory returns the caller's EXP ledger, newest first
+func (h *UserHandler) ExpHistory(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
 	if err != nil {
-		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "Failed to get updated user"})
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
 		return
 	}
 
-	writeJSON(ctx, fasthttp.StatusOK, updatedUser)
+	limit, offset := pageArgs(ctx)
+
+	events, err := h.userRepo.GetExpHistory(userID, limit, offset)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get exp history"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, events)
 }
 
-// DeleteUser deletes a user
-func (h *UserHandler) DeleteUser(ctx *fasthttp.RequestCtx) {
-	idStr := ctx.UserValue("id").(string)
-	id, err := strconv.Atoi(idStr)
+// ReverseExpEvent reverses a single EXP award if user is admin
+func (h *UserHandler) ReverseExpEvent(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
 	if err != nil {
-		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	admin := requireAdmin(ctx, h.userRepo)
+	if admin == nil {
 		return
 	}
 
-	if err := h.userRepo.Delete(id); err != nil {
-		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "Failed to delete user"})
+	rev, err := h.userRepo.ReverseExpEvent(id, admin.ID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to reverse exp"})
 		return
 	}
+	if rev == nil {
+		writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": "event not found or not reversible"})
+		return
+	}
+	if orig, err := h.userRepo.GetExpEvent(id); err == nil {
+		recordAudit(ctx, admin.ID, models.AuditExpReverse, "exp_event", id, orig, rev)
+	}
+	writeJSON(ctx, fasthttp.StatusCreated, rev)
+}
 
-	writeJSON(ctx, fasthttp.StatusOK, map[string]string{"message": "User deleted successfully"})
+// roleRequest represents the payload for changing a user's role
+type roleRequest struct {
+	Role string `json:"role"`
 }
 
-// Leaderboard returns top 50 users by experience and the current user's rank
-func (h *UserHandler) Leaderboard(ctx *fasthttp.RequestCtx) {
-	userID, err := getUserIDFromToken(ctx)
+// SetRole makes a user a regular user, moderator or admin if caller is admin.
+// Admins cannot change their own role.
+func (h *UserHandler) SetRole(ctx *fasthttp.RequestCtx) {
+	id, err := strconv.Atoi(ctx.UserValue("id").(string))
 	if err != nil {
-		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
 		return
 	}
-	users, err := h.userRepo.GetTopByExp(50)
-	if err != nil {
-		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get leaderboard"})
+	admin := requireAdmin(ctx, h.userRepo)
+	if admin == nil {
 		return
 	}
-	rank, exp, err := h.userRepo.GetRank(userID)
-	if err != nil {
-		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get rank"})
+	if admin.ID == id {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "you cannot change your own role"})
 		return
 	}
-	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
-		"leaderboard": users,
-		"rank":        rank,
-		"exp":         exp,
-	})
+
+	var req roleRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if !models.ValidRole(req.Role) {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "role must be user, moderator or admin"})
+		return
+	}
+	user, err := h.userRepo.GetByID(id)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "user not found"})
+		return
+	}
+
+	if err := h.userRepo.SetRole(id, req.Role); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to update user"})
+		return
+	}
+	before := map[string]interface{}{"role": user.Role, "is_admin": user.IsAdmin}
+	user.Role, user.IsAdmin = req.Role, req.Role == models.RoleAdmin
+	recordAudit(ctx, admin.ID, models.AuditUserRole, models.ReportTargetUser, id, before,
+		map[string]interface{}{"role": user.Role, "is_admin": user.IsAdmin})
+	writeJSON(ctx, fasthttp.StatusOK, user)
+}
+
+// parseBoundingBox parses "minLat,minLon,maxLat,maxLon"
+func parseBoundingBox(s string) (*models.BoundingBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bbox must be minLat,minLon,maxLat,maxLon")
+	}
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bbox")
+		}
+		v[i] = f
+	}
+	box := &models.BoundingBox{MinLatitude: v[0], MinLongitude: v[1], MaxLatitude: v[2], MaxLongitude: v[3]}
+	if !box.Valid() {
+		return nil, fmt.Errorf("invalid bbox")
+	}
+	return box, nil
 }
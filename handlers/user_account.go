@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// maxNameLength is the longest display name accepted
+const maxNameLength = 64
+
+// Ways to delete an account
+const (
+	deleteModeDelete    = "delete"
+	deleteModeAnonymize = "anonymize"
+)
+
+// GetMe returns the caller's own account
+func (h *UserHandler) GetMe(ctx *fasthttp.RequestCtx) {
+	userID, err := getSuspendedUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	user, err := h.userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get user"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, user)
+}
+
+// updateMeRequest represents the payload for updating the caller's profile;
+// fields left out are unchanged
+type updateMeRequest struct {
+	Name     *string `json:"name"`
+	Timezone *string `json:"timezone"`
+}
+
+// UpdateMe changes the caller's profile. Email and password have their own
+// endpoints since they need the current password.
+func (h *UserHandler) UpdateMe(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var req updateMeRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	var name string
+	if req.Name != nil {
+		name = strings.TrimSpace(*req.Name)
+		if name == "" || len(name) > maxNameLength {
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": fmt.Sprintf("name must be 1 to %d characters", maxNameLength)})
+			return
+		}
+	}
+	if req.Timezone != nil {
+		if _, err := time.LoadLocation(*req.Timezone); err != nil || *req.Timezone == "" || *req.Timezone == "Local" {
+			writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid timezone"})
+			return
+		}
+	}
+
+	if req.Name != nil {
+		err = h.userRepo.SetName(userID, name)
+	}
+	if err == nil && req.Timezone != nil {
+		err = h.userRepo.SetTimezone(userID, *req.Timezone)
+	}
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to update profile"})
+		return
+	}
+	user, err := h.userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get user"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, user)
+}
+
+// changePasswordRequest represents the payload for changing the caller's password
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ChangePassword sets a new password given the current one. Every other
+// session is signed out; the caller gets a new token.
+func (h *UserHandler) ChangePassword(ctx *fasthttp.RequestCtx) {
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var req changePasswordRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if len(req.NewPassword) < minPasswordLength {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": fmt.Sprintf("password must be at least %d characters", minPasswordLength)})
+		return
+	}
+	user, ok := h.checkCurrentPassword(ctx, userID, req.CurrentPassword)
+	if !ok {
+		return
+	}
+
+	if err := user.SetPassword(req.NewPassword); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to set password"})
+		return
+	}
+	if err := h.userRepo.ChangePassword(userID, user.PasswordHash); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to change password"})
+		return
+	}
+	user.TokenVersion++
+	signed, err := issueToken(user)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to sign token"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{"token": signed, "user": user})
+}
+
+// checkCurrentPassword loads the caller and confirms the password they gave
+// for a sensitive change, writing an error and returning false otherwise
+func (h *UserHandler) checkCurrentPassword(ctx *fasthttp.RequestCtx, userID int, password string) (*models.User, bool) {
+	user, err := h.userRepo.GetByID(userID)
+	if err != nil || user == nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get user"})
+		return nil, false
+	}
+	if !user.CheckPassword(password) {
+		// accounts made through a provider or magic link have a random password
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "current password is incorrect; if you never set one, use a password reset"})
+		return nil, false
+	}
+	return user, true
+}
+
+// ExportMe returns everything stored about the caller as a zip holding
+// data.json, their uploaded images and their avatar
+func (h *UserHandler) ExportMe(ctx *fasthttp.RequestCtx) {
+	userID, err := getSuspendedUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	export, err := h.userRepo.Export(userID)
+	if err != nil {
+		log.Printf("user %d: export: %v", userID, err)
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to export data"})
+		return
+	}
+
+	ctx.Response.Header.Set("Content-Type", "application/zip")
+	ctx.Response.Header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="trashman-export-%d.zip"`, userID))
+	zw := zip.NewWriter(ctx)
+	w, err := zw.Create("data.json")
+	if err == nil {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(export)
+	}
+	for _, path := range export.Images {
+		if err != nil {
+			break
+		}
+		err = addUpload(zw, path)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Printf("user %d: export: %v", userID, err)
+	}
+}
+
+// exportDirs maps the directories uploaded images are read from to where
+// they go in the export
+var exportDirs = map[string]string{
+	"uploads":        "images/",
+	models.AvatarDir: "avatar/",
+}
+
+// addUpload copies an uploaded image or avatar into the export. Images pruned
+// for disk space are skipped.
+func addUpload(zw *zip.Writer, path string) error {
+	path = filepath.Clean(path)
+	dir, _, _ := strings.Cut(path, string(filepath.Separator))
+	prefix, ok := exportDirs[dir]
+	if !ok || dir == path {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	w, err := zw.Create(prefix + filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// deleteMeRequest represents the payload for deleting the caller's account
+type deleteMeRequest struct {
+	Password string `json:"password"`
+	// Mode is delete to remove everything the user made, or anonymize to
+	// keep their posts and comments under a placeholder name
+	Mode string `json:"mode"`
+}
+
+// DeleteMe deletes the caller's account given their password. Owners of
+// teams with other members must hand the team over first.
+func (h *UserHandler) DeleteMe(ctx *fasthttp.RequestCtx) {
+	userID, err := getSuspendedUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var req deleteMeRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.Mode != deleteModeDelete && req.Mode != deleteModeAnonymize {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "mode must be delete or anonymize"})
+		return
+	}
+	if _, ok := h.checkCurrentPassword(ctx, userID, req.Password); !ok {
+		return
+	}
+
+	var images []string
+	if req.Mode == deleteModeDelete {
+		images, err = h.userRepo.DeleteAccount(userID)
+	} else {
+		images, err = h.userRepo.AnonymizeAccount(userID)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrTeamOwner) {
+			writeJSON(ctx, fasthttp.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		log.Printf("user %d: delete account: %v", userID, err)
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to delete account"})
+		return
+	}
+	for _, path := range images {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("user %d: remove %s: %v", userID, path, err)
+		}
+	}
+	// the entry outlives the account, so it records nothing personal
+	recordAudit(ctx, userID, models.AuditUserDelete, models.ReportTargetUser, userID, nil, map[string]string{"mode": req.Mode})
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"gobackend/events"
+	"gobackend/models"
+
+	"github.com/valyala/fasthttp"
+)
+
+// VerificationHandler handles crowd verification of trash posts
+type VerificationHandler struct {
+	repo     *models.VerificationRepository
+	postRepo *models.TrashPostRepository
+	exp      *models.ExpEngine
+	// radius is how close, in meters, a verifier must be to the post
+	radius float64
+	// goneThreshold is how many users must say "gone" before a post is closed
+	goneThreshold int
+}
+
+func NewVerificationHandler(repo *models.VerificationRepository, postRepo *models.TrashPostRepository, exp *models.ExpEngine) *VerificationHandler {
+	h := &VerificationHandler{repo: repo, postRepo: postRepo, exp: exp, radius: 150, goneThreshold: 3}
+	if r, err := strconv.ParseFloat(os.Getenv("VERIFY_RADIUS_METERS"), 64); err == nil && r > 0 {
+		h.radius = r
+	}
+	if n, err := strconv.Atoi(os.Getenv("VERIFY_GONE_THRESHOLD")); err == nil && n > 0 {
+		h.goneThreshold = n
+	}
+	return h
+}
+
+// verificationRequest represents the payload for verifying a post
+type verificationRequest struct {
+	Status    string   `json:"status"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+}
+
+// CreateVerification records whether the trash reported in a post is still there.
+// The caller must be near the post, may not verify their own post and may
+// verify each post once a day.
+func (h *VerificationHandler) CreateVerification(ctx *fasthttp.RequestCtx) {
+	postID, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	userID, err := getUserIDFromToken(ctx)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var req verificationRequest
+	if err := readJSON(ctx, &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if !models.ValidVerificationStatus(req.Status) {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "status must be still_there, partially_cleaned or gone"})
+		return
+	}
+	if req.Latitude == nil || req.Longitude == nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "latitude and longitude required"})
+		return
+	}
+
+	post, err := h.postRepo.GetByID(postID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get post"})
+		return
+	}
+	if post == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "post not found"})
+		return
+	}
+	if post.UserID == userID {
+		writeJSON(ctx, fasthttp.StatusForbidden, map[string]string{"error": "you cannot verify your own post"})
+		return
+	}
+
+	distance := models.DistanceMeters(post.Latitude, post.Longitude, *req.Latitude, *req.Longitude)
+	if distance > h.radius {
+		writeJSON(ctx, fasthttp.StatusUnprocessableEntity, map[string]string{"error": fmt.Sprintf("you must be within %.0f m of the spot", h.radius)})
+		return
+	}
+	v := &models.Verification{
+		PostID:    postID,
+		UserID:    userID,
+		Status:    req.Status,
+		Latitude:  *req.Latitude,
+		Longitude: *req.Longitude,
+		Distance:  distance,
+	}
+	closed, err := h.repo.Create(v, h.goneThreshold)
+	if errors.Is(err, models.ErrVerifiedRecently) {
+		writeJSON(ctx, fasthttp.StatusTooManyRequests, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to verify post"})
+		return
+	}
+
+	award, err := h.exp.Award(models.ExpAction{
+		Action:     models.ExpReasonVerification,
+		UserID:     userID,
+		OwnerID:    post.UserID,
+		ActorID:    userID,
+		PostID:     postID,
+		SourceType: models.ExpSourceVerification,
+		SourceID:   v.ID,
+	}.At(v.Latitude, v.Longitude))
+	if err != nil {
+		log.Printf("verification %d: award exp: %v", v.ID, err)
+	}
+	events.Publish(events.Event{
+		Type:   events.TrashPostVerified,
+		UserID: userID,
+		Data:   map[string]interface{}{"post_id": postID, "verification_id": v.ID, "status": v.Status, "exp_awarded": award.Awarded()},
+	})
+
+	status := post.Status
+	if closed {
+		status = models.TrashStatusGone
+	}
+	writeJSON(ctx, fasthttp.StatusCreated, map[string]interface{}{
+		"verification": v,
+		"post_status":  status,
+	})
+}
+
+// GetVerifications returns a post's verification summary and individual votes.
+// Votes never reveal where the verifier stood, and only signed-in callers see
+// who cast them.
+func (h *VerificationHandler) GetVerifications(ctx *fasthttp.RequestCtx) {
+	postID, err := strconv.Atoi(ctx.UserValue("id").(string))
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+
+	post, err := h.postRepo.GetByID(postID)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get post"})
+		return
+	}
+	if post == nil {
+		writeJSON(ctx, fasthttp.StatusNotFound, map[string]string{"error": "post not found"})
+		return
+	}
+
+	viewer := viewerID(ctx)
+	votes, err := h.repo.GetVotes(postID, viewer)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get verifications"})
+		return
+	}
+	if viewer == 0 {
+		for _, v := range votes {
+			v.User = nil
+		}
+	}
+	if err := h.repo.Summarize([]*models.TrashPost{post}); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, map[string]string{"error": "failed to get verifications"})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, map[string]interface{}{
+		"post_id":       postID,
+		"status":        post.Status,
+		"summary":       post.Verification,
+		"verifications": votes,
+	})
+}
@@ -0,0 +1,78 @@
+// Package identicon draws the placeholder pictures shown for users without
+// an avatar: a symmetric 5x5 pattern in one color, derived from a seed so the
+// same user always gets the same picture.
+package identicon
+
+import (
+	"crypto/sha256"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// grid is the number of cells along each side of the pattern
+const grid = 5
+
+// background is the color of unset cells and the margin
+var background = color.RGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}
+
+// Render draws the identicon for seed as a size by size image. The pattern
+// sits inside a margin of half a cell.
+func Render(seed []byte, size int) image.Image {
+	sum := sha256.Sum256(seed)
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: background}, image.Point{}, draw.Src)
+
+	fg := &image.Uniform{C: foreground(sum[0], sum[1])}
+	cell := float64(size) / (grid + 1)
+	margin := cell / 2
+	// the left columns come from the hash and the right ones mirror them
+	bit := 0
+	for col := 0; col < (grid+1)/2; col++ {
+		for row := 0; row < grid; row++ {
+			on := sum[2+bit/8]>>(bit%8)&1 == 1
+			bit++
+			if !on {
+				continue
+			}
+			for _, c := range []int{col, grid - 1 - col} {
+				r := image.Rect(
+					int(margin+float64(c)*cell), int(margin+float64(row)*cell),
+					int(margin+float64(c+1)*cell), int(margin+float64(row+1)*cell))
+				draw.Draw(img, r, fg, image.Point{}, draw.Src)
+			}
+		}
+	}
+	return img
+}
+
+// foreground picks a saturated, mid-light color from two hash bytes so
+// patterns stay readable on the light background
+func foreground(h1, h2 byte) color.RGBA {
+	hue := (int(h1)<<8 | int(h2)) % 360
+	return hsl(float64(hue), 0.55, 0.5)
+}
+
+// hsl converts a hue in degrees, saturation and lightness to RGB
+func hsl(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g = c, x
+	case h < 120:
+		r, g = x, c
+	case h < 180:
+		g, b = c, x
+	case h < 240:
+		g, b = x, c
+	case h < 300:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	return color.RGBA{R: uint8((r + m) * 255), G: uint8((g + m) * 255), B: uint8((b + m) * 255), A: 0xff}
+}
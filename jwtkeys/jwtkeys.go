@@ -0,0 +1,304 @@
+// Package jwtkeys holds the keys session tokens are signed with. One key
+// signs; the others still verify, so keys can be rotated without signing
+// everyone out. Public keys are published as a JWKS for other services.
+package jwtkeys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key strength minimums
+const (
+	MinSecretLength = 32
+	MinRSABits      = 2048
+)
+
+// ErrNoKeys is returned when no signing key is configured
+var ErrNoKeys = errors.New("no JWT signing key configured; set JWT_SECRET to at least 32 bytes or JWT_KEYS_FILE")
+
+// KeyConfig is one key in the JWT_KEYS_FILE
+type KeyConfig struct {
+	ID string `json:"kid"`
+	// Alg is HS256, EdDSA or RS256
+	Alg string `json:"alg"`
+	// Secret is the HS256 key
+	Secret string `json:"secret,omitempty"`
+	// PrivateKeyFile is a PEM private key for EdDSA or RS256
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	// PublicKeyFile is a PEM public key for a retired key that only verifies
+	PublicKeyFile string `json:"public_key_file,omitempty"`
+	// Active marks the signing key; without one the first key that can sign is used
+	Active bool `json:"active,omitempty"`
+}
+
+// Key is a loaded signing or verification key
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	// private is nil for keys that only verify
+	private interface{}
+	public  interface{}
+}
+
+// Manager signs and verifies tokens with the configured keys
+type Manager struct {
+	keys map[string]*Key
+	// ordered keeps the configured order for choosing a signer and listing keys
+	ordered []*Key
+	signer  *Key
+	// legacy verifies tokens issued before they carried a kid
+	legacy *Key
+}
+
+// Load builds the key manager from JWT_KEYS_FILE, a JSON array of keys, and
+// JWT_SECRET. A JWT_SECRET key also verifies tokens without a kid, which
+// were issued before keys had ids. It fails rather than sign with a weak key.
+func Load() (*Manager, error) {
+	m := &Manager{keys: map[string]*Key{}}
+
+	if path := os.Getenv("JWT_KEYS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+		var configs []KeyConfig
+		if err := json.Unmarshal(data, &configs); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		for _, c := range configs {
+			k, err := load(c)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", c.ID, err)
+			}
+			if err := m.add(k, c.Active); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		k, err := hmacKey("", secret)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_SECRET: %w", err)
+		}
+		if err := m.add(k, false); err != nil {
+			return nil, err
+		}
+		m.legacy = k
+	}
+
+	if m.signer == nil {
+		for _, k := range m.ordered {
+			if k.private != nil {
+				m.signer = k
+				break
+			}
+		}
+	}
+	if m.signer == nil {
+		return nil, ErrNoKeys
+	}
+	return m, nil
+}
+
+// load reads a configured key
+func load(c KeyConfig) (*Key, error) {
+	if c.ID == "" {
+		return nil, errors.New("kid required")
+	}
+	switch c.Alg {
+	case "HS256":
+		return hmacKey(c.ID, c.Secret)
+	case "EdDSA", "RS256":
+	default:
+		return nil, fmt.Errorf("unsupported alg %q", c.Alg)
+	}
+
+	k := &Key{ID: c.ID, Method: jwt.GetSigningMethod(c.Alg)}
+	switch {
+	case c.PrivateKeyFile != "":
+		block, err := readPEM(c.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			if priv, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", c.PrivateKeyFile, err)
+			}
+		}
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a signing key", c.PrivateKeyFile)
+		}
+		k.private, k.public = priv, signer.Public()
+	case c.PublicKeyFile != "":
+		block, err := readPEM(c.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if k.public, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", c.PublicKeyFile, err)
+		}
+	default:
+		return nil, errors.New("private_key_file or public_key_file required")
+	}
+
+	switch pub := k.public.(type) {
+	case ed25519.PublicKey:
+		if c.Alg != "EdDSA" {
+			return nil, fmt.Errorf("Ed25519 key cannot sign %s", c.Alg)
+		}
+	case *rsa.PublicKey:
+		if c.Alg != "RS256" {
+			return nil, fmt.Errorf("RSA key cannot sign %s", c.Alg)
+		}
+		if pub.N.BitLen() < MinRSABits {
+			return nil, fmt.Errorf("RSA key is %d bits, at least %d required", pub.N.BitLen(), MinRSABits)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+	return k, nil
+}
+
+// hmacKey returns an HS256 key, refusing short secrets. Keys without an id
+// get one derived from the secret.
+func hmacKey(id, secret string) (*Key, error) {
+	if len(secret) < MinSecretLength {
+		return nil, fmt.Errorf("secret is %d bytes, at least %d required", len(secret), MinSecretLength)
+	}
+	if id == "" {
+		sum := sha256.Sum256([]byte(secret))
+		id = "hs-" + hex.EncodeToString(sum[:4])
+	}
+	return &Key{ID: id, Method: jwt.SigningMethodHS256, private: []byte(secret), public: []byte(secret)}, nil
+}
+
+// readPEM reads the first PEM block of a file
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return block, nil
+}
+
+// add registers a key, making it the signer if active
+func (m *Manager) add(k *Key, active bool) error {
+	if _, ok := m.keys[k.ID]; ok {
+		return fmt.Errorf("duplicate kid %q", k.ID)
+	}
+	if active {
+		if m.signer != nil {
+			return fmt.Errorf("keys %q and %q are both active", m.signer.ID, k.ID)
+		}
+		if k.private == nil {
+			return fmt.Errorf("active key %q has no private key", k.ID)
+		}
+		m.signer = k
+	}
+	m.keys[k.ID] = k
+	m.ordered = append(m.ordered, k)
+	return nil
+}
+
+// Sign signs claims with the active key, naming it in the kid header
+func (m *Manager) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(m.signer.Method, claims)
+	token.Header["kid"] = m.signer.ID
+	return token.SignedString(m.signer.private)
+}
+
+// Parse verifies a token against the key its kid names, with that key's
+// algorithm only, and returns its claims
+func (m *Manager) Parse(tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		k := m.legacy
+		if kid, ok := t.Header["kid"].(string); ok {
+			k = m.keys[kid]
+		}
+		if k == nil {
+			return nil, errors.New("unknown signing key")
+		}
+		if t.Method.Alg() != k.Method.Alg() {
+			return nil, errors.New("unexpected signing method")
+		}
+		return k.public, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// JWK is a public key in JSON Web Key form
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKS returns the public keys tokens may be signed with. HMAC keys are
+// secret and never listed.
+func (m *Manager) JWKS() map[string][]JWK {
+	b64 := base64.RawURLEncoding.EncodeToString
+	keys := []JWK{}
+	for _, k := range m.ordered {
+		switch pub := k.public.(type) {
+		case ed25519.PublicKey:
+			keys = append(keys, JWK{Kty: "OKP", Kid: k.ID, Alg: "EdDSA", Use: "sig", Crv: "Ed25519", X: b64(pub)})
+		case *rsa.PublicKey:
+			keys = append(keys, JWK{Kty: "RSA", Kid: k.ID, Alg: "RS256", Use: "sig", N: b64(pub.N.Bytes()), E: b64(big.NewInt(int64(pub.E)).Bytes())})
+		}
+	}
+	return map[string][]JWK{"keys": keys}
+}
+
+// Generate returns a new PKCS#8 PEM private key for EdDSA or RS256
+func Generate(alg string) ([]byte, error) {
+	var priv interface{}
+	var err error
+	switch strings.ToUpper(alg) {
+	case "EDDSA":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	case "RS256":
+		priv, err = rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return nil, fmt.Errorf("unsupported alg %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
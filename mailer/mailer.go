@@ -0,0 +1,126 @@
+// Package mailer sends transactional email such as verification and password
+// reset links. Deployments pick an implementation through the environment:
+// SMTP for real delivery or a local catcher, files or the log for development.
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages
+type Mailer interface {
+	Send(m Message) error
+}
+
+// format renders m as an RFC 5322 message
+func format(from string, m Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// validHeader rejects values that could inject extra headers
+func validHeader(values ...string) error {
+	for _, v := range values {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid header value %q", v)
+		}
+	}
+	return nil
+}
+
+// SMTPMailer sends through an SMTP server. Username may be empty for servers,
+// such as local catchers, that do not require authentication.
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// Send delivers m through the SMTP server
+func (s *SMTPMailer) Send(m Message) error {
+	if err := validHeader(m.To, m.Subject); err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, []string{m.To}, format(s.From, m))
+}
+
+// FileMailer writes each message to its own .eml file in Dir
+type FileMailer struct {
+	Dir  string
+	From string
+	seq  atomic.Int64
+}
+
+// Send writes m to a new file
+func (f *FileMailer) Send(m Message) error {
+	if err := validHeader(m.To, m.Subject); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.Dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%d-%d.eml", time.Now().UnixNano(), os.Getpid(), f.seq.Add(1))
+	return os.WriteFile(filepath.Join(f.Dir, name), format(f.From, m), 0600)
+}
+
+// LogMailer writes messages to the server log instead of sending them
+type LogMailer struct{}
+
+// Send logs m
+func (LogMailer) Send(m Message) error {
+	log.Printf("mail to %s: %s\n%s", m.To, m.Subject, m.Body)
+	return nil
+}
+
+// FromEnv returns the mailer configured by MAIL_SMTP_ADDR (with MAIL_SMTP_USERNAME
+// and MAIL_SMTP_PASSWORD) or MAIL_DIR, falling back to the log. MAIL_FROM sets
+// the sender.
+func FromEnv() Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	if addr := os.Getenv("MAIL_SMTP_ADDR"); addr != "" {
+		return &SMTPMailer{
+			Addr:     addr,
+			From:     from,
+			Username: os.Getenv("MAIL_SMTP_USERNAME"),
+			Password: os.Getenv("MAIL_SMTP_PASSWORD"),
+		}
+	}
+	if dir := os.Getenv("MAIL_DIR"); dir != "" {
+		return &FileMailer{Dir: dir, From: from}
+	}
+	return LogMailer{}
+}
@@ -3,10 +3,18 @@ package main
 import (
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"gobackend/database"
+	"gobackend/events"
 	"gobackend/handlers"
+	"gobackend/jwtkeys"
+	"gobackend/mailer"
 	"gobackend/models"
+	"gobackend/oidc"
+	"gobackend/webauthn"
 
 	"github.com/fasthttp/router"
 	"github.com/valyala/fasthttp"
@@ -22,20 +30,129 @@ func main() {
 	if dbPath == "" {
 		dbPath = "./data/app.db"
 	}
+	expRulesPath := os.Getenv("EXP_RULES_PATH")
+	if expRulesPath == "" {
+		expRulesPath = filepath.Join(filepath.Dir(dbPath), "exp_rules.json")
+	}
 
 	db, err := database.Initialize(dbPath)
 	if err != nil {
 		log.Fatalf("failed to init db: %v", err)
 	}
 
+	levels, err := models.LoadLevelCurve(os.Getenv("LEVEL_CURVE_PATH"))
+	if err != nil {
+		log.Fatalf("failed to load level curve: %v", err)
+	}
+	models.SetLevelCurve(levels)
+
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], db); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+
+	keys, err := jwtkeys.Load()
+	if err != nil {
+		log.Fatalf("failed to load JWT keys: %v", err)
+	}
+
+	rateLimits, err := models.LoadRateLimits(os.Getenv("RATE_LIMITS_PATH"))
+	if err != nil {
+		log.Fatalf("failed to load rate limits: %v", err)
+	}
+
+	achievements, err := models.LoadAchievements(os.Getenv("ACHIEVEMENTS_PATH"))
+	if err != nil {
+		log.Fatalf("failed to load achievements: %v", err)
+	}
+
 	userRepo := models.NewUserRepository(db.DB)
+
 	trashRepo := models.NewTrashPostRepository(db.DB)
 	commentRepo := models.NewCommentRepository(db.DB)
+	teamRepo := models.NewTeamRepository(db.DB)
+	regionRepo := models.NewRegionRepository(db.DB)
+	achievementRepo := models.NewAchievementRepository(db.DB, achievements)
+	streakRepo := models.NewStreakRepository(db.DB)
+	questRepo := models.NewQuestRepository(db.DB)
+	rewardRepo := models.NewRewardRepository(db.DB)
+	verificationRepo := models.NewVerificationRepository(db.DB)
+	categoryRepo := models.NewCategoryRepository(db.DB)
+	moderationRepo := models.NewModerationRepository(db.DB)
+	auditRepo := models.NewAuditRepository(db.DB)
+	tokenRepo := models.NewTokenRepository(db.DB)
+	twoFactorRepo := models.NewTwoFactorRepository(db.DB)
+	passkeyRepo := models.NewPasskeyRepository(db.DB)
+	identityRepo := models.NewIdentityRepository(db.DB)
+	apiKeyRepo := models.NewAPIKeyRepository(db.DB)
+	rateLimitRepo := models.NewRateLimitRepository(db.DB)
+
+	handlers.SetAccountRepository(userRepo)
+	handlers.SetSigningKeys(keys)
+	handlers.SetAPIKeyRepository(apiKeyRepo)
+	handlers.SetAuditLog(auditRepo)
+	// prefork children share the database, so only the master prunes it
+	if !prefork.IsChild() {
+		go pruneAuditLog(auditRepo, auditRetention())
+		go pruneRateLimits(rateLimitRepo, rateLimits.LoginLockout)
+	}
+
+	expEngine, err := models.NewExpEngine(db.DB, expRulesPath)
+	if err != nil {
+		log.Fatalf("failed to load exp rules: %v", err)
+	}
+	// rules are held in memory per process; the master serves no requests
+	if prefork.IsChild() {
+		expEngine.Watch(10 * time.Second)
+	}
+
+	providers, err := oidc.Load()
+	if err != nil {
+		log.Fatalf("failed to load sign-in providers: %v", err)
+	}
 
-	userHandler := handlers.NewUserHandler(userRepo)
-	trashHandler := handlers.NewTrashPostHandler(trashRepo, userRepo)
-	commentHandler := handlers.NewCommentHandler(commentRepo, userRepo, trashRepo)
-	oauthHandler := handlers.NewOAuthHandler(userRepo)
+	limiter := handlers.NewRateLimiter(rateLimitRepo, rateLimits)
+	userHandler := handlers.NewUserHandler(userRepo, regionRepo, limiter)
+	trashHandler := handlers.NewTrashPostHandler(trashRepo, userRepo, categoryRepo, verificationRepo, expEngine)
+	commentHandler := handlers.NewCommentHandler(commentRepo, userRepo, trashRepo, expEngine)
+	oauthHandler := handlers.NewOAuthHandler(providers, userRepo, identityRepo)
+	teamHandler := handlers.NewTeamHandler(teamRepo, userRepo)
+	regionHandler := handlers.NewRegionHandler(regionRepo, userRepo)
+	expRulesHandler := handlers.NewExpRulesHandler(expEngine, userRepo)
+	achievementHandler := handlers.NewAchievementHandler(achievementRepo, userRepo)
+	streakHandler := handlers.NewStreakHandler(streakRepo)
+	profileHandler := handlers.NewProfileHandler(userRepo, achievementRepo, streakRepo)
+	questHandler := handlers.NewQuestHandler(questRepo, userRepo)
+	rewardHandler := handlers.NewRewardHandler(rewardRepo, userRepo)
+	verificationHandler := handlers.NewVerificationHandler(verificationRepo, trashRepo, expEngine)
+	categoryHandler := handlers.NewCategoryHandler(categoryRepo, userRepo)
+	moderationHandler := handlers.NewModerationHandler(moderationRepo, userRepo, trashRepo, commentRepo)
+	auditHandler := handlers.NewAuditHandler(auditRepo, userRepo)
+	accountHandler := handlers.NewAccountHandler(userRepo, tokenRepo, mailer.FromEnv())
+	twoFactorHandler := handlers.NewTwoFactorHandler(twoFactorRepo, userRepo)
+	apiKeyHandler := handlers.NewAPIKeyHandler(apiKeyRepo, userRepo, teamRepo)
+	passkeyHandler := handlers.NewPasskeyHandler(passkeyRepo, userRepo, webauthn.FromEnv())
+
+	// streaks and quests update before achievements look at them
+	for _, activity := range []string{events.TrashPostCreated, events.CommentCreated, events.TrashPostVerified} {
+		events.Subscribe(activity, streakHandler.OnActivity)
+		events.Subscribe(activity, questHandler.OnActivity)
+		events.Subscribe(activity, achievementHandler.OnActivity)
+	}
+	notify := events.LogNotifier
+	if url := os.Getenv("NOTIFY_WEBHOOK_URL"); url != "" {
+		notify = events.WebhookNotifier(url)
+	}
+	events.Subscribe(events.AchievementUnlocked, notify)
+	events.Subscribe(events.QuestCompleted, notify)
+	events.Subscribe(events.LevelUp, notify)
+	events.Subscribe(events.HazardReported, notify)
+	events.Subscribe(events.UserWarned, notify)
+	events.Subscribe(events.UserSuspended, notify)
+	events.Subscribe(events.LevelUp, achievementHandler.OnActivity)
+	events.Subscribe(events.UserCreated, accountHandler.OnUserCreated)
 
 	r := router.New()
 	r.GET("/health", func(ctx *fasthttp.RequestCtx) {
@@ -46,19 +163,161 @@ func main() {
 
 	r.POST("/users", userHandler.CreateUser)
 	r.POST("/login", userHandler.Login)
+	r.POST("/auth/verify-email", accountHandler.VerifyEmail)
+	r.POST("/auth/verify-email/request", accountHandler.RequestVerification)
+	r.POST("/auth/password-reset", accountHandler.ResetPassword)
+	r.POST("/auth/password-reset/request", accountHandler.RequestPasswordReset)
+	r.POST("/auth/magic-link", accountHandler.RequestMagicLink)
+	r.POST("/auth/magic-link/verify", accountHandler.ExchangeMagicLink)
+	r.POST("/auth/change-email", accountHandler.ConfirmEmailChange)
+	r.GET("/auth/2fa", twoFactorHandler.GetStatus)
+	r.POST("/auth/2fa/enroll", twoFactorHandler.Enroll)
+	r.POST("/auth/2fa/confirm", twoFactorHandler.Confirm)
+	r.POST("/auth/2fa/verify", twoFactorHandler.Verify)
+	r.POST("/auth/2fa/disable", twoFactorHandler.Disable)
+	r.POST("/auth/2fa/recovery-codes", twoFactorHandler.RegenerateRecoveryCodes)
+	r.GET("/auth/passkeys", passkeyHandler.GetPasskeys)
+	r.PUT("/auth/passkeys/{id}", passkeyHandler.RenamePasskey)
+	r.DELETE("/auth/passkeys/{id}", passkeyHandler.DeletePasskey)
+	r.POST("/auth/passkeys/register/options", passkeyHandler.RegistrationOptions)
+	r.POST("/auth/passkeys/register", passkeyHandler.Register)
+	r.POST("/auth/passkeys/login/options", passkeyHandler.LoginOptions)
+	r.POST("/auth/passkeys/login", passkeyHandler.Login)
 	r.GET("/leaderboard", userHandler.Leaderboard)
-	r.GET("/auth/google/login", oauthHandler.Login)
-	r.GET("/auth/google/callback", oauthHandler.Callback)
+	r.GET("/leaderboard/teams", teamHandler.Leaderboard)
+	r.GET("/users/me", userHandler.GetMe)
+	r.PATCH("/users/me", userHandler.UpdateMe)
+	r.DELETE("/users/me", userHandler.DeleteMe)
+	r.PUT("/users/me/password", userHandler.ChangePassword)
+	r.PUT("/users/me/email", accountHandler.RequestEmailChange)
+	r.GET("/users/me/export", userHandler.ExportMe)
+	r.GET("/users/me/exp-history", userHandler.ExpHistory)
+	r.PUT("/users/me/timezone", userHandler.UpdateTimezone)
+	r.PUT("/users/me/privacy", profileHandler.UpdatePrivacy)
+	r.PUT("/users/me/avatar", profileHandler.UploadAvatar)
+	r.DELETE("/users/me/avatar", profileHandler.DeleteAvatar)
+	r.GET("/users/me/streak", streakHandler.GetStreak)
+	r.GET("/users/me/quests", questHandler.GetMyQuests)
+	r.GET("/users/me/points", rewardHandler.GetPoints)
+	r.GET("/users/me/redemptions", rewardHandler.GetMyRedemptions)
+	r.GET("/users/me/appeals", moderationHandler.GetMyAppeals)
+	r.POST("/users/me/appeals", moderationHandler.CreateAppeal)
+	r.GET("/users/{id}/achievements", achievementHandler.GetUserAchievements)
+	r.GET("/users/{id}/profile", profileHandler.GetProfile)
+	r.GET("/users/{id}/identicon.png", profileHandler.Identicon)
+	r.ServeFiles("/avatars/{filepath:*}", "./avatars")
+	r.GET("/achievements", achievementHandler.GetAchievements)
+	r.POST("/admin/exp-events/{id}/reverse", userHandler.ReverseExpEvent)
+	r.GET("/admin/audit", auditHandler.GetAuditLog)
+	r.GET("/admin/exp-rules", expRulesHandler.GetRules)
+	r.PUT("/admin/exp-rules", expRulesHandler.UpdateRules)
+	r.GET("/admin/quests", questHandler.GetTemplates)
+	r.POST("/admin/quests", questHandler.CreateTemplate)
+	r.PUT("/admin/quests/{id}", questHandler.UpdateTemplate)
+	r.PUT("/admin/users/{id}/sponsor", rewardHandler.SetSponsor)
+	r.PUT("/admin/users/{id}/role", userHandler.SetRole)
+	r.GET("/admin/users/{id}/state", moderationHandler.GetAccountState)
+	r.PUT("/admin/users/{id}/state", moderationHandler.SetAccountState)
+	r.DELETE("/admin/users/{id}/2fa", twoFactorHandler.ResetUser)
+	r.GET("/admin/security/2fa-policy", twoFactorHandler.GetPolicy)
+	r.PUT("/admin/security/2fa-policy", twoFactorHandler.UpdatePolicy)
+	r.POST("/admin/redemptions/{id}/void", rewardHandler.VoidRedemption)
+	r.GET("/rewards", rewardHandler.GetRewards)
+	r.POST("/rewards", rewardHandler.CreateReward)
+	r.PUT("/rewards/{id}", rewardHandler.UpdateReward)
+	r.POST("/rewards/{id}/redeem", rewardHandler.Redeem)
+	r.POST("/redemptions/use", rewardHandler.UseRedemption)
+	r.GET("/regions", regionHandler.GetRegions)
+	r.POST("/regions", regionHandler.CreateRegion)
+	r.DELETE("/regions/{id}", regionHandler.DeleteRegion)
+	r.POST("/teams", teamHandler.CreateTeam)
+	r.POST("/teams/join", teamHandler.JoinTeam)
+	r.GET("/teams/{id}", teamHandler.GetTeam)
+	r.DELETE("/teams/{id}", teamHandler.DeleteTeam)
+	r.POST("/teams/{id}/leave", teamHandler.LeaveTeam)
+	r.POST("/teams/{id}/invite-code", teamHandler.RegenerateInviteCode)
+	r.PUT("/teams/{id}/members/{userId}", teamHandler.UpdateMember)
+	r.DELETE("/teams/{id}/members/{userId}", teamHandler.RemoveMember)
+	r.GET("/.well-known/jwks.json", handlers.JWKS)
+	r.GET("/auth/providers", oauthHandler.GetProviders)
+	r.GET("/auth/{provider}/login", oauthHandler.Login)
+	r.GET("/auth/{provider}/callback", oauthHandler.Callback)
+	r.GET("/users/me/identities", oauthHandler.GetIdentities)
+	r.POST("/users/me/identities/{provider}", oauthHandler.LinkIdentity)
+	r.DELETE("/users/me/identities/{provider}", oauthHandler.UnlinkIdentity)
+	r.GET("/users/me/api-keys", apiKeyHandler.GetMyKeys)
+	r.POST("/users/me/api-keys", apiKeyHandler.CreateMyKey)
+	r.DELETE("/users/me/api-keys/{keyId}", apiKeyHandler.RevokeMyKey)
+	r.GET("/teams/{id}/api-keys", apiKeyHandler.GetTeamKeys)
+	r.POST("/teams/{id}/api-keys", apiKeyHandler.CreateTeamKey)
+	r.DELETE("/teams/{id}/api-keys/{keyId}", apiKeyHandler.RevokeTeamKey)
 	r.ServeFiles("/uploads/{filepath:*}", "./uploads")
 	r.POST("/trashposts", trashHandler.CreateTrashPost)
 	r.GET("/trashposts", trashHandler.GetTrashPosts)
+	r.GET("/trashposts/export", trashHandler.ExportTrashPosts)
+	r.GET("/trashposts/stats", trashHandler.TrashPostStats)
+	r.GET("/categories", categoryHandler.GetCategories)
+	r.GET("/admin/categories", categoryHandler.GetAllCategories)
+	r.POST("/admin/categories", categoryHandler.CreateCategory)
+	r.PUT("/admin/categories/{id}", categoryHandler.UpdateCategory)
 	r.DELETE("/trashposts/{id}", trashHandler.DeleteTrashPost)
 	r.POST("/trashposts/{id}/comments", commentHandler.CreateComment)
 	r.GET("/trashposts/{id}/comments", commentHandler.GetComments)
+	r.POST("/trashposts/{id}/verifications", verificationHandler.CreateVerification)
+	r.GET("/trashposts/{id}/verifications", verificationHandler.GetVerifications)
+	r.POST("/reports", moderationHandler.CreateReport)
+	r.GET("/moderation/queue", moderationHandler.GetQueue)
+	r.GET("/moderation/history", moderationHandler.GetHistory)
+	r.GET("/moderation/appeals", moderationHandler.GetAppeals)
+	r.POST("/moderation/appeals/{id}/resolve", moderationHandler.ResolveAppeal)
+	r.GET("/moderation/{type}/{id}", moderationHandler.GetTarget)
+	r.POST("/moderation/{type}/{id}/actions", moderationHandler.Act)
 
-	server := &fasthttp.Server{Handler: r.Handler}
+	server := &fasthttp.Server{Handler: limiter.Handler(r.Handler)}
 
 	if err := prefork.New(server).ListenAndServe(":" + port); err != nil {
 		log.Fatalf("server error: %v", err)
 	}
 }
+
+// auditRetention reads how long audit entries are kept from AUDIT_RETENTION_DAYS.
+// It defaults to a year and cannot be shorter than models.MinAuditRetention.
+func auditRetention() time.Duration {
+	retention := 365 * 24 * time.Hour
+	if v := os.Getenv("AUDIT_RETENTION_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days <= 0 {
+			log.Printf("invalid AUDIT_RETENTION_DAYS %q, keeping %v", v, retention)
+			return retention
+		}
+		retention = time.Duration(days) * 24 * time.Hour
+	}
+	if retention < models.MinAuditRetention {
+		log.Printf("AUDIT_RETENTION_DAYS is below the minimum, keeping %v", models.MinAuditRetention)
+		retention = models.MinAuditRetention
+	}
+	return retention
+}
+
+// pruneAuditLog drops expired audit entries now and then once a day
+func pruneAuditLog(repo *models.AuditRepository, retention time.Duration) {
+	for {
+		if n, err := repo.Prune(retention); err != nil {
+			log.Printf("prune audit log: %v", err)
+		} else if n > 0 {
+			log.Printf("pruned %d audit log entries", n)
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// pruneRateLimits drops idle rate limit buckets and forgotten login failures
+// now and then once an hour
+func pruneRateLimits(repo *models.RateLimitRepository, lockout models.LoginLockout) {
+	for {
+		if err := repo.Prune(lockout); err != nil {
+			log.Printf("prune rate limits: %v", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,260 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Achievement is a declarative badge definition. A user earns it once their
+// value for Metric reaches Threshold.
+type Achievement struct {
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Icon        string `json:"icon,omitempty"`
+	Metric      string `json:"metric"`
+	Threshold   int    `json:"threshold"`
+}
+
+// UserAchievement is an achievement awarded to a user
+type UserAchievement struct {
+	*Achievement
+	AwardedAt time.Time `json:"awarded_at"`
+}
+
+// achievementMetric computes a user's current value for a metric
+type achievementMetric func(db *sql.DB, userID int) (int, error)
+
+func countMetric(query string) achievementMetric {
+	return func(db *sql.DB, userID int) (int, error) {
+		var n int
+		err := db.QueryRow(query, userID).Scan(&n)
+		return n, err
+	}
+}
+
+// achievementMetrics are the metrics definitions can refer to
+var achievementMetrics = map[string]achievementMetric{
+	"trash_posts":   countMetric(`SELECT COUNT(*) FROM trash_posts WHERE user_id = ?`),
+	"comments":      countMetric(`SELECT COUNT(*) FROM comments WHERE user_id = ?`),
+	"verifications": countMetric(`SELECT COUNT(*) FROM trash_verifications WHERE user_id = ?`),
+	"exp":           countMetric(`SELECT COALESCE((SELECT exp FROM users WHERE id = ?), 0)`),
+	"level":         userLevel,
+	// most reports the user made on a single trail
+	"trail_posts": countMetric(`
+       SELECT COALESCE(MAX(n), 0) FROM (
+               SELECT COUNT(*) AS n FROM trash_posts
+               WHERE user_id = ? AND COALESCE(trail, '') != ''
+               GROUP BY trail
+       )`),
+	// reports made between 22:00 and 05:00 local solar time, estimated from the
+	// report's longitude so no user timezone is needed
+	"night_posts": countMetric(`
+       SELECT COUNT(*) FROM (
+               SELECT ((CAST(strftime('%H', created_at) AS INTEGER) * 60
+                        + CAST(strftime('%M', created_at) AS INTEGER)
+                        + CAST(longitude * 4 AS INTEGER)) % 1440 + 1440) % 1440 AS minute
+               FROM trash_posts WHERE user_id = ?
+       ) WHERE minute >= 1320 OR minute < 300`),
+	"streak_days": longestActivityStreak,
+	// reports the user confirmed cleaned up on site
+	"cleanups": countMetric(`SELECT COUNT(DISTINCT post_id) FROM trash_verifications WHERE user_id = ? AND status = '` + VerificationGone + `'`),
+}
+
+// userLevel returns the user's level on the current curve
+func userLevel(db *sql.DB, userID int) (int, error) {
+	var exp int
+	if err := db.QueryRow(`SELECT COALESCE((SELECT exp FROM users WHERE id = ?), 0)`, userID).Scan(&exp); err != nil {
+		return 0, err
+	}
+	return CurrentLevelCurve().Level(exp), nil
+}
+
+// longestActivityStreak returns the longest tracked streak, or for activity
+// from before streaks were tracked, the longest run of consecutive UTC days on
+// which the user posted or commented
+func longestActivityStreak(db *sql.DB, userID int) (int, error) {
+	var tracked int
+	if err := db.QueryRow(`SELECT COALESCE((SELECT longest FROM user_streaks WHERE user_id = ?), 0)`, userID).Scan(&tracked); err != nil {
+		return 0, err
+	}
+
+	query := `
+       SELECT DISTINCT date(created_at) AS day FROM (
+               SELECT created_at FROM trash_posts WHERE user_id = ?
+               UNION ALL
+               SELECT created_at FROM comments WHERE user_id = ?
+       ) ORDER BY day`
+	rows, err := db.Query(query, userID, userID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	longest, current := tracked, 0
+	var prev time.Time
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return 0, err
+		}
+		day, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return 0, err
+		}
+		if !prev.IsZero() && day.Sub(prev) == 24*time.Hour {
+			current++
+		} else {
+			current = 1
+		}
+		if current > longest {
+			longest = current
+		}
+		prev = day
+	}
+	return longest, rows.Err()
+}
+
+// DefaultAchievements returns the definitions used when no file is configured
+func DefaultAchievements() []*Achievement {
+	return []*Achievement{
+		{Key: "first_report", Name: "First report", Description: "Reported your first trash spot", Metric: "trash_posts", Threshold: 1},
+		{Key: "spotter", Name: "Spotter", Description: "Reported 10 trash spots", Metric: "trash_posts", Threshold: 10},
+		{Key: "first_comment", Name: "Conversation starter", Description: "Commented on a report", Metric: "comments", Threshold: 1},
+		{Key: "fact_checker", Name: "Fact checker", Description: "Verified 10 reports", Metric: "verifications", Threshold: 10},
+		{Key: "cleanup_10", Name: "Cleanup crew", Description: "Confirmed 10 spots cleaned up", Metric: "cleanups", Threshold: 10},
+		{Key: "trail_guardian", Name: "Trail guardian", Description: "Reported 10 spots on the same trail", Metric: "trail_posts", Threshold: 10},
+		{Key: "streak_7", Name: "7-day streak", Description: "Were active 7 days in a row", Metric: "streak_days", Threshold: 7},
+		{Key: "night_owl", Name: "Night owl", Description: "Reported 5 spots between 10pm and 5am", Metric: "night_posts", Threshold: 5},
+		{Key: "veteran", Name: "Veteran", Description: "Earned 1000 EXP", Metric: "exp", Threshold: 1000},
+		{Key: "level_10", Name: "Seasoned", Description: "Reached level 10", Metric: "level", Threshold: 10},
+	}
+}
+
+// LoadAchievements reads definitions from a JSON file, falling back to the
+// defaults when path is empty or the file does not exist
+func LoadAchievements(path string) ([]*Achievement, error) {
+	if path == "" {
+		return DefaultAchievements(), nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return DefaultAchievements(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var defs []*Achievement
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return nil, fmt.Errorf("parse achievements: %w", err)
+	}
+	seen := map[string]bool{}
+	for _, d := range defs {
+		if d.Key == "" || seen[d.Key] {
+			return nil, fmt.Errorf("achievement keys must be unique and non-empty")
+		}
+		if _, ok := achievementMetrics[d.Metric]; !ok {
+			return nil, fmt.Errorf("%s: unknown metric %q", d.Key, d.Metric)
+		}
+		seen[d.Key] = true
+	}
+	return defs, nil
+}
+
+// AchievementRepository evaluates achievement definitions and stores awards
+type AchievementRepository struct {
+	db    *sql.DB
+	defs  []*Achievement
+	byKey map[string]*Achievement
+}
+
+// NewAchievementRepository creates a new achievement repository
+func NewAchievementRepository(db *sql.DB, defs []*Achievement) *AchievementRepository {
+	byKey := make(map[string]*Achievement, len(defs))
+	for _, d := range defs {
+		byKey[d.Key] = d
+	}
+	return &AchievementRepository{db: db, defs: defs, byKey: byKey}
+}
+
+// Definitions returns all achievement definitions
+func (r *AchievementRepository) Definitions() []*Achievement {
+	return r.defs
+}
+
+// GetByUserID returns the achievements a user has been awarded, newest first.
+// Awards whose definition was removed are skipped.
+func (r *AchievementRepository) GetByUserID(userID int) ([]*UserAchievement, error) {
+	rows, err := r.db.Query(`SELECT achievement_key, awarded_at FROM user_achievements WHERE user_id = ? ORDER BY awarded_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	awards := []*UserAchievement{}
+	for rows.Next() {
+		var key string
+		var at time.Time
+		if err := rows.Scan(&key, &at); err != nil {
+			return nil, err
+		}
+		if def := r.byKey[key]; def != nil {
+			awards = append(awards, &UserAchievement{Achievement: def, AwardedAt: at})
+		}
+	}
+	return awards, rows.Err()
+}
+
+// Evaluate checks every definition the user has not earned yet and awards
+// those whose threshold is met. It returns only the new awards.
+func (r *AchievementRepository) Evaluate(userID int) ([]*UserAchievement, error) {
+	earned, err := r.GetByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[string]bool, len(earned))
+	for _, a := range earned {
+		have[a.Key] = true
+	}
+
+	values := map[string]int{}
+	var awarded []*UserAchievement
+	for _, def := range r.defs {
+		if have[def.Key] {
+			continue
+		}
+		value, ok := values[def.Metric]
+		if !ok {
+			metric := achievementMetrics[def.Metric]
+			if metric == nil {
+				continue
+			}
+			if value, err = metric(r.db, userID); err != nil {
+				return nil, fmt.Errorf("metric %s: %w", def.Metric, err)
+			}
+			values[def.Metric] = value
+		}
+		if value < def.Threshold {
+			continue
+		}
+
+		// another process may have awarded it concurrently; only report rows we inserted
+		ua := &UserAchievement{Achievement: def}
+		err := r.db.QueryRow(`
+                       INSERT INTO user_achievements (user_id, achievement_key) VALUES (?, ?)
+                       ON CONFLICT DO NOTHING
+                       RETURNING awarded_at`, userID, def.Key).Scan(&ua.AwardedAt)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		awarded = append(awarded, ua)
+	}
+	return awarded, nil
+}
@@ -0,0 +1,186 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// API key scopes
+const (
+	ScopeReadPosts       = "read:posts"
+	ScopeWritePosts      = "write:posts"
+	ScopeAdminModeration = "admin:moderation"
+)
+
+// APIKeyScopes lists the scopes a key can be granted
+var APIKeyScopes = []string{ScopeReadPosts, ScopeWritePosts, ScopeAdminModeration}
+
+// APIKeyPrefix starts every API key, telling them apart from session tokens
+const APIKeyPrefix = "tmk_"
+
+// apiKeyPrefixLength is how much of a key is kept in the clear to recognise it
+const apiKeyPrefixLength = len(APIKeyPrefix) + 8
+
+// API key errors
+var (
+	ErrAPIKeyInvalid  = errors.New("invalid or expired API key")
+	ErrAPIKeyNotFound = errors.New("API key not found")
+)
+
+// APIKey is a long-lived credential for scripts and other systems. Only
+// its hash is stored; the key itself is shown once, when it is created.
+type APIKey struct {
+	ID     int `json:"id" db:"id"`
+	UserID int `json:"user_id" db:"user_id"`
+	// TeamID is set for keys shared by a team
+	TeamID     int        `json:"team_id,omitempty" db:"team_id"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"prefix"`
+	Scopes     []string   `json:"scopes" db:"scopes"`
+	ExpiresAt  time.Time  `json:"expires_at" db:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip,omitempty" db:"last_used_ip"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+}
+
+// HasScope reports whether the key was granted scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidAPIKeyScope reports whether scope is a known API key scope
+func ValidAPIKeyScope(scope string) bool {
+	for _, s := range APIKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAPIKey reports whether a bearer credential is an API key rather than a token
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, APIKeyPrefix)
+}
+
+// apiKeyColumns lists the api_keys columns read by scanAPIKey
+const apiKeyColumns = `id, user_id, COALESCE(team_id, 0), name, prefix, scopes, expires_at, last_used_at, last_used_ip, created_at`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	k := &APIKey{}
+	var scopes string
+	err := row.Scan(&k.ID, &k.UserID, &k.TeamID, &k.Name, &k.Prefix, &scopes, &k.ExpiresAt, &k.LastUsedAt, &k.LastUsedIP, &k.CreatedAt)
+	k.Scopes = strings.Fields(scopes)
+	return k, err
+}
+
+// apiKeyLastUsedInterval limits how often last-use is written for a busy key
+const apiKeyLastUsedInterval = time.Minute
+
+// APIKeyRepository handles API keys
+type APIKeyRepository struct {
+	db *sql.DB
+}
+
+// NewAPIKeyRepository creates a new API key repository
+func NewAPIKeyRepository(db *sql.DB) *APIKeyRepository {
+	return &APIKeyRepository{db: db}
+}
+
+// Create stores a new key and returns the key itself, which is not kept
+func (r *APIKeyRepository) Create(k *APIKey) (string, error) {
+	secret, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	key := APIKeyPrefix + secret
+	k.Prefix = key[:apiKeyPrefixLength]
+
+	query := `
+       INSERT INTO api_keys (user_id, team_id, name, prefix, key_hash, scopes, expires_at)
+       VALUES (?, ?, ?, ?, ?, ?, ?)
+       RETURNING id, created_at`
+	err = r.db.QueryRow(query, k.UserID, nullInt(k.TeamID), k.Name, k.Prefix, HashToken(key),
+		strings.Join(k.Scopes, " "), k.ExpiresAt.UTC().Format(sqliteTimeFormat)).Scan(&k.ID, &k.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Authenticate returns the unexpired key. A team key only works while the
+// user who made it can still manage the team.
+func (r *APIKeyRepository) Authenticate(key string) (*APIKey, error) {
+	query := `
+       SELECT ` + apiKeyColumns + ` FROM api_keys k
+       WHERE key_hash = ? AND expires_at > ?
+         AND (team_id IS NULL OR EXISTS (
+               SELECT 1 FROM team_members m
+               WHERE m.team_id = k.team_id AND m.user_id = k.user_id AND m.role IN (?, ?)))`
+	k, err := scanAPIKey(r.db.QueryRow(query, HashToken(key), time.Now().UTC().Format(sqliteTimeFormat), TeamRoleOwner, TeamRoleAdmin))
+	if err == sql.ErrNoRows {
+		return nil, ErrAPIKeyInvalid
+	}
+	return k, err
+}
+
+// RecordUse notes when and from where the key was last used
+func (r *APIKeyRepository) RecordUse(id int, ip string) error {
+	now := time.Now().UTC()
+	_, err := r.db.Exec(`UPDATE api_keys SET last_used_at = ?, last_used_ip = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ? OR last_used_ip <> ?)`,
+		now.Format(sqliteTimeFormat), ip, id, now.Add(-apiKeyLastUsedInterval).Format(sqliteTimeFormat), ip)
+	return err
+}
+
+// GetByUser retrieves a user's personal keys
+func (r *APIKeyRepository) GetByUser(userID int) ([]*APIKey, error) {
+	return r.list(`SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id = ? AND team_id IS NULL ORDER BY id`, userID)
+}
+
+// GetByTeam retrieves a team's keys
+func (r *APIKeyRepository) GetByTeam(teamID int) ([]*APIKey, error) {
+	return r.list(`SELECT `+apiKeyColumns+` FROM api_keys WHERE team_id = ? ORDER BY id`, teamID)
+}
+
+func (r *APIKeyRepository) list(query string, args ...interface{}) ([]*APIKey, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// Revoke deletes a user's personal key
+func (r *APIKeyRepository) Revoke(id, userID int) (*APIKey, error) {
+	return r.revoke(`DELETE FROM api_keys WHERE id = ? AND user_id = ? AND team_id IS NULL RETURNING `+apiKeyColumns, id, userID)
+}
+
+// RevokeTeamKey deletes a team's key
+func (r *APIKeyRepository) RevokeTeamKey(id, teamID int) (*APIKey, error) {
+	return r.revoke(`DELETE FROM api_keys WHERE id = ? AND team_id = ? RETURNING `+apiKeyColumns, id, teamID)
+}
+
+func (r *APIKeyRepository) revoke(query string, args ...interface{}) (*APIKey, error) {
+	k, err := scanAPIKey(r.db.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return nil, ErrAPIKeyNotFound
+	}
+	return k, err
+}
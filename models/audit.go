@@ -0,0 +1,171 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// MinAuditRetention is the shortest retention the audit_log table allows
+const MinAuditRetention = 30 * 24 * time.Hour
+
+// Audited actions
+const (
+	AuditTrashPostDelete = "trash_post.delete"
+	AuditTrashPostPrune  = "trash_post.prune"
+	AuditUserDelete      = "user.delete"
+	AuditUserRole        = "user.role"
+	AuditUserSponsor     = "user.sponsor"
+	AuditUserState       = "user.state"
+	AuditUserTwoFactor   = "user.two_factor_reset"
+	AuditTwoFactorPolicy = "two_factor_policy.update"
+	AuditAPIKeyCreate    = "api_key.create"
+	AuditAPIKeyRevoke    = "api_key.revoke"
+	// AuditModeration is followed by the moderation action taken
+	AuditModeration     = "moderation."
+	AuditAppealResolve  = "appeal.resolve"
+	AuditExpReverse     = "exp_event.reverse"
+	AuditExpReconcile   = "exp.reconcile"
+	AuditExpRulesUpdate = "exp_rules.update"
+	AuditQuestCreate    = "quest_template.create"
+	AuditQuestUpdate    = "quest_template.update"
+	AuditCategoryCreate = "category.create"
+	AuditCategoryUpdate = "category.update"
+	AuditRegionCreate   = "region.create"
+	AuditRegionDelete   = "region.delete"
+	AuditRedemptionVoid = "redemption.void"
+)
+
+// AuditEntry records who did what to which object, and how it looked before and after
+type AuditEntry struct {
+	ID int `json:"id" db:"id"`
+	// ActorID is 0 for actions the system takes on its own
+	ActorID    int             `json:"actor_id,omitempty" db:"actor_id"`
+	Action     string          `json:"action" db:"action"`
+	TargetType string          `json:"target_type" db:"target_type"`
+	TargetID   int             `json:"target_id,omitempty" db:"target_id"`
+	Before     json.RawMessage `json:"before,omitempty" db:"before"`
+	After      json.RawMessage `json:"after,omitempty" db:"after"`
+	IP         string          `json:"ip,omitempty" db:"ip"`
+	UserAgent  string          `json:"user_agent,omitempty" db:"user_agent"`
+	CreatedAt  time.Time       `json:"created_at" db:"created_at"`
+}
+
+// AuditFilter narrows an audit log query. Zero fields do not filter.
+type AuditFilter struct {
+	ActorID    int
+	Action     string
+	TargetType string
+	TargetID   int
+	Since      *time.Time
+	Until      *time.Time
+	Limit      int
+	Offset     int
+}
+
+// AuditRepository handles the append-only audit log
+type AuditRepository struct {
+	db *sql.DB
+}
+
+// NewAuditRepository creates a new audit repository
+func NewAuditRepository(db *sql.DB) *AuditRepository {
+	return &AuditRepository{db: db}
+}
+
+// nullJSON stores an empty snapshot as NULL
+func nullJSON(v json.RawMessage) interface{} {
+	if len(v) == 0 || string(v) == "null" {
+		return nil
+	}
+	return string(v)
+}
+
+// Record appends an entry to the audit log
+func (r *AuditRepository) Record(e *AuditEntry) error {
+	query := `
+       INSERT INTO audit_log (actor_id, action, target_type, target_id, before, after, ip, user_agent)
+       VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+       RETURNING id, created_at`
+	return r.db.QueryRow(query, nullInt(e.ActorID), e.Action, e.TargetType, nullInt(e.TargetID),
+		nullJSON(e.Before), nullJSON(e.After), e.IP, e.UserAgent).Scan(&e.ID, &e.CreatedAt)
+}
+
+// Query returns the entries matching the filter, newest first. An action
+// ending in a dot matches every action with that prefix.
+func (r *AuditRepository) Query(f AuditFilter) ([]*AuditEntry, error) {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+	if f.ActorID != 0 {
+		conds = append(conds, "actor_id = ?")
+		args = append(args, f.ActorID)
+	}
+	if strings.HasSuffix(f.Action, ".") {
+		conds = append(conds, "substr(action, 1, ?) = ?")
+		args = append(args, len(f.Action), f.Action)
+	} else if f.Action != "" {
+		conds = append(conds, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.TargetType != "" {
+		conds = append(conds, "target_type = ?")
+		args = append(args, f.TargetType)
+	}
+	if f.TargetID != 0 {
+		conds = append(conds, "target_id = ?")
+		args = append(args, f.TargetID)
+	}
+	if f.Since != nil {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, f.Since.UTC().Format(sqliteTimeFormat))
+	}
+	if f.Until != nil {
+		conds = append(conds, "created_at <= ?")
+		args = append(args, f.Until.UTC().Format(sqliteTimeFormat))
+	}
+	query := `
+       SELECT id, COALESCE(actor_id, 0), action, target_type, COALESCE(target_id, 0),
+              COALESCE(before, ''), COALESCE(after, ''), ip, user_agent, created_at
+       FROM audit_log
+       WHERE ` + strings.Join(conds, " AND ") + `
+       ORDER BY id DESC
+       LIMIT ? OFFSET ?`
+	rows, err := r.db.Query(query, append(args, f.Limit, f.Offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		e := &AuditEntry{}
+		var before, after string
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.Action, &e.TargetType, &e.TargetID,
+			&before, &after, &e.IP, &e.UserAgent, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if before != "" {
+			e.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			e.After = json.RawMessage(after)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Prune deletes entries older than the retention period, which cannot be
+// shorter than MinAuditRetention. It returns how many entries were removed.
+func (r *AuditRepository) Prune(retention time.Duration) (int64, error) {
+	if retention < MinAuditRetention {
+		retention = MinAuditRetention
+	}
+	before := time.Now().UTC().Add(-retention).Format(sqliteTimeFormat)
+	res, err := r.db.Exec(`DELETE FROM audit_log WHERE created_at < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
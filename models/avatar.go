@@ -0,0 +1,84 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+// AvatarSizes are the square sizes in pixels avatars are stored and served at
+var AvatarSizes = []int{64, 128, 256, 512}
+
+// AvatarDir is where avatar images are stored, apart from post uploads so
+// they are not pruned with them
+const AvatarDir = "avatars"
+
+// ValidAvatarSize reports whether avatars are served at size
+func ValidAvatarSize(size int) bool {
+	for _, s := range AvatarSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// AvatarPath returns where the avatar with key is stored at size
+func AvatarPath(key string, size int) string {
+	return filepath.Join(AvatarDir, fmt.Sprintf("%s-%d.jpg", key, size))
+}
+
+// avatarPaths returns every stored size of the avatar with key
+func avatarPaths(key string) []string {
+	if key == "" {
+		return nil
+	}
+	paths := make([]string, 0, len(AvatarSizes))
+	for _, size := range AvatarSizes {
+		paths = append(paths, AvatarPath(key, size))
+	}
+	return paths
+}
+
+// AvatarURLs returns the URL of a user's picture at each size, keyed by size.
+// Users without an uploaded avatar get their identicon.
+func AvatarURLs(userID int, key string) map[string]string {
+	urls := make(map[string]string, len(AvatarSizes))
+	for _, size := range AvatarSizes {
+		if key != "" {
+			urls[strconv.Itoa(size)] = "/" + filepath.ToSlash(AvatarPath(key, size))
+		} else {
+			urls[strconv.Itoa(size)] = fmt.Sprintf("/users/%d/identicon.png?size=%d", userID, size)
+		}
+	}
+	return urls
+}
+
+// SetAvatar sets the key of the user's avatar files, empty for none, and
+// returns the paths of the files it replaced
+func (r *UserRepository) SetAvatar(userID int, key string) ([]string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	old, err := userAvatarPaths(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE users SET avatar_key = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, key, userID); err != nil {
+		return nil, err
+	}
+	return old, tx.Commit()
+}
+
+// userAvatarPaths returns the paths of the user's current avatar files
+func userAvatarPaths(tx *sql.Tx, userID int) ([]string, error) {
+	var key string
+	if err := tx.QueryRow(`SELECT avatar_key FROM users WHERE id = ?`, userID).Scan(&key); err != nil {
+		return nil, err
+	}
+	return avatarPaths(key), nil
+}
@@ -0,0 +1,162 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Severities in increasing order; posts store the 1-based rank, 0 when unset
+var Severities = []string{"low", "medium", "high", "critical"}
+
+// SeverityRank returns the stored rank of a severity name. The empty name is rank 0.
+func SeverityRank(name string) (int, bool) {
+	if name == "" {
+		return 0, true
+	}
+	for i, s := range Severities {
+		if s == name {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// severityName returns the name of a stored severity rank
+func severityName(rank int) string {
+	if rank < 1 || rank > len(Severities) {
+		return ""
+	}
+	return Severities[rank-1]
+}
+
+// HazardFlags are the hazards a report can be flagged with. Any flag makes
+// the report hazardous and triggers an alert.
+var HazardFlags = map[string]bool{
+	"sharp":     true,
+	"chemical":  true,
+	"biohazard": true,
+	"asbestos":  true,
+	"fire":      true,
+	"medical":   true,
+}
+
+// ErrUnknownCategory is returned for category keys that do not exist or are inactive
+var ErrUnknownCategory = errors.New("unknown category")
+
+var categoryKeyPattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// TrashCategory is an admin-managed kind of trash
+type TrashCategory struct {
+	ID        int       `json:"id" db:"id"`
+	Key       string    `json:"key" db:"key"`
+	Name      string    `json:"name" db:"name"`
+	Hazardous bool      `json:"hazardous" db:"hazardous"`
+	Active    bool      `json:"active" db:"active"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Validate checks a category before it is stored
+func (c *TrashCategory) Validate() error {
+	switch {
+	case !categoryKeyPattern.MatchString(c.Key):
+		return fmt.Errorf("key must be 1-32 lowercase letters, digits or underscores")
+	case c.Name == "":
+		return fmt.Errorf("name required")
+	}
+	return nil
+}
+
+// CategoryRepository handles trash category database operations
+type CategoryRepository struct {
+	db *sql.DB
+}
+
+// NewCategoryRepository creates a new category repository
+func NewCategoryRepository(db *sql.DB) *CategoryRepository {
+	return &CategoryRepository{db: db}
+}
+
+const categoryColumns = `id, key, name, hazardous, active, created_at`
+
+func scanCategory(row interface{ Scan(...interface{}) error }) (*TrashCategory, error) {
+	c := &TrashCategory{}
+	err := row.Scan(&c.ID, &c.Key, &c.Name, &c.Hazardous, &c.Active, &c.CreatedAt)
+	return c, err
+}
+
+// Create inserts a new category
+func (r *CategoryRepository) Create(c *TrashCategory) error {
+	query := `
+       INSERT INTO trash_categories (key, name, hazardous, active)
+       VALUES (?, ?, ?, ?)
+       RETURNING id, created_at`
+	return r.db.QueryRow(query, c.Key, c.Name, c.Hazardous, c.Active).Scan(&c.ID, &c.CreatedAt)
+}
+
+// Update changes a category. Its key is kept so existing filters keep working.
+func (r *CategoryRepository) Update(c *TrashCategory) error {
+	_, err := r.db.Exec(`UPDATE trash_categories SET name = ?, hazardous = ?, active = ? WHERE id = ?`, c.Name, c.Hazardous, c.Active, c.ID)
+	return err
+}
+
+// GetByID retrieves a category by id
+func (r *CategoryRepository) GetByID(id int) (*TrashCategory, error) {
+	c, err := scanCategory(r.db.QueryRow(`SELECT `+categoryColumns+` FROM trash_categories WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+// GetAll returns all categories, or only active ones
+func (r *CategoryRepository) GetAll(activeOnly bool) ([]*TrashCategory, error) {
+	query := `SELECT ` + categoryColumns + ` FROM trash_categories`
+	if activeOnly {
+		query += ` WHERE active = 1`
+	}
+	rows, err := r.db.Query(query + ` ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []*TrashCategory{}
+	for rows.Next() {
+		c, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// GetByKeys returns the active categories with the given keys, in the order
+// given. The first key that is unknown or inactive fails with ErrUnknownCategory.
+func (r *CategoryRepository) GetByKeys(keys []string) ([]*TrashCategory, error) {
+	all, err := r.GetAll(true)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]*TrashCategory, len(all))
+	for _, c := range all {
+		byKey[c.Key] = c
+	}
+
+	categories := make([]*TrashCategory, 0, len(keys))
+	seen := map[string]bool{}
+	for _, k := range keys {
+		c := byKey[k]
+		if c == nil {
+			return nil, fmt.Errorf("%w %q", ErrUnknownCategory, k)
+		}
+		if !seen[k] {
+			seen[k] = true
+			categories = append(categories, c)
+		}
+	}
+	return categories, nil
+}
@@ -7,12 +7,13 @@ import (
 
 // Comment represents a comment on a trash post
 type Comment struct {
-	ID        int       `json:"id" db:"id"`
-	PostID    int       `json:"post_id" db:"post_id"`
-	UserID    int       `json:"user_id" db:"user_id"`
-	User      *User     `json:"user,omitempty"`
-	Content   string    `json:"content" db:"content"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	ID        int         `json:"id" db:"id"`
+	PostID    int         `json:"post_id" db:"post_id"`
+	UserID    int         `json:"user_id" db:"user_id"`
+	User      *PublicUser `json:"user,omitempty"`
+	Content   string      `json:"content" db:"content"`
+	Hidden    bool        `json:"hidden,omitempty" db:"hidden"`
+	CreatedAt time.Time   `json:"created_at" db:"created_at"`
 }
 
 // CommentRepository handles comment database operations
@@ -34,16 +35,34 @@ func (r *CommentRepository) Create(c *Comment) error {
 	return r.db.QueryRow(query, c.PostID, c.UserID, c.Content).Scan(&c.ID, &c.CreatedAt)
 }
 
-// GetByPostID retrieves all comments for a given post
-func (r *CommentRepository) GetByPostID(postID int) ([]*Comment, error) {
+// GetByID retrieves a single comment without its author
+func (r *CommentRepository) GetByID(id int) (*Comment, error) {
+	c := &Comment{}
+	query := `SELECT id, post_id, user_id, content, hidden, created_at FROM comments WHERE id = ?`
+	err := r.db.QueryRow(query, id).Scan(&c.ID, &c.PostID, &c.UserID, &c.Content, &c.Hidden, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+// Delete removes a comment by id
+func (r *CommentRepository) Delete(id int) error {
+	_, err := r.db.Exec(`DELETE FROM comments WHERE id = ?`, id)
+	return err
+}
+
+// GetByPostID retrieves the comments on a post visible to the viewer, who is
+// 0 when anonymous. Shadow-banned users only see their own comments.
+func (r *CommentRepository) GetByPostID(postID, viewerID int) ([]*Comment, error) {
 	query := `
         SELECT c.id, c.post_id, c.user_id, c.content, c.created_at,
-               u.id, u.name, u.email, u.is_admin, u.exp, u.created_at, u.updated_at
+               ` + publicUserColumns + `
         FROM comments c
         JOIN users u ON c.user_id = u.id
-        WHERE c.post_id = ?
+        WHERE c.post_id = ? AND c.hidden = 0 AND c.user_id NOT ` + shadowBannedSQL + `
         ORDER BY c.created_at ASC`
-	rows, err := r.db.Query(query, postID)
+	rows, err := r.db.Query(query, postID, viewerID)
 	if err != nil {
 		return nil, err
 	}
@@ -52,9 +71,8 @@ func (r *CommentRepository) GetByPostID(postID int) ([]*Comment, error) {
 	var comments []*Comment
 	for rows.Next() {
 		c := &Comment{}
-		u := &User{}
-		if err := rows.Scan(&c.ID, &c.PostID, &c.UserID, &c.Content, &c.CreatedAt,
-			&u.ID, &u.Name, &u.Email, &u.IsAdmin, &u.Exp, &u.CreatedAt, &u.UpdatedAt); err != nil {
+		u := &PublicUser{}
+		if err := rows.Scan(append([]interface{}{&c.ID, &c.PostID, &c.UserID, &c.Content, &c.CreatedAt}, u.scanDest()...)...); err != nil {
 			return nil, err
 		}
 		c.User = u
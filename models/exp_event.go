@@ -0,0 +1,394 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"gobackend/events"
+)
+
+// EXP award reasons
+const (
+	ExpReasonTrashPost       = "trash_post_created"
+	ExpReasonComment         = "comment_created"
+	ExpReasonCommentReceived = "comment_received"
+	ExpReasonReversal        = "reversal"
+	ExpReasonLegacyBalance   = "legacy_balance"
+)
+
+// Entity types an EXP award can be attributed to
+const (
+	ExpSourceTrashPost = "trash_post"
+	ExpSourceComment   = "comment"
+)
+
+// ExpEvent is a single EXP award recorded in the append-only ledger.
+// users.exp is a cache of the sum of a user's events.
+type ExpEvent struct {
+	ID         int       `json:"id" db:"id"`
+	UserID     int       `json:"user_id" db:"user_id"`
+	Amount     int       `json:"amount" db:"amount"`
+	Reason     string    `json:"reason" db:"reason"`
+	SourceType string    `json:"source_type,omitempty" db:"source_type"`
+	SourceID   int       `json:"source_id,omitempty" db:"source_id"`
+	ActorID    int       `json:"actor_id,omitempty" db:"actor_id"`
+	ReversalOf int       `json:"reversal_of,omitempty" db:"reversal_of"`
+	PostID     int       `json:"post_id,omitempty" db:"post_id"`
+	Reversed   bool      `json:"reversed"`
+	Latitude   *float64  `json:"latitude,omitempty" db:"latitude"`
+	Longitude  *float64  `json:"longitude,omitempty" db:"longitude"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+
+	// levels before and after the award, set when it is recorded
+	levelFrom, levelTo int
+}
+
+// Awarded returns the amount of an award made by ExpEngine.Award, which is
+// nil when the action earned nothing
+func (e *ExpEvent) Awarded() int {
+	if e == nil {
+		return 0
+	}
+	return e.Amount
+}
+
+// At sets the location the EXP was earned at
+func (e *ExpEvent) At(lat, lon float64) *ExpEvent {
+	e.Latitude = &lat
+	e.Longitude = &lon
+	return e
+}
+
+// ExpCorrection describes a cached total that was rebuilt from the ledger:
+// a user's with only UserID set, a team's with only TeamID set, or what a
+// member earned in a team with both
+type ExpCorrection struct {
+	UserID int `json:"user_id,omitempty"`
+	TeamID int `json:"team_id,omitempty"`
+	Cached int `json:"cached"`
+	Ledger int `json:"ledger"`
+}
+
+// nullInt stores zero ids as NULL
+func nullInt(v int) interface{} {
+	if v == 0 {
+		return nil
+	}
+	return v
+}
+
+// addExpTx writes the ledger row and updates the cached totals of the user
+// and their teams. Awards are credited to the teams the user currently
+// belongs to; reversals debit exactly the teams the reversed award credited.
+func addExpTx(tx *sql.Tx, e *ExpEvent) error {
+	query := `
+       INSERT INTO exp_events (user_id, amount, reason, source_type, source_id, actor_id, reversal_of, post_id, latitude, longitude)
+       VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+       RETURNING id, created_at`
+	if err := tx.QueryRow(query, e.UserID, e.Amount, e.Reason, e.SourceType, nullInt(e.SourceID), nullInt(e.ActorID),
+		nullInt(e.ReversalOf), nullInt(e.PostID), e.Latitude, e.Longitude).Scan(&e.ID, &e.CreatedAt); err != nil {
+		return err
+	}
+	var total int
+	if err := tx.QueryRow(`UPDATE users SET exp = exp + ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? RETURNING exp`, e.Amount, e.UserID).Scan(&total); err != nil {
+		return err
+	}
+	curve := CurrentLevelCurve()
+	e.levelFrom, e.levelTo = curve.Level(total-e.Amount), curve.Level(total)
+
+	award := e.ID
+	credit := `INSERT INTO exp_event_teams (event_id, team_id) SELECT ?, team_id FROM team_members WHERE user_id = ?`
+	args := []interface{}{e.ID, e.UserID}
+	if e.ReversalOf != 0 {
+		award = e.ReversalOf
+		credit = `INSERT INTO exp_event_teams (event_id, team_id) SELECT ?, team_id FROM exp_event_teams WHERE event_id = ?`
+		args = []interface{}{e.ID, e.ReversalOf}
+	}
+	if _, err := tx.Exec(credit, args...); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE teams SET exp = exp + ? WHERE id IN (SELECT team_id FROM exp_event_teams WHERE event_id = ?)`, e.Amount, e.ID); err != nil {
+		return err
+	}
+	// a member who left and rejoined did not earn the award in their current membership
+	query = `
+       UPDATE team_members SET exp = exp + ?
+       WHERE user_id = ? AND team_id IN (SELECT team_id FROM exp_event_teams WHERE event_id = ?)
+         AND joined_at <= (SELECT created_at FROM exp_events WHERE id = ?)`
+	_, err := tx.Exec(query, e.Amount, e.UserID, e.ID, award)
+	return err
+}
+
+// publishLevelUp emits a LevelUp event if a committed award crossed a level threshold
+func publishLevelUp(e *ExpEvent) {
+	if e.levelTo <= e.levelFrom {
+		return
+	}
+	events.Publish(events.Event{
+		Type:   events.LevelUp,
+		UserID: e.UserID,
+		Data:   map[string]interface{}{"level": e.levelTo, "previous_level": e.levelFrom},
+	})
+}
+
+// AddExp records an EXP award in the ledger, increments the user's experience
+// points and credits the teams they currently belong to
+func (r *UserRepository) AddExp(e *ExpEvent) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := addExpTx(tx, e); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	publishLevelUp(e)
+	return nil
+}
+
+const expEventColumns = `e.id, e.user_id, e.amount, e.reason, e.source_type, COALESCE(e.source_id, 0), COALESCE(e.actor_id, 0),
+               COALESCE(e.reversal_of, 0), COALESCE(e.post_id, 0), EXISTS (SELECT 1 FROM exp_events r WHERE r.reversal_of = e.id),
+               e.latitude, e.longitude, e.created_at`
+
+func scanExpEvent(row interface{ Scan(...interface{}) error }) (*ExpEvent, error) {
+	e := &ExpEvent{}
+	err := row.Scan(&e.ID, &e.UserID, &e.Amount, &e.Reason, &e.SourceType, &e.SourceID, &e.ActorID,
+		&e.ReversalOf, &e.PostID, &e.Reversed, &e.Latitude, &e.Longitude, &e.CreatedAt)
+	return e, err
+}
+
+func queryExpEvents(q rowsQueryer, query string, args ...interface{}) ([]*ExpEvent, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*ExpEvent{}
+	for rows.Next() {
+		e, err := scanExpEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// GetExpEvent retrieves a single ledger entry
+func (r *UserRepository) GetExpEvent(id int) (*ExpEvent, error) {
+	e, err := scanExpEvent(r.db.QueryRow(`SELECT `+expEventColumns+` FROM exp_events e WHERE e.id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return e, err
+}
+
+// GetExpHistory returns a user's ledger entries, newest first
+func (r *UserRepository) GetExpHistory(userID, limit, offset int) ([]*ExpEvent, error) {
+	query := `SELECT ` + expEventColumns + `
+       FROM exp_events e
+       WHERE e.user_id = ?
+       ORDER BY e.id DESC
+       LIMIT ? OFFSET ?`
+	return queryExpEvents(r.db, query, userID, limit, offset)
+}
+
+// reverseTx appends a reversal for each event that has not been reversed yet
+func reverseTx(tx *sql.Tx, events []*ExpEvent, actorID int) ([]*ExpEvent, error) {
+	var reversals []*ExpEvent
+	for _, e := range events {
+		if e.Reversed || e.ReversalOf != 0 || e.Amount == 0 {
+			continue
+		}
+		rev := &ExpEvent{
+			UserID:     e.UserID,
+			Amount:     -e.Amount,
+			Reason:     ExpReasonReversal,
+			SourceType: e.SourceType,
+			SourceID:   e.SourceID,
+			ActorID:    actorID,
+			ReversalOf: e.ID,
+			PostID:     e.PostID,
+			Latitude:   e.Latitude,
+			Longitude:  e.Longitude,
+		}
+		if err := addExpTx(tx, rev); err != nil {
+			return nil, err
+		}
+		if err := clawbackPointsTx(tx, e.ID, rev.ID, actorID); err != nil {
+			return nil, err
+		}
+		reversals = append(reversals, rev)
+	}
+	return reversals, nil
+}
+
+// ReverseExpEvent appends a reversal for a single ledger entry. It returns nil
+// if the entry was already reversed or is itself a reversal.
+func (r *UserRepository) ReverseExpEvent(id, actorID int) (*ExpEvent, error) {
+	e, err := r.GetExpEvent(id)
+	if err != nil || e == nil {
+		return nil, err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	reversals, err := reverseTx(tx, []*ExpEvent{e}, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if len(reversals) == 0 {
+		return nil, nil
+	}
+	return reversals[0], nil
+}
+
+// ReverseExpAndDeletePost deletes a trash post and reverses every award
+// attributed to it or its comments, in one transaction
+func (r *UserRepository) ReverseExpAndDeletePost(postID, actorID int) ([]*ExpEvent, error) {
+	query := `SELECT ` + expEventColumns + `
+       FROM exp_events e
+       WHERE e.post_id = ?
+          OR (e.source_type = ? AND e.source_id = ?)
+          OR (e.source_type = ? AND e.source_id IN (SELECT id FROM comments WHERE post_id = ?))
+       ORDER BY e.id`
+	return r.reverseAndDelete(`DELETE FROM trash_posts WHERE id = ?`, postID, actorID,
+		query, postID, ExpSourceTrashPost, postID, ExpSourceComment, postID)
+}
+
+// ReverseExpAndDeleteComment deletes a comment and reverses every award
+// attributed to it, in one transaction
+func (r *UserRepository) ReverseExpAndDeleteComment(commentID, actorID int) ([]*ExpEvent, error) {
+	query := `SELECT ` + expEventColumns + `
+       FROM exp_events e
+       WHERE e.source_type = ? AND e.source_id = ?
+       ORDER BY e.id`
+	return r.reverseAndDelete(`DELETE FROM comments WHERE id = ?`, commentID, actorID,
+		query, ExpSourceComment, commentID)
+}
+
+// reverseAndDelete reverses the events query selects, then deletes the
+// content they were awarded for, so neither happens without the other
+func (r *UserRepository) reverseAndDelete(deleteQuery string, id, actorID int, query string, args ...interface{}) ([]*ExpEvent, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	events, err := queryExpEvents(tx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	reversals, err := reverseTx(tx, events, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(deleteQuery, id); err != nil {
+		return nil, err
+	}
+	return reversals, tx.Commit()
+}
+
+// expLedgerQueries compute each cached total from the ledger, returning the
+// user id, team id, cached and ledger totals of the ones that drifted. A
+// member's total counts the awards made since they joined the team.
+var expLedgerQueries = []struct {
+	query  string
+	update func(tx *sql.Tx, c *ExpCorrection) error
+}{
+	{
+		query: `
+       SELECT u.id, 0, u.exp, COALESCE(SUM(e.amount), 0)
+       FROM users u
+       LEFT JOIN exp_events e ON e.user_id = u.id
+       GROUP BY u.id
+       HAVING u.exp != COALESCE(SUM(e.amount), 0)`,
+		update: func(tx *sql.Tx, c *ExpCorrection) error {
+			_, err := tx.Exec(`UPDATE users SET exp = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, c.Ledger, c.UserID)
+			return err
+		},
+	},
+	{
+		query: `
+       SELECT 0, t.id, t.exp, COALESCE(SUM(e.amount), 0)
+       FROM teams t
+       LEFT JOIN exp_event_teams et ON et.team_id = t.id
+       LEFT JOIN exp_events e ON e.id = et.event_id
+       GROUP BY t.id
+       HAVING t.exp != COALESCE(SUM(e.amount), 0)`,
+		update: func(tx *sql.Tx, c *ExpCorrection) error {
+			_, err := tx.Exec(`UPDATE teams SET exp = ? WHERE id = ?`, c.Ledger, c.TeamID)
+			return err
+		},
+	},
+	{
+		query: `
+       SELECT * FROM (
+               SELECT m.user_id, m.team_id, m.exp, (
+                       SELECT COALESCE(SUM(e.amount), 0)
+                       FROM exp_event_teams et
+                       JOIN exp_events e ON e.id = et.event_id
+                       LEFT JOIN exp_events o ON o.id = e.reversal_of
+                       WHERE et.team_id = m.team_id AND e.user_id = m.user_id
+                         AND COALESCE(o.created_at, e.created_at) >= m.joined_at
+               ) AS ledger
+               FROM team_members m
+       ) WHERE exp != ledger`,
+		update: func(tx *sql.Tx, c *ExpCorrection) error {
+			_, err := tx.Exec(`UPDATE team_members SET exp = ? WHERE user_id = ? AND team_id = ?`, c.Ledger, c.UserID, c.TeamID)
+			return err
+		},
+	},
+}
+
+// ReconcileExp rebuilds every cached EXP total of users, teams and team
+// members from the ledger and returns the ones that had drifted
+func (r *UserRepository) ReconcileExp() ([]*ExpCorrection, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var corrections []*ExpCorrection
+	for _, q := range expLedgerQueries {
+		rows, err := tx.Query(q.query)
+		if err != nil {
+			return nil, err
+		}
+		var drifted []*ExpCorrection
+		for rows.Next() {
+			c := &ExpCorrection{}
+			if err := rows.Scan(&c.UserID, &c.TeamID, &c.Cached, &c.Ledger); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			drifted = append(drifted, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		for _, c := range drifted {
+			if err := q.update(tx, c); err != nil {
+				return nil, err
+			}
+		}
+		corrections = append(corrections, drifted...)
+	}
+	return corrections, tx.Commit()
+}
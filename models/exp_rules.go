@@ -0,0 +1,308 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ExpRule configures how much EXP an action earns and how it is limited
+type ExpRule struct {
+	// Points awarded for the action before any limits apply
+	Points int `json:"points"`
+	// DailyCap is the most EXP a user can earn from the action per UTC day; 0 means no cap
+	DailyCap int `json:"daily_cap,omitempty"`
+	// AllowSelf awards EXP when users act on their own content
+	AllowSelf bool `json:"allow_self,omitempty"`
+	// Diminishing reduces the award for repeating the action on the same post
+	Diminishing *DiminishingReturns `json:"diminishing,omitempty"`
+	// CooldownSeconds is the minimum time between two awards for the action
+	CooldownSeconds int `json:"cooldown_seconds,omitempty"`
+	// RewardPoints are credited to the points wallet along with a full award,
+	// scaled down when limits reduce the EXP
+	RewardPoints int `json:"reward_points,omitempty"`
+}
+
+// DiminishingReturns multiplies the award by Factor for every repeat on the
+// same post beyond the first After awards
+type DiminishingReturns struct {
+	After  int     `json:"after"`
+	Factor float64 `json:"factor"`
+}
+
+// ExpRules maps action names (the ledger reason) to their rule
+type ExpRules struct {
+	Actions map[string]*ExpRule `json:"actions"`
+}
+
+// DefaultExpRules returns the rules used when no configuration file exists
+func DefaultExpRules() *ExpRules {
+	return &ExpRules{Actions: map[string]*ExpRule{
+		ExpReasonTrashPost: {
+			Points:          50,
+			DailyCap:        500,
+			CooldownSeconds: 60,
+			RewardPoints:    10,
+		},
+		ExpReasonComment: {
+			Points:          10,
+			DailyCap:        100,
+			Diminishing:     &DiminishingReturns{After: 1, Factor: 0.5},
+			CooldownSeconds: 30,
+		},
+		ExpReasonCommentReceived: {
+			Points:      10,
+			DailyCap:    200,
+			Diminishing: &DiminishingReturns{After: 3, Factor: 0.5},
+		},
+		ExpReasonVerification: {
+			Points:          5,
+			DailyCap:        50,
+			Diminishing:     &DiminishingReturns{After: 1, Factor: 0},
+			CooldownSeconds: 60,
+		},
+	}}
+}
+
+// Validate checks the rules for values the engine cannot apply
+func (rs *ExpRules) Validate() error {
+	if rs == nil || rs.Actions == nil {
+		return fmt.Errorf("actions required")
+	}
+	for name, rule := range rs.Actions {
+		switch {
+		case rule == nil:
+			return fmt.Errorf("%s: rule required", name)
+		case rule.Points < 0:
+			return fmt.Errorf("%s: points must not be negative", name)
+		case rule.DailyCap < 0:
+			return fmt.Errorf("%s: daily_cap must not be negative", name)
+		case rule.CooldownSeconds < 0:
+			return fmt.Errorf("%s: cooldown_seconds must not be negative", name)
+		case rule.RewardPoints < 0:
+			return fmt.Errorf("%s: reward_points must not be negative", name)
+		case rule.Diminishing != nil && (rule.Diminishing.After < 0 || rule.Diminishing.Factor < 0 || rule.Diminishing.Factor > 1):
+			return fmt.Errorf("%s: diminishing needs after >= 0 and factor between 0 and 1", name)
+		}
+	}
+	return nil
+}
+
+// ExpAction describes something a user did that may earn EXP
+type ExpAction struct {
+	// Action is the rule name, recorded as the ledger reason
+	Action string
+	// UserID receives the EXP
+	UserID int
+	// OwnerID owns the content acted on; it equals UserID for self-interaction
+	OwnerID    int
+	ActorID    int
+	PostID     int
+	SourceType string
+	SourceID   int
+	Latitude   *float64
+	Longitude  *float64
+}
+
+// At sets the location the action happened at
+func (a ExpAction) At(lat, lon float64) ExpAction {
+	a.Latitude = &lat
+	a.Longitude = &lon
+	return a
+}
+
+// ExpEngine evaluates ExpRules against the ledger and records the awards.
+// Rules are read from a JSON file and reloaded when the file changes.
+type ExpEngine struct {
+	db    *sql.DB
+	path  string
+	mu    sync.RWMutex
+	rules *ExpRules
+	mod   time.Time
+}
+
+// NewExpEngine creates an engine reading rules from path. The default rules
+// are used until the file exists.
+func NewExpEngine(db *sql.DB, path string) (*ExpEngine, error) {
+	e := &ExpEngine{db: db, path: path, rules: DefaultExpRules()}
+	if err := e.reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Rules returns the rules currently in effect
+func (e *ExpEngine) Rules() *ExpRules {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.rules
+}
+
+// Update validates and saves new rules. Other processes pick them up on their next reload.
+func (e *ExpEngine) Update(rules *ExpRules) error {
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(e.path), 0755); err != nil {
+		return fmt.Errorf("create dir: %w", err)
+	}
+	tmp := e.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write rules: %w", err)
+	}
+	if err := os.Rename(tmp, e.path); err != nil {
+		return fmt.Errorf("replace rules: %w", err)
+	}
+	return e.reload()
+}
+
+// reload reads the rules file if it changed since the last read
+func (e *ExpEngine) reload() error {
+	info, err := os.Stat(e.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("stat rules: %w", err)
+	}
+
+	e.mu.RLock()
+	unchanged := info.ModTime().Equal(e.mod)
+	e.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		return fmt.Errorf("read rules: %w", err)
+	}
+	rules := &ExpRules{}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return fmt.Errorf("parse rules: %w", err)
+	}
+	if err := rules.Validate(); err != nil {
+		return fmt.Errorf("invalid rules: %w", err)
+	}
+
+	e.mu.Lock()
+	e.rules = rules
+	e.mod = info.ModTime()
+	e.mu.Unlock()
+	return nil
+}
+
+// Watch polls the rules file and reloads it when it changes. A broken file is
+// logged and the previous rules stay in effect.
+func (e *ExpEngine) Watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := e.reload(); err != nil {
+				log.Printf("exp rules: %v", err)
+			}
+		}
+	}()
+}
+
+// Award evaluates the action against the rules and records the resulting EXP.
+// It returns nil when the action earns nothing.
+func (e *ExpEngine) Award(a ExpAction) (*ExpEvent, error) {
+	rule := e.Rules().Actions[a.Action]
+	if rule == nil || rule.Points == 0 {
+		return nil, nil
+	}
+	if !rule.AllowSelf && a.OwnerID != 0 && a.OwnerID == a.UserID {
+		return nil, nil
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	amount, err := evaluateRule(tx, rule, a)
+	if err != nil || amount <= 0 {
+		return nil, err
+	}
+
+	ev := &ExpEvent{
+		UserID:     a.UserID,
+		Amount:     amount,
+		Reason:     a.Action,
+		SourceType: a.SourceType,
+		SourceID:   a.SourceID,
+		ActorID:    a.ActorID,
+		PostID:     a.PostID,
+		Latitude:   a.Latitude,
+		Longitude:  a.Longitude,
+	}
+	if err := addExpTx(tx, ev); err != nil {
+		return nil, err
+	}
+	if points := rule.RewardPoints * amount / rule.Points; points > 0 {
+		pt := &PointTransaction{UserID: a.UserID, Amount: points, Reason: a.Action, ExpEventID: ev.ID, ActorID: a.ActorID}
+		if err := addPointsTx(tx, pt); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	publishLevelUp(ev)
+	return ev, nil
+}
+
+// evaluateRule applies cooldown, diminishing returns and the daily cap
+func evaluateRule(tx *sql.Tx, rule *ExpRule, a ExpAction) (int, error) {
+	now := time.Now().UTC()
+
+	if rule.CooldownSeconds > 0 {
+		since := now.Add(-time.Duration(rule.CooldownSeconds) * time.Second).Format(sqliteTimeFormat)
+		var recent bool
+		query := `SELECT EXISTS (SELECT 1 FROM exp_events WHERE user_id = ? AND reason = ? AND amount > 0 AND created_at > ?)`
+		if err := tx.QueryRow(query, a.UserID, a.Action, since).Scan(&recent); err != nil {
+			return 0, err
+		}
+		if recent {
+			return 0, nil
+		}
+	}
+
+	amount := float64(rule.Points)
+	if rule.Diminishing != nil && a.PostID != 0 {
+		var repeats int
+		query := `SELECT COUNT(*) FROM exp_events WHERE user_id = ? AND reason = ? AND post_id = ? AND amount > 0`
+		if err := tx.QueryRow(query, a.UserID, a.Action, a.PostID).Scan(&repeats); err != nil {
+			return 0, err
+		}
+		if over := repeats - rule.Diminishing.After + 1; over > 0 {
+			amount *= math.Pow(rule.Diminishing.Factor, float64(over))
+		}
+	}
+
+	points := int(amount)
+	if rule.DailyCap > 0 && points > 0 {
+		dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Format(sqliteTimeFormat)
+		var earned int
+		query := `SELECT COALESCE(SUM(amount), 0) FROM exp_events WHERE user_id = ? AND reason = ? AND created_at >= ?`
+		if err := tx.QueryRow(query, a.UserID, a.Action, dayStart).Scan(&earned); err != nil {
+			return 0, err
+		}
+		if remaining := rule.DailyCap - earned; points > remaining {
+			points = remaining
+		}
+	}
+	return points, nil
+}
@@ -0,0 +1,188 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Identity errors
+var (
+	ErrIdentityLinked   = errors.New("this account at the provider is already linked to another user")
+	ErrProviderLinked   = errors.New("an account at this provider is already linked")
+	ErrIdentityNotFound = errors.New("identity not found")
+	// ErrLastSignInMethod keeps users from unlinking the only way they can sign in
+	ErrLastSignInMethod = errors.New("cannot unlink the last way to sign in; verify your email or add a passkey first")
+	ErrStateInvalid     = errors.New("invalid or expired authorization state")
+)
+
+// Identity links a user to an account at an external sign-in provider
+type Identity struct {
+	ID       int    `json:"id" db:"id"`
+	UserID   int    `json:"user_id" db:"user_id"`
+	Provider string `json:"provider" db:"provider"`
+	// Subject is the provider's stable id for the account
+	Subject string `json:"-" db:"subject"`
+	// Email is what the provider last reported, for display only
+	Email       string     `json:"email,omitempty" db:"email"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty" db:"last_login_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// identityColumns lists the user_identities columns read by scanIdentity
+const identityColumns = `id, user_id, provider, subject, email, last_login_at, created_at`
+
+func scanIdentity(row interface{ Scan(...interface{}) error }) (*Identity, error) {
+	i := &Identity{}
+	err := row.Scan(&i.ID, &i.UserID, &i.Provider, &i.Subject, &i.Email, &i.LastLoginAt, &i.CreatedAt)
+	return i, err
+}
+
+// OAuthState is an outstanding authorization request
+type OAuthState struct {
+	Provider string
+	// Verifier is the PKCE code verifier
+	Verifier string
+	Nonce    string
+	// UserID is set when linking an identity to a signed-in user
+	UserID int
+}
+
+// IdentityRepository handles provider identities and authorization states
+type IdentityRepository struct {
+	db *sql.DB
+}
+
+// NewIdentityRepository creates a new identity repository
+func NewIdentityRepository(db *sql.DB) *IdentityRepository {
+	return &IdentityRepository{db: db}
+}
+
+// CreateState stores an authorization request under the hash of its state
+func (r *IdentityRepository) CreateState(state string, s *OAuthState, ttl time.Duration) error {
+	now := time.Now().UTC()
+	if _, err := r.db.Exec(`DELETE FROM oauth_states WHERE expires_at <= ?`, now.Format(sqliteTimeFormat)); err != nil {
+		return err
+	}
+	_, err := r.db.Exec(`INSERT INTO oauth_states (state_hash, provider, verifier, nonce, user_id, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		HashToken(state), s.Provider, s.Verifier, s.Nonce, nullInt(s.UserID), now.Add(ttl).Format(sqliteTimeFormat))
+	return err
+}
+
+// ConsumeState removes an unexpired authorization request for the provider and returns it
+func (r *IdentityRepository) ConsumeState(state, provider string) (*OAuthState, error) {
+	s := &OAuthState{Provider: provider}
+	query := `
+       DELETE FROM oauth_states
+       WHERE state_hash = ? AND provider = ? AND expires_at > ?
+       RETURNING verifier, nonce, COALESCE(user_id, 0)`
+	err := r.db.QueryRow(query, HashToken(state), provider, time.Now().UTC().Format(sqliteTimeFormat)).Scan(
+		&s.Verifier, &s.Nonce, &s.UserID)
+	if err == sql.ErrNoRows {
+		return nil, ErrStateInvalid
+	}
+	return s, err
+}
+
+// Get retrieves the identity for a provider subject
+func (r *IdentityRepository) Get(provider, subject string) (*Identity, error) {
+	i, err := scanIdentity(r.db.QueryRow(`SELECT `+identityColumns+` FROM user_identities WHERE provider = ? AND subject = ?`, provider, subject))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return i, err
+}
+
+// GetByUser retrieves a user's identities
+func (r *IdentityRepository) GetByUser(userID int) ([]*Identity, error) {
+	rows, err := r.db.Query(`SELECT `+identityColumns+` FROM user_identities WHERE user_id = ? ORDER BY provider`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+	for rows.Next() {
+		i, err := scanIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, i)
+	}
+	return identities, rows.Err()
+}
+
+// Link attaches a provider identity to a user. A user has at most one
+// identity per provider, and an identity belongs to one user.
+func (r *IdentityRepository) Link(i *Identity) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var owner int
+	err = tx.QueryRow(`SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?`, i.Provider, i.Subject).Scan(&owner)
+	if err == nil {
+		if owner != i.UserID {
+			return ErrIdentityLinked
+		}
+		return ErrProviderLinked
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM user_identities WHERE user_id = ? AND provider = ?)`, i.UserID, i.Provider).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrProviderLinked
+	}
+
+	query := `
+       INSERT INTO user_identities (user_id, provider, subject, email)
+       VALUES (?, ?, ?, ?)
+       RETURNING id, created_at`
+	if err := tx.QueryRow(query, i.UserID, i.Provider, i.Subject, i.Email).Scan(&i.ID, &i.CreatedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordLogin notes a sign-in through the identity and the email the provider reported
+func (r *IdentityRepository) RecordLogin(id int, email string) error {
+	_, err := r.db.Exec(`UPDATE user_identities SET email = ?, last_login_at = CURRENT_TIMESTAMP WHERE id = ?`, email, id)
+	return err
+}
+
+// Unlink detaches the user's identity at a provider. It fails with
+// ErrLastSignInMethod unless the user can still sign in through another
+// identity, a passkey, or their verified email.
+func (r *IdentityRepository) Unlink(userID int, provider string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+       SELECT (SELECT COUNT(*) FROM user_identities WHERE user_id = ? AND provider <> ?)
+            + (SELECT COUNT(*) FROM passkeys WHERE user_id = ?)
+            + (SELECT COUNT(*) FROM users WHERE id = ? AND email_verified_at IS NOT NULL)`
+	var others int
+	if err := tx.QueryRow(query, userID, provider, userID, userID).Scan(&others); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM user_identities WHERE user_id = ? AND provider = ?`, userID, provider)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrIdentityNotFound
+	}
+	if others == 0 {
+		return ErrLastSignInMethod
+	}
+	return tx.Commit()
+}
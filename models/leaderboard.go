@@ -0,0 +1,179 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Leaderboard periods
+const (
+	PeriodAllTime = "all"
+	PeriodWeek    = "week"
+	PeriodMonth   = "month"
+	PeriodSeason  = "season"
+)
+
+// Ranking modes. Standard ranking leaves gaps after ties (1, 1, 3), dense does not (1, 1, 2).
+const (
+	RankingStandard = "standard"
+	RankingDense    = "dense"
+)
+
+// sqliteTimeFormat matches the format CURRENT_TIMESTAMP writes
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// LeaderboardQuery scopes a leaderboard to a time window and/or area
+type LeaderboardQuery struct {
+	Start   *time.Time
+	End     *time.Time
+	Box     *BoundingBox
+	Ranking string
+	// Viewer is who the board is shown to; shadow-banned users only see
+	// themselves on it
+	Viewer int
+}
+
+// LeaderboardEntry is a user's position on a leaderboard. Exp is the EXP earned
+// within the query's scope, which may differ from the user's total.
+type LeaderboardEntry struct {
+	Rank int         `json:"rank"`
+	Exp  int         `json:"exp"`
+	User *PublicUser `json:"user"`
+}
+
+// PeriodRange returns the UTC window [start, end) of the period containing now.
+// Weeks start on Monday; seasons are meteorological (Mar-May, Jun-Aug, Sep-Nov, Dec-Feb).
+func PeriodRange(period string, now time.Time) (time.Time, time.Time, error) {
+	now = now.UTC()
+	y, m, d := now.Date()
+	switch period {
+	case PeriodWeek:
+		offset := (int(now.Weekday()) + 6) % 7
+		start := time.Date(y, m, d-offset, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 7), nil
+	case PeriodMonth:
+		start := time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0), nil
+	case PeriodSeason:
+		sm := int(m) - int(m)%3
+		if sm == 0 {
+			sm = 12
+			y--
+		}
+		start := time.Date(y, time.Month(sm), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 3, 0), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("unknown period %q", period)
+}
+
+// unrankedSQL is true for users left off leaderboards: those who chose to
+// hide, deleted accounts, which keep their ledger, and shadow-banned users
+// other than the viewer, who is bound as its parameter
+const unrankedSQL = `IN (SELECT id FROM users WHERE hide_from_leaderboard = 1 OR status = 'deleted' OR (status = 'shadow_banned' AND id != ?))`
+
+// rankedSQL builds a CTE named "ranked" with columns user_id, exp, rnk and pos
+func (q *LeaderboardQuery) rankedSQL() (string, []interface{}) {
+	var totals string
+	args := []interface{}{q.Viewer}
+	if q.Start == nil && q.End == nil && q.Box == nil {
+		totals = `SELECT id AS user_id, exp FROM users WHERE id NOT ` + unrankedSQL
+	} else {
+		where := []string{"user_id NOT " + unrankedSQL}
+		if q.Start != nil {
+			where = append(where, "created_at >= ?")
+			args = append(args, q.Start.UTC().Format(sqliteTimeFormat))
+		}
+		if q.End != nil {
+			where = append(where, "created_at < ?")
+			args = append(args, q.End.UTC().Format(sqliteTimeFormat))
+		}
+		if q.Box != nil {
+			where = append(where, "latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ?")
+			args = append(args, q.Box.MinLatitude, q.Box.MaxLatitude, q.Box.MinLongitude, q.Box.MaxLongitude)
+		}
+		totals = `SELECT user_id, SUM(amount) AS exp FROM exp_events WHERE ` + strings.Join(where, " AND ") + ` GROUP BY user_id`
+	}
+
+	rankFn := "RANK()"
+	if q.Ranking == RankingDense {
+		rankFn = "DENSE_RANK()"
+	}
+
+	cte := `
+       WITH totals AS (` + totals + `),
+       ranked AS (
+               SELECT user_id, exp,
+                      ` + rankFn + ` OVER (ORDER BY exp DESC) AS rnk,
+                      ROW_NUMBER() OVER (ORDER BY exp DESC, user_id ASC) AS pos
+               FROM totals
+       )`
+	return cte, args
+}
+
+func (r *UserRepository) queryLeaderboard(query string, args ...interface{}) ([]*LeaderboardEntry, []int, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var entries []*LeaderboardEntry
+	var positions []int
+	for rows.Next() {
+		e := &LeaderboardEntry{}
+		u := &PublicUser{}
+		var pos int
+		if err := rows.Scan(append([]interface{}{&e.Rank, &e.Exp, &pos}, u.scanDest()...)...); err != nil {
+			return nil, nil, err
+		}
+		e.User = u
+		entries = append(entries, e)
+		positions = append(positions, pos)
+	}
+	return entries, positions, rows.Err()
+}
+
+// GetLeaderboard returns the top users for the query limited by count
+func (r *UserRepository) GetLeaderboard(q LeaderboardQuery, limit int) ([]*LeaderboardEntry, error) {
+	cte, args := q.rankedSQL()
+	query := cte + `
+       SELECT r.rnk, r.exp, r.pos, ` + publicUserColumns + `
+       FROM ranked r
+       JOIN users u ON u.id = r.user_id
+       WHERE r.pos <= ?
+       ORDER BY r.pos`
+	entries, _, err := r.queryLeaderboard(query, append(args, limit)...)
+	return entries, err
+}
+
+// GetLeaderboardPosition returns the user's own entry plus up to n entries directly
+// above and below them. self is nil if the user has no EXP in the query's scope.
+func (r *UserRepository) GetLeaderboardPosition(q LeaderboardQuery, userID, n int) (self *LeaderboardEntry, above, below []*LeaderboardEntry, err error) {
+	cte, args := q.rankedSQL()
+	query := cte + `,
+       me AS (SELECT pos FROM ranked WHERE user_id = ?)
+       SELECT r.rnk, r.exp, r.pos - me.pos, ` + publicUserColumns + `
+       FROM ranked r
+       JOIN me ON r.pos BETWEEN me.pos - ? AND me.pos + ?
+       JOIN users u ON u.id = r.user_id
+       ORDER BY r.pos`
+	entries, offsets, err := r.queryLeaderboard(query, append(args, userID, n, n)...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	above = []*LeaderboardEntry{}
+	below = []*LeaderboardEntry{}
+	for i, e := range entries {
+		switch {
+		case offsets[i] < 0:
+			above = append(above, e)
+		case offsets[i] > 0:
+			below = append(below, e)
+		default:
+			self = e
+		}
+	}
+	return self, above, below, nil
+}
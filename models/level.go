@@ -0,0 +1,148 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// LevelCurve maps total EXP to levels. Users start at level 1 with 0 EXP.
+// Either Table or the Base/Exponent formula is used, the table taking precedence.
+type LevelCurve struct {
+	// Table lists the total EXP needed to reach level 2, 3, and so on
+	Table []int `json:"table,omitempty"`
+	// Base and Exponent define the EXP needed to go from level n to n+1 as Base * n^Exponent
+	Base     float64 `json:"base,omitempty"`
+	Exponent float64 `json:"exponent,omitempty"`
+	// MaxLevel caps the formula; the table's length caps a table curve
+	MaxLevel int `json:"max_level,omitempty"`
+
+	// thresholds[i] is the total EXP needed to reach level i+2
+	thresholds []int
+}
+
+// LevelProgress describes where a user stands on the level curve
+type LevelProgress struct {
+	Level          int `json:"level"`
+	ExpIntoLevel   int `json:"exp_into_level"`
+	ExpToNextLevel int `json:"exp_to_next_level"`
+}
+
+// DefaultLevelCurve returns the curve used when no file is configured
+func DefaultLevelCurve() *LevelCurve {
+	c := &LevelCurve{Base: 100, Exponent: 1.5, MaxLevel: 100}
+	c.compile()
+	return c
+}
+
+// Validate checks the curve for values that cannot be applied
+func (c *LevelCurve) Validate() error {
+	if len(c.Table) > 0 {
+		prev := 0
+		for i, t := range c.Table {
+			if t <= prev {
+				return fmt.Errorf("table: level %d must need more EXP than level %d", i+2, i+1)
+			}
+			prev = t
+		}
+		return nil
+	}
+	switch {
+	case c.Base <= 0:
+		return fmt.Errorf("base must be positive")
+	case c.Exponent < 0:
+		return fmt.Errorf("exponent must not be negative")
+	case c.MaxLevel < 2:
+		return fmt.Errorf("max_level must be at least 2")
+	}
+	return nil
+}
+
+// compile turns the configuration into level thresholds
+func (c *LevelCurve) compile() {
+	if len(c.Table) > 0 {
+		c.thresholds = append([]int(nil), c.Table...)
+		return
+	}
+	c.thresholds = make([]int, 0, c.MaxLevel-1)
+	total := 0
+	for n := 1; n < c.MaxLevel; n++ {
+		step := int(math.Round(c.Base * math.Pow(float64(n), c.Exponent)))
+		if step < 1 {
+			step = 1
+		}
+		total += step
+		c.thresholds = append(c.thresholds, total)
+	}
+}
+
+// Level returns the level reached with the given total EXP
+func (c *LevelCurve) Level(exp int) int {
+	// number of thresholds at or below exp
+	return sort.Search(len(c.thresholds), func(i int) bool { return c.thresholds[i] > exp }) + 1
+}
+
+// Progress returns the level reached with the given total EXP and how far
+// the user is into it. At the maximum level ExpToNextLevel is 0.
+func (c *LevelCurve) Progress(exp int) LevelProgress {
+	if exp < 0 {
+		exp = 0
+	}
+	level := c.Level(exp)
+	start := 0
+	if level > 1 {
+		start = c.thresholds[level-2]
+	}
+	p := LevelProgress{Level: level, ExpIntoLevel: exp - start}
+	if level-1 < len(c.thresholds) {
+		p.ExpToNextLevel = c.thresholds[level-1] - exp
+	}
+	return p
+}
+
+// LoadLevelCurve reads a curve from a JSON file, falling back to the default
+// when path is empty or the file does not exist
+func LoadLevelCurve(path string) (*LevelCurve, error) {
+	if path == "" {
+		return DefaultLevelCurve(), nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return DefaultLevelCurve(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &LevelCurve{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("parse level curve: %w", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid level curve: %w", err)
+	}
+	c.compile()
+	return c, nil
+}
+
+var (
+	levelMu    sync.RWMutex
+	levelCurve = DefaultLevelCurve()
+)
+
+// SetLevelCurve replaces the curve used for all level calculations
+func SetLevelCurve(c *LevelCurve) {
+	levelMu.Lock()
+	defer levelMu.Unlock()
+	levelCurve = c
+}
+
+// CurrentLevelCurve returns the curve used for all level calculations
+func CurrentLevelCurve() *LevelCurve {
+	levelMu.RLock()
+	defer levelMu.RUnlock()
+	return levelCurve
+}
@@ -0,0 +1,615 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Report targets
+const (
+	ReportTargetPost    = "post"
+	ReportTargetComment = "comment"
+	ReportTargetUser    = "user"
+)
+
+// Report statuses. Reports stay open until a moderator acts on their target.
+const (
+	ReportOpen      = "open"
+	ReportDismissed = "dismissed"
+	ReportResolved  = "resolved"
+)
+
+// ReportReasons are the reasons a report can give
+var ReportReasons = map[string]bool{
+	"spam":          true,
+	"abuse":         true,
+	"inappropriate": true,
+	"misleading":    true,
+	"privacy":       true,
+	"other":         true,
+}
+
+// Moderation actions. ModAutoHide is taken by the system, never by a moderator.
+// The account actions ban, shadow-ban and reinstate are taken by admins.
+const (
+	ModDismiss   = "dismiss"
+	ModHide      = "hide"
+	ModDelete    = "delete"
+	ModWarn      = "warn"
+	ModSuspend   = "suspend"
+	ModAutoHide  = "auto_hide"
+	ModBan       = "ban"
+	ModShadowBan = "shadow_ban"
+	ModReinstate = "reinstate"
+)
+
+// ModerationActions are the actions a moderator can take on a target
+var ModerationActions = map[string]bool{
+	ModDismiss: true,
+	ModHide:    true,
+	ModDelete:  true,
+	ModWarn:    true,
+	ModSuspend: true,
+}
+
+// Appeal statuses
+const (
+	AppealOpen     = "open"
+	AppealAccepted = "accepted"
+	AppealRejected = "rejected"
+)
+
+// Moderation errors
+var (
+	ErrTargetNotFound   = errors.New("reported content not found")
+	ErrAlreadyReported  = errors.New("you already reported this")
+	ErrAppealOpen       = errors.New("you already have an open appeal")
+	ErrAppealNotFound   = errors.New("appeal not found")
+	ErrAppealNotPending = errors.New("appeal was already resolved")
+)
+
+// ValidReportTarget reports whether t is something that can be reported
+func ValidReportTarget(t string) bool {
+	return t == ReportTargetPost || t == ReportTargetComment || t == ReportTargetUser
+}
+
+// Report is a user's flag on a post, comment or user
+type Report struct {
+	ID         int        `json:"id" db:"id"`
+	ReporterID int        `json:"reporter_id" db:"reporter_id"`
+	TargetType string     `json:"target_type" db:"target_type"`
+	TargetID   int        `json:"target_id" db:"target_id"`
+	Reason     string     `json:"reason" db:"reason"`
+	Details    string     `json:"details,omitempty" db:"details"`
+	Status     string     `json:"status" db:"status"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty" db:"resolved_at"`
+	ResolvedBy *int       `json:"resolved_by,omitempty" db:"resolved_by"`
+}
+
+// Validate checks a report before it is stored
+func (rep *Report) Validate() error {
+	switch {
+	case !ValidReportTarget(rep.TargetType):
+		return fmt.Errorf("target_type must be post, comment or user")
+	case rep.TargetID <= 0:
+		return fmt.Errorf("target_id required")
+	case !ReportReasons[rep.Reason]:
+		return fmt.Errorf("unknown reason %q", rep.Reason)
+	case len(rep.Details) > 1000:
+		return fmt.Errorf("details must be at most 1000 characters")
+	}
+	return nil
+}
+
+// ModerationAction is an entry in the moderation history
+type ModerationAction struct {
+	ID int `json:"id" db:"id"`
+	// ModeratorID is 0 for automatic actions
+	ModeratorID     int       `json:"moderator_id,omitempty" db:"moderator_id"`
+	TargetType      string    `json:"target_type" db:"target_type"`
+	TargetID        int       `json:"target_id" db:"target_id"`
+	SubjectUserID   int       `json:"subject_user_id,omitempty" db:"subject_user_id"`
+	Action          string    `json:"action" db:"action"`
+	Reason          string    `json:"reason,omitempty" db:"reason"`
+	ReportsResolved int       `json:"reports_resolved" db:"reports_resolved"`
+	CreatedAt       time.Time `json:"created_at" db:"created_at"`
+}
+
+// Appeal is a suspended user's request to have the suspension lifted
+type Appeal struct {
+	ID     int `json:"id" db:"id"`
+	UserID int `json:"user_id" db:"user_id"`
+	// ModerationActionID is the suspension being appealed, if it was recorded
+	ModerationActionID int        `json:"moderation_action_id,omitempty" db:"moderation_action_id"`
+	Message            string     `json:"message" db:"message"`
+	Status             string     `json:"status" db:"status"`
+	Response           string     `json:"response,omitempty" db:"response"`
+	CreatedAt          time.Time  `json:"created_at" db:"created_at"`
+	ResolvedAt         *time.Time `json:"resolved_at,omitempty" db:"resolved_at"`
+	ResolvedBy         *int       `json:"resolved_by,omitempty" db:"resolved_by"`
+}
+
+// QueueItem is a reported target waiting for a moderator
+type QueueItem struct {
+	TargetType    string         `json:"target_type"`
+	TargetID      int            `json:"target_id"`
+	SubjectUserID int            `json:"subject_user_id,omitempty"`
+	Hidden        bool           `json:"hidden"`
+	Reporters     int            `json:"reporters"`
+	Reasons       map[string]int `json:"reasons"`
+	FirstReported time.Time      `json:"first_reported_at"`
+	LastReported  time.Time      `json:"last_reported_at"`
+}
+
+// ModerationHistoryFilter narrows the moderation history. Zero fields do not filter.
+type ModerationHistoryFilter struct {
+	TargetType    string
+	TargetID      int
+	SubjectUserID int
+	ModeratorID   int
+	Action        string
+	Limit, Offset int
+}
+
+// ModerationRepository handles reports and moderation actions
+type ModerationRepository struct {
+	db *sql.DB
+}
+
+// NewModerationRepository creates a new moderation repository
+func NewModerationRepository(db *sql.DB) *ModerationRepository {
+	return &ModerationRepository{db: db}
+}
+
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// rowsQueryer is a database or transaction running multi-row queries
+type rowsQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// targetTable returns the table holding hideable content of a target type
+func targetTable(targetType string) string {
+	switch targetType {
+	case ReportTargetPost:
+		return "trash_posts"
+	case ReportTargetComment:
+		return "comments"
+	}
+	return ""
+}
+
+// targetState returns who is responsible for a target and whether it is
+// hidden. It returns ErrTargetNotFound if the target does not exist.
+func targetState(q queryer, targetType string, targetID int) (ownerID int, hidden bool, err error) {
+	if targetType == ReportTargetUser {
+		err = q.QueryRow(`SELECT id FROM users WHERE id = ?`, targetID).Scan(&ownerID)
+	} else {
+		err = q.QueryRow(`SELECT user_id, hidden FROM `+targetTable(targetType)+` WHERE id = ?`, targetID).Scan(&ownerID, &hidden)
+	}
+	if err == sql.ErrNoRows {
+		return 0, false, ErrTargetNotFound
+	}
+	return ownerID, hidden, err
+}
+
+// TargetOwner returns the user responsible for a target
+func (r *ModerationRepository) TargetOwner(targetType string, targetID int) (int, error) {
+	ownerID, _, err := targetState(r.db, targetType, targetID)
+	return ownerID, err
+}
+
+// CreateReport stores a report. Once autoHideFlags different users have open
+// reports on a post or comment, it is hidden until a moderator looks at it
+// and hidden is true.
+func (r *ModerationRepository) CreateReport(rep *Report, autoHideFlags int) (hidden bool, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	ownerID, wasHidden, err := targetState(tx, rep.TargetType, rep.TargetID)
+	if err != nil {
+		return false, err
+	}
+
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM reports WHERE reporter_id = ? AND target_type = ? AND target_id = ? AND status = ?)`
+	if err := tx.QueryRow(query, rep.ReporterID, rep.TargetType, rep.TargetID, ReportOpen).Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists {
+		return false, ErrAlreadyReported
+	}
+
+	query = `
+       INSERT INTO reports (reporter_id, target_type, target_id, reason, details)
+       VALUES (?, ?, ?, ?, ?)
+       RETURNING id, status, created_at`
+	if err := tx.QueryRow(query, rep.ReporterID, rep.TargetType, rep.TargetID, rep.Reason, rep.Details).Scan(
+		&rep.ID, &rep.Status, &rep.CreatedAt); err != nil {
+		return false, err
+	}
+
+	if table := targetTable(rep.TargetType); table != "" && !wasHidden && autoHideFlags > 0 {
+		var reporters int
+		// reports from shadow-banned users are kept but do not hide anything
+		query := `
+               SELECT COUNT(DISTINCT reporter_id) FROM reports
+               WHERE target_type = ? AND target_id = ? AND status = ?
+                 AND reporter_id NOT IN (SELECT id FROM users WHERE status = 'shadow_banned')`
+		if err := tx.QueryRow(query, rep.TargetType, rep.TargetID, ReportOpen).Scan(&reporters); err != nil {
+			return false, err
+		}
+		if reporters >= autoHideFlags {
+			if _, err := tx.Exec(`UPDATE `+table+` SET hidden = 1 WHERE id = ?`, rep.TargetID); err != nil {
+				return false, err
+			}
+			a := &ModerationAction{
+				TargetType:    rep.TargetType,
+				TargetID:      rep.TargetID,
+				SubjectUserID: ownerID,
+				Action:        ModAutoHide,
+				Reason:        fmt.Sprintf("%d reports", reporters),
+			}
+			if err := insertActionTx(tx, a); err != nil {
+				return false, err
+			}
+			hidden = true
+		}
+	}
+	return hidden, tx.Commit()
+}
+
+func insertActionTx(tx *sql.Tx, a *ModerationAction) error {
+	query := `
+       INSERT INTO moderation_actions (moderator_id, target_type, target_id, subject_user_id, action, reason, reports_resolved)
+       VALUES (?, ?, ?, ?, ?, ?, ?)
+       RETURNING id, created_at`
+	return tx.QueryRow(query, nullInt(a.ModeratorID), a.TargetType, a.TargetID, nullInt(a.SubjectUserID),
+		a.Action, a.Reason, a.ReportsResolved).Scan(&a.ID, &a.CreatedAt)
+}
+
+// Act records a moderator's action on a target and closes its open reports.
+// Dismissing also restores content that was hidden, hiding hides it and
+// suspending suspends the subject until suspendUntil. Deleting content and
+// its EXP is left to the caller, which must do it before calling Act.
+func (r *ModerationRepository) Act(a *ModerationAction, suspendUntil *time.Time) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	table := targetTable(a.TargetType)
+	switch a.Action {
+	case ModDismiss, ModHide:
+		if table != "" {
+			if _, err := tx.Exec(`UPDATE `+table+` SET hidden = ? WHERE id = ?`, a.Action == ModHide, a.TargetID); err != nil {
+				return err
+			}
+		}
+	case ModSuspend:
+		if suspendUntil == nil {
+			return fmt.Errorf("suspension end required")
+		}
+		if _, err := tx.Exec(`UPDATE users SET suspended_until = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			suspendUntil.UTC().Format(sqliteTimeFormat), a.SubjectUserID); err != nil {
+			return err
+		}
+	}
+
+	status := ReportResolved
+	if a.Action == ModDismiss {
+		status = ReportDismissed
+	}
+	res, err := tx.Exec(`
+       UPDATE reports SET status = ?, resolved_at = CURRENT_TIMESTAMP, resolved_by = ?
+       WHERE target_type = ? AND target_id = ? AND status = ?`,
+		status, a.ModeratorID, a.TargetType, a.TargetID, ReportOpen)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	a.ReportsResolved = int(n)
+
+	if err := insertActionTx(tx, a); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Queue returns targets with open reports, most reported first
+func (r *ModerationRepository) Queue(limit, offset int) ([]*QueueItem, error) {
+	query := `
+       SELECT target_type, target_id, COUNT(DISTINCT reporter_id), MIN(created_at), MAX(created_at)
+       FROM reports WHERE status = ?
+       GROUP BY target_type, target_id
+       ORDER BY COUNT(DISTINCT reporter_id) DESC, MIN(created_at) ASC
+       LIMIT ? OFFSET ?`
+	rows, err := r.db.Query(query, ReportOpen, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	items := []*QueueItem{}
+	for rows.Next() {
+		it := &QueueItem{Reasons: map[string]int{}}
+		var first, last string
+		if err := rows.Scan(&it.TargetType, &it.TargetID, &it.Reporters, &first, &last); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		// aggregates lose the column type, so times come back as text
+		it.FirstReported, _ = time.Parse(sqliteTimeFormat, first)
+		it.LastReported, _ = time.Parse(sqliteTimeFormat, last)
+		items = append(items, it)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, it := range items {
+		ownerID, hidden, err := targetState(r.db, it.TargetType, it.TargetID)
+		if err != nil && !errors.Is(err, ErrTargetNotFound) {
+			return nil, err
+		}
+		it.SubjectUserID, it.Hidden = ownerID, hidden
+
+		rows, err := r.db.Query(`SELECT reason, COUNT(*) FROM reports WHERE target_type = ? AND target_id = ? AND status = ? GROUP BY reason`,
+			it.TargetType, it.TargetID, ReportOpen)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var reason string
+			var n int
+			if err := rows.Scan(&reason, &n); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			it.Reasons[reason] = n
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// GetReports returns every report on a target, newest first
+func (r *ModerationRepository) GetReports(targetType string, targetID int) ([]*Report, error) {
+	query := `
+       SELECT id, reporter_id, target_type, target_id, reason, details, status, created_at, resolved_at, resolved_by
+       FROM reports WHERE target_type = ? AND target_id = ? ORDER BY id DESC`
+	rows, err := r.db.Query(query, targetType, targetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []*Report{}
+	for rows.Next() {
+		rep := &Report{}
+		if err := rows.Scan(&rep.ID, &rep.ReporterID, &rep.TargetType, &rep.TargetID, &rep.Reason, &rep.Details,
+			&rep.Status, &rep.CreatedAt, &rep.ResolvedAt, &rep.ResolvedBy); err != nil {
+			return nil, err
+		}
+		reports = append(reports, rep)
+	}
+	return reports, rows.Err()
+}
+
+// History returns moderation actions matching the filter, newest first
+func (r *ModerationRepository) History(f ModerationHistoryFilter) ([]*ModerationAction, error) {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+	if f.TargetType != "" {
+		conds = append(conds, "target_type = ?")
+		args = append(args, f.TargetType)
+	}
+	if f.TargetID != 0 {
+		conds = append(conds, "target_id = ?")
+		args = append(args, f.TargetID)
+	}
+	if f.SubjectUserID != 0 {
+		conds = append(conds, "subject_user_id = ?")
+		args = append(args, f.SubjectUserID)
+	}
+	if f.ModeratorID != 0 {
+		conds = append(conds, "moderator_id = ?")
+		args = append(args, f.ModeratorID)
+	}
+	if f.Action != "" {
+		conds = append(conds, "action = ?")
+		args = append(args, f.Action)
+	}
+	query := `
+       SELECT id, COALESCE(moderator_id, 0), target_type, target_id, COALESCE(subject_user_id, 0), action, reason, reports_resolved, created_at
+       FROM moderation_actions
+       WHERE ` + strings.Join(conds, " AND ") + `
+       ORDER BY id DESC
+       LIMIT ? OFFSET ?`
+	rows, err := r.db.Query(query, append(args, f.Limit, f.Offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actions := []*ModerationAction{}
+	for rows.Next() {
+		a := &ModerationAction{}
+		if err := rows.Scan(&a.ID, &a.ModeratorID, &a.TargetType, &a.TargetID, &a.SubjectUserID, &a.Action,
+			&a.Reason, &a.ReportsResolved, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+	return actions, rows.Err()
+}
+
+// SetAccountState changes a user's account state and records a as the action
+// taken. Banning also bumps the user's token version so every token issued
+// so far stops working. Reinstating clears any suspension.
+func (r *ModerationRepository) SetAccountState(a *ModerationAction, status string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setAccountStateTx(tx, a, status); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func setAccountStateTx(tx *sql.Tx, a *ModerationAction, status string) error {
+	query := `
+       UPDATE users SET status = ?,
+              suspended_until = CASE WHEN ? = 'active' THEN NULL ELSE suspended_until END,
+              token_version = token_version + CASE WHEN ? = 'banned' THEN 1 ELSE 0 END,
+              updated_at = CURRENT_TIMESTAMP
+       WHERE id = ?`
+	if _, err := tx.Exec(query, status, status, status, a.SubjectUserID); err != nil {
+		return err
+	}
+	a.TargetType, a.TargetID = ReportTargetUser, a.SubjectUserID
+	return insertActionTx(tx, a)
+}
+
+// CreateAppeal stores an appeal against the user's latest suspension.
+// A user can have one open appeal at a time.
+func (r *ModerationRepository) CreateAppeal(ap *Appeal) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM account_appeals WHERE user_id = ? AND status = ?)`, ap.UserID, AppealOpen).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrAppealOpen
+	}
+
+	err = tx.QueryRow(`SELECT id FROM moderation_actions WHERE subject_user_id = ? AND action = ? ORDER BY id DESC LIMIT 1`,
+		ap.UserID, ModSuspend).Scan(&ap.ModerationActionID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	query := `
+       INSERT INTO account_appeals (user_id, moderation_action_id, message)
+       VALUES (?, ?, ?)
+       RETURNING id, status, created_at`
+	if err := tx.QueryRow(query, ap.UserID, nullInt(ap.ModerationActionID), ap.Message).Scan(&ap.ID, &ap.Status, &ap.CreatedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const appealColumns = `id, user_id, COALESCE(moderation_action_id, 0), message, status, response, created_at, resolved_at, resolved_by`
+
+func scanAppeal(row interface{ Scan(...interface{}) error }) (*Appeal, error) {
+	ap := &Appeal{}
+	err := row.Scan(&ap.ID, &ap.UserID, &ap.ModerationActionID, &ap.Message, &ap.Status, &ap.Response,
+		&ap.CreatedAt, &ap.ResolvedAt, &ap.ResolvedBy)
+	return ap, err
+}
+
+// GetAppeals returns appeals, newest first, optionally only a user's or only those with a status
+func (r *ModerationRepository) GetAppeals(userID int, status string, limit, offset int) ([]*Appeal, error) {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+	if userID != 0 {
+		conds = append(conds, "user_id = ?")
+		args = append(args, userID)
+	}
+	if status != "" {
+		conds = append(conds, "status = ?")
+		args = append(args, status)
+	}
+	query := `SELECT ` + appealColumns + ` FROM account_appeals WHERE ` + strings.Join(conds, " AND ") + ` ORDER BY id DESC LIMIT ? OFFSET ?`
+	rows, err := r.db.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	appeals := []*Appeal{}
+	for rows.Next() {
+		ap, err := scanAppeal(rows)
+		if err != nil {
+			return nil, err
+		}
+		appeals = append(appeals, ap)
+	}
+	return appeals, rows.Err()
+}
+
+// ResolveAppeal accepts or rejects an open appeal. Accepting it reinstates
+// the user, which is recorded as an action by the moderator.
+func (r *ModerationRepository) ResolveAppeal(id, moderatorID int, accept bool, response string) (*Appeal, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ap, err := scanAppeal(tx.QueryRow(`SELECT `+appealColumns+` FROM account_appeals WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrAppealNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ap.Status != AppealOpen {
+		return nil, ErrAppealNotPending
+	}
+
+	ap.Status, ap.Response = AppealRejected, response
+	if accept {
+		ap.Status = AppealAccepted
+	}
+	query := `
+       UPDATE account_appeals SET status = ?, response = ?, resolved_at = CURRENT_TIMESTAMP, resolved_by = ?
+       WHERE id = ?
+       RETURNING resolved_at, resolved_by`
+	if err := tx.QueryRow(query, ap.Status, ap.Response, moderatorID, id).Scan(&ap.ResolvedAt, &ap.ResolvedBy); err != nil {
+		return nil, err
+	}
+
+	if accept {
+		a := &ModerationAction{
+			ModeratorID:   moderatorID,
+			SubjectUserID: ap.UserID,
+			Action:        ModReinstate,
+			Reason:        fmt.Sprintf("appeal %d accepted", ap.ID),
+		}
+		var status string
+		if err := tx.QueryRow(`SELECT status FROM users WHERE id = ?`, ap.UserID).Scan(&status); err != nil {
+			return nil, err
+		}
+		// an appeal lifts a suspension; it does not undo a ban handed out since
+		if status == AccountActive {
+			if err := setAccountStateTx(tx, a, AccountActive); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ap, tx.Commit()
+}
@@ -0,0 +1,194 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// WebAuthn ceremonies a challenge is issued for
+const (
+	CeremonyRegistration   = "registration"
+	CeremonyAuthentication = "authentication"
+)
+
+// Passkey errors
+var (
+	ErrChallengeInvalid = errors.New("invalid or expired challenge")
+	ErrPasskeyExists    = errors.New("passkey already registered")
+	ErrPasskeyNotFound  = errors.New("passkey not found")
+	// ErrSignCount means the authenticator's counter went backwards, which
+	// happens when a credential has been cloned
+	ErrSignCount = errors.New("passkey sign count did not increase")
+)
+
+// Passkey is a WebAuthn credential a user can sign in with
+type Passkey struct {
+	ID           int    `json:"id" db:"id"`
+	UserID       int    `json:"user_id" db:"user_id"`
+	CredentialID string `json:"credential_id" db:"credential_id"`
+	// PublicKey is the COSE encoded key
+	PublicKey      []byte     `json:"-" db:"public_key"`
+	Alg            int        `json:"alg" db:"alg"`
+	SignCount      uint32     `json:"sign_count" db:"sign_count"`
+	AAGUID         string     `json:"aaguid,omitempty" db:"aaguid"`
+	Transports     []string   `json:"transports,omitempty" db:"transports"`
+	Name           string     `json:"name" db:"name"`
+	BackupEligible bool       `json:"backup_eligible" db:"backup_eligible"`
+	BackedUp       bool       `json:"backed_up" db:"backed_up"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+}
+
+// passkeyColumns lists the passkeys columns read by scanPasskey
+const passkeyColumns = `id, user_id, credential_id, public_key, alg, sign_count, aaguid, transports, name, backup_eligible, backed_up, last_used_at, created_at`
+
+func scanPasskey(row interface{ Scan(...interface{}) error }) (*Passkey, error) {
+	p := &Passkey{}
+	var transports string
+	err := row.Scan(&p.ID, &p.UserID, &p.CredentialID, &p.PublicKey, &p.Alg, &p.SignCount, &p.AAGUID, &transports,
+		&p.Name, &p.BackupEligible, &p.BackedUp, &p.LastUsedAt, &p.CreatedAt)
+	if transports != "" {
+		p.Transports = strings.Split(transports, ",")
+	}
+	return p, err
+}
+
+// PasskeyRepository handles passkeys and WebAuthn challenges
+type PasskeyRepository struct {
+	db *sql.DB
+}
+
+// NewPasskeyRepository creates a new passkey repository
+func NewPasskeyRepository(db *sql.DB) *PasskeyRepository {
+	return &PasskeyRepository{db: db}
+}
+
+// CreateChallenge stores a challenge for a ceremony. userID is 0 when the
+// user is not known yet.
+func (r *PasskeyRepository) CreateChallenge(challenge, ceremony string, userID int, ttl time.Duration) error {
+	now := time.Now().UTC()
+	if _, err := r.db.Exec(`DELETE FROM webauthn_challenges WHERE expires_at <= ?`, now.Format(sqliteTimeFormat)); err != nil {
+		return err
+	}
+	_, err := r.db.Exec(`INSERT INTO webauthn_challenges (challenge, ceremony, user_id, expires_at) VALUES (?, ?, ?, ?)`,
+		challenge, ceremony, nullInt(userID), now.Add(ttl).Format(sqliteTimeFormat))
+	return err
+}
+
+// ConsumeChallenge removes an unexpired challenge for the ceremony and
+// returns the user it was issued to, or 0 if none
+func (r *PasskeyRepository) ConsumeChallenge(challenge, ceremony string) (int, error) {
+	var userID int
+	query := `
+       DELETE FROM webauthn_challenges
+       WHERE challenge = ? AND ceremony = ? AND expires_at > ?
+       RETURNING COALESCE(user_id, 0)`
+	err := r.db.QueryRow(query, challenge, ceremony, time.Now().UTC().Format(sqliteTimeFormat)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrChallengeInvalid
+	}
+	return userID, err
+}
+
+// Create stores a newly registered passkey
+func (r *PasskeyRepository) Create(p *Passkey) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM passkeys WHERE credential_id = ?)`, p.CredentialID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrPasskeyExists
+	}
+
+	query := `
+       INSERT INTO passkeys (user_id, credential_id, public_key, alg, sign_count, aaguid, transports, name, backup_eligible, backed_up)
+       VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+       RETURNING id, created_at`
+	if err := tx.QueryRow(query, p.UserID, p.CredentialID, p.PublicKey, p.Alg, p.SignCount, p.AAGUID,
+		strings.Join(p.Transports, ","), p.Name, p.BackupEligible, p.BackedUp).Scan(&p.ID, &p.CreatedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetByCredentialID retrieves a passkey by its WebAuthn credential id
+func (r *PasskeyRepository) GetByCredentialID(credentialID string) (*Passkey, error) {
+	p, err := scanPasskey(r.db.QueryRow(`SELECT `+passkeyColumns+` FROM passkeys WHERE credential_id = ?`, credentialID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+// GetByUser retrieves a user's passkeys, oldest first
+func (r *PasskeyRepository) GetByUser(userID int) ([]*Passkey, error) {
+	rows, err := r.db.Query(`SELECT `+passkeyColumns+` FROM passkeys WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []*Passkey{}
+	for rows.Next() {
+		p, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, p)
+	}
+	return passkeys, rows.Err()
+}
+
+// RecordUse stores the sign count and backup state from a verified sign-in.
+// Authenticators that keep a counter must report a higher one each time;
+// both counts being zero means the authenticator does not keep one.
+func (r *PasskeyRepository) RecordUse(p *Passkey, signCount uint32, backedUp bool) error {
+	if (signCount != 0 || p.SignCount != 0) && signCount <= p.SignCount {
+		return ErrSignCount
+	}
+	query := `
+       UPDATE passkeys SET sign_count = ?, backed_up = ?, last_used_at = CURRENT_TIMESTAMP
+       WHERE id = ? AND sign_count = ?`
+	res, err := r.db.Exec(query, signCount, backedUp, p.ID, p.SignCount)
+	if err != nil {
+		return err
+	}
+	// a concurrent sign-in with the same counter value got there first
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrSignCount
+	}
+	p.SignCount = signCount
+	return nil
+}
+
+// Rename changes the label of one of the user's passkeys
+func (r *PasskeyRepository) Rename(id, userID int, name string) error {
+	res, err := r.db.Exec(`UPDATE passkeys SET name = ? WHERE id = ? AND user_id = ?`, name, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+// Delete removes one of the user's passkeys
+func (r *PasskeyRepository) Delete(id, userID int) error {
+	res, err := r.db.Exec(`DELETE FROM passkeys WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
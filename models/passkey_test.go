@@ -0,0 +1,103 @@
+package models
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"gobackend/database"
+)
+
+// newTestDB returns a fresh, migrated database
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := database.Initialize(filepath.Join(t.TempDir(), "app.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db.DB
+}
+
+// newPasskey registers a passkey reporting signCount for a new user
+func newPasskey(t *testing.T, db *sql.DB, signCount uint32) *Passkey {
+	t.Helper()
+	user := &User{Name: "alice", Email: "alice@example.com", Role: RoleUser}
+	if err := user.SetPassword("password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewUserRepository(db).Create(user); err != nil {
+		t.Fatal(err)
+	}
+	p := &Passkey{UserID: user.ID, CredentialID: "credential", PublicKey: []byte{0xa0}, Alg: -7, SignCount: signCount, Name: "laptop"}
+	if err := NewPasskeyRepository(db).Create(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// storedSignCount reads the sign count back from the database
+func storedSignCount(t *testing.T, repo *PasskeyRepository, p *Passkey) uint32 {
+	t.Helper()
+	stored, err := repo.GetByCredentialID(p.CredentialID)
+	if err != nil || stored == nil {
+		t.Fatalf("passkey %s: %v", p.CredentialID, err)
+	}
+	return stored.SignCount
+}
+
+func TestRecordUseSignCount(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewPasskeyRepository(db)
+	p := newPasskey(t, db, 5)
+
+	for _, count := range []uint32{5, 4, 0} {
+		if err := repo.RecordUse(p, count, false); err != ErrSignCount {
+			t.Errorf("sign count %d after 5: err = %v, want ErrSignCount", count, err)
+		}
+	}
+	if got := storedSignCount(t, repo, p); got != 5 {
+		t.Fatalf("rejected uses changed the sign count to %d", got)
+	}
+
+	if err := repo.RecordUse(p, 9, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedSignCount(t, repo, p); got != 9 || p.SignCount != 9 {
+		t.Errorf("sign count stored %d, in memory %d; want 9", got, p.SignCount)
+	}
+}
+
+func TestRecordUseConcurrentSignIn(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewPasskeyRepository(db)
+	p := newPasskey(t, db, 1)
+
+	// two sign-ins loaded the passkey before either recorded its use
+	stale := *p
+	if err := repo.RecordUse(p, 2, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.RecordUse(&stale, 2, false); err != ErrSignCount {
+		t.Errorf("replayed count: err = %v, want ErrSignCount", err)
+	}
+	if err := repo.RecordUse(&stale, 3, false); err != ErrSignCount {
+		t.Errorf("count from a stale copy: err = %v, want ErrSignCount", err)
+	}
+	if got := storedSignCount(t, repo, p); got != 2 {
+		t.Errorf("sign count = %d, want 2", got)
+	}
+}
+
+func TestRecordUseWithoutCounter(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewPasskeyRepository(db)
+	p := newPasskey(t, db, 0)
+
+	// authenticators without a counter always report zero
+	for i := 0; i < 2; i++ {
+		if err := repo.RecordUse(p, 0, false); err != nil {
+			t.Fatalf("use %d: %v", i+1, err)
+		}
+	}
+}
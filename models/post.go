@@ -29,18 +29,17 @@ func (r *PostRepository) Create(post *Post) error {
 // GetByID retrieves a post by ID with user information
 func (r *PostRepository) GetByID(id int) (*Post, error) {
 	post := &Post{}
-	user := &User{}
+	user := &PublicUser{}
 
 	query := `
                SELECT p.id, p.title, p.content, p.user_id, p.created_at, p.updated_at,
-                       u.id, u.name, u.email, u.exp, u.created_at, u.updated_at
+                       ` + publicUserColumns + `
 		FROM posts p
 		JOIN users u ON p.user_id = u.id
 		WHERE p.id = ?`
 
-	err := r.db.QueryRow(query, id).Scan(
-		&post.ID, &post.Title, &post.Content, &post.UserID, &post.CreatedAt, &post.UpdatedAt,
-		&user.ID, &user.Name, &user.Email, &user.Exp, &user.CreatedAt, &user.UpdatedAt)
+	err := r.db.QueryRow(query, id).Scan(append([]interface{}{
+		&post.ID, &post.Title, &post.Content, &post.UserID, &post.CreatedAt, &post.UpdatedAt}, user.scanDest()...)...)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -57,7 +56,7 @@ func (r *PostRepository) GetByID(id int) (*Post, error) {
 func (r *PostRepository) GetAll() ([]*Post, error) {
 	query := `
                SELECT p.id, p.title, p.content, p.user_id, p.created_at, p.updated_at,
-                       u.id, u.name, u.email, u.exp, u.created_at, u.updated_at
+                       ` + publicUserColumns + `
 		FROM posts p
 		JOIN users u ON p.user_id = u.id
 		ORDER BY p.created_at DESC`
@@ -71,11 +70,10 @@ func (r *PostRepository) GetAll() ([]*Post, error) {
 	var posts []*Post
 	for rows.Next() {
 		post := &Post{}
-		user := &User{}
+		user := &PublicUser{}
 
-		err := rows.Scan(
-			&post.ID, &post.Title, &post.Content, &post.UserID, &post.CreatedAt, &post.UpdatedAt,
-			&user.ID, &user.Name, &user.Email, &user.Exp, &user.CreatedAt, &user.UpdatedAt)
+		err := rows.Scan(append([]interface{}{
+			&post.ID, &post.Title, &post.Content, &post.UserID, &post.CreatedAt, &post.UpdatedAt}, user.scanDest()...)...)
 		if err != nil {
 			return nil, err
 		}
@@ -90,7 +88,7 @@ func (r *PostRepository) GetAll() ([]*Post, error) {
 func (r *PostRepository) GetByUserID(userID int) ([]*Post, error) {
 	query := `
                SELECT p.id, p.title, p.content, p.user_id, p.created_at, p.updated_at,
-                       u.id, u.name, u.email, u.exp, u.created_at, u.updated_at
+                       ` + publicUserColumns + `
 		FROM posts p
 		JOIN users u ON p.user_id = u.id
 		WHERE p.user_id = ?
@@ -105,11 +103,10 @@ func (r *PostRepository) GetByUserID(userID int) ([]*Post, error) {
 	var posts []*Post
 	for rows.Next() {
 		post := &Post{}
-		user := &User{}
+		user := &PublicUser{}
 
-		err := rows.Scan(
-			&post.ID, &post.Title, &post.Content, &post.UserID, &post.CreatedAt, &post.UpdatedAt,
-			&user.ID, &user.Name, &user.Email, &user.Exp, &user.CreatedAt, &user.UpdatedAt)
+		err := rows.Scan(append([]interface{}{
+			&post.ID, &post.Title, &post.Content, &post.UserID, &post.CreatedAt, &post.UpdatedAt}, user.scanDest()...)...)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// PublicUser is how a user is shown to other users. It never carries contact
+// details, roles or account state.
+type PublicUser struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Exp       int    `json:"exp"`
+	AvatarKey string `json:"-"`
+}
+
+// MarshalJSON adds the user's position on the level curve and avatar URLs
+func (u PublicUser) MarshalJSON() ([]byte, error) {
+	type publicUser PublicUser
+	return json.Marshal(struct {
+		publicUser
+		LevelProgress
+		AvatarURLs map[string]string `json:"avatar_urls"`
+	}{publicUser(u), CurrentLevelCurve().Progress(u.Exp), AvatarURLs(u.ID, u.AvatarKey)})
+}
+
+// publicUserColumns lists the columns of users aliased u read by scanDest
+const publicUserColumns = `u.id, u.name, u.exp, u.avatar_key`
+
+// scanDest returns the scan destinations for publicUserColumns
+func (u *PublicUser) scanDest() []interface{} {
+	return []interface{}{&u.ID, &u.Name, &u.Exp, &u.AvatarKey}
+}
+
+// Public returns the user as other users see them
+func (u *User) Public() *PublicUser {
+	return &PublicUser{ID: u.ID, Name: u.Name, Exp: u.Exp, AvatarKey: u.AvatarKey}
+}
+
+// ProfileStats summarises a user's activity on their profile
+type ProfileStats struct {
+	TrashPosts    int     `json:"trash_posts"`
+	GonePosts     int     `json:"gone_posts"`
+	VolumeLiters  float64 `json:"volume_liters"`
+	Comments      int     `json:"comments"`
+	Verifications int     `json:"verifications"`
+	CurrentStreak int     `json:"current_streak"`
+	LongestStreak int     `json:"longest_streak"`
+	// Rank is the all-time leaderboard rank, left out for users who hide from it
+	Rank int `json:"rank,omitempty"`
+}
+
+// Profile is a user's public profile. Private profiles only show the user.
+type Profile struct {
+	User     *PublicUser        `json:"user"`
+	Private  bool               `json:"private"`
+	JoinedAt *time.Time         `json:"joined_at,omitempty"`
+	Badges   []*UserAchievement `json:"badges,omitempty"`
+	Stats    *ProfileStats      `json:"stats,omitempty"`
+}
+
+// GetProfileStats counts a user's visible contributions. Streaks are left to
+// the caller since they depend on the user's timezone. The rank is as the
+// viewer sees the leaderboard.
+func (r *UserRepository) GetProfileStats(userID, viewerID int) (*ProfileStats, error) {
+	s := &ProfileStats{}
+	query := `
+       SELECT (SELECT COUNT(*) FROM trash_posts WHERE user_id = ?1 AND hidden = 0),
+              (SELECT COUNT(*) FROM trash_posts WHERE user_id = ?1 AND hidden = 0 AND status = ?2),
+              (SELECT COALESCE(SUM(volume_liters), 0) FROM trash_posts WHERE user_id = ?1 AND hidden = 0),
+              (SELECT COUNT(*) FROM comments WHERE user_id = ?1 AND hidden = 0),
+              (SELECT COUNT(*) FROM trash_verifications WHERE user_id = ?1)`
+	err := r.db.QueryRow(query, userID, TrashStatusGone).Scan(&s.TrashPosts, &s.GonePosts, &s.VolumeLiters, &s.Comments, &s.Verifications)
+	if err != nil {
+		return nil, err
+	}
+
+	self, _, _, err := r.GetLeaderboardPosition(LeaderboardQuery{Ranking: RankingStandard, Viewer: viewerID}, userID, 0)
+	if err != nil {
+		return nil, err
+	}
+	if self != nil {
+		s.Rank = self.Rank
+	}
+	return s, nil
+}
@@ -0,0 +1,232 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"gobackend/events"
+)
+
+// Quest conditions narrow which actions count towards a quest
+const (
+	// QuestConditionNewTrail only counts reports on trails the user had not reported on before the week started
+	QuestConditionNewTrail = "new_trail"
+)
+
+// ExpReasonQuest is the ledger reason for quest rewards
+const ExpReasonQuest = "quest_completed"
+
+// ExpSourceQuest attributes EXP to a user quest
+const ExpSourceQuest = "quest"
+
+// QuestActions are the event types quests can track
+var QuestActions = map[string]bool{
+	events.TrashPostCreated:  true,
+	events.CommentCreated:    true,
+	events.TrashPostVerified: true,
+}
+
+// QuestTemplate is an admin-defined weekly quest
+type QuestTemplate struct {
+	ID          int       `json:"id" db:"id"`
+	Title       string    `json:"title" db:"title"`
+	Description string    `json:"description" db:"description"`
+	Action      string    `json:"action" db:"action"`
+	Condition   string    `json:"condition,omitempty" db:"condition"`
+	Target      int       `json:"target" db:"target"`
+	ExpReward   int       `json:"exp_reward" db:"exp_reward"`
+	Active      bool      `json:"active" db:"active"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+// Validate checks a template before it is stored
+func (t *QuestTemplate) Validate() error {
+	switch {
+	case t.Title == "":
+		return fmt.Errorf("title required")
+	case !QuestActions[t.Action]:
+		return fmt.Errorf("unknown action %q", t.Action)
+	case t.Condition != "" && t.Condition != QuestConditionNewTrail:
+		return fmt.Errorf("unknown condition %q", t.Condition)
+	case t.Condition == QuestConditionNewTrail && t.Action != events.TrashPostCreated:
+		return fmt.Errorf("condition %q only applies to %s", t.Condition, events.TrashPostCreated)
+	case t.Target <= 0:
+		return fmt.Errorf("target must be positive")
+	case t.ExpReward < 0:
+		return fmt.Errorf("exp_reward must not be negative")
+	}
+	return nil
+}
+
+// UserQuest is a quest assigned to a user for one week
+type UserQuest struct {
+	ID          int            `json:"id" db:"id"`
+	UserID      int            `json:"user_id" db:"user_id"`
+	TemplateID  int            `json:"template_id" db:"template_id"`
+	Template    *QuestTemplate `json:"quest"`
+	WeekStart   string         `json:"week_start" db:"week_start"`
+	Progress    int            `json:"progress" db:"progress"`
+	CompletedAt *time.Time     `json:"completed_at,omitempty" db:"completed_at"`
+}
+
+// QuestRepository handles quest database operations
+type QuestRepository struct {
+	db *sql.DB
+}
+
+// NewQuestRepository creates a new quest repository
+func NewQuestRepository(db *sql.DB) *QuestRepository {
+	return &QuestRepository{db: db}
+}
+
+const questTemplateColumns = `t.id, t.title, t.description, t.action, t.condition, t.target, t.exp_reward, t.active, t.created_at`
+
+func scanQuestTemplate(row interface{ Scan(...interface{}) error }, t *QuestTemplate) error {
+	return row.Scan(&t.ID, &t.Title, &t.Description, &t.Action, &t.Condition, &t.Target, &t.ExpReward, &t.Active, &t.CreatedAt)
+}
+
+// CreateTemplate inserts a new quest template
+func (r *QuestRepository) CreateTemplate(t *QuestTemplate) error {
+	query := `
+       INSERT INTO quest_templates (title, description, action, condition, target, exp_reward, active)
+       VALUES (?, ?, ?, ?, ?, ?, ?)
+       RETURNING id, created_at`
+	return r.db.QueryRow(query, t.Title, t.Description, t.Action, t.Condition, t.Target, t.ExpReward, t.Active).Scan(&t.ID, &t.CreatedAt)
+}
+
+// UpdateTemplate updates a quest template. Quests already assigned keep their progress.
+func (r *QuestRepository) UpdateTemplate(t *QuestTemplate) error {
+	query := `
+       UPDATE quest_templates
+       SET title = ?, description = ?, action = ?, condition = ?, target = ?, exp_reward = ?, active = ?
+       WHERE id = ?`
+	_, err := r.db.Exec(query, t.Title, t.Description, t.Action, t.Condition, t.Target, t.ExpReward, t.Active, t.ID)
+	return err
+}
+
+// GetTemplate retrieves a quest template by id
+func (r *QuestRepository) GetTemplate(id int) (*QuestTemplate, error) {
+	t := &QuestTemplate{}
+	err := scanQuestTemplate(r.db.QueryRow(`SELECT `+questTemplateColumns+` FROM quest_templates t WHERE t.id = ?`, id), t)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+// GetTemplates returns all quest templates, or only active ones
+func (r *QuestRepository) GetTemplates(activeOnly bool) ([]*QuestTemplate, error) {
+	query := `SELECT ` + questTemplateColumns + ` FROM quest_templates t`
+	if activeOnly {
+		query += ` WHERE t.active = 1`
+	}
+	rows, err := r.db.Query(query + ` ORDER BY t.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []*QuestTemplate{}
+	for rows.Next() {
+		t := &QuestTemplate{}
+		if err := scanQuestTemplate(rows, t); err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// GetForWeek returns the quests assigned to a user for the week
+func (r *QuestRepository) GetForWeek(userID int, weekStart string) ([]*UserQuest, error) {
+	query := `
+       SELECT q.id, q.user_id, q.template_id, q.week_start, q.progress, q.completed_at, ` + questTemplateColumns + `
+       FROM user_quests q
+       JOIN quest_templates t ON t.id = q.template_id
+       WHERE q.user_id = ? AND q.week_start = ?
+       ORDER BY q.id`
+	rows, err := r.db.Query(query, userID, weekStart)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quests := []*UserQuest{}
+	for rows.Next() {
+		q := &UserQuest{Template: &QuestTemplate{}}
+		t := q.Template
+		if err := rows.Scan(&q.ID, &q.UserID, &q.TemplateID, &q.WeekStart, &q.Progress, &q.CompletedAt,
+			&t.ID, &t.Title, &t.Description, &t.Action, &t.Condition, &t.Target, &t.ExpReward, &t.Active, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		quests = append(quests, q)
+	}
+	return quests, rows.Err()
+}
+
+// EnsureAssigned returns the user's quests for the week, assigning up to n
+// active templates first if the user has none. The choice is deterministic
+// per user and week, so concurrent calls pick the same quests.
+func (r *QuestRepository) EnsureAssigned(userID int, weekStart string, n int) ([]*UserQuest, error) {
+	quests, err := r.GetForWeek(userID, weekStart)
+	if err != nil || len(quests) > 0 {
+		return quests, err
+	}
+
+	templates, err := r.GetTemplates(true)
+	if err != nil || len(templates) == 0 {
+		return quests, err
+	}
+
+	score := func(t *QuestTemplate) uint32 {
+		h := fnv.New32a()
+		fmt.Fprintf(h, "%d:%s:%d", userID, weekStart, t.ID)
+		return h.Sum32()
+	}
+	sort.Slice(templates, func(i, j int) bool { return score(templates[i]) < score(templates[j]) })
+	if len(templates) > n {
+		templates = templates[:n]
+	}
+
+	for _, t := range templates {
+		if _, err := r.db.Exec(`INSERT OR IGNORE INTO user_quests (user_id, template_id, week_start) VALUES (?, ?, ?)`, userID, t.ID, weekStart); err != nil {
+			return nil, err
+		}
+	}
+	return r.GetForWeek(userID, weekStart)
+}
+
+// Advance adds one to a quest's progress. completed is true only for the call
+// that completed the quest.
+func (r *QuestRepository) Advance(q *UserQuest) (completed bool, err error) {
+	err = r.db.QueryRow(`UPDATE user_quests SET progress = progress + 1 WHERE id = ? AND completed_at IS NULL RETURNING progress`, q.ID).Scan(&q.Progress)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil || q.Progress < q.Template.Target {
+		return false, err
+	}
+
+	res, err := r.db.Exec(`UPDATE user_quests SET completed_at = CURRENT_TIMESTAMP WHERE id = ? AND completed_at IS NULL`, q.ID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	now := time.Now().UTC()
+	q.CompletedAt = &now
+	return true, nil
+}
+
+// HasReportedTrailBefore reports whether the user posted on the trail before the given time
+func (r *QuestRepository) HasReportedTrailBefore(userID int, trail string, before time.Time) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM trash_posts WHERE user_id = ? AND trail = ? AND created_at < ?)`
+	err := r.db.QueryRow(query, userID, trail, before.UTC().Format(sqliteTimeFormat)).Scan(&exists)
+	return exists, err
+}
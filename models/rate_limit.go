@@ -0,0 +1,302 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// Rate limit bucket keys
+const (
+	RateLimitByIP   = "ip"
+	RateLimitByUser = "user"
+)
+
+// RateLimitRule is a token bucket for each caller of a route. Callers may
+// make Burst requests at once and get Limit more every WindowSeconds.
+type RateLimitRule struct {
+	// Route is a method and path pattern such as "POST /trashposts/{id}/comments";
+	// the method may be * for any
+	Route string `json:"route"`
+	// By is ip, or user for the signed-in user, falling back to ip for anonymous callers
+	By            string `json:"by"`
+	Limit         int    `json:"limit"`
+	WindowSeconds int    `json:"window_seconds"`
+	// Burst is the bucket size; it defaults to Limit
+	Burst int `json:"burst,omitempty"`
+
+	method   string
+	segments []string
+}
+
+// LoginLockout locks password sign-in for an account after repeated
+// failures, doubling the lock with every further failure
+type LoginLockout struct {
+	// Threshold is the number of failures that triggers the first lock; 0 disables lockout
+	Threshold   int `json:"threshold"`
+	BaseSeconds int `json:"base_seconds"`
+	MaxSeconds  int `json:"max_seconds"`
+	// ResetSeconds forgets failures after this long without one
+	ResetSeconds int `json:"reset_seconds"`
+}
+
+// RateLimits configures request throttling
+type RateLimits struct {
+	Rules        []*RateLimitRule `json:"rules"`
+	LoginLockout LoginLockout     `json:"login_lockout"`
+}
+
+// DefaultRateLimits returns the limits used when no configuration file exists
+func DefaultRateLimits() *RateLimits {
+	return &RateLimits{
+		Rules: []*RateLimitRule{
+			{Route: "POST /login", By: RateLimitByIP, Limit: 10, WindowSeconds: 60},
+			{Route: "POST /users", By: RateLimitByIP, Limit: 5, WindowSeconds: 3600},
+			{Route: "POST /trashposts", By: RateLimitByUser, Limit: 20, WindowSeconds: 3600, Burst: 5},
+			{Route: "POST /trashposts", By: RateLimitByIP, Limit: 60, WindowSeconds: 3600, Burst: 10},
+			{Route: "POST /trashposts/{id}/comments", By: RateLimitByUser, Limit: 30, WindowSeconds: 600, Burst: 10},
+			{Route: "POST /reports", By: RateLimitByUser, Limit: 20, WindowSeconds: 3600, Burst: 5},
+			{Route: "POST /auth/magic-link", By: RateLimitByIP, Limit: 20, WindowSeconds: 3600, Burst: 5},
+			{Route: "POST /auth/password-reset/request", By: RateLimitByIP, Limit: 20, WindowSeconds: 3600, Burst: 5},
+			{Route: "POST /auth/2fa/verify", By: RateLimitByIP, Limit: 20, WindowSeconds: 60},
+			{Route: "POST /auth/passkeys/login", By: RateLimitByIP, Limit: 20, WindowSeconds: 60},
+			{Route: "PUT /users/me/password", By: RateLimitByUser, Limit: 10, WindowSeconds: 3600},
+			{Route: "PUT /users/me/email", By: RateLimitByUser, Limit: 10, WindowSeconds: 3600},
+			{Route: "DELETE /users/me", By: RateLimitByUser, Limit: 10, WindowSeconds: 3600},
+			{Route: "GET /users/me/export", By: RateLimitByUser, Limit: 5, WindowSeconds: 3600, Burst: 2},
+			{Route: "PUT /users/me/avatar", By: RateLimitByUser, Limit: 10, WindowSeconds: 3600},
+		},
+		LoginLockout: LoginLockout{Threshold: 5, BaseSeconds: 60, MaxSeconds: 3600, ResetSeconds: 86400},
+	}
+}
+
+// LoadRateLimits reads limits from a JSON file, falling back to the defaults
+// when path is empty or the file does not exist
+func LoadRateLimits(path string) (*RateLimits, error) {
+	limits := DefaultRateLimits()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			limits = &RateLimits{}
+			if err := json.Unmarshal(data, limits); err != nil {
+				return nil, fmt.Errorf("parse rate limits: %w", err)
+			}
+		}
+	}
+	if err := limits.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid rate limits: %w", err)
+	}
+	for _, rule := range limits.Rules {
+		rule.compile()
+	}
+	return limits, nil
+}
+
+// Validate checks the limits for values that cannot be applied
+func (l *RateLimits) Validate() error {
+	for i, rule := range l.Rules {
+		method, path, ok := strings.Cut(rule.Route, " ")
+		switch {
+		case !ok || method == "" || !strings.HasPrefix(path, "/"):
+			return fmt.Errorf("rule %d: route must be a method and a path", i)
+		case rule.By != RateLimitByIP && rule.By != RateLimitByUser:
+			return fmt.Errorf("%s: by must be ip or user", rule.Route)
+		case rule.Limit <= 0 || rule.WindowSeconds <= 0:
+			return fmt.Errorf("%s: limit and window_seconds must be positive", rule.Route)
+		case rule.Burst < 0:
+			return fmt.Errorf("%s: burst must not be negative", rule.Route)
+		}
+	}
+	lo := l.LoginLockout
+	if lo.Threshold < 0 || (lo.Threshold > 0 && (lo.BaseSeconds <= 0 || lo.MaxSeconds < lo.BaseSeconds || lo.ResetSeconds <= 0)) {
+		return fmt.Errorf("login_lockout needs base_seconds > 0, max_seconds >= base_seconds and reset_seconds > 0")
+	}
+	return nil
+}
+
+func (r *RateLimitRule) compile() {
+	method, path, _ := strings.Cut(r.Route, " ")
+	r.method = strings.ToUpper(method)
+	r.segments = strings.Split(strings.TrimSuffix(path, "/"), "/")
+}
+
+// Matches reports whether the rule applies to a request
+func (r *RateLimitRule) Matches(method, path string) bool {
+	if r.method != "*" && r.method != method {
+		return false
+	}
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(segments) != len(r.segments) {
+		return false
+	}
+	for i, s := range r.segments {
+		if s != segments[i] && !(strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}")) {
+			return false
+		}
+	}
+	return true
+}
+
+// Capacity is the bucket size
+func (r *RateLimitRule) Capacity() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return r.Limit
+}
+
+// rate is the refill rate in tokens per second
+func (r *RateLimitRule) rate() float64 {
+	return float64(r.Limit) / float64(r.WindowSeconds)
+}
+
+// RateLimitDecision is the outcome of taking a token from a bucket
+type RateLimitDecision struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until a token is available, when not allowed
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// rateLimitIdle is how long an untouched bucket is kept; a full bucket
+// and a missing one behave the same
+const rateLimitIdle = 24 * time.Hour
+
+// RateLimitRepository keeps rate limit buckets and login failures in the
+// database, so every server process enforces the same limits
+type RateLimitRepository struct {
+	db *sql.DB
+}
+
+// NewRateLimitRepository creates a new rate limit repository
+func NewRateLimitRepository(db *sql.DB) *RateLimitRepository {
+	return &RateLimitRepository{db: db}
+}
+
+// Take takes a token from the rule's bucket for key. A new bucket starts full.
+func (r *RateLimitRepository) Take(rule *RateLimitRule, key string) (*RateLimitDecision, error) {
+	capacity, rate := float64(rule.Capacity()), rule.rate()
+	now := float64(time.Now().UnixNano()) / 1e9
+	bucket := rule.Route + "|" + rule.By + "|" + key
+
+	// the update is skipped when the refilled bucket holds less than a token,
+	// so a denied request returns no row and does not delay the refill
+	query := `
+       INSERT INTO rate_limit_buckets (bucket, tokens, updated_at) VALUES (?1, ?2 - 1, ?3)
+       ON CONFLICT (bucket) DO UPDATE SET
+               tokens = MIN(?2, tokens + (?3 - updated_at) * ?4) - 1,
+               updated_at = ?3
+       WHERE MIN(?2, tokens + (?3 - updated_at) * ?4) >= 1
+       RETURNING tokens`
+	var tokens float64
+	err := r.db.QueryRow(query, bucket, capacity, now, rate).Scan(&tokens)
+	if err == nil {
+		return &RateLimitDecision{
+			Allowed:   true,
+			Remaining: int(tokens),
+			Reset:     seconds((capacity - tokens) / rate),
+		}, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var updatedAt float64
+	if err := r.db.QueryRow(`SELECT tokens, updated_at FROM rate_limit_buckets WHERE bucket = ?`, bucket).Scan(&tokens, &updatedAt); err != nil {
+		return nil, err
+	}
+	tokens = math.Min(capacity, tokens+(now-updatedAt)*rate)
+	return &RateLimitDecision{
+		RetryAfter: seconds((1 - tokens) / rate),
+		Reset:      seconds((capacity - tokens) / rate),
+	}, nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Max(s, 0) * float64(time.Second))
+}
+
+// LoginLockedUntil returns until when password sign-in to account is locked,
+// or the zero time
+func (r *RateLimitRepository) LoginLockedUntil(account string) (time.Time, error) {
+	var until time.Time
+	err := r.db.QueryRow(`SELECT locked_until FROM login_failures WHERE account = ? AND locked_until > ?`,
+		account, time.Now().UTC().Format(sqliteTimeFormat)).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return until, err
+}
+
+// RecordLoginFailure counts a failed password sign-in to account and returns
+// the lock it triggers, or the zero time. Accounts need not exist, so
+// lockouts do not reveal which do.
+func (r *RateLimitRepository) RecordLoginFailure(account string, lo LoginLockout) (time.Time, error) {
+	if lo.Threshold == 0 {
+		return time.Time{}, nil
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var failures int
+	var last time.Time
+	err = tx.QueryRow(`SELECT failures, last_failure_at FROM login_failures WHERE account = ?`, account).Scan(&failures, &last)
+	if err != nil && err != sql.ErrNoRows {
+		return time.Time{}, err
+	}
+	if now.Sub(last) > time.Duration(lo.ResetSeconds)*time.Second {
+		failures = 0
+	}
+	failures++
+
+	var until time.Time
+	if failures >= lo.Threshold {
+		lock := float64(lo.BaseSeconds) * math.Pow(2, float64(failures-lo.Threshold))
+		until = now.Add(seconds(math.Min(lock, float64(lo.MaxSeconds))))
+	}
+	query := `
+       INSERT INTO login_failures (account, failures, last_failure_at, locked_until) VALUES (?, ?, ?, ?)
+       ON CONFLICT (account) DO UPDATE SET
+               failures = excluded.failures,
+               last_failure_at = excluded.last_failure_at,
+               locked_until = excluded.locked_until`
+	var lockedUntil interface{}
+	if !until.IsZero() {
+		lockedUntil = until.Format(sqliteTimeFormat)
+	}
+	if _, err := tx.Exec(query, account, failures, now.Format(sqliteTimeFormat), lockedUntil); err != nil {
+		return time.Time{}, err
+	}
+	return until, tx.Commit()
+}
+
+// ClearLoginFailures forgets failures after a successful sign-in
+func (r *RateLimitRepository) ClearLoginFailures(account string) error {
+	_, err := r.db.Exec(`DELETE FROM login_failures WHERE account = ?`, account)
+	return err
+}
+
+// Prune removes idle buckets and forgotten login failures
+func (r *RateLimitRepository) Prune(lo LoginLockout) error {
+	idle := float64(time.Now().Add(-rateLimitIdle).UnixNano()) / 1e9
+	if _, err := r.db.Exec(`DELETE FROM rate_limit_buckets WHERE updated_at < ?`, idle); err != nil {
+		return err
+	}
+	before := time.Now().UTC().Add(-time.Duration(lo.ResetSeconds) * time.Second).Format(sqliteTimeFormat)
+	_, err := r.db.Exec(`DELETE FROM login_failures WHERE last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)`,
+		before, time.Now().UTC().Format(sqliteTimeFormat))
+	return err
+}
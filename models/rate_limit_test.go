@@ -0,0 +1,191 @@
+package models
+
+import (
+	"database/sql"
+	"math"
+	"testing"
+	"time"
+)
+
+// age moves every bucket's last update back by d, as if d had passed
+func age(t *testing.T, db *sql.DB, d time.Duration) {
+	t.Helper()
+	if _, err := db.Exec(`UPDATE rate_limit_buckets SET updated_at = updated_at - ?`, d.Seconds()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// near reports whether got is within a second below want, allowing for the
+// time the test itself takes
+func near(got, want time.Duration) bool {
+	return got <= want && got > want-time.Second
+}
+
+func take(t *testing.T, repo *RateLimitRepository, rule *RateLimitRule, key string) *RateLimitDecision {
+	t.Helper()
+	d, err := repo.Take(rule, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestTakeRefill(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewRateLimitRepository(db)
+	// a token a second, three at once
+	rule := &RateLimitRule{Route: "POST /reports", By: RateLimitByUser, Limit: 60, WindowSeconds: 60, Burst: 3}
+
+	for want := 2; want >= 0; want-- {
+		if d := take(t, repo, rule, "1"); !d.Allowed || d.Remaining != want {
+			t.Fatalf("decision = %+v, want allowed with %d remaining", d, want)
+		}
+	}
+	if d := take(t, repo, rule, "1"); d.Allowed {
+		t.Fatal("fourth request allowed from a bucket of three")
+	}
+	if d := take(t, repo, rule, "2"); !d.Allowed {
+		t.Fatal("another caller's bucket was drained")
+	}
+
+	age(t, db, 2*time.Second)
+	for i := 0; i < 2; i++ {
+		if d := take(t, repo, rule, "1"); !d.Allowed {
+			t.Fatalf("request %d after two seconds denied", i+1)
+		}
+	}
+	if d := take(t, repo, rule, "1"); d.Allowed {
+		t.Fatal("more requests allowed than two seconds refilled")
+	}
+
+	// refilling stops at the bucket size
+	age(t, db, time.Hour)
+	if d := take(t, repo, rule, "1"); !d.Allowed || d.Remaining != 2 {
+		t.Fatalf("decision after an hour = %+v, want 2 remaining", d)
+	}
+}
+
+func TestTakeDeniedKeepsRefill(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewRateLimitRepository(db)
+	// a token every ten seconds
+	rule := &RateLimitRule{Route: "POST /login", By: RateLimitByIP, Limit: 1, WindowSeconds: 10}
+
+	if d := take(t, repo, rule, "ip"); !d.Allowed {
+		t.Fatal("first request denied")
+	}
+	var before float64
+	if err := db.QueryRow(`SELECT updated_at FROM rate_limit_buckets`).Scan(&before); err != nil {
+		t.Fatal(err)
+	}
+	// denied requests while the bucket refills neither use nor restart it
+	for i := 0; i < 3; i++ {
+		age(t, db, 3*time.Second)
+		if d := take(t, repo, rule, "ip"); d.Allowed {
+			t.Fatalf("request after %ds allowed", 3*(i+1))
+		}
+	}
+	var after float64
+	if err := db.QueryRow(`SELECT updated_at FROM rate_limit_buckets`).Scan(&after); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(after-(before-9)) > 1e-3 {
+		t.Errorf("denied requests moved the bucket's update time by %.3fs", after-(before-9))
+	}
+	age(t, db, time.Second)
+	if d := take(t, repo, rule, "ip"); !d.Allowed {
+		t.Fatal("request after ten seconds denied")
+	}
+}
+
+func TestTakeRetryAfterAndReset(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewRateLimitRepository(db)
+	// two at once, a token every ten seconds
+	rule := &RateLimitRule{Route: "POST /trashposts", By: RateLimitByUser, Limit: 6, WindowSeconds: 60, Burst: 2}
+
+	d := take(t, repo, rule, "1")
+	if !d.Allowed || d.RetryAfter != 0 || !near(d.Reset, 10*time.Second) {
+		t.Errorf("first decision = %+v, want reset in 10s", d)
+	}
+	d = take(t, repo, rule, "1")
+	if !d.Allowed || !near(d.Reset, 20*time.Second) {
+		t.Errorf("second decision = %+v, want reset in 20s", d)
+	}
+	d = take(t, repo, rule, "1")
+	if d.Allowed || d.Remaining != 0 || !near(d.RetryAfter, 10*time.Second) || !near(d.Reset, 20*time.Second) {
+		t.Errorf("denied decision = %+v, want retry in 10s and reset in 20s", d)
+	}
+
+	age(t, db, 4*time.Second)
+	d = take(t, repo, rule, "1")
+	if d.Allowed || !near(d.RetryAfter, 6*time.Second) || !near(d.Reset, 16*time.Second) {
+		t.Errorf("decision after 4s = %+v, want retry in 6s and reset in 16s", d)
+	}
+}
+
+// failAt records a login failure and returns how long the lock it triggered lasts
+func failAt(t *testing.T, repo *RateLimitRepository, lo LoginLockout) time.Duration {
+	t.Helper()
+	until, err := repo.RecordLoginFailure("alice@example.com", lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until.IsZero() {
+		return 0
+	}
+	return time.Until(until).Round(time.Second)
+}
+
+func TestLoginLockoutDoubles(t *testing.T) {
+	repo := NewRateLimitRepository(newTestDB(t))
+	lo := LoginLockout{Threshold: 3, BaseSeconds: 60, MaxSeconds: 200, ResetSeconds: 3600}
+
+	want := []time.Duration{0, 0, 60 * time.Second, 120 * time.Second, 200 * time.Second, 200 * time.Second}
+	for i, w := range want {
+		if got := failAt(t, repo, lo); got != w {
+			t.Errorf("failure %d: locked for %v, want %v", i+1, got, w)
+		}
+	}
+	until, err := repo.LoginLockedUntil("alice@example.com")
+	// the stored lock is kept to the second
+	if err != nil || !near(time.Until(until), 200*time.Second) {
+		t.Errorf("locked until %v, %v; want in 200s", until, err)
+	}
+
+	if err := repo.ClearLoginFailures("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := failAt(t, repo, lo); got != 0 {
+		t.Errorf("failure after sign-in locked for %v", got)
+	}
+}
+
+func TestLoginFailuresForgotten(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewRateLimitRepository(db)
+	lo := LoginLockout{Threshold: 2, BaseSeconds: 60, MaxSeconds: 600, ResetSeconds: 60}
+
+	if got := failAt(t, repo, lo); got != 0 {
+		t.Fatalf("first failure locked for %v", got)
+	}
+	last := time.Now().UTC().Add(-61 * time.Second).Format(sqliteTimeFormat)
+	if _, err := db.Exec(`UPDATE login_failures SET last_failure_at = ?`, last); err != nil {
+		t.Fatal(err)
+	}
+	if got := failAt(t, repo, lo); got != 0 {
+		t.Errorf("failure a minute after the last locked for %v; the old failure was not forgotten", got)
+	}
+	if got := failAt(t, repo, lo); got != 60*time.Second {
+		t.Errorf("second recent failure locked for %v, want 1m0s", got)
+	}
+}
+
+func TestLoginLockoutDisabled(t *testing.T) {
+	repo := NewRateLimitRepository(newTestDB(t))
+	for i := 0; i < 10; i++ {
+		if got := failAt(t, repo, LoginLockout{}); got != 0 {
+			t.Fatalf("failure %d locked for %v with lockout disabled", i+1, got)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// BoundingBox is a latitude/longitude rectangle
+type BoundingBox struct {
+	MinLatitude  float64 `json:"min_latitude" db:"min_latitude"`
+	MinLongitude float64 `json:"min_longitude" db:"min_longitude"`
+	MaxLatitude  float64 `json:"max_latitude" db:"max_latitude"`
+	MaxLongitude float64 `json:"max_longitude" db:"max_longitude"`
+}
+
+// Valid reports whether the box has sane coordinates and non-negative extent
+func (b BoundingBox) Valid() bool {
+	return b.MinLatitude >= -90 && b.MaxLatitude <= 90 &&
+		b.MinLongitude >= -180 && b.MaxLongitude <= 180 &&
+		b.MinLatitude <= b.MaxLatitude && b.MinLongitude <= b.MaxLongitude
+}
+
+// Region is a named bounding box used to scope leaderboards
+type Region struct {
+	ID   int    `json:"id" db:"id"`
+	Name string `json:"name" db:"name"`
+	BoundingBox
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// RegionRepository handles region database operations
+type RegionRepository struct {
+	db *sql.DB
+}
+
+// NewRegionRepository creates a new region repository
+func NewRegionRepository(db *sql.DB) *RegionRepository {
+	return &RegionRepository{db: db}
+}
+
+// Create inserts a new region
+func (r *RegionRepository) Create(region *Region) error {
+	query := `
+       INSERT INTO regions (name, min_latitude, min_longitude, max_latitude, max_longitude)
+       VALUES (?, ?, ?, ?, ?)
+       RETURNING id, created_at`
+	return r.db.QueryRow(query, region.Name, region.MinLatitude, region.MinLongitude, region.MaxLatitude, region.MaxLongitude).
+		Scan(&region.ID, &region.CreatedAt)
+}
+
+// GetByName retrieves a region by its case-insensitive name
+func (r *RegionRepository) GetByName(name string) (*Region, error) {
+	g := &Region{}
+	query := `SELECT id, name, min_latitude, min_longitude, max_latitude, max_longitude, created_at FROM regions WHERE name = ?`
+	err := r.db.QueryRow(query, name).Scan(&g.ID, &g.Name, &g.MinLatitude, &g.MinLongitude, &g.MaxLatitude, &g.MaxLongitude, &g.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return g, err
+}
+
+// GetByID retrieves a region by id
+func (r *RegionRepository) GetByID(id int) (*Region, error) {
+	g := &Region{}
+	query := `SELECT id, name, min_latitude, min_longitude, max_latitude, max_longitude, created_at FROM regions WHERE id = ?`
+	err := r.db.QueryRow(query, id).Scan(&g.ID, &g.Name, &g.MinLatitude, &g.MinLongitude, &g.MaxLatitude, &g.MaxLongitude, &g.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return g, err
+}
+
+// GetAll retrieves all regions ordered by name
+func (r *RegionRepository) GetAll() ([]*Region, error) {
+	query := `SELECT id, name, min_latitude, min_longitude, max_latitude, max_longitude, created_at FROM regions ORDER BY name`
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var regions []*Region
+	for rows.Next() {
+		g := &Region{}
+		if err := rows.Scan(&g.ID, &g.Name, &g.MinLatitude, &g.MinLongitude, &g.MaxLatitude, &g.MaxLongitude, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		regions = append(regions, g)
+	}
+	return regions, rows.Err()
+}
+
+// Delete removes a region by id
+func (r *RegionRepository) Delete(id int) error {
+	_, err := r.db.Exec(`DELETE FROM regions WHERE id = ?`, id)
+	return err
+}
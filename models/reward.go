@@ -0,0 +1,386 @@
+package models
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Point transaction reasons besides the EXP rule names points are earned with
+const (
+	PointsReasonRedemption = "redemption"
+	PointsReasonRefund     = "redemption_voided"
+	PointsReasonReversal   = "reversal"
+)
+
+// Redemption statuses
+const (
+	RedemptionIssued = "issued"
+	RedemptionUsed   = "used"
+	RedemptionVoided = "voided"
+)
+
+// Redemption failures the caller can act on
+var (
+	ErrRewardUnavailable  = errors.New("reward is not available")
+	ErrOutOfStock         = errors.New("reward is out of stock")
+	ErrRedemptionLimit    = errors.New("redemption limit reached for this reward")
+	ErrInsufficientPoints = errors.New("not enough points")
+)
+
+// PointTransaction is a single entry in the append-only points ledger.
+// users.points is a cache of the sum of a user's transactions.
+type PointTransaction struct {
+	ID           int       `json:"id" db:"id"`
+	UserID       int       `json:"user_id" db:"user_id"`
+	Amount       int       `json:"amount" db:"amount"`
+	Reason       string    `json:"reason" db:"reason"`
+	ExpEventID   int       `json:"exp_event_id,omitempty" db:"exp_event_id"`
+	RedemptionID int       `json:"redemption_id,omitempty" db:"redemption_id"`
+	ActorID      int       `json:"actor_id,omitempty" db:"actor_id"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+// Reward is a sponsor-provided item users can redeem points for
+type Reward struct {
+	ID           int       `json:"id" db:"id"`
+	SponsorID    int       `json:"sponsor_id" db:"sponsor_id"`
+	Title        string    `json:"title" db:"title"`
+	Description  string    `json:"description" db:"description"`
+	Cost         int       `json:"cost" db:"cost"`
+	Stock        *int      `json:"stock" db:"stock"`
+	PerUserLimit int       `json:"per_user_limit" db:"per_user_limit"`
+	Active       bool      `json:"active" db:"active"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+// Validate checks a reward before it is stored
+func (rw *Reward) Validate() error {
+	switch {
+	case rw.Title == "":
+		return fmt.Errorf("title required")
+	case rw.Cost <= 0:
+		return fmt.Errorf("cost must be positive")
+	case rw.Stock != nil && *rw.Stock < 0:
+		return fmt.Errorf("stock must not be negative")
+	case rw.PerUserLimit < 0:
+		return fmt.Errorf("per_user_limit must not be negative")
+	}
+	return nil
+}
+
+// Redemption is a reward claimed by a user. Code is handed to the sponsor,
+// who marks it used.
+type Redemption struct {
+	ID         int        `json:"id" db:"id"`
+	RewardID   int        `json:"reward_id" db:"reward_id"`
+	UserID     int        `json:"user_id" db:"user_id"`
+	Cost       int        `json:"cost" db:"cost"`
+	Code       string     `json:"code" db:"code"`
+	Status     string     `json:"status" db:"status"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	UsedAt     *time.Time `json:"used_at,omitempty" db:"used_at"`
+	VoidedAt   *time.Time `json:"voided_at,omitempty" db:"voided_at"`
+	VoidedBy   int        `json:"voided_by,omitempty" db:"voided_by"`
+	VoidReason string     `json:"void_reason,omitempty" db:"void_reason"`
+}
+
+// NewRedemptionCode generates a random code in the form XXXX-XXXX-XXXX
+func NewRedemptionCode() (string, error) {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return fmt.Sprintf("%s-%s-%s", b[:4], b[4:8], b[8:]), nil
+}
+
+// addPointsTx writes the ledger row and updates the user's cached balance
+func addPointsTx(tx *sql.Tx, t *PointTransaction) error {
+	query := `
+       INSERT INTO point_transactions (user_id, amount, reason, exp_event_id, redemption_id, actor_id)
+       VALUES (?, ?, ?, ?, ?, ?)
+       RETURNING id, created_at`
+	if err := tx.QueryRow(query, t.UserID, t.Amount, t.Reason, nullInt(t.ExpEventID), nullInt(t.RedemptionID),
+		nullInt(t.ActorID)).Scan(&t.ID, &t.CreatedAt); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`UPDATE users SET points = points + ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, t.Amount, t.UserID)
+	return err
+}
+
+// clawbackPointsTx takes back the points credited with an EXP award that is
+// being reversed. The balance may go negative if they were already spent.
+func clawbackPointsTx(tx *sql.Tx, expEventID, reversalID, actorID int) error {
+	var userID, amount int
+	err := tx.QueryRow(`SELECT user_id, COALESCE(SUM(amount), 0) FROM point_transactions WHERE exp_event_id = ? GROUP BY user_id`, expEventID).Scan(&userID, &amount)
+	if err == sql.ErrNoRows || amount == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return addPointsTx(tx, &PointTransaction{UserID: userID, Amount: -amount, Reason: PointsReasonReversal, ExpEventID: reversalID, ActorID: actorID})
+}
+
+// RewardRepository handles points wallet, reward catalog and redemption operations
+type RewardRepository struct {
+	db *sql.DB
+}
+
+// NewRewardRepository creates a new reward repository
+func NewRewardRepository(db *sql.DB) *RewardRepository {
+	return &RewardRepository{db: db}
+}
+
+// GetBalance returns a user's points balance
+func (r *RewardRepository) GetBalance(userID int) (int, error) {
+	var balance int
+	err := r.db.QueryRow(`SELECT points FROM users WHERE id = ?`, userID).Scan(&balance)
+	return balance, err
+}
+
+// GetTransactions returns a user's points ledger entries, newest first
+func (r *RewardRepository) GetTransactions(userID, limit, offset int) ([]*PointTransaction, error) {
+	query := `
+       SELECT id, user_id, amount, reason, COALESCE(exp_event_id, 0), COALESCE(redemption_id, 0), COALESCE(actor_id, 0), created_at
+       FROM point_transactions
+       WHERE user_id = ?
+       ORDER BY id DESC
+       LIMIT ? OFFSET ?`
+	rows, err := r.db.Query(query, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txs := []*PointTransaction{}
+	for rows.Next() {
+		t := &PointTransaction{}
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Amount, &t.Reason, &t.ExpEventID, &t.RedemptionID, &t.ActorID, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		txs = append(txs, t)
+	}
+	return txs, rows.Err()
+}
+
+const rewardColumns = `id, sponsor_id, title, description, cost, stock, per_user_limit, active, created_at`
+
+func scanReward(row interface{ Scan(...interface{}) error }) (*Reward, error) {
+	rw := &Reward{}
+	err := row.Scan(&rw.ID, &rw.SponsorID, &rw.Title, &rw.Description, &rw.Cost, &rw.Stock, &rw.PerUserLimit, &rw.Active, &rw.CreatedAt)
+	return rw, err
+}
+
+// CreateReward adds a reward to the catalog
+func (r *RewardRepository) CreateReward(rw *Reward) error {
+	query := `
+       INSERT INTO rewards (sponsor_id, title, description, cost, stock, per_user_limit, active)
+       VALUES (?, ?, ?, ?, ?, ?, ?)
+       RETURNING id, created_at`
+	return r.db.QueryRow(query, rw.SponsorID, rw.Title, rw.Description, rw.Cost, rw.Stock, rw.PerUserLimit, rw.Active).Scan(&rw.ID, &rw.CreatedAt)
+}
+
+// UpdateReward updates a reward. Existing redemptions are not affected.
+func (r *RewardRepository) UpdateReward(rw *Reward) error {
+	query := `
+       UPDATE rewards
+       SET title = ?, description = ?, cost = ?, stock = ?, per_user_limit = ?, active = ?
+       WHERE id = ?`
+	_, err := r.db.Exec(query, rw.Title, rw.Description, rw.Cost, rw.Stock, rw.PerUserLimit, rw.Active, rw.ID)
+	return err
+}
+
+// GetReward retrieves a reward by id
+func (r *RewardRepository) GetReward(id int) (*Reward, error) {
+	rw, err := scanReward(r.db.QueryRow(`SELECT `+rewardColumns+` FROM rewards WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return rw, err
+}
+
+// GetRewards returns the catalog. Only active rewards are listed unless
+// sponsorID is set, in which case all of that sponsor's rewards are.
+func (r *RewardRepository) GetRewards(sponsorID int) ([]*Reward, error) {
+	query := `SELECT ` + rewardColumns + ` FROM rewards WHERE active = 1 ORDER BY cost, id`
+	args := []interface{}{}
+	if sponsorID != 0 {
+		query = `SELECT ` + rewardColumns + ` FROM rewards WHERE sponsor_id = ? ORDER BY id`
+		args = append(args, sponsorID)
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rewards := []*Reward{}
+	for rows.Next() {
+		rw, err := scanReward(rows)
+		if err != nil {
+			return nil, err
+		}
+		rewards = append(rewards, rw)
+	}
+	return rewards, rows.Err()
+}
+
+const redemptionColumns = `id, reward_id, user_id, cost, code, status, created_at, used_at, voided_at, COALESCE(voided_by, 0), void_reason`
+
+func scanRedemption(row interface{ Scan(...interface{}) error }) (*Redemption, error) {
+	rd := &Redemption{}
+	err := row.Scan(&rd.ID, &rd.RewardID, &rd.UserID, &rd.Cost, &rd.Code, &rd.Status, &rd.CreatedAt, &rd.UsedAt, &rd.VoidedAt, &rd.VoidedBy, &rd.VoidReason)
+	return rd, err
+}
+
+// GetRedemption retrieves a redemption by id
+func (r *RewardRepository) GetRedemption(id int) (*Redemption, error) {
+	rd, err := scanRedemption(r.db.QueryRow(`SELECT `+redemptionColumns+` FROM redemptions WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return rd, err
+}
+
+// GetRedemptionByCode retrieves a redemption by its code
+func (r *RewardRepository) GetRedemptionByCode(code string) (*Redemption, error) {
+	rd, err := scanRedemption(r.db.QueryRow(`SELECT `+redemptionColumns+` FROM redemptions WHERE code = ?`, code))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return rd, err
+}
+
+// GetRedemptionsByUser returns a user's redemptions, newest first
+func (r *RewardRepository) GetRedemptionsByUser(userID int) ([]*Redemption, error) {
+	rows, err := r.db.Query(`SELECT `+redemptionColumns+` FROM redemptions WHERE user_id = ? ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	redemptions := []*Redemption{}
+	for rows.Next() {
+		rd, err := scanRedemption(rows)
+		if err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, rd)
+	}
+	return redemptions, rows.Err()
+}
+
+// Redeem spends the user's points on a reward and issues a single-use code.
+// Stock, the per-user limit and the balance are checked and updated in one
+// transaction, so concurrent redemptions cannot oversell or overspend.
+func (r *RewardRepository) Redeem(rewardID, userID int) (*Redemption, error) {
+	code, err := NewRedemptionCode()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rw, err := scanReward(tx.QueryRow(`SELECT `+rewardColumns+` FROM rewards WHERE id = ?`, rewardID))
+	if err == sql.ErrNoRows || (err == nil && !rw.Active) {
+		return nil, ErrRewardUnavailable
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if rw.PerUserLimit > 0 {
+		var n int
+		query := `SELECT COUNT(*) FROM redemptions WHERE reward_id = ? AND user_id = ? AND status != ?`
+		if err := tx.QueryRow(query, rewardID, userID, RedemptionVoided).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n >= rw.PerUserLimit {
+			return nil, ErrRedemptionLimit
+		}
+	}
+
+	res, err := tx.Exec(`UPDATE rewards SET stock = stock - 1 WHERE id = ? AND stock IS NOT NULL AND stock > 0`, rewardID)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 && rw.Stock != nil {
+		return nil, ErrOutOfStock
+	}
+
+	var balance int
+	if err := tx.QueryRow(`SELECT points FROM users WHERE id = ?`, userID).Scan(&balance); err != nil {
+		return nil, err
+	}
+	if balance < rw.Cost {
+		return nil, ErrInsufficientPoints
+	}
+
+	rd := &Redemption{RewardID: rewardID, UserID: userID, Cost: rw.Cost, Code: code, Status: RedemptionIssued}
+	query := `
+       INSERT INTO redemptions (reward_id, user_id, cost, code, status)
+       VALUES (?, ?, ?, ?, ?)
+       RETURNING id, created_at`
+	if err := tx.QueryRow(query, rd.RewardID, rd.UserID, rd.Cost, rd.Code, rd.Status).Scan(&rd.ID, &rd.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := addPointsTx(tx, &PointTransaction{UserID: userID, Amount: -rw.Cost, Reason: PointsReasonRedemption, RedemptionID: rd.ID, ActorID: userID}); err != nil {
+		return nil, err
+	}
+	return rd, tx.Commit()
+}
+
+// MarkUsed marks an issued redemption as used. It returns false if the code
+// was already used or voided.
+func (r *RewardRepository) MarkUsed(id int) (bool, error) {
+	res, err := r.db.Exec(`UPDATE redemptions SET status = ?, used_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ?`, RedemptionUsed, id, RedemptionIssued)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Void cancels a redemption, refunds its points and returns it to stock.
+// It returns nil if the redemption does not exist or was already voided.
+func (r *RewardRepository) Void(id, actorID int, reason string) (*Redemption, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+       UPDATE redemptions
+       SET status = ?, voided_at = CURRENT_TIMESTAMP, voided_by = ?, void_reason = ?
+       WHERE id = ? AND status != ?
+       RETURNING ` + redemptionColumns
+	rd, err := scanRedemption(tx.QueryRow(query, RedemptionVoided, actorID, reason, id, RedemptionVoided))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`UPDATE rewards SET stock = stock + 1 WHERE id = ? AND stock IS NOT NULL`, rd.RewardID); err != nil {
+		return nil, err
+	}
+	if err := addPointsTx(tx, &PointTransaction{UserID: rd.UserID, Amount: rd.Cost, Reason: PointsReasonRefund, RedemptionID: rd.ID, ActorID: actorID}); err != nil {
+		return nil, err
+	}
+	return rd, tx.Commit()
+}
@@ -0,0 +1,160 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+	_ "time/tzdata" // timezone names must resolve even on slim images
+)
+
+// Streak freeze rules: one freeze is earned for every StreakFreezeEvery
+// consecutive days, up to MaxStreakFreezes. Freezes are used up automatically
+// to cover missed days.
+const (
+	StreakFreezeEvery = 7
+	MaxStreakFreezes  = 2
+)
+
+const dayFormat = "2006-01-02"
+
+// Streak tracks consecutive days with a qualifying action
+type Streak struct {
+	UserID      int    `json:"user_id"`
+	Current     int    `json:"current"`
+	Longest     int    `json:"longest"`
+	LastDay     string `json:"last_day,omitempty"`
+	Freezes     int    `json:"freezes"`
+	Timezone    string `json:"timezone"`
+	ActiveToday bool   `json:"active_today"`
+}
+
+// UserLocation resolves a user's timezone, falling back to UTC for unknown names
+func UserLocation(tz string) *time.Location {
+	if loc, err := time.LoadLocation(tz); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// LocalDay returns the calendar date of t in loc as midnight UTC, so days
+// can be compared and subtracted without DST surprises
+func LocalDay(t time.Time, loc *time.Location) time.Time {
+	y, m, d := t.In(loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// WeekStart returns the Monday of the week containing day
+func WeekStart(day time.Time) time.Time {
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+func daysBetween(from, to time.Time) int {
+	return int(to.Sub(from).Hours() / 24)
+}
+
+// StreakRepository handles streak database operations
+type StreakRepository struct {
+	db *sql.DB
+}
+
+// NewStreakRepository creates a new streak repository
+func NewStreakRepository(db *sql.DB) *StreakRepository {
+	return &StreakRepository{db: db}
+}
+
+func getStreak(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, userID int) (*Streak, error) {
+	s := &Streak{UserID: userID}
+	query := `
+       SELECT u.timezone, COALESCE(s.current, 0), COALESCE(s.longest, 0), COALESCE(s.last_day, ''), COALESCE(s.freezes, 0)
+       FROM users u
+       LEFT JOIN user_streaks s ON s.user_id = u.id
+       WHERE u.id = ?`
+	err := q.QueryRow(query, userID).Scan(&s.Timezone, &s.Current, &s.Longest, &s.LastDay, &s.Freezes)
+	return s, err
+}
+
+// Get returns the user's streak as of now. A streak whose missed days can no
+// longer be covered by freezes is reported as 0.
+func (r *StreakRepository) Get(userID int) (*Streak, error) {
+	s, err := getStreak(r.db, userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil || s.LastDay == "" {
+		return s, err
+	}
+
+	last, err := time.Parse(dayFormat, s.LastDay)
+	if err != nil {
+		return nil, err
+	}
+	gap := daysBetween(last, LocalDay(time.Now(), UserLocation(s.Timezone)))
+	s.ActiveToday = gap == 0
+	if gap > 1 && gap-1 > s.Freezes {
+		s.Current = 0
+	}
+	return s, nil
+}
+
+// RecordActivity counts a qualifying action at the given time towards the
+// user's streak and returns the updated streak
+func (r *StreakRepository) RecordActivity(userID int, at time.Time) (*Streak, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	s, err := getStreak(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	today := LocalDay(at, UserLocation(s.Timezone))
+
+	if s.LastDay == "" {
+		s.Current = 1
+	} else {
+		last, err := time.Parse(dayFormat, s.LastDay)
+		if err != nil {
+			return nil, err
+		}
+		gap := daysBetween(last, today)
+		switch {
+		case gap <= 0:
+			// already counted today, or a late event for an earlier day
+			s.ActiveToday = true
+			return s, nil
+		case gap == 1:
+			s.Current++
+		case gap-1 <= s.Freezes:
+			s.Freezes -= gap - 1
+			s.Current++
+		default:
+			s.Current = 1
+		}
+	}
+
+	if s.Current%StreakFreezeEvery == 0 && s.Freezes < MaxStreakFreezes {
+		s.Freezes++
+	}
+	if s.Current > s.Longest {
+		s.Longest = s.Current
+	}
+	s.LastDay = today.Format(dayFormat)
+	s.ActiveToday = true
+
+	query := `
+       INSERT INTO user_streaks (user_id, current, longest, last_day, freezes, updated_at)
+       VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+       ON CONFLICT (user_id) DO UPDATE SET
+               current = excluded.current,
+               longest = excluded.longest,
+               last_day = excluded.last_day,
+               freezes = excluded.freezes,
+               updated_at = excluded.updated_at`
+	if _, err := tx.Exec(query, s.UserID, s.Current, s.Longest, s.LastDay, s.Freezes); err != nil {
+		return nil, err
+	}
+	return s, tx.Commit()
+}
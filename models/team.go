@@ -0,0 +1,280 @@
+package models
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrTeamNameTaken is returned when another team already uses the name
+var ErrTeamNameTaken = errors.New("team name already taken")
+
+// Team member roles
+const (
+	TeamRoleOwner  = "owner"
+	TeamRoleAdmin  = "admin"
+	TeamRoleMember = "member"
+)
+
+// Team represents a group of users competing together, such as a school or company
+type Team struct {
+	ID          int       `json:"id" db:"id"`
+	Name        string    `json:"name" db:"name"`
+	Description string    `json:"description" db:"description"`
+	InviteCode  string    `json:"invite_code,omitempty" db:"invite_code"`
+	OwnerID     int       `json:"owner_id" db:"owner_id"`
+	Exp         int       `json:"exp" db:"exp"`
+	MemberCount int       `json:"member_count"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+// TeamMember represents a user's membership in a team
+type TeamMember struct {
+	TeamID   int         `json:"team_id" db:"team_id"`
+	UserID   int         `json:"user_id" db:"user_id"`
+	User     *PublicUser `json:"user,omitempty"`
+	Role     string      `json:"role" db:"role"`
+	Exp      int         `json:"exp" db:"exp"`
+	JoinedAt time.Time   `json:"joined_at" db:"joined_at"`
+}
+
+// TeamRank is a team's position on the team leaderboard
+type TeamRank struct {
+	Rank int   `json:"rank"`
+	Team *Team `json:"team"`
+}
+
+// CanManage reports whether the member may manage invites and members
+func (m *TeamMember) CanManage() bool {
+	return m.Role == TeamRoleOwner || m.Role == TeamRoleAdmin
+}
+
+// ValidTeamRole reports whether role is a known team role
+func ValidTeamRole(role string) bool {
+	return role == TeamRoleOwner || role == TeamRoleAdmin || role == TeamRoleMember
+}
+
+// NewInviteCode returns a random invite code
+func NewInviteCode() (string, error) {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b), nil
+}
+
+// TeamRepository handles team database operations
+type TeamRepository struct {
+	db *sql.DB
+}
+
+// NewTeamRepository creates a new team repository
+func NewTeamRepository(db *sql.DB) *TeamRepository {
+	return &TeamRepository{db: db}
+}
+
+const teamColumns = `t.id, t.name, t.description, t.invite_code, t.owner_id, t.exp, t.created_at,
+               (SELECT COUNT(*) FROM team_members m WHERE m.team_id = t.id)`
+
+func scanTeam(row interface{ Scan(...interface{}) error }) (*Team, error) {
+	t := &Team{}
+	err := row.Scan(&t.ID, &t.Name, &t.Description, &t.InviteCode, &t.OwnerID, &t.Exp, &t.CreatedAt, &t.MemberCount)
+	return t, err
+}
+
+// Create inserts a new team and makes its owner the first member
+func (r *TeamRepository) Create(team *Team) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM teams WHERE name = ?)`, team.Name).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrTeamNameTaken
+	}
+
+	query := `
+       INSERT INTO teams (name, description, invite_code, owner_id)
+       VALUES (?, ?, ?, ?)
+       RETURNING id, exp, created_at`
+	if err := tx.QueryRow(query, team.Name, team.Description, team.InviteCode, team.OwnerID).Scan(&team.ID, &team.Exp, &team.CreatedAt); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO team_members (team_id, user_id, role) VALUES (?, ?, ?)`, team.ID, team.OwnerID, TeamRoleOwner); err != nil {
+		return err
+	}
+	team.MemberCount = 1
+	return tx.Commit()
+}
+
+// GetByID retrieves a team by id
+func (r *TeamRepository) GetByID(id int) (*Team, error) {
+	t, err := scanTeam(r.db.QueryRow(`SELECT `+teamColumns+` FROM teams t WHERE t.id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+// GetByInviteCode retrieves a team by its invite code
+func (r *TeamRepository) GetByInviteCode(code string) (*Team, error) {
+	t, err := scanTeam(r.db.QueryRow(`SELECT `+teamColumns+` FROM teams t WHERE t.invite_code = ?`, code))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+// GetByUserID returns the teams a user belongs to
+func (r *TeamRepository) GetByUserID(userID int) ([]*Team, error) {
+	query := `SELECT ` + teamColumns + `
+       FROM teams t
+       JOIN team_members tm ON tm.team_id = t.id
+       WHERE tm.user_id = ?
+       ORDER BY t.exp DESC`
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var teams []*Team
+	for rows.Next() {
+		t, err := scanTeam(rows)
+		if err != nil {
+			return nil, err
+		}
+		teams = append(teams, t)
+	}
+	return teams, rows.Err()
+}
+
+// Delete removes a team and its memberships
+func (r *TeamRepository) Delete(id int) error {
+	_, err := r.db.Exec(`DELETE FROM teams WHERE id = ?`, id)
+	return err
+}
+
+// SetInviteCode replaces a team's invite code
+func (r *TeamRepository) SetInviteCode(teamID int, code string) error {
+	_, err := r.db.Exec(`UPDATE teams SET invite_code = ? WHERE id = ?`, code, teamID)
+	return err
+}
+
+// AddMember adds a user to a team with the given role
+func (r *TeamRepository) AddMember(teamID, userID int, role string) error {
+	_, err := r.db.Exec(`INSERT INTO team_members (team_id, user_id, role) VALUES (?, ?, ?)`, teamID, userID, role)
+	return err
+}
+
+// RemoveMember removes a user from a team. The team keeps the EXP the member contributed.
+func (r *TeamRepository) RemoveMember(teamID, userID int) error {
+	_, err := r.db.Exec(`DELETE FROM team_members WHERE team_id = ? AND user_id = ?`, teamID, userID)
+	return err
+}
+
+// UpdateMemberRole changes a member's role
+func (r *TeamRepository) UpdateMemberRole(teamID, userID int, role string) error {
+	_, err := r.db.Exec(`UPDATE team_members SET role = ? WHERE team_id = ? AND user_id = ?`, role, teamID, userID)
+	return err
+}
+
+// TransferOwnership makes newOwnerID the owner and demotes the previous owner to admin
+func (r *TeamRepository) TransferOwnership(teamID, newOwnerID int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE team_members SET role = ? WHERE team_id = ? AND role = ?`, TeamRoleAdmin, teamID, TeamRoleOwner); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE team_members SET role = ? WHERE team_id = ? AND user_id = ?`, TeamRoleOwner, teamID, newOwnerID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE teams SET owner_id = ? WHERE id = ?`, newOwnerID, teamID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetMember retrieves a single membership
+func (r *TeamRepository) GetMember(teamID, userID int) (*TeamMember, error) {
+	m := &TeamMember{}
+	query := `SELECT team_id, user_id, role, exp, joined_at FROM team_members WHERE team_id = ? AND user_id = ?`
+	err := r.db.QueryRow(query, teamID, userID).Scan(&m.TeamID, &m.UserID, &m.Role, &m.Exp, &m.JoinedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return m, err
+}
+
+// GetMembers returns all members of a team ordered by contributed EXP
+func (r *TeamRepository) GetMembers(teamID int) ([]*TeamMember, error) {
+	query := `
+       SELECT tm.team_id, tm.user_id, tm.role, tm.exp, tm.joined_at,
+              ` + publicUserColumns + `
+       FROM team_members tm
+       JOIN users u ON tm.user_id = u.id
+       WHERE tm.team_id = ?
+       ORDER BY tm.exp DESC, tm.joined_at ASC`
+	rows, err := r.db.Query(query, teamID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []*TeamMember
+	for rows.Next() {
+		m := &TeamMember{}
+		u := &PublicUser{}
+		if err := rows.Scan(append([]interface{}{&m.TeamID, &m.UserID, &m.Role, &m.Exp, &m.JoinedAt}, u.scanDest()...)...); err != nil {
+			return nil, err
+		}
+		m.User = u
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// GetTopByExp returns teams ordered by EXP descending limited by count
+func (r *TeamRepository) GetTopByExp(limit int) ([]*TeamRank, error) {
+	query := `SELECT RANK() OVER (ORDER BY t.exp DESC), ` + teamColumns + `
+       FROM teams t
+       ORDER BY t.exp DESC, t.id ASC
+       LIMIT ?`
+	rows, err := r.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ranks []*TeamRank
+	for rows.Next() {
+		t := &Team{}
+		tr := &TeamRank{Team: t}
+		if err := rows.Scan(&tr.Rank, &t.ID, &t.Name, &t.Description, &t.InviteCode, &t.OwnerID, &t.Exp, &t.CreatedAt, &t.MemberCount); err != nil {
+			return nil, err
+		}
+		ranks = append(ranks, tr)
+	}
+	return ranks, rows.Err()
+}
+
+// GetRank returns the ranking (1-based) of a team by id
+func (r *TeamRepository) GetRank(teamID int) (int, error) {
+	var rank int
+	err := r.db.QueryRow(`SELECT COUNT(*) + 1 FROM teams WHERE exp > (SELECT exp FROM teams WHERE id = ?)`, teamID).Scan(&rank)
+	return rank, err
+}
@@ -2,20 +2,112 @@ package models
 
 import (
 	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // TrashPost represents a trash spot reported by a user
 type TrashPost struct {
-	ID          int       `json:"id" db:"id"`
-	UserID      int       `json:"user_id" db:"user_id"`
-	User        *User     `json:"user,omitempty"`
-	Latitude    float64   `json:"latitude" db:"latitude"`
-	Longitude   float64   `json:"longitude" db:"longitude"`
-	ImagePath   string    `json:"image_path,omitempty" db:"image_path"`
-	Description string    `json:"description" db:"description"`
-	Trail       string    `json:"trail,omitempty" db:"trail"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	ID           int         `json:"id" db:"id"`
+	UserID       int         `json:"user_id" db:"user_id"`
+	User         *PublicUser `json:"user,omitempty"`
+	Latitude     float64     `json:"latitude" db:"latitude"`
+	Longitude    float64     `json:"longitude" db:"longitude"`
+	ImagePath    string      `json:"image_path,omitempty" db:"image_path"`
+	Description  string      `json:"description" db:"description"`
+	Trail        string      `json:"trail,omitempty" db:"trail"`
+	Categories   []string    `json:"categories"`
+	Severity     string      `json:"severity,omitempty" db:"severity"`
+	VolumeLiters float64     `json:"volume_liters,omitempty" db:"volume_liters"`
+	Hazards      []string    `json:"hazards"`
+	Hazardous    bool        `json:"hazardous"`
+	Status       string      `json:"status" db:"status"`
+	Hidden       bool        `json:"hidden,omitempty" db:"hidden"`
+	CreatedAt    time.Time   `json:"created_at" db:"created_at"`
+
+	Verification *VerificationSummary `json:"verification,omitempty"`
+}
+
+// TrashPostFilter narrows post listings, exports and statistics. Zero fields do not filter.
+// Posts hidden by moderation are always left out, and so are posts by
+// shadow-banned users other than the viewer.
+type TrashPostFilter struct {
+	Start, End  *time.Time
+	Categories  []string
+	MinSeverity int
+	Hazards     []string
+	Hazardous   *bool
+	Status      string
+	// ViewerID is the user looking, 0 when anonymous
+	ViewerID int
+}
+
+// shadowBannedSQL is true for user ids other than the viewer's whose account is shadow-banned
+const shadowBannedSQL = `IN (SELECT id FROM users WHERE status = 'shadow_banned' AND id != ?)`
+
+// hazardousSQL is true for posts with a hazard flag or a hazardous category
+const hazardousSQL = `(EXISTS (SELECT 1 FROM trash_post_hazards h WHERE h.post_id = tp.id)
+               OR EXISTS (SELECT 1 FROM trash_post_categories pc JOIN trash_categories c ON c.id = pc.category_id
+                          WHERE pc.post_id = tp.id AND c.hazardous = 1))`
+
+func placeholders(n int) string {
+	return "?" + strings.Repeat(", ?", n-1)
+}
+
+// where returns the SQL condition for the filter on trash_posts aliased tp
+func (f TrashPostFilter) where() (string, []interface{}) {
+	conds := []string{"tp.hidden = 0", "tp.user_id NOT " + shadowBannedSQL}
+	args := []interface{}{f.ViewerID}
+	if f.Start != nil {
+		conds = append(conds, "tp.created_at >= ?")
+		args = append(args, f.Start.UTC().Format(sqliteTimeFormat))
+	}
+	if f.End != nil {
+		conds = append(conds, "tp.created_at <= ?")
+		args = append(args, f.End.UTC().Format(sqliteTimeFormat))
+	}
+	if len(f.Categories) > 0 {
+		conds = append(conds, `tp.id IN (SELECT pc.post_id FROM trash_post_categories pc
+                       JOIN trash_categories c ON c.id = pc.category_id WHERE c.key IN (`+placeholders(len(f.Categories))+`))`)
+		for _, c := range f.Categories {
+			args = append(args, c)
+		}
+	}
+	if f.MinSeverity > 0 {
+		conds = append(conds, "tp.severity >= ?")
+		args = append(args, f.MinSeverity)
+	}
+	if len(f.Hazards) > 0 {
+		conds = append(conds, `tp.id IN (SELECT post_id FROM trash_post_hazards WHERE hazard IN (`+placeholders(len(f.Hazards))+`))`)
+		for _, h := range f.Hazards {
+			args = append(args, h)
+		}
+	}
+	if f.Hazardous != nil {
+		if *f.Hazardous {
+			conds = append(conds, hazardousSQL)
+		} else {
+			conds = append(conds, "NOT "+hazardousSQL)
+		}
+	}
+	if f.Status != "" {
+		conds = append(conds, "tp.status = ?")
+		args = append(args, f.Status)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// TrashPostStats summarizes the posts matching a filter
+type TrashPostStats struct {
+	Total        int            `json:"total"`
+	Hazardous    int            `json:"hazardous"`
+	VolumeLiters float64        `json:"volume_liters"`
+	ByCategory   map[string]int `json:"by_category"`
+	BySeverity   map[string]int `json:"by_severity"`
+	ByHazard     map[string]int `json:"by_hazard"`
+	ByStatus     map[string]int `json:"by_status"`
 }
 
 // TrashPostRepository handles trash post database operations
@@ -28,53 +120,198 @@ func NewTrashPostRepository(db *sql.DB) *TrashPostRepository {
 	return &TrashPostRepository{db: db}
 }
 
-// Create inserts a new trash post
+// Create inserts a new trash post with its categories and hazard flags.
+// Categories are given by key and must exist.
 func (r *TrashPostRepository) Create(post *TrashPost) error {
-	query := `
-       INSERT INTO trash_posts (user_id, latitude, longitude, image_path, description, trail)
-       VALUES (?, ?, ?, ?, ?, ?)`
+	severity, ok := SeverityRank(post.Severity)
+	if !ok {
+		return fmt.Errorf("unknown severity %q", post.Severity)
+	}
 
-	res, err := r.db.Exec(query, post.UserID, post.Latitude, post.Longitude, post.ImagePath, post.Description, post.Trail)
+	tx, err := r.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	id, err := res.LastInsertId()
-	if err != nil {
+	query := `
+       INSERT INTO trash_posts (user_id, latitude, longitude, image_path, description, trail, severity, volume_liters)
+       VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+       RETURNING id, status, created_at`
+	if err := tx.QueryRow(query, post.UserID, post.Latitude, post.Longitude, post.ImagePath, post.Description, post.Trail,
+		severity, post.VolumeLiters).Scan(&post.ID, &post.Status, &post.CreatedAt); err != nil {
 		return err
 	}
 
-	post.ID = int(id)
-	return r.db.QueryRow(`SELECT created_at FROM trash_posts WHERE id = ?`, post.ID).Scan(&post.CreatedAt)
+	for _, key := range post.Categories {
+		var hazardous bool
+		query := `
+               INSERT INTO trash_post_categories (post_id, category_id)
+               SELECT ?, id FROM trash_categories WHERE key = ?
+               RETURNING (SELECT hazardous FROM trash_categories WHERE key = ?)`
+		if err := tx.QueryRow(query, post.ID, key, key).Scan(&hazardous); err != nil {
+			return fmt.Errorf("category %q: %w", key, err)
+		}
+		post.Hazardous = post.Hazardous || hazardous
+	}
+	for _, hazard := range post.Hazards {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO trash_post_hazards (post_id, hazard) VALUES (?, ?)`, post.ID, hazard); err != nil {
+			return err
+		}
+		post.Hazardous = true
+	}
+	return tx.Commit()
 }
 
-// GetByDateRange returns all trash posts between start and end dates inclusive
-func (r *TrashPostRepository) GetByDateRange(start, end time.Time) ([]*TrashPost, error) {
+// Search returns the posts matching the filter, newest first
+func (r *TrashPostRepository) Search(f TrashPostFilter) ([]*TrashPost, error) {
+	where, args := f.where()
 	query := `
-       SELECT tp.id, tp.user_id, tp.latitude, tp.longitude, COALESCE(tp.image_path, ''), tp.description, COALESCE(tp.trail, ''), tp.created_at,
-              u.id, u.name, u.email, u.is_admin, u.exp, u.created_at, u.updated_at
+       SELECT tp.id, tp.user_id, tp.latitude, tp.longitude, COALESCE(tp.image_path, ''), tp.description, COALESCE(tp.trail, ''),
+              tp.severity, tp.volume_liters, tp.status, tp.created_at,
+              ` + publicUserColumns + `
        FROM trash_posts tp
        JOIN users u ON tp.user_id = u.id
-       WHERE tp.created_at BETWEEN ? AND ?
+       WHERE ` + where + `
        ORDER BY tp.created_at DESC`
 
-	rows, err := r.db.Query(query, start, end)
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var posts []*TrashPost
+	posts := []*TrashPost{}
 	for rows.Next() {
 		p := &TrashPost{}
-		u := &User{}
-		if err := rows.Scan(&p.ID, &p.UserID, &p.Latitude, &p.Longitude, &p.ImagePath, &p.Description, &p.Trail, &p.CreatedAt, &u.ID, &u.Name, &u.Email, &u.IsAdmin, &u.Exp, &u.CreatedAt, &u.UpdatedAt); err != nil {
+		u := &PublicUser{}
+		var severity int
+		if err := rows.Scan(append([]interface{}{&p.ID, &p.UserID, &p.Latitude, &p.Longitude, &p.ImagePath, &p.Description, &p.Trail,
+			&severity, &p.VolumeLiters, &p.Status, &p.CreatedAt}, u.scanDest()...)...); err != nil {
 			return nil, err
 		}
+		p.Severity = severityName(severity)
 		p.User = u
 		posts = append(posts, p)
 	}
-	return posts, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return posts, r.loadDetails(posts)
+}
+
+// loadDetails fills in the categories and hazard flags of each post
+func (r *TrashPostRepository) loadDetails(posts []*TrashPost) error {
+	byID := make(map[int]*TrashPost, len(posts))
+	for _, p := range posts {
+		p.Categories, p.Hazards = []string{}, []string{}
+		byID[p.ID] = p
+	}
+
+	// stay well below SQLite's bound parameter limit
+	const chunk = 500
+	for start := 0; start < len(posts); start += chunk {
+		end := start + chunk
+		if end > len(posts) {
+			end = len(posts)
+		}
+		ids := make([]interface{}, 0, end-start)
+		for _, p := range posts[start:end] {
+			ids = append(ids, p.ID)
+		}
+		in := placeholders(len(ids))
+
+		query := `
+               SELECT pc.post_id, 'category', c.key, c.hazardous
+               FROM trash_post_categories pc JOIN trash_categories c ON c.id = pc.category_id
+               WHERE pc.post_id IN (` + in + `)
+               UNION ALL
+               SELECT post_id, 'hazard', hazard, 1 FROM trash_post_hazards WHERE post_id IN (` + in + `)
+               ORDER BY 3`
+		rows, err := r.db.Query(query, append(ids, ids...)...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var postID int
+			var kind, value string
+			var hazardous bool
+			if err := rows.Scan(&postID, &kind, &value, &hazardous); err != nil {
+				rows.Close()
+				return err
+			}
+			p := byID[postID]
+			if kind == "category" {
+				p.Categories = append(p.Categories, value)
+			} else {
+				p.Hazards = append(p.Hazards, value)
+			}
+			p.Hazardous = p.Hazardous || hazardous
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats summarizes the posts matching the filter
+func (r *TrashPostRepository) Stats(f TrashPostFilter) (*TrashPostStats, error) {
+	where, args := f.where()
+	s := &TrashPostStats{
+		ByCategory: map[string]int{},
+		BySeverity: map[string]int{},
+		ByHazard:   map[string]int{},
+		ByStatus:   map[string]int{},
+	}
+
+	query := `SELECT COUNT(*), COALESCE(SUM(tp.volume_liters), 0), COALESCE(SUM(` + hazardousSQL + `), 0) FROM trash_posts tp WHERE ` + where
+	if err := r.db.QueryRow(query, args...).Scan(&s.Total, &s.VolumeLiters, &s.Hazardous); err != nil {
+		return nil, err
+	}
+
+	groups := []struct {
+		query string
+		into  map[string]int
+	}{
+		{`SELECT c.key, COUNT(*) FROM trash_post_categories pc JOIN trash_categories c ON c.id = pc.category_id
+               WHERE pc.post_id IN (SELECT tp.id FROM trash_posts tp WHERE ` + where + `) GROUP BY c.key`, s.ByCategory},
+		{`SELECT h.hazard, COUNT(*) FROM trash_post_hazards h
+               WHERE h.post_id IN (SELECT tp.id FROM trash_posts tp WHERE ` + where + `) GROUP BY h.hazard`, s.ByHazard},
+		{`SELECT tp.severity, COUNT(*) FROM trash_posts tp WHERE ` + where + ` GROUP BY tp.severity`, nil},
+		{`SELECT tp.status, COUNT(*) FROM trash_posts tp WHERE ` + where + ` GROUP BY tp.status`, s.ByStatus},
+	}
+	for _, g := range groups {
+		rows, err := r.db.Query(g.query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var key string
+			var n int
+			if err := rows.Scan(&key, &n); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if g.into == nil {
+				// severities are stored as ranks
+				rank, _ := strconv.Atoi(key)
+				name := severityName(rank)
+				if name == "" {
+					name = "unspecified"
+				}
+				s.BySeverity[name] = n
+				continue
+			}
+			g.into[key] = n
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 // Delete removes a trash post by id
@@ -86,19 +323,24 @@ func (r *TrashPostRepository) Delete(id int) error {
 // GetByID retrieves a single trash post
 func (r *TrashPostRepository) GetByID(id int) (*TrashPost, error) {
 	p := &TrashPost{}
-	query := `SELECT id, user_id, latitude, longitude, COALESCE(image_path, ''), description, COALESCE(trail, ''), created_at FROM trash_posts WHERE id = ?`
-	err := r.db.QueryRow(query, id).Scan(&p.ID, &p.UserID, &p.Latitude, &p.Longitude, &p.ImagePath, &p.Description, &p.Trail, &p.CreatedAt)
+	var severity int
+	query := `SELECT id, user_id, latitude, longitude, COALESCE(image_path, ''), description, COALESCE(trail, ''), severity, volume_liters, status, hidden, created_at FROM trash_posts WHERE id = ?`
+	err := r.db.QueryRow(query, id).Scan(&p.ID, &p.UserID, &p.Latitude, &p.Longitude, &p.ImagePath, &p.Description, &p.Trail, &severity, &p.VolumeLiters, &p.Status, &p.Hidden, &p.CreatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return p, err
+	if err != nil {
+		return nil, err
+	}
+	p.Severity = severityName(severity)
+	return p, r.loadDetails([]*TrashPost{p})
 }
 
 // GetOldestWithImage returns the oldest post that has an image
 func (r *TrashPostRepository) GetOldestWithImage() (*TrashPost, error) {
 	p := &TrashPost{}
-	query := `SELECT id, user_id, latitude, longitude, image_path, description, trail, created_at FROM trash_posts WHERE image_path != '' ORDER BY created_at ASC LIMIT 1`
-	err := r.db.QueryRow(query).Scan(&p.ID, &p.UserID, &p.Latitude, &p.Longitude, &p.ImagePath, &p.Description, &p.Trail, &p.CreatedAt)
+	query := `SELECT id, user_id, latitude, longitude, image_path, description, COALESCE(trail, ''), status, created_at FROM trash_posts WHERE image_path != '' ORDER BY created_at ASC LIMIT 1`
+	err := r.db.QueryRow(query).Scan(&p.ID, &p.UserID, &p.Latitude, &p.Longitude, &p.ImagePath, &p.Description, &p.Trail, &p.Status, &p.CreatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
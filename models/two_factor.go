@@ -0,0 +1,406 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters, the defaults every authenticator app supports (RFC 6238)
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is how many steps either side of now are accepted, for clock drift
+	totpSkew = 1
+)
+
+// RecoveryCodeCount is how many recovery codes a user gets at a time
+const RecoveryCodeCount = 10
+
+// Failed codes lock two-factor verification for a while, so the six digits
+// cannot be guessed
+const (
+	maxTwoFactorFailures = 5
+	twoFactorLockout     = 15 * time.Minute
+)
+
+// Two-factor errors
+var (
+	ErrTwoFactorNotEnrolled = errors.New("two-factor authentication is not set up")
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorCode        = errors.New("invalid two-factor code")
+	ErrTwoFactorLocked      = errors.New("too many invalid two-factor codes, try again later")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random base32 secret for an authenticator app
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPCode returns the code for the secret at the given time step
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000), nil
+}
+
+// ProvisioningURI returns the otpauth:// URI authenticator apps read from a QR code
+func ProvisioningURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// isTOTPCode reports whether code looks like a TOTP code rather than a recovery code
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeRecoveryCode ignores case, spaces and dashes people add when typing codes
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+}
+
+// newRecoveryCodes returns RecoveryCodeCount random codes shaped like xxxxx-xxxxx
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+// TwoFactorStatus describes a user's two-factor setup
+type TwoFactorStatus struct {
+	Enabled           bool       `json:"enabled"`
+	EnabledAt         *time.Time `json:"enabled_at,omitempty"`
+	RecoveryCodesLeft int        `json:"recovery_codes_left"`
+	RequiredByPolicy  bool       `json:"required_by_policy"`
+	PendingEnrollment bool       `json:"pending_enrollment,omitempty"`
+}
+
+// TwoFactorRepository handles TOTP secrets, recovery codes and the two-factor policy
+type TwoFactorRepository struct {
+	db *sql.DB
+}
+
+// NewTwoFactorRepository creates a new two-factor repository
+func NewTwoFactorRepository(db *sql.DB) *TwoFactorRepository {
+	return &TwoFactorRepository{db: db}
+}
+
+// Status returns the user's two-factor setup
+func (r *TwoFactorRepository) Status(user *User) (*TwoFactorStatus, error) {
+	s := &TwoFactorStatus{Enabled: user.TwoFactorEnabledAt != nil, EnabledAt: user.TwoFactorEnabledAt}
+	query := `
+       SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = ?),
+              (SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = ? AND used_at IS NULL),
+              EXISTS (SELECT 1 FROM two_factor_policy WHERE role = ?)`
+	var enrolled bool
+	if err := r.db.QueryRow(query, user.ID, user.ID, user.Role).Scan(&enrolled, &s.RecoveryCodesLeft, &s.RequiredByPolicy); err != nil {
+		return nil, err
+	}
+	s.PendingEnrollment = enrolled && !s.Enabled
+	return s, nil
+}
+
+// Enroll starts two-factor setup with a new secret, replacing any unconfirmed one
+func (r *TwoFactorRepository) Enroll(userID int) (string, error) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var enabled bool
+	if err := tx.QueryRow(`SELECT two_factor_enabled_at IS NOT NULL FROM users WHERE id = ?`, userID).Scan(&enabled); err != nil {
+		return "", err
+	}
+	if enabled {
+		return "", ErrTwoFactorEnabled
+	}
+	query := `
+       INSERT INTO user_totp (user_id, secret) VALUES (?, ?)
+       ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret, last_step = 0,
+              failures = 0, locked_until = NULL, created_at = CURRENT_TIMESTAMP`
+	if _, err := tx.Exec(query, userID, secret); err != nil {
+		return "", err
+	}
+	return secret, tx.Commit()
+}
+
+// Confirm enables two-factor authentication once the user proves their
+// authenticator produces codes for the enrolled secret, and signs out the
+// sessions that began without it. It returns the user's recovery codes in
+// plain form; only their hashes are kept.
+func (r *TwoFactorRepository) Confirm(userID int, code string) ([]string, error) {
+	var codes []string
+	err := r.verify(userID, code, false, func(tx *sql.Tx) error {
+		var enabled bool
+		if err := tx.QueryRow(`SELECT two_factor_enabled_at IS NOT NULL FROM users WHERE id = ?`, userID).Scan(&enabled); err != nil {
+			return err
+		}
+		if enabled {
+			return ErrTwoFactorEnabled
+		}
+		query := `
+       UPDATE users SET two_factor_enabled_at = CURRENT_TIMESTAMP, token_version = token_version + 1,
+              updated_at = CURRENT_TIMESTAMP
+       WHERE id = ?`
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+		var err error
+		codes, err = replaceRecoveryCodesTx(tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+// Verify checks a TOTP or recovery code for a user with two-factor
+// authentication enabled. A recovery code is used up by a successful check.
+func (r *TwoFactorRepository) Verify(userID int, code string) error {
+	return r.verify(userID, code, true, func(tx *sql.Tx) error {
+		var enabled bool
+		if err := tx.QueryRow(`SELECT two_factor_enabled_at IS NOT NULL FROM users WHERE id = ?`, userID).Scan(&enabled); err != nil {
+			return err
+		}
+		if !enabled {
+			return ErrTwoFactorNotEnrolled
+		}
+		return nil
+	})
+}
+
+// verify checks code against the user's secret, and recovery codes if
+// allowRecovery, then runs then in the same transaction. Failed codes are
+// counted even though the error is returned, and lock the user out of
+// verification after maxTwoFactorFailures.
+func (r *TwoFactorRepository) verify(userID int, code string, allowRecovery bool, then func(tx *sql.Tx) error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var lastStep int64
+	var failures int
+	var lockedUntil *time.Time
+	err = tx.QueryRow(`SELECT secret, last_step, failures, locked_until FROM user_totp WHERE user_id = ?`, userID).Scan(
+		&secret, &lastStep, &failures, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return ErrTwoFactorNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if lockedUntil != nil && lockedUntil.After(now) {
+		return ErrTwoFactorLocked
+	}
+
+	ok := false
+	code = strings.TrimSpace(code)
+	if isTOTPCode(code) {
+		current := now.Unix() / totpPeriod
+		for step := current - totpSkew; step <= current+totpSkew; step++ {
+			want, err := TOTPCode(secret, step)
+			if err != nil {
+				return err
+			}
+			if step > lastStep && hmac.Equal([]byte(want), []byte(code)) {
+				lastStep, ok = step, true
+				break
+			}
+		}
+	} else if allowRecovery && code != "" {
+		res, err := tx.Exec(`UPDATE user_recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`,
+			userID, HashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		ok = n > 0
+	}
+
+	if !ok {
+		failures++
+		var until interface{}
+		if failures >= maxTwoFactorFailures {
+			failures = 0
+			until = now.UTC().Add(twoFactorLockout).Format(sqliteTimeFormat)
+		}
+		if _, err := tx.Exec(`UPDATE user_totp SET failures = ?, locked_until = ? WHERE user_id = ?`, failures, until, userID); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return ErrTwoFactorCode
+	}
+
+	if _, err := tx.Exec(`UPDATE user_totp SET last_step = ?, failures = 0, locked_until = NULL WHERE user_id = ?`, lastStep, userID); err != nil {
+		return err
+	}
+	if err := then(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// replaceRecoveryCodesTx discards the user's recovery codes and stores new ones
+func replaceRecoveryCodesTx(tx *sql.Tx, userID int) ([]string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return nil, err
+	}
+	for _, c := range codes {
+		if _, err := tx.Exec(`INSERT INTO user_recovery_codes (user_id, code_hash) VALUES (?, ?)`,
+			userID, HashToken(normalizeRecoveryCode(c))); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes after checking a
+// current code, and returns the new ones in plain form
+func (r *TwoFactorRepository) RegenerateRecoveryCodes(userID int, code string) ([]string, error) {
+	var codes []string
+	err := r.verify(userID, code, true, func(tx *sql.Tx) error {
+		var err error
+		codes, err = replaceRecoveryCodesTx(tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+// Disable removes the user's secret and recovery codes
+func (r *TwoFactorRepository) Disable(userID int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM user_totp WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE users SET two_factor_enabled_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RequiredRoles returns the roles that must use two-factor authentication
+func (r *TwoFactorRepository) RequiredRoles() ([]string, error) {
+	rows, err := r.db.Query(`SELECT role FROM two_factor_policy ORDER BY role`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// SetRequiredRoles replaces the roles that must use two-factor authentication
+func (r *TwoFactorRepository) SetRequiredRoles(roles []string) error {
+	for _, role := range roles {
+		if !ValidRole(role) {
+			return fmt.Errorf("invalid role %q", role)
+		}
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM two_factor_policy`); err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO two_factor_policy (role) VALUES (?)`, role); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// TwoFactorRequired reports whether the policy requires the role to use
+// two-factor authentication
+func (r *UserRepository) TwoFactorRequired(role string) (bool, error) {
+	var required bool
+	err := r.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM two_factor_policy WHERE role = ?)`, role).Scan(&required)
+	return required, err
+}
@@ -2,21 +2,98 @@ package models
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+// User roles. Admins can do everything moderators can.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// ValidRole reports whether r is a known role
+func ValidRole(r string) bool {
+	return r == RoleUser || r == RoleModerator || r == RoleAdmin
+}
+
+// Account states. Suspension is not stored as a state: an active account is
+// suspended while its suspended_until lies in the future.
+const (
+	AccountActive       = "active"
+	AccountSuspended    = "suspended"
+	AccountBanned       = "banned"
+	AccountShadowBanned = "shadow_banned"
+	// AccountDeleted is an account its owner deleted while keeping their
+	// posts; it holds no personal data and cannot sign in
+	AccountDeleted = "deleted"
+)
+
+// ErrEmailTaken is returned when an address already belongs to another user
+var ErrEmailTaken = errors.New("email already in use")
+
 // User represents a user in the system
 type User struct {
-	ID           int       `json:"id" db:"id"`
-	Name         string    `json:"name" db:"name"`
-	Email        string    `json:"email" db:"email"`
-	PasswordHash string    `json:"-" db:"password"`
-	IsAdmin      bool      `json:"is_admin" db:"is_admin"`
-	Exp          int       `json:"exp" db:"exp"`
-	CreatedAt    time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+	ID           int    `json:"id" db:"id"`
+	Name         string `json:"name" db:"name"`
+	Email        string `json:"email" db:"email"`
+	PasswordHash string `json:"-" db:"password"`
+	IsAdmin      bool   `json:"is_admin" db:"is_admin"`
+	Exp          int    `json:"exp" db:"exp"`
+	Timezone     string `json:"timezone,omitempty" db:"timezone"`
+	IsSponsor    bool   `json:"is_sponsor,omitempty" db:"is_sponsor"`
+	Role         string `json:"role" db:"role"`
+	// SuspendedUntil is set while a moderator has suspended the account
+	SuspendedUntil *time.Time `json:"suspended_until,omitempty" db:"suspended_until"`
+	// Status is never serialized so shadow-banned users cannot tell
+	Status string `json:"-" db:"status"`
+	// TokenVersion is embedded in issued tokens; bumping it revokes them all
+	TokenVersion    int        `json:"-" db:"token_version"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty" db:"email_verified_at"`
+	// TwoFactorEnabledAt is set once the user confirmed a TOTP authenticator
+	TwoFactorEnabledAt *time.Time      `json:"two_factor_enabled_at,omitempty" db:"two_factor_enabled_at"`
+	Privacy            PrivacySettings `json:"privacy"`
+	// AvatarKey names the user's uploaded avatar files, empty for none
+	AvatarKey string    `json:"-" db:"avatar_key"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// PrivacySettings control what other users can see of a user
+type PrivacySettings struct {
+	// HideFromLeaderboard leaves the user off user leaderboards
+	HideFromLeaderboard bool `json:"hide_from_leaderboard" db:"hide_from_leaderboard"`
+	// HideActivity leaves stats out of the user's profile
+	HideActivity bool `json:"hide_activity" db:"hide_activity"`
+	// PrivateProfile shows others only the user's name on their profile
+	PrivateProfile bool `json:"private_profile" db:"private_profile"`
+}
+
+// MarshalJSON adds the user's position on the level curve and avatar URLs
+func (u User) MarshalJSON() ([]byte, error) {
+	type user User
+	return json.Marshal(struct {
+		user
+		LevelProgress
+		AvatarURLs map[string]string `json:"avatar_urls"`
+	}{user(u), CurrentLevelCurve().Progress(u.Exp), AvatarURLs(u.ID, u.AvatarKey)})
+}
+
+// IsModerator reports whether the user may act on reported content
+func (u *User) IsModerator() bool {
+	return u.IsAdmin || u.Role == RoleModerator || u.Role == RoleAdmin
+}
+
+// AccountState returns the user's effective account state at now
+func (u *User) AccountState(now time.Time) string {
+	if u.Status == AccountActive && u.SuspendedUntil != nil && u.SuspendedUntil.After(now) {
+		return AccountSuspended
+	}
+	return u.Status
 }
 
 // SetPassword hashes and sets the password for the user
@@ -36,13 +113,13 @@ func (u *User) CheckPassword(pw string) bool {
 
 // Post represents a post in the system
 type Post struct {
-	ID        int       `json:"id" db:"id"`
-	Title     string    `json:"title" db:"title"`
-	Content   string    `json:"content" db:"content"`
-	UserID    int       `json:"user_id" db:"user_id"`
-	User      *User     `json:"user,omitempty"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	ID        int         `json:"id" db:"id"`
+	Title     string      `json:"title" db:"title"`
+	Content   string      `json:"content" db:"content"`
+	UserID    int         `json:"user_id" db:"user_id"`
+	User      *PublicUser `json:"user,omitempty"`
+	CreatedAt time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at" db:"updated_at"`
 }
 
 // UserRepository handles user database operations
@@ -55,26 +132,37 @@ func NewUserRepository(db *sql.DB) *UserRepository {
 	return &UserRepository{db: db}
 }
 
+// userColumns lists the users columns read by scanUser
+const userColumns = `id, name, email, password, is_admin, exp, timezone, is_sponsor, role, suspended_until, status, token_version, email_verified_at, two_factor_enabled_at, hide_from_leaderboard, hide_activity, private_profile, avatar_key, created_at, updated_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (*User, error) {
+	u := &User{}
+	err := row.Scan(&u.ID, &u.Name, &u.Email, &u.PasswordHash, &u.IsAdmin, &u.Exp, &u.Timezone, &u.IsSponsor, &u.Role, &u.SuspendedUntil, &u.Status, &u.TokenVersion, &u.EmailVerifiedAt, &u.TwoFactorEnabledAt,
+		&u.Privacy.HideFromLeaderboard, &u.Privacy.HideActivity, &u.Privacy.PrivateProfile, &u.AvatarKey, &u.CreatedAt, &u.UpdatedAt)
+	return u, err
+}
+
 // Create creates a new user
 func (r *UserRepository) Create(user *User) error {
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+	if user.IsAdmin {
+		user.Role = RoleAdmin
+	}
 	query := `
-               INSERT INTO users (name, email, password, is_admin)
-               VALUES (?, ?, ?, ?)
-               RETURNING id, exp, created_at, updated_at`
+               INSERT INTO users (name, email, password, is_admin, role)
+               VALUES (?, ?, ?, ?, ?)
+               RETURNING id, exp, status, created_at, updated_at`
 
-	err := r.db.QueryRow(query, user.Name, user.Email, user.PasswordHash, user.IsAdmin).Scan(
-		&user.ID, &user.Exp, &user.CreatedAt, &user.UpdatedAt)
+	err := r.db.QueryRow(query, user.Name, user.Email, user.PasswordHash, user.IsAdmin, user.Role).Scan(
+		&user.ID, &user.Exp, &user.Status, &user.CreatedAt, &user.UpdatedAt)
 	return err
 }
 
 // GetByID retrieves a user by ID
 func (r *UserRepository) GetByID(id int) (*User, error) {
-	user := &User{}
-	query := `SELECT id, name, email, password, is_admin, exp, created_at, updated_at FROM users WHERE id = ?`
-
-	err := r.db.QueryRow(query, id).Scan(
-		&user.ID, &user.Name, &user.Email, &user.PasswordHash, &user.IsAdmin, &user.Exp, &user.CreatedAt, &user.UpdatedAt)
-
+	user, err := scanUser(r.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -83,12 +171,18 @@ func (r *UserRepository) GetByID(id int) (*User, error) {
 
 // GetByEmail retrieves a user by email
 func (r *UserRepository) GetByEmail(email string) (*User, error) {
-	user := &User{}
-	query := `SELECT id, name, email, password, is_admin, exp, created_at, updated_at FROM users WHERE email = ?`
-
-	err := r.db.QueryRow(query, email).Scan(
-		&user.ID, &user.Name, &user.Email, &user.PasswordHash, &user.IsAdmin, &user.Exp, &user.CreatedAt, &user.UpdatedAt)
+	user, err := scanUser(r.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = ?`, email))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return user, err
+}
 
+// FindByEmail retrieves a user by email ignoring case, preferring an exact
+// match where older accounts differ only in case
+func (r *UserRepository) FindByEmail(email string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE email = ? COLLATE NOCASE ORDER BY email = ? DESC, id LIMIT 1`
+	user, err := scanUser(r.db.QueryRow(query, email, email))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -97,7 +191,7 @@ func (r *UserRepository) GetByEmail(email string) (*User, error) {
 
 // GetAll retrieves all users
 func (r *UserRepository) GetAll() ([]*User, error) {
-	query := `SELECT id, name, email, password, is_admin, exp, created_at, updated_at FROM users ORDER BY created_at DESC`
+	query := `SELECT ` + userColumns + ` FROM users ORDER BY created_at DESC`
 
 	rows, err := r.db.Query(query)
 	if err != nil {
@@ -107,8 +201,7 @@ func (r *UserRepository) GetAll() ([]*User, error) {
 
 	var users []*User
 	for rows.Next() {
-		user := &User{}
-		err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.PasswordHash, &user.IsAdmin, &user.Exp, &user.CreatedAt, &user.UpdatedAt)
+		user, err := scanUser(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -117,49 +210,71 @@ func (r *UserRepository) GetAll() ([]*User, error) {
 	return users, nil
 }
 
-// Update updates a user
-func (r *UserRepository) Update(user *User) error {
-	query := `
-               UPDATE users
-               SET name = ?, email = ?, password = ?, is_admin = ?, updated_at = CURRENT_TIMESTAMP
-               WHERE id = ?`
-
-	_, err := r.db.Exec(query, user.Name, user.Email, user.PasswordHash, user.IsAdmin, user.ID)
+// SetName changes the user's display name
+func (r *UserRepository) SetName(userID int, name string) error {
+	_, err := r.db.Exec(`UPDATE users SET name = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, name, userID)
 	return err
 }
 
-// Delete deletes a user
-func (r *UserRepository) Delete(id int) error {
-	query := `DELETE FROM users WHERE id = ?`
-	_, err := r.db.Exec(query, id)
+// SetPrivacy replaces the user's privacy settings
+func (r *UserRepository) SetPrivacy(userID int, p PrivacySettings) error {
+	query := `UPDATE users SET hide_from_leaderboard = ?, hide_activity = ?, private_profile = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	_, err := r.db.Exec(query, p.HideFromLeaderboard, p.HideActivity, p.PrivateProfile, userID)
 	return err
 }
 
-// AddExp increments a user's experience points
-func (r *UserRepository) AddExp(userID, amount int) error {
-	_, err := r.db.Exec(`UPDATE users SET exp = exp + ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, amount, userID)
+// ChangePassword sets a new password hash. Every session token the user had
+// stops working.
+func (r *UserRepository) ChangePassword(userID int, passwordHash string) error {
+	query := `UPDATE users SET password = ?, token_version = token_version + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	_, err := r.db.Exec(query, passwordHash, userID)
 	return err
 }
 
-
-// GetTopByExp returns users ordered by experience descendi22ng limited by count
-func (r *UserRepository) GetTopByExp(limit int) ([]*User, error) {
-	query := `SELECT id, name, email, password, is_admin, exp, created_at, updated_at FROM users ORDER BY exp DESC LIMIT ?`
-	rows, err := r.db.Query(query, limit)
+// GetTopByExp returns the users with the most experience limited by count,
+// leaving out those who hide from leaderboards and, unless they are the
+// viewer, shadow-banned users
+func (r *UserRepository) GetTopByExp(limit, viewerID int) ([]*PublicUser, error) {
+	query := `SELECT ` + publicUserColumns + ` FROM users u WHERE u.id NOT ` + unrankedSQL + ` ORDER BY u.exp DESC LIMIT ?`
+	rows, err := r.db.Query(query, viewerID, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var users []*User
+	var users []*PublicUser
 	for rows.Next() {
-		u := &User{}
-		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.PasswordHash, &u.IsAdmin, &u.Exp, &u.CreatedAt, &u.UpdatedAt); err != nil {
+		u := &PublicUser{}
+		if err := rows.Scan(u.scanDest()...); err != nil {
 			return nil, err
 		}
 		users = append(users, u)
 	}
-	return users, nil
+	return users, rows.Err()
+}
+
+// SetTimezone sets the IANA timezone used for the user's day boundaries
+func (r *UserRepository) SetTimezone(userID int, tz string) error {
+	_, err := r.db.Exec(`UPDATE users SET timezone = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, tz, userID)
+	return err
+}
+
+// SetSponsor grants or revokes a user's permission to manage rewards
+func (r *UserRepository) SetSponsor(userID int, sponsor bool) error {
+	_, err := r.db.Exec(`UPDATE users SET is_sponsor = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, sponsor, userID)
+	return err
+}
+
+// SetRole changes a user's role. The admin flag follows the role.
+func (r *UserRepository) SetRole(userID int, role string) error {
+	_, err := r.db.Exec(`UPDATE users SET role = ?, is_admin = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, role, role == RoleAdmin, userID)
+	return err
+}
+
+// MarkEmailVerified records that the user proved they read their current address
+func (r *UserRepository) MarkEmailVerified(userID int) error {
+	_, err := r.db.Exec(`UPDATE users SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP), updated_at = CURRENT_TIMESTAMP WHERE id = ?`, userID)
+	return err
 }
 
 // GetRank returns the ranking (1-based) and exp for a user by id
@@ -0,0 +1,239 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrTeamOwner is returned when deleting an account that still owns a team
+// other users belong to
+var ErrTeamOwner = errors.New("transfer ownership of your teams or delete them first")
+
+// deletedUserName is shown in place of an anonymized user's name
+const deletedUserName = "Deleted user"
+
+// AccountExport is everything stored about a user, for them to download
+type AccountExport struct {
+	ExportedAt time.Time `json:"exported_at"`
+	// Data holds the rows of each kind, keyed by kind
+	Data map[string][]map[string]interface{} `json:"data"`
+	// Images are the paths of the user's uploaded images and avatar
+	Images []string `json:"images"`
+}
+
+// exportQueries select a user's rows of each kind. Columns are listed so
+// credentials and secrets such as token hashes never end up in an export.
+// Moderation history is left out since it would reveal a shadow ban.
+var exportQueries = []struct{ name, query string }{
+	{"profile", `SELECT id, name, email, exp, points, timezone, role, is_sponsor, suspended_until, email_verified_at, two_factor_enabled_at, hide_from_leaderboard, hide_activity, private_profile, avatar_key, created_at, updated_at FROM users WHERE id = ?`},
+	{"trash_posts", `SELECT id, latitude, longitude, COALESCE(image_path, '') AS image_path, description, COALESCE(trail, '') AS trail, severity, volume_liters, status, status_changed_at, created_at FROM trash_posts WHERE user_id = ? ORDER BY id`},
+	{"trash_post_categories", `SELECT pc.post_id, c.key FROM trash_post_categories pc JOIN trash_categories c ON c.id = pc.category_id JOIN trash_posts p ON p.id = pc.post_id WHERE p.user_id = ? ORDER BY pc.post_id`},
+	{"comments", `SELECT id, post_id, content, created_at FROM comments WHERE user_id = ? ORDER BY id`},
+	{"trash_verifications", `SELECT id, post_id, status, latitude, longitude, distance, created_at FROM trash_verifications WHERE user_id = ? ORDER BY id`},
+	{"reports", `SELECT id, target_type, target_id, reason, details, status, created_at, resolved_at FROM reports WHERE reporter_id = ? ORDER BY id`},
+	{"appeals", `SELECT id, message, status, response, created_at, resolved_at FROM account_appeals WHERE user_id = ? ORDER BY id`},
+	{"exp_events", `SELECT id, amount, reason, source_type, source_id, post_id, reversal_of, latitude, longitude, created_at FROM exp_events WHERE user_id = ? ORDER BY id`},
+	{"point_transactions", `SELECT id, amount, reason, created_at FROM point_transactions WHERE user_id = ? ORDER BY id`},
+	{"redemptions", `SELECT r.id, r.reward_id, w.title, r.cost, r.code, r.status, r.created_at, r.used_at, r.voided_at, r.void_reason FROM redemptions r JOIN rewards w ON w.id = r.reward_id WHERE r.user_id = ? ORDER BY r.id`},
+	{"rewards", `SELECT id, title, description, cost, stock, per_user_limit, active, created_at FROM rewards WHERE sponsor_id = ? ORDER BY id`},
+	{"achievements", `SELECT achievement_key, awarded_at FROM user_achievements WHERE user_id = ? ORDER BY awarded_at`},
+	{"streak", `SELECT current, longest, last_day, freezes, updated_at FROM user_streaks WHERE user_id = ?`},
+	{"quests", `SELECT q.id, t.title, q.week_start, q.progress, q.completed_at, q.created_at FROM user_quests q JOIN quest_templates t ON t.id = q.template_id WHERE q.user_id = ? ORDER BY q.id`},
+	{"teams", `SELECT m.team_id, t.name, m.role, m.exp, m.joined_at FROM team_members m JOIN teams t ON t.id = m.team_id WHERE m.user_id = ? ORDER BY m.joined_at`},
+	{"identities", `SELECT provider, email, last_login_at, created_at FROM user_identities WHERE user_id = ? ORDER BY id`},
+	{"passkeys", `SELECT id, name, aaguid, transports, backup_eligible, backed_up, last_used_at, created_at FROM passkeys WHERE user_id = ? ORDER BY id`},
+	{"api_keys", `SELECT id, team_id, name, prefix, scopes, expires_at, last_used_at, last_used_ip, created_at FROM api_keys WHERE user_id = ? ORDER BY id`},
+}
+
+// Export collects everything stored about a user
+func (r *UserRepository) Export(userID int) (*AccountExport, error) {
+	e := &AccountExport{ExportedAt: time.Now().UTC(), Data: map[string][]map[string]interface{}{}}
+	for _, q := range exportQueries {
+		rows, err := queryMaps(r.db, q.query, userID)
+		if err != nil {
+			return nil, fmt.Errorf("export %s: %w", q.name, err)
+		}
+		e.Data[q.name] = rows
+	}
+	for _, post := range e.Data["trash_posts"] {
+		if path, _ := post["image_path"].(string); path != "" {
+			e.Images = append(e.Images, path)
+		}
+	}
+	for _, profile := range e.Data["profile"] {
+		key, _ := profile["avatar_key"].(string)
+		e.Images = append(e.Images, avatarPaths(key)...)
+	}
+	return e, nil
+}
+
+// queryMaps returns each row as a map from column name to value
+func queryMaps(db *sql.DB, query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, c := range columns {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			row[c] = values[i]
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// prepareAccountRemoval fails with ErrTeamOwner if the user owns a team with
+// other members, deletes the teams they own alone and forgets the sign-in
+// state kept by address rather than by user
+func prepareAccountRemoval(tx *sql.Tx, userID int) error {
+	var shared int
+	query := `
+       SELECT COUNT(*) FROM teams t
+       WHERE t.owner_id = ? AND EXISTS (SELECT 1 FROM team_members m WHERE m.team_id = t.id AND m.user_id != t.owner_id)`
+	if err := tx.QueryRow(query, userID).Scan(&shared); err != nil {
+		return err
+	}
+	if shared > 0 {
+		return ErrTeamOwner
+	}
+	if _, err := tx.Exec(`DELETE FROM teams WHERE owner_id = ?`, userID); err != nil {
+		return err
+	}
+
+	var email string
+	if err := tx.QueryRow(`SELECT email FROM users WHERE id = ?`, userID).Scan(&email); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM magic_links WHERE email = ? COLLATE NOCASE`, email); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM login_failures WHERE account = ?`, strings.ToLower(email))
+	return err
+}
+
+// DeleteAccount deletes a user together with everything they created and
+// returns the paths of their uploaded images and avatar for the caller to remove
+func (r *UserRepository) DeleteAccount(userID int) ([]string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := prepareAccountRemoval(tx, userID); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(`SELECT image_path FROM trash_posts WHERE user_id = ? AND image_path != ''`, userID)
+	if err != nil {
+		return nil, err
+	}
+	var images []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		images = append(images, path)
+	}
+	rows.Close()
+	avatars, err := userAvatarPaths(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	images = append(images, avatars...)
+
+	// the user's ledger entries go with them, and so must what they earned their teams
+	query := `
+       UPDATE teams SET exp = exp - (
+               SELECT COALESCE(SUM(e.amount), 0)
+               FROM exp_event_teams et
+               JOIN exp_events e ON e.id = et.event_id
+               WHERE et.team_id = teams.id AND e.user_id = ?1
+       )
+       WHERE id IN (
+               SELECT et.team_id FROM exp_event_teams et
+               JOIN exp_events e ON e.id = et.event_id
+               WHERE e.user_id = ?1
+       )`
+	if _, err := tx.Exec(query, userID); err != nil {
+		return nil, err
+	}
+
+	// everything else the user owns goes with them through ON DELETE CASCADE
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = ?`, userID); err != nil {
+		return nil, err
+	}
+	return images, tx.Commit()
+}
+
+// AnonymizeAccount strips a user of their personal data and credentials but
+// keeps what they contributed, so their posts stay on the map under a
+// placeholder name. The account cannot be signed in to again. It returns the
+// paths of the user's avatar for the caller to remove.
+func (r *UserRepository) AnonymizeAccount(userID int) ([]string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := prepareAccountRemoval(tx, userID); err != nil {
+		return nil, err
+	}
+	avatars, err := userAvatarPaths(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	personal := []string{
+		`DELETE FROM team_members WHERE user_id = ?`,
+		`DELETE FROM user_tokens WHERE user_id = ?`,
+		`DELETE FROM user_totp WHERE user_id = ?`,
+		`DELETE FROM user_recovery_codes WHERE user_id = ?`,
+		`DELETE FROM passkeys WHERE user_id = ?`,
+		`DELETE FROM webauthn_challenges WHERE user_id = ?`,
+		`DELETE FROM user_identities WHERE user_id = ?`,
+		`DELETE FROM oauth_states WHERE user_id = ?`,
+		`DELETE FROM api_keys WHERE user_id = ?`,
+		`DELETE FROM account_appeals WHERE user_id = ?`,
+		`UPDATE rewards SET active = 0 WHERE sponsor_id = ?`,
+	}
+	for _, query := range personal {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	query := `
+       UPDATE users SET name = ?, email = ?, password = '', is_admin = 0, role = ?, is_sponsor = 0,
+              timezone = 'UTC', suspended_until = NULL, status = ?, token_version = token_version + 1,
+              email_verified_at = NULL, two_factor_enabled_at = NULL, avatar_key = '', updated_at = CURRENT_TIMESTAMP
+       WHERE id = ?`
+	email := fmt.Sprintf("deleted-%d@invalid", userID)
+	if _, err := tx.Exec(query, deletedUserName, email, RoleUser, AccountDeleted, userID); err != nil {
+		return nil, err
+	}
+	return avatars, tx.Commit()
+}
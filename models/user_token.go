@@ -0,0 +1,257 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Purposes of mailed tokens
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenResetPassword = "reset_password"
+	// TokenChangeEmail is sent to the new address; its email is the address to switch to
+	TokenChangeEmail = "change_email"
+)
+
+// Mailed token errors
+var (
+	ErrTokenInvalid  = errors.New("invalid or expired token")
+	ErrTooManyTokens = errors.New("too many requests, try again later")
+)
+
+// UserToken is a single-use token mailed to a user. Only its hash is stored.
+type UserToken struct {
+	ID        int        `json:"id" db:"id"`
+	UserID    int        `json:"user_id" db:"user_id"`
+	Purpose   string     `json:"purpose" db:"purpose"`
+	Email     string     `json:"email" db:"email"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty" db:"used_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+}
+
+// HashToken returns the stored form of a token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken returns a random URL-safe token
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// TokenRepository handles mailed single-use tokens
+type TokenRepository struct {
+	db *sql.DB
+}
+
+// NewTokenRepository creates a new token repository
+func NewTokenRepository(db *sql.DB) *TokenRepository {
+	return &TokenRepository{db: db}
+}
+
+// Issue creates a token for the user and returns it in plain form. Unused
+// tokens the user had for the same purpose stop working. It fails with
+// ErrTooManyTokens once perHour tokens were issued for the purpose in the
+// last hour, so nobody can use the app to flood an inbox.
+func (r *TokenRepository) Issue(userID int, purpose, email string, ttl time.Duration, perHour int) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var recent int
+	since := time.Now().UTC().Add(-time.Hour).Format(sqliteTimeFormat)
+	query := `SELECT COUNT(*) FROM user_tokens WHERE user_id = ? AND purpose = ? AND created_at > ?`
+	if err := tx.QueryRow(query, userID, purpose, since).Scan(&recent); err != nil {
+		return "", err
+	}
+	if perHour > 0 && recent >= perHour {
+		return "", ErrTooManyTokens
+	}
+
+	// expire rather than delete older tokens so they still count towards the limit
+	now := time.Now().UTC().Format(sqliteTimeFormat)
+	if _, err := tx.Exec(`UPDATE user_tokens SET expires_at = ? WHERE user_id = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?`,
+		now, userID, purpose, now); err != nil {
+		return "", err
+	}
+	expires := time.Now().UTC().Add(ttl).Format(sqliteTimeFormat)
+	if _, err := tx.Exec(`INSERT INTO user_tokens (user_id, purpose, token_hash, email, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		userID, purpose, HashToken(token), email, expires); err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// consumeTx marks a valid token used and returns it, or fails with ErrTokenInvalid
+func consumeTx(tx *sql.Tx, purpose, token string) (*UserToken, error) {
+	t := &UserToken{Purpose: purpose}
+	query := `
+       UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP
+       WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+       RETURNING id, user_id, email, expires_at, used_at, created_at`
+	err := tx.QueryRow(query, HashToken(token), purpose, time.Now().UTC().Format(sqliteTimeFormat)).Scan(
+		&t.ID, &t.UserID, &t.Email, &t.ExpiresAt, &t.UsedAt, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrTokenInvalid
+	}
+	return t, err
+}
+
+// VerifyEmail consumes an email verification token and marks the address it
+// was sent to as verified. It returns the user id. A token sent to an address
+// the user has since changed away from is invalid.
+func (r *TokenRepository) VerifyEmail(token string) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	t, err := consumeTx(tx, TokenVerifyEmail, token)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`UPDATE users SET email_verified_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND email = ?`,
+		t.UserID, t.Email)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0, ErrTokenInvalid
+	}
+	return t.UserID, tx.Commit()
+}
+
+// ResetPassword consumes a password reset token and sets the new password
+// hash. Every session token the user had stops working, and since the user
+// proved they read the mailbox, the address counts as verified.
+func (r *TokenRepository) ResetPassword(token, passwordHash string) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	t, err := consumeTx(tx, TokenResetPassword, token)
+	if err != nil {
+		return 0, err
+	}
+	query := `
+       UPDATE users SET password = ?, token_version = token_version + 1,
+              email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP),
+              updated_at = CURRENT_TIMESTAMP
+       WHERE id = ? AND email = ?`
+	res, err := tx.Exec(query, passwordHash, t.UserID, t.Email)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0, ErrTokenInvalid
+	}
+	return t.UserID, tx.Commit()
+}
+
+// ChangeEmail consumes an email change token and switches the user to the
+// address it was sent to, which counts as verified. It fails with
+// ErrEmailTaken if another user has taken the address since.
+func (r *TokenRepository) ChangeEmail(token string) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	t, err := consumeTx(tx, TokenChangeEmail, token)
+	if err != nil {
+		return 0, err
+	}
+	var taken bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE email = ? COLLATE NOCASE AND id != ?)`, t.Email, t.UserID).Scan(&taken); err != nil {
+		return 0, err
+	}
+	if taken {
+		return 0, ErrEmailTaken
+	}
+	query := `
+       UPDATE users SET email = ?, email_verified_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+       WHERE id = ? AND status != ?`
+	res, err := tx.Exec(query, t.Email, t.UserID, AccountDeleted)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0, ErrTokenInvalid
+	}
+	return t.UserID, tx.Commit()
+}
+
+// IssueMagicLink creates a sign-in token for an address and returns it in
+// plain form. Earlier unused links for the address stop working. Requests
+// are counted per address whether or not it belongs to a user, so the
+// ErrTooManyTokens limit reveals nothing about which addresses are registered.
+func (r *TokenRepository) IssueMagicLink(email string, ttl time.Duration, perHour int) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var recent int
+	since := time.Now().UTC().Add(-time.Hour).Format(sqliteTimeFormat)
+	query := `SELECT COUNT(*) FROM magic_links WHERE email = ? COLLATE NOCASE AND created_at > ?`
+	if err := tx.QueryRow(query, email, since).Scan(&recent); err != nil {
+		return "", err
+	}
+	if perHour > 0 && recent >= perHour {
+		return "", ErrTooManyTokens
+	}
+
+	now := time.Now().UTC().Format(sqliteTimeFormat)
+	if _, err := tx.Exec(`UPDATE magic_links SET expires_at = ? WHERE email = ? COLLATE NOCASE AND used_at IS NULL AND expires_at > ?`,
+		now, email, now); err != nil {
+		return "", err
+	}
+	expires := time.Now().UTC().Add(ttl).Format(sqliteTimeFormat)
+	if _, err := tx.Exec(`INSERT INTO magic_links (email, token_hash, expires_at) VALUES (?, ?, ?)`,
+		email, HashToken(token), expires); err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// ConsumeMagicLink uses up a sign-in token and returns the address it was sent to
+func (r *TokenRepository) ConsumeMagicLink(token string) (string, error) {
+	var email string
+	query := `
+       UPDATE magic_links SET used_at = CURRENT_TIMESTAMP
+       WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?
+       RETURNING email`
+	err := r.db.QueryRow(query, HashToken(token), time.Now().UTC().Format(sqliteTimeFormat)).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", ErrTokenInvalid
+	}
+	return email, err
+}
@@ -0,0 +1,277 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+// Trash post statuses
+const (
+	TrashStatusOpen = "open"
+	TrashStatusGone = "gone"
+)
+
+// Verification answers to "is the trash still there?"
+const (
+	VerificationStillThere = "still_there"
+	VerificationPartial    = "partially_cleaned"
+	VerificationGone       = "gone"
+)
+
+// ExpReasonVerification is the ledger reason and rule name for verifying a report
+const ExpReasonVerification = "trash_post_verified"
+
+// ExpSourceVerification attributes EXP to a verification
+const ExpSourceVerification = "trash_verification"
+
+// Verification tuning
+const (
+	// VerificationHalfLife is how long it takes for a vote to count half as much
+	VerificationHalfLife = 30 * 24 * time.Hour
+	// VerificationInterval is how often one user may verify the same post
+	VerificationInterval = 24 * time.Hour
+)
+
+// ErrVerifiedRecently is returned when a user verifies the same post again
+// within VerificationInterval
+var ErrVerifiedRecently = errors.New("you already verified this post today")
+
+// verificationWeights is how strongly each answer says the trash is still there
+var verificationWeights = map[string]float64{
+	VerificationStillThere: 1,
+	VerificationPartial:    0.5,
+	VerificationGone:       0,
+}
+
+// ValidVerificationStatus reports whether s is a known answer
+func ValidVerificationStatus(s string) bool {
+	_, ok := verificationWeights[s]
+	return ok
+}
+
+// Verification is a user's confirmation of a report's current state
+type Verification struct {
+	ID        int       `json:"id" db:"id"`
+	PostID    int       `json:"post_id" db:"post_id"`
+	UserID    int       `json:"user_id" db:"user_id"`
+	Status    string    `json:"status" db:"status"`
+	Latitude  float64   `json:"latitude" db:"latitude"`
+	Longitude float64   `json:"longitude" db:"longitude"`
+	Distance  float64   `json:"distance_m" db:"distance"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// VerificationVote is a verification as shown on the post. It carries how far
+// from the spot the verifier was rather than where they stood; User is left
+// out for anonymous viewers.
+type VerificationVote struct {
+	ID        int         `json:"id"`
+	Status    string      `json:"status"`
+	Distance  float64     `json:"distance_m"`
+	User      *PublicUser `json:"user,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// VerificationSummary scores how current a report is. Freshness decays with
+// the time since anyone last looked; Confidence is the decay-weighted share
+// of votes, counting the report itself, that say the trash is still there.
+type VerificationSummary struct {
+	StillThere     int        `json:"still_there"`
+	Partial        int        `json:"partially_cleaned"`
+	Gone           int        `json:"gone"`
+	LastVerifiedAt *time.Time `json:"last_verified_at,omitempty"`
+	Freshness      float64    `json:"freshness"`
+	Confidence     float64    `json:"confidence"`
+}
+
+// decay returns the weight of something that happened at t
+func decay(t, now time.Time) float64 {
+	return math.Pow(0.5, now.Sub(t).Hours()/VerificationHalfLife.Hours())
+}
+
+// summarize scores a post from its verifications
+func summarize(created time.Time, votes []*Verification, now time.Time) *VerificationSummary {
+	s := &VerificationSummary{}
+	last := created
+	present, total := decay(created, now), decay(created, now)
+	for _, v := range votes {
+		switch v.Status {
+		case VerificationStillThere:
+			s.StillThere++
+		case VerificationPartial:
+			s.Partial++
+		case VerificationGone:
+			s.Gone++
+		}
+		w := decay(v.CreatedAt, now)
+		present += w * verificationWeights[v.Status]
+		total += w
+		if v.CreatedAt.After(last) {
+			at := v.CreatedAt
+			s.LastVerifiedAt = &at
+			last = at
+		}
+	}
+	s.Freshness = math.Round(decay(last, now)*100) / 100
+	s.Confidence = math.Round(present/total*100) / 100
+	return s
+}
+
+// DistanceMeters returns the great-circle distance between two points
+func DistanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371000
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// VerificationRepository handles trash post verification database operations
+type VerificationRepository struct {
+	db *sql.DB
+}
+
+// NewVerificationRepository creates a new verification repository
+func NewVerificationRepository(db *sql.DB) *VerificationRepository {
+	return &VerificationRepository{db: db}
+}
+
+// Create stores a verification, failing with ErrVerifiedRecently if the user
+// verified the post within VerificationInterval. If it makes goneThreshold
+// different users' latest answer "gone", an open post is marked gone and
+// closed is true. Shadow-banned users' answers do not count toward closing.
+func (r *VerificationRepository) Create(v *Verification, goneThreshold int) (closed bool, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var recent bool
+	since := time.Now().UTC().Add(-VerificationInterval).Format(sqliteTimeFormat)
+	query := `SELECT EXISTS (SELECT 1 FROM trash_verifications WHERE post_id = ? AND user_id = ? AND created_at > ?)`
+	if err := tx.QueryRow(query, v.PostID, v.UserID, since).Scan(&recent); err != nil {
+		return false, err
+	}
+	if recent {
+		return false, ErrVerifiedRecently
+	}
+
+	query = `
+       INSERT INTO trash_verifications (post_id, user_id, status, latitude, longitude, distance)
+       VALUES (?, ?, ?, ?, ?, ?)
+       RETURNING id, created_at`
+	if err := tx.QueryRow(query, v.PostID, v.UserID, v.Status, v.Latitude, v.Longitude, v.Distance).Scan(&v.ID, &v.CreatedAt); err != nil {
+		return false, err
+	}
+
+	if v.Status == VerificationGone && goneThreshold > 0 {
+		// users whose most recent answer for the post is "gone"
+		var gone int
+		query := `
+               SELECT COUNT(*) FROM (
+                       SELECT status, ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY id DESC) AS rn
+                       FROM trash_verifications
+                       WHERE post_id = ? AND user_id NOT IN (SELECT id FROM users WHERE status = 'shadow_banned')
+               ) WHERE rn = 1 AND status = ?`
+		if err := tx.QueryRow(query, v.PostID, VerificationGone).Scan(&gone); err != nil {
+			return false, err
+		}
+		if gone >= goneThreshold {
+			res, err := tx.Exec(`UPDATE trash_posts SET status = ?, status_changed_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ?`,
+				TrashStatusGone, v.PostID, TrashStatusOpen)
+			if err != nil {
+				return false, err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return false, err
+			}
+			closed = n > 0
+		}
+	}
+	return closed, tx.Commit()
+}
+
+// GetVotes returns a post's verifications as shown on the post, newest
+// first. Shadow-banned users' votes are only listed for themselves.
+func (r *VerificationRepository) GetVotes(postID, viewerID int) ([]*VerificationVote, error) {
+	query := `
+       SELECT v.id, v.status, v.distance, v.created_at, ` + publicUserColumns + `
+       FROM trash_verifications v JOIN users u ON u.id = v.user_id
+       WHERE v.post_id = ? AND v.user_id NOT ` + shadowBannedSQL + `
+       ORDER BY v.id DESC`
+	rows, err := r.db.Query(query, postID, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	votes := []*VerificationVote{}
+	for rows.Next() {
+		v := &VerificationVote{User: &PublicUser{}}
+		if err := rows.Scan(append([]interface{}{&v.ID, &v.Status, &v.Distance, &v.CreatedAt}, v.User.scanDest()...)...); err != nil {
+			return nil, err
+		}
+		// to the nearest 10 m, so votes cannot be used to place the verifier
+		v.Distance = math.Round(v.Distance/10) * 10
+		votes = append(votes, v)
+	}
+	return votes, rows.Err()
+}
+
+func (r *VerificationRepository) query(query string, args ...interface{}) ([]*Verification, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	votes := []*Verification{}
+	for rows.Next() {
+		v := &Verification{}
+		if err := rows.Scan(&v.ID, &v.PostID, &v.UserID, &v.Status, &v.Latitude, &v.Longitude, &v.Distance, &v.CreatedAt); err != nil {
+			return nil, err
+		}
+		votes = append(votes, v)
+	}
+	return votes, rows.Err()
+}
+
+// Summarize computes the verification summary of each post in place.
+// Shadow-banned users' votes are left out.
+func (r *VerificationRepository) Summarize(posts []*TrashPost) error {
+	// stay well below SQLite's bound parameter limit
+	const chunk = 500
+	byPost := map[int][]*Verification{}
+	for start := 0; start < len(posts); start += chunk {
+		end := start + chunk
+		if end > len(posts) {
+			end = len(posts)
+		}
+		ids := make([]interface{}, 0, end-start)
+		for _, p := range posts[start:end] {
+			ids = append(ids, p.ID)
+		}
+		votes, err := r.query(`
+               SELECT id, post_id, user_id, status, latitude, longitude, distance, created_at
+               FROM trash_verifications
+               WHERE post_id IN (?`+strings.Repeat(",?", len(ids)-1)+`)
+                 AND user_id NOT IN (SELECT id FROM users WHERE status = 'shadow_banned')`, ids...)
+		if err != nil {
+			return err
+		}
+		for _, v := range votes {
+			byPost[v.PostID] = append(byPost[v.PostID], v)
+		}
+	}
+	now := time.Now()
+	for _, p := range posts {
+		p.Verification = summarize(p.CreatedAt, byPost[p.ID], now)
+	}
+	return nil
+}
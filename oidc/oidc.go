@@ -0,0 +1,625 @@
+// Package oidc is a registry of external sign-in providers. Any OpenID
+// Connect issuer is configured by its issuer URL through discovery; plain
+// OAuth2 providers such as GitHub by their endpoints and a userinfo URL.
+// Each provider maps its own claim names onto the user details sign-in needs.
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+// ErrUnavailable wraps failures to reach a provider
+var ErrUnavailable = errors.New("sign-in provider unavailable")
+
+// httpClient is used for discovery, key set and userinfo requests
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// jwksRefetchInterval limits how often an unknown key id makes a provider's
+// key set be fetched again
+const jwksRefetchInterval = time.Minute
+
+// idTokenAlgorithms are the signing algorithms accepted for ID tokens. HMAC
+// is left out since a client secret is no proof of who signed.
+var idTokenAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// ClaimMapping names the claims, in the ID token or userinfo response, that
+// carry a user's details. Nested claims are written as dotted paths.
+type ClaimMapping struct {
+	Subject       string `json:"subject,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified string `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+}
+
+// Provider is a configured sign-in provider
+type Provider struct {
+	Name         string `json:"-"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RedirectURL  string `json:"redirect_url"`
+	// Issuer enables discovery and ID token checks
+	Issuer string `json:"issuer,omitempty"`
+	// Endpoints for providers without discovery; they override discovered ones
+	AuthURL     string       `json:"auth_url,omitempty"`
+	TokenURL    string       `json:"token_url,omitempty"`
+	UserInfoURL string       `json:"userinfo_url,omitempty"`
+	Scopes      []string     `json:"scopes,omitempty"`
+	Claims      ClaimMapping `json:"claims,omitempty"`
+	// TrustEmail treats the reported email as verified, for providers that
+	// only report verified addresses but have no claim saying so
+	TrustEmail bool `json:"trust_email,omitempty"`
+
+	mu         sync.Mutex
+	discovered bool
+	jwksURL    string
+	// keys are the issuer's ID token signing keys by key id
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+// Identity is who the provider says signed in
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// presets fill in well-known providers configured by name alone
+var presets = map[string]*Provider{
+	"google": {
+		Issuer: "https://accounts.google.com",
+	},
+	"github": {
+		AuthURL:     "https://github.com/login/oauth/authorize",
+		TokenURL:    "https://github.com/login/oauth/access_token",
+		UserInfoURL: "https://api.github.com/user",
+		Scopes:      []string{"read:user", "user:email"},
+		Claims:      ClaimMapping{Subject: "id", Name: "name"},
+	},
+}
+
+// applyDefaults fills unset fields from the provider's preset and the OpenID Connect standard claims
+func (p *Provider) applyDefaults() {
+	if preset, ok := presets[p.Name]; ok {
+		if p.Issuer == "" && p.AuthURL == "" {
+			p.Issuer = preset.Issuer
+		}
+		if p.AuthURL == "" {
+			p.AuthURL, p.TokenURL = preset.AuthURL, preset.TokenURL
+		}
+		if p.UserInfoURL == "" {
+			p.UserInfoURL = preset.UserInfoURL
+		}
+		if p.Scopes == nil {
+			p.Scopes = preset.Scopes
+		}
+		if p.Claims == (ClaimMapping{}) {
+			p.Claims = preset.Claims
+		}
+	}
+	if p.Scopes == nil && p.Issuer != "" {
+		p.Scopes = []string{"openid", "email", "profile"}
+	}
+	if p.Claims.Subject == "" {
+		p.Claims.Subject = "sub"
+	}
+	if p.Claims.Email == "" {
+		p.Claims.Email = "email"
+	}
+	if p.Claims.EmailVerified == "" && p.Issuer != "" {
+		p.Claims.EmailVerified = "email_verified"
+	}
+	if p.Claims.Name == "" {
+		p.Claims.Name = "name"
+	}
+	if p.RedirectURL == "" {
+		if base := os.Getenv("OAUTH_CALLBACK_BASE_URL"); base != "" {
+			p.RedirectURL = strings.TrimRight(base, "/") + "/auth/" + p.Name + "/callback"
+		}
+	}
+}
+
+// validate checks the provider can be used
+func (p *Provider) validate() error {
+	switch {
+	case p.ClientID == "":
+		return fmt.Errorf("provider %s: client_id required", p.Name)
+	case p.RedirectURL == "":
+		return fmt.Errorf("provider %s: redirect_url or OAUTH_CALLBACK_BASE_URL required", p.Name)
+	case p.Issuer == "" && (p.AuthURL == "" || p.TokenURL == ""):
+		return fmt.Errorf("provider %s: issuer or auth_url and token_url required", p.Name)
+	case p.Issuer == "" && p.UserInfoURL == "":
+		return fmt.Errorf("provider %s: userinfo_url required without an issuer", p.Name)
+	}
+	return nil
+}
+
+// discover fills the endpoints from the issuer's discovery document. A
+// failed attempt is retried on the next sign-in.
+func (p *Provider) discover(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovered || p.Issuer == "" {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(p.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: discovery returned %s", ErrUnavailable, resp.Status)
+	}
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&doc); err != nil {
+		return fmt.Errorf("%w: invalid discovery document", ErrUnavailable)
+	}
+	if doc.Issuer != p.Issuer || doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return fmt.Errorf("%w: discovery document does not match issuer %s", ErrUnavailable, p.Issuer)
+	}
+
+	if p.AuthURL == "" {
+		p.AuthURL = doc.AuthorizationEndpoint
+	}
+	if p.TokenURL == "" {
+		p.TokenURL = doc.TokenEndpoint
+	}
+	if p.UserInfoURL == "" {
+		p.UserInfoURL = doc.UserinfoEndpoint
+	}
+	p.jwksURL = doc.JWKSURI
+	p.discovered = true
+	return nil
+}
+
+// config returns the OAuth2 client configuration once the endpoints are known
+func (p *Provider) config(ctx context.Context) (*oauth2.Config, error) {
+	if err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Endpoint:     oauth2.Endpoint{AuthURL: p.AuthURL, TokenURL: p.TokenURL},
+		RedirectURL:  p.RedirectURL,
+		Scopes:       p.Scopes,
+	}, nil
+}
+
+// AuthCodeURL returns where to send the browser to sign in, with a PKCE
+// challenge for verifier and, for OpenID Connect providers, the nonce
+func (p *Provider) AuthCodeURL(ctx context.Context, state, verifier, nonce string) (string, error) {
+	cfg, err := p.config(ctx)
+	if err != nil {
+		return "", err
+	}
+	opts := []oauth2.AuthCodeOption{oauth2.S256ChallengeOption(verifier)}
+	if p.Issuer != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", nonce))
+	}
+	return cfg.AuthCodeURL(state, opts...), nil
+}
+
+// Identify exchanges an authorization code and returns who signed in
+func (p *Provider) Identify(ctx context.Context, code, verifier, nonce string) (*Identity, error) {
+	cfg, err := p.config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+	token, err := cfg.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("%w: token exchange failed", ErrUnavailable)
+	}
+
+	claims := map[string]interface{}{}
+	if p.Issuer != "" {
+		if claims, err = p.idTokenClaims(ctx, token, nonce); err != nil {
+			return nil, err
+		}
+	}
+	if p.UserInfoURL != "" {
+		info, err := p.userInfo(ctx, cfg, token)
+		if err != nil {
+			return nil, err
+		}
+		// userinfo must describe the same user as the ID token
+		if sub, ok := claims["sub"]; ok && claimString(info, "sub") != "" && claimString(info, "sub") != fmt.Sprint(sub) {
+			return nil, errors.New("userinfo subject does not match ID token")
+		}
+		for k, v := range info {
+			claims[k] = v
+		}
+	}
+
+	id := &Identity{
+		Subject: claimString(claims, p.Claims.Subject),
+		Email:   claimString(claims, p.Claims.Email),
+		Name:    claimString(claims, p.Claims.Name),
+	}
+	id.EmailVerified = id.Email != "" && (p.TrustEmail || claimBool(claims, p.Claims.EmailVerified))
+	if id.Subject == "" {
+		return nil, fmt.Errorf("provider did not return the %s claim", p.Claims.Subject)
+	}
+	return id, nil
+}
+
+// idTokenClaims checks the ID token was signed by the issuer and answers this
+// client's request, and returns its claims
+func (p *Provider) idTokenClaims(ctx context.Context, token *oauth2.Token, nonce string) (map[string]interface{}, error) {
+	raw, _ := token.Extra("id_token").(string)
+	if raw == "" {
+		return nil, errors.New("no ID token")
+	}
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithJSONNumber(), jwt.WithValidMethods(idTokenAlgorithms), jwt.WithExpirationRequired())
+	_, err := parser.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.verificationKey(ctx, kid)
+	})
+	switch {
+	case errors.Is(err, ErrUnavailable):
+		return nil, err
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return nil, errors.New("ID token expired")
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return nil, errors.New("invalid ID token signature")
+	case err != nil:
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	iss, _ := claims.GetIssuer()
+	aud, _ := claims.GetAudience()
+	gotNonce, _ := claims["nonce"].(string)
+	audienceOK := false
+	for _, a := range aud {
+		audienceOK = audienceOK || a == p.ClientID
+	}
+	switch {
+	// Google also issues tokens naming itself without the scheme
+	case iss != p.Issuer && "https://"+iss != p.Issuer:
+		return nil, errors.New("ID token from unexpected issuer")
+	case !audienceOK:
+		return nil, errors.New("ID token for another client")
+	case subtle.ConstantTimeCompare([]byte(gotNonce), []byte(nonce)) != 1:
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// verificationKey returns the issuer's signing key with kid. An unknown kid
+// makes the key set be fetched again, since the issuer may have rotated keys.
+func (p *Provider) verificationKey(ctx context.Context, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key := p.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < jwksRefetchInterval {
+		return nil, errors.New("ID token signed with an unknown key")
+	}
+	keys, err := fetchJWKS(ctx, p.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	p.keys, p.keysFetched = keys, time.Now()
+	if key := p.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, errors.New("ID token signed with an unknown key")
+}
+
+// lookupKey returns the cached key with kid. Tokens without a kid are only
+// accepted from issuers that publish a single key.
+func (p *Provider) lookupKey(kid string) interface{} {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return p.keys[kid]
+}
+
+// fetchJWKS fetches a JSON Web Key Set and returns its signing keys by key
+// id. Keys of unsupported types are skipped.
+func fetchJWKS(ctx context.Context, url string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: key set returned %s", ErrUnavailable, resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("%w: invalid key set", ErrUnavailable)
+	}
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// jwk is a public key in JSON Web Key form
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes the key for signature checks
+func (k jwk) publicKey() (interface{}, error) {
+	b := func(s string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(data) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := b(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := b(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// userInfo fetches the userinfo document with the access token
+func (p *Provider) userInfo(ctx context.Context, cfg *oauth2.Config, token *oauth2.Token) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := cfg.Client(ctx, token).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: userinfo returned %s", ErrUnavailable, resp.Status)
+	}
+	info := map[string]interface{}{}
+	dec := json.NewDecoder(io.LimitReader(resp.Body, 1<<20))
+	dec.UseNumber()
+	if err := dec.Decode(&info); err != nil {
+		return nil, fmt.Errorf("%w: invalid userinfo response", ErrUnavailable)
+	}
+	return info, nil
+}
+
+// claim looks up a dotted claim path
+func claim(claims map[string]interface{}, path string) interface{} {
+	if path == "" {
+		return nil
+	}
+	var v interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+// claimString returns a claim as a string; numeric ids keep all their digits
+func claimString(claims map[string]interface{}, path string) string {
+	switch v := claim(claims, path).(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// claimBool returns a claim as a bool, accepting the string form some providers send
+func claimBool(claims map[string]interface{}, path string) bool {
+	switch v := claim(claims, path).(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	return false
+}
+
+// Registry holds the configured providers by name
+type Registry struct {
+	providers map[string]*Provider
+}
+
+// validName restricts provider names to what fits in a route
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Load builds the registry from OAUTH_PROVIDERS_FILE, a JSON object of
+// providers by name, and OAUTH_PROVIDERS, a comma separated list of names
+// configured by OAUTH_<NAME>_* variables. GOOGLE_CLIENT_ID and friends still
+// configure Google when nothing else does.
+func Load() (*Registry, error) {
+	r := &Registry{providers: map[string]*Provider{}}
+
+	if path := os.Getenv("OAUTH_PROVIDERS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+		var file map[string]*Provider
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		for name, p := range file {
+			if err := r.add(name, p); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, name := range strings.Split(os.Getenv("OAUTH_PROVIDERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if err := r.add(name, fromEnv(name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if _, ok := r.providers["google"]; !ok && os.Getenv("GOOGLE_CLIENT_ID") != "" {
+		google := &Provider{
+			ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
+			ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+			RedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
+		}
+		if err := r.add("google", google); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// fromEnv reads a provider from its OAUTH_<NAME>_* variables
+func fromEnv(name string) *Provider {
+	prefix := "OAUTH_" + strings.ToUpper(strings.NewReplacer("-", "_").Replace(name)) + "_"
+	env := func(key string) string { return os.Getenv(prefix + key) }
+	p := &Provider{
+		ClientID:     env("CLIENT_ID"),
+		ClientSecret: env("CLIENT_SECRET"),
+		RedirectURL:  env("REDIRECT_URL"),
+		Issuer:       env("ISSUER"),
+		AuthURL:      env("AUTH_URL"),
+		TokenURL:     env("TOKEN_URL"),
+		UserInfoURL:  env("USERINFO_URL"),
+		Claims: ClaimMapping{
+			Subject:       env("CLAIM_SUBJECT"),
+			Email:         env("CLAIM_EMAIL"),
+			EmailVerified: env("CLAIM_EMAIL_VERIFIED"),
+			Name:          env("CLAIM_NAME"),
+		},
+	}
+	if scopes := env("SCOPES"); scopes != "" {
+		p.Scopes = strings.FieldsFunc(scopes, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	p.TrustEmail, _ = strconv.ParseBool(env("TRUST_EMAIL"))
+	return p
+}
+
+// add validates and registers a provider
+func (r *Registry) add(name string, p *Provider) error {
+	name = strings.ToLower(name)
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid provider name %q", name)
+	}
+	if _, ok := r.providers[name]; ok {
+		return fmt.Errorf("provider %s configured twice", name)
+	}
+	p.Name = name
+	p.applyDefaults()
+	if err := p.validate(); err != nil {
+		return err
+	}
+	r.providers[name] = p
+	return nil
+}
+
+// Get returns a provider by name, or nil
+func (r *Registry) Get(name string) *Provider {
+	return r.providers[name]
+}
+
+// Names returns the configured provider names in order
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
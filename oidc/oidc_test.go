@@ -0,0 +1,112 @@
+package oidc
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"gobackend/oidc/oidctest"
+
+	"golang.org/x/oauth2"
+)
+
+var alice = oidctest.User{Subject: "alice-sub", Email: "alice@example.com", EmailVerified: true, Name: "Alice"}
+
+// newProvider starts a fake issuer and registers a provider for it
+func newProvider(t *testing.T) (*oidctest.Issuer, *Provider) {
+	t.Helper()
+	iss, err := oidctest.NewIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(iss.Close)
+	r := &Registry{providers: map[string]*Provider{}}
+	p := &Provider{ClientID: "client", ClientSecret: "secret", RedirectURL: "http://localhost/auth/mock/callback", Issuer: iss.URL}
+	if err := r.add("mock", p); err != nil {
+		t.Fatal(err)
+	}
+	return iss, p
+}
+
+// authorize starts a sign-in with the given nonce and PKCE verifier and returns the code
+func authorize(t *testing.T, iss *oidctest.Issuer, p *Provider, verifier, nonce string) string {
+	t.Helper()
+	authURL, err := p.AuthCodeURL(context.Background(), "state", verifier, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state, err := iss.Authorize(authURL, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != "state" {
+		t.Fatalf("state = %q, want %q", state, "state")
+	}
+	return code
+}
+
+func TestIdentify(t *testing.T) {
+	iss, p := newProvider(t)
+	verifier := oauth2.GenerateVerifier()
+	code := authorize(t, iss, p, verifier, "nonce")
+
+	id, err := p.Identify(context.Background(), code, verifier, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Identity{Subject: alice.Subject, Email: alice.Email, EmailVerified: true, Name: alice.Name}
+	if *id != want {
+		t.Errorf("identity = %+v, want %+v", *id, want)
+	}
+	if len(iss.Verifiers) != 1 || iss.Verifiers[0] != verifier {
+		t.Errorf("token endpoint got verifiers %q, want %q", iss.Verifiers, verifier)
+	}
+}
+
+func TestIdentifyWrongVerifier(t *testing.T) {
+	iss, p := newProvider(t)
+	code := authorize(t, iss, p, oauth2.GenerateVerifier(), "nonce")
+
+	if _, err := p.Identify(context.Background(), code, oauth2.GenerateVerifier(), "nonce"); err == nil {
+		t.Fatal("code exchanged with another request's PKCE verifier")
+	}
+}
+
+func TestIdentifyNonceMismatch(t *testing.T) {
+	iss, p := newProvider(t)
+	verifier := oauth2.GenerateVerifier()
+	code := authorize(t, iss, p, verifier, "nonce")
+
+	_, err := p.Identify(context.Background(), code, verifier, "other-nonce")
+	if err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Fatalf("err = %v, want nonce mismatch", err)
+	}
+}
+
+func TestIdentifyBadSignature(t *testing.T) {
+	iss, p := newProvider(t)
+	iss.BadSignature = true
+	verifier := oauth2.GenerateVerifier()
+	code := authorize(t, iss, p, verifier, "nonce")
+
+	_, err := p.Identify(context.Background(), code, verifier, "nonce")
+	if err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("err = %v, want invalid signature", err)
+	}
+}
+
+func TestClaimMapping(t *testing.T) {
+	claims := map[string]interface{}{
+		"id":      float64(12345678),
+		"profile": map[string]interface{}{"mail": "a@example.com", "verified": "true"},
+	}
+	if got := claimString(claims, "id"); got != "12345678" {
+		t.Errorf("claimString(id) = %q", got)
+	}
+	if got := claimString(claims, "profile.mail"); got != "a@example.com" {
+		t.Errorf("claimString(profile.mail) = %q", got)
+	}
+	if !claimBool(claims, "profile.verified") {
+		t.Error("claimBool(profile.verified) = false")
+	}
+}
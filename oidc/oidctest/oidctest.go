@@ -0,0 +1,193 @@
+// Package oidctest runs a fake OpenID Connect issuer for tests. It serves
+// discovery, a key set, a token endpoint that checks PKCE and a userinfo
+// endpoint; Authorize stands in for the user signing in at the provider.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// keyID names the issuer's signing key in its key set
+const keyID = "test-key"
+
+// User is who signs in at the issuer
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// grant is an authorization code waiting to be exchanged
+type grant struct {
+	user      User
+	clientID  string
+	nonce     string
+	challenge string
+}
+
+// Issuer is a running fake issuer
+type Issuer struct {
+	*httptest.Server
+	// BadSignature signs ID tokens with a key the issuer does not publish
+	BadSignature bool
+	// Verifiers records the PKCE verifiers sent to the token endpoint
+	Verifiers []string
+
+	key   *rsa.PrivateKey
+	other *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]grant
+	tokens map[string]User
+}
+
+// NewIssuer starts an issuer. Call Close when done.
+func NewIssuer() (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	s := &Issuer{key: key, other: other, grants: map[string]grant{}, tokens: map[string]User{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/jwks", s.jwks)
+	mux.HandleFunc("/token", s.token)
+	mux.HandleFunc("/userinfo", s.userinfo)
+	s.Server = httptest.NewServer(mux)
+	return s, nil
+}
+
+// Authorize signs u in for the authorization request at authURL and returns
+// the code the issuer would redirect back with, together with the state
+func (s *Issuer) Authorize(authURL string, u User) (code, state string, err error) {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		return "", "", err
+	}
+	q := parsed.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		return "", "", errors.New("authorization request without an S256 PKCE challenge")
+	}
+	code = randomString()
+	s.mu.Lock()
+	s.grants[code] = grant{user: u, clientID: q.Get("client_id"), nonce: q.Get("nonce"), challenge: q.Get("code_challenge")}
+	s.mu.Unlock()
+	return code, q.Get("state"), nil
+}
+
+func (s *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 s.URL,
+		"authorization_endpoint": s.URL + "/authorize",
+		"token_endpoint":         s.URL + "/token",
+		"userinfo_endpoint":      s.URL + "/userinfo",
+		"jwks_uri":               s.URL + "/jwks",
+	})
+}
+
+func (s *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	pub := s.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA", "kid": keyID, "alg": "RS256", "use": "sig",
+		"n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes()),
+	}}})
+}
+
+// token exchanges a code once, checking the PKCE verifier against the
+// challenge of the authorization request
+func (s *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	clientID, _, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+	}
+	verifier := r.PostForm.Get("code_verifier")
+
+	s.mu.Lock()
+	s.Verifiers = append(s.Verifiers, verifier)
+	g, ok := s.grants[r.PostForm.Get("code")]
+	delete(s.grants, r.PostForm.Get("code"))
+	s.mu.Unlock()
+	sum := sha256.Sum256([]byte(verifier))
+	if !ok || g.clientID != clientID || base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	signer := s.key
+	if s.BadSignature {
+		signer = s.other
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            s.URL,
+		"aud":            clientID,
+		"sub":            g.user.Subject,
+		"email":          g.user.Email,
+		"email_verified": g.user.EmailVerified,
+		"name":           g.user.Name,
+		"nonce":          g.nonce,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	})
+	idToken.Header["kid"] = keyID
+	signed, err := idToken.SignedString(signer)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	access := randomString()
+	s.mu.Lock()
+	s.tokens[access] = g.user
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": access, "token_type": "Bearer", "expires_in": 3600, "id_token": signed,
+	})
+}
+
+func (s *Issuer) userinfo(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	u, ok := s.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	s.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sub": u.Subject, "email": u.Email, "email_verified": u.EmailVerified, "name": u.Name,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,113 @@
+package webauthn
+
+import (
+	"errors"
+	"math"
+)
+
+var errCBOR = errors.New("malformed CBOR")
+
+// maxCBORDepth bounds nesting so hostile input cannot exhaust the stack
+const maxCBORDepth = 16
+
+// decodeCBOR decodes the first CBOR item in b and returns it with the bytes
+// that follow. It supports the subset authenticators emit (RFC 8949 with
+// definite lengths only): integers become int64, byte strings []byte, text
+// strings string, arrays []interface{}, maps map[interface{}]interface{} with
+// int64 or string keys, and false, true and null. Tags are skipped.
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeItem(b, 0)
+}
+
+func decodeItem(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth || len(b) == 0 {
+		return nil, nil, errCBOR
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(b) < n {
+			return nil, nil, errCBOR
+		}
+		for _, c := range b[:n] {
+			arg = arg<<8 | uint64(c)
+		}
+		b = b[n:]
+	default:
+		return nil, nil, errCBOR
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return int64(arg), b, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return -1 - int64(arg), b, nil
+	case 2, 3:
+		if arg > uint64(len(b)) {
+			return nil, nil, errCBOR
+		}
+		if major == 3 {
+			return string(b[:arg]), b[arg:], nil
+		}
+		return b[:arg], b[arg:], nil
+	case 4:
+		// every item takes at least a byte, which also bounds the allocation
+		if arg > uint64(len(b)) {
+			return nil, nil, errCBOR
+		}
+		items := make([]interface{}, arg)
+		for i := range items {
+			var err error
+			if items[i], b, err = decodeItem(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		return items, b, nil
+	case 5:
+		if arg > uint64(len(b)) {
+			return nil, nil, errCBOR
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, rest, err := decodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBOR
+			}
+			v, rest, err := decodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k], b = v, rest
+		}
+		return m, b, nil
+	case 6:
+		return decodeItem(b, depth+1)
+	default:
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22:
+			return nil, b, nil
+		}
+		return nil, nil, errCBOR
+	}
+}
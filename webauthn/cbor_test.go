@@ -0,0 +1,80 @@
+package webauthn
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want interface{}
+	}{
+		{"small int", []byte{0x17}, int64(23)},
+		{"uint8", []byte{0x18, 0xff}, int64(255)},
+		{"uint64", []byte{0x1b, 0, 0, 0, 1, 0, 0, 0, 0}, int64(1 << 32)},
+		{"negative", []byte{0x39, 0x01, 0x00}, int64(-257)},
+		{"bytes", []byte{0x43, 1, 2, 3}, []byte{1, 2, 3}},
+		{"text", []byte{0x63, 'f', 'm', 't'}, "fmt"},
+		{"array", []byte{0x82, 0x01, 0x20}, []interface{}{int64(1), int64(-1)}},
+		{"map", []byte{0xa2, 0x01, 0x02, 0x61, 'a', 0xf5}, map[interface{}]interface{}{int64(1): int64(2), "a": true}},
+		{"simple values", []byte{0x83, 0xf4, 0xf5, 0xf6}, []interface{}{false, true, nil}},
+		{"tag skipped", []byte{0xc1, 0x05}, int64(5)},
+	}
+	for _, tt := range tests {
+		got, rest, err := decodeCBOR(append(tt.in, 0xff))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+		if !bytes.Equal(rest, []byte{0xff}) {
+			t.Errorf("%s: rest = %x", tt.name, rest)
+		}
+	}
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	nested := bytes.Repeat([]byte{0x81}, maxCBORDepth+2)
+	tests := map[string][]byte{
+		"empty":                  {},
+		"truncated argument":     {0x19, 0x01},
+		"reserved additional":    {0x1c},
+		"indefinite length":      {0x5f, 0x41, 0x00, 0xff},
+		"negative overflow":      {0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"unsigned overflow":      {0x1b, 0x80, 0, 0, 0, 0, 0, 0, 0},
+		"bytes past the end":     {0x45, 0x01, 0x02},
+		"huge byte string":       {0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"array past the end":     {0x83, 0x01, 0x02},
+		"huge array":             {0x9b, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"map missing value":      {0xa1, 0x01},
+		"huge map":               {0xbb, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"byte string map key":    {0xa1, 0x41, 0x00, 0x01},
+		"array map key":          {0xa1, 0x80, 0x01},
+		"tag without item":       {0xc1},
+		"undefined":              {0xf7},
+		"float":                  {0xfa, 0, 0, 0, 0},
+		"nesting past the limit": append(nested, 0x00),
+	}
+	for name, in := range tests {
+		if _, _, err := decodeCBOR(in); err != errCBOR {
+			t.Errorf("%s: err = %v, want errCBOR", name, err)
+		}
+	}
+}
+
+func TestDecodeCBORTruncated(t *testing.T) {
+	in := encodeCBOR(cborMap{{"fmt", "none"}, {"attStmt", cborMap{}}, {"authData", bytes.Repeat([]byte{7}, 300)}, {-2, -300}})
+	if _, rest, err := decodeCBOR(in); err != nil || len(rest) != 0 {
+		t.Fatalf("full input: rest %x, err %v", rest, err)
+	}
+	for n := 0; n < len(in); n++ {
+		if _, _, err := decodeCBOR(in[:n]); err != errCBOR {
+			t.Fatalf("truncated to %d bytes: err = %v", n, err)
+		}
+	}
+}